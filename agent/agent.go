@@ -1,6 +1,8 @@
 package agent
 
 import (
+	"context"
+	"errors"
 	"io"
 	"os"
 
@@ -9,7 +11,7 @@ import (
 )
 
 type lazySigner struct {
-	agent agent.Agent
+	agent agent.ExtendedAgent
 	pub   ssh.PublicKey
 }
 
@@ -21,15 +23,31 @@ func (s *lazySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
 	return s.agent.Sign(s.pub, data)
 }
 
-type dialfn func() (io.ReadWriteCloser, error)
+// SignWithAlgorithm makes lazySigner an ssh.AlgorithmSigner, so that RSA keys
+// sign with rsa-sha2-256 / rsa-sha2-512 for the servers rejecting SHA-1.
+func (s *lazySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512:
+		flags = agent.SignatureFlagRsaSha512
+	}
+
+	return s.agent.SignWithFlags(s.pub, data, flags)
+}
+
+type dialfn func(ctx context.Context) (io.ReadWriteCloser, error)
 
 // FIXME Windows の Named Pipe (を開いている ssh-agent の実装??) が 1分 アイドルすると閉じるので、都度接続している...
 type lazyAgent struct {
+	// ctx cancels the dials.
+	ctx  context.Context
 	dial dialfn
 }
 
 func (a *lazyAgent) newClient() (agent.ExtendedAgent, io.ReadWriteCloser, error) {
-	conn, err := a.dial()
+	conn, err := a.dial(a.ctx)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -147,20 +165,53 @@ func (a *lazyAgent) Extension(extensionType string, contents []byte) ([]byte, er
 	return client.Extension(extensionType, contents)
 }
 
-func ForwardAgent(client *ssh.Client, sess *ssh.Session, ag agent.ExtendedAgent) error {
-	if err := agent.RequestAgentForwarding(sess); err != nil {
-		return err
+// ForwardAgent requests the agent forwarding on sess and serves the
+// auth-agent@openssh.com channels with ag. With the agent of NewAgent, each
+// request of a channel connects to the local agent anew, so a channel kept
+// open by the remote does not outlive the agent connection closed when idle.
+//
+// The channels are closed when ctx is done.
+func ForwardAgent(ctx context.Context, client *ssh.Client, sess *ssh.Session, ag agent.ExtendedAgent) error {
+	// The handler first, the server may open a channel as soon as it replies.
+	channels := client.HandleChannelOpen(agentChannelType)
+	if channels == nil {
+		return errors.New("Agent forwarding already requested.")
 	}
+	go func() {
+		for ch := range channels {
+			go serveForwarded(ctx, ch, ag)
+		}
+	}()
 
-	if err := agent.ForwardToAgent(client, ag); err != nil {
+	if err := agent.RequestAgentForwarding(sess); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func NewAgent() agent.ExtendedAgent {
+// agentChannelType is the channel of the forwarded agent.
+// REF https://datatracker.ietf.org/doc/html/draft-miller-ssh-agent#section-6
+const agentChannelType = "auth-agent@openssh.com"
+
+func serveForwarded(ctx context.Context, newch ssh.NewChannel, ag agent.ExtendedAgent) {
+	ch, reqs, err := newch.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	stop := context.AfterFunc(ctx, func() { ch.Close() })
+	defer stop()
+
+	agent.ServeAgent(ag, ch)
+}
+
+// NewAgent returns the agent of SSH_AUTH_SOCK, or the OpenSSH agent or
+// Pageant on Windows, connected for each request. ctx cancels the dials.
+func NewAgent(ctx context.Context) agent.ExtendedAgent {
 	p := os.Getenv("SSH_AUTH_SOCK")
 	dial := newAgentDialer(p)
-	return &lazyAgent{ dial: dial }
+	return &lazyAgent{ctx: ctx, dial: dial}
 }
@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestLazySignerAlgorithm(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+
+	ag := &lazyAgent{ctx: context.Background(), dial: func(context.Context) (io.ReadWriteCloser, error) {
+		c1, c2 := net.Pipe()
+		go agent.ServeAgent(keyring, c2)
+		return c1, nil
+	}}
+
+	signers, err := ag.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 {
+		t.Fatalf("%v", signers)
+	}
+
+	as, ok := signers[0].(ssh.AlgorithmSigner)
+	if !ok {
+		t.Fatal("not an AlgorithmSigner")
+	}
+
+	data := []byte("data")
+	for _, algo := range []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA} {
+		sig, err := as.SignWithAlgorithm(rand.Reader, data, algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig.Format != algo {
+			t.Errorf("%s: %s", algo, sig.Format)
+		}
+		if err := as.PublicKey().Verify(data, sig); err != nil {
+			t.Errorf("%s: %s", algo, err)
+		}
+	}
+}
+
+// idleClosingConn fails the reads after idle, like the Windows agent closing
+// the pipe idle for a minute.
+type idleClosingConn struct {
+	net.Conn
+	idle time.Duration
+}
+
+func (c *idleClosingConn) Read(p []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(c.idle))
+	return c.Conn.Read(p)
+}
+
+func TestForwardAgentAfterIdle(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+
+	const idle = 50 * time.Millisecond
+	var dials atomic.Int32
+	ag := &lazyAgent{ctx: context.Background(), dial: func(context.Context) (io.ReadWriteCloser, error) {
+		dials.Add(1)
+		c1, c2 := net.Pipe()
+		go func() {
+			agent.ServeAgent(keyring, &idleClosingConn{c2, idle})
+			c2.Close()
+		}()
+		return c1, nil
+	}}
+
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The server lists the keys through the forwarded agent, twice on a
+	// channel with an idle period between.
+	result := make(chan error, 1)
+	go func() {
+		result <- func() error {
+			c, err := l.Accept()
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+
+			conn, chans, reqs, err := ssh.NewServerConn(c, cfg)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			go ssh.DiscardRequests(reqs)
+
+			newch := <-chans
+			ch, sreqs, err := newch.Accept()
+			if err != nil {
+				return err
+			}
+			defer ch.Close()
+			req := <-sreqs
+			if req.Type != "auth-agent-req@openssh.com" {
+				return fmt.Errorf("unexpected request: %s", req.Type)
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(sreqs)
+
+			agentCh, agentReqs, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+			if err != nil {
+				return err
+			}
+			defer agentCh.Close()
+			go ssh.DiscardRequests(agentReqs)
+
+			remote := agent.NewClient(agentCh)
+			for i := range 2 {
+				if i > 0 {
+					time.Sleep(3 * idle)
+				}
+				keys, err := remote.List()
+				if err != nil {
+					return fmt.Errorf("list %d: %w", i, err)
+				}
+				if len(keys) != 1 {
+					return fmt.Errorf("list %d: %d keys", i, len(keys))
+				}
+			}
+			return nil
+		}()
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	if err := ForwardAgent(context.Background(), client, sess, ag); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+	if n := dials.Load(); n != 2 {
+		t.Errorf("dialed %d times, want one per request", n)
+	}
+}
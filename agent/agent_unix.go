@@ -3,6 +3,7 @@
 package agent
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net"
@@ -10,13 +11,14 @@ import (
 
 func newAgentDialer(pathIfSpecified string) dialfn {
 	if pathIfSpecified == "" {
-		return func() (io.ReadWriteCloser, error) {
+		return func(context.Context) (io.ReadWriteCloser, error) {
 			return nil, errors.New("Could not connect agent socket")
 		}
 	}
 
-	return func() (io.ReadWriteCloser, error) {
-		conn, err := net.Dial("unix", pathIfSpecified)
+	return func(ctx context.Context) (io.ReadWriteCloser, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "unix", pathIfSpecified)
 		if err != nil {
 			return nil, err
 		}
@@ -3,6 +3,7 @@
 package agent
 
 import (
+	"context"
 	"io"
 
 	"github.com/Microsoft/go-winio"
@@ -14,9 +15,15 @@ func newAgentDialer(pathIfSpecified string) dialfn {
 		p = pathIfSpecified
 	}
 
-	return func() (io.ReadWriteCloser, error) {
-		conn, err := winio.DialPipe(p, nil)
+	return func(ctx context.Context) (io.ReadWriteCloser, error) {
+		conn, err := winio.DialPipeContext(ctx, p)
 		if err != nil {
+			// Fall back to Pageant when the OpenSSH agent is not running.
+			if pathIfSpecified == "" {
+				if _, perr := findPageant(); perr == nil {
+					return &pageantConn{query: queryPageant}, nil
+				}
+			}
 			return nil, err
 		}
 
@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// REF https://tartarus.org/~simon/putty-snapshots/htmldoc/AppendixB.html (Pageant)
+// REF https://git.tartarus.org/?p=simon/putty.git;a=blob;f=windows/agent-client.c
+
+// pageantMaxMsgLen is AGENT_MAX_MSGLEN of the WM_COPYDATA protocol.
+const pageantMaxMsgLen = 8192
+
+var errPageantMsgTooLong = errors.New("Agent message too long.")
+
+// pageantConn adapts the request / response exchange of Pageant to the
+// stream the agent client speaks. Each complete (length prefixed) request
+// written is passed to query, and its response is returned by Read.
+type pageantConn struct {
+	query func(req []byte) ([]byte, error)
+
+	wbuf []byte
+	rbuf bytes.Buffer
+}
+
+func (c *pageantConn) Write(b []byte) (int, error) {
+	c.wbuf = append(c.wbuf, b...)
+
+	for len(c.wbuf) >= 4 {
+		n := int(binary.BigEndian.Uint32(c.wbuf))
+		if n > pageantMaxMsgLen-4 {
+			c.wbuf = nil
+			return 0, errPageantMsgTooLong
+		}
+		if len(c.wbuf) < 4+n {
+			break
+		}
+
+		res, err := c.query(c.wbuf[:4+n])
+		c.wbuf = c.wbuf[4+n:]
+		if err != nil {
+			return 0, err
+		}
+
+		if len(res) < 4 || int(binary.BigEndian.Uint32(res))+4 != len(res) {
+			return 0, errors.New("Malformed agent response.")
+		}
+		c.rbuf.Write(res)
+	}
+
+	return len(b), nil
+}
+
+func (c *pageantConn) Read(b []byte) (int, error) {
+	if c.rbuf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.rbuf.Read(b)
+}
+
+func (c *pageantConn) Close() error {
+	return nil
+}
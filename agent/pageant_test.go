@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// mockPageant answers each framed request with the keyring.
+func mockPageant(t *testing.T, keyring agent.Agent, requests *[][]byte) func(req []byte) ([]byte, error) {
+	return func(req []byte) ([]byte, error) {
+		*requests = append(*requests, bytes.Clone(req))
+
+		var res bytes.Buffer
+		rw := struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader(req), &res}
+		if err := agent.ServeAgent(keyring, rw); err != nil && !errors.Is(err, io.EOF) {
+			t.Error(err)
+		}
+		return res.Bytes(), nil
+	}
+}
+
+func TestPageantConn(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: "pageant"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests [][]byte
+	ag := &lazyAgent{ctx: context.Background(), dial: func(context.Context) (io.ReadWriteCloser, error) {
+		return &pageantConn{query: mockPageant(t, keyring, &requests)}, nil
+	}}
+
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "pageant" {
+		t.Fatalf("%v", keys)
+	}
+
+	if _, err := ag.Sign(keys[0], []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("%d", len(requests))
+	}
+	for _, req := range requests {
+		if int(binary.BigEndian.Uint32(req))+4 != len(req) {
+			t.Fatalf("%x", req)
+		}
+	}
+}
+
+func TestPageantConnFraming(t *testing.T) {
+	var requests [][]byte
+	conn := &pageantConn{query: func(req []byte) ([]byte, error) {
+		requests = append(requests, bytes.Clone(req))
+		// SSH_AGENT_SUCCESS
+		return []byte{0, 0, 0, 1, 6}, nil
+	}}
+
+	// Two requests split at arbitrary points.
+	msgs := []byte{0, 0, 0, 1, 11, 0, 0, 0, 2, 19, 0}
+	for _, chunk := range [][]byte{msgs[:2], msgs[2:6], msgs[6:]} {
+		if _, err := conn.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(requests) != 2 || !bytes.Equal(requests[0], msgs[:5]) || !bytes.Equal(requests[1], msgs[5:]) {
+		t.Fatalf("%x", requests)
+	}
+
+	res, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, []byte{0, 0, 0, 1, 6, 0, 0, 0, 1, 6}) {
+		t.Fatalf("%x", res)
+	}
+
+	if _, err := conn.Write([]byte{0, 0, 0x20, 0}); !errors.Is(err, errPageantMsgTooLong) {
+		t.Fatalf("%v", err)
+	}
+
+	conn = &pageantConn{query: func(req []byte) ([]byte, error) {
+		return []byte{0, 0, 0, 9, 6}, nil
+	}}
+	if _, err := conn.Write([]byte{0, 0, 0, 1, 11}); err == nil {
+		t.Fatal("must fail with a truncated response")
+	}
+}
@@ -0,0 +1,102 @@
+//go:build windows
+
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	wmCopyData        = 0x004a
+	agentCopyDataId   = 0x804e50ba
+	pageantWindowName = "Pageant"
+)
+
+var (
+	user32           = windows.NewLazySystemDLL("user32.dll")
+	procFindWindowW  = user32.NewProc("FindWindowW")
+	procSendMessageW = user32.NewProc("SendMessageW")
+)
+
+var errPageantNotFound = errors.New("Pageant not running.")
+
+type copyDataStruct struct {
+	dwData uintptr
+	cbData uint32
+	lpData uintptr
+}
+
+func findPageant() (uintptr, error) {
+	name, err := windows.UTF16PtrFromString(pageantWindowName)
+	if err != nil {
+		return 0, err
+	}
+
+	hwnd, _, _ := procFindWindowW.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(name)))
+	if hwnd == 0 {
+		return 0, errPageantNotFound
+	}
+	return hwnd, nil
+}
+
+// queryPageant passes the request through a shared memory mapping and WM_COPYDATA.
+func queryPageant(req []byte) ([]byte, error) {
+	if len(req) > pageantMaxMsgLen {
+		return nil, errPageantMsgTooLong
+	}
+
+	hwnd, err := findPageant()
+	if err != nil {
+		return nil, err
+	}
+
+	mapname := fmt.Sprintf("PageantRequest%08x", windows.GetCurrentThreadId())
+	mapnamew, err := windows.UTF16PtrFromString(mapname)
+	if err != nil {
+		return nil, err
+	}
+	// Pageant reads the name as a NUL terminated ANSI string.
+	mapnamep, err := windows.BytePtrFromString(mapname)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping, err := windows.CreateFileMapping(windows.InvalidHandle, nil, windows.PAGE_READWRITE, 0, pageantMaxMsgLen, mapnamew)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(mapping)
+
+	addr, err := windows.MapViewOfFile(mapping, windows.FILE_MAP_WRITE, 0, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.UnmapViewOfFile(addr)
+
+	view := unsafe.Slice((*byte)(unsafe.Add(nil, addr)), pageantMaxMsgLen)
+	copy(view, req)
+
+	cds := copyDataStruct{
+		dwData: agentCopyDataId,
+		cbData: uint32(len(mapname) + 1),
+		lpData: uintptr(unsafe.Pointer(mapnamep)),
+	}
+	ret, _, _ := procSendMessageW.Call(hwnd, wmCopyData, 0, uintptr(unsafe.Pointer(&cds)))
+	if ret == 0 {
+		return nil, errors.New("Pageant refused the request.")
+	}
+
+	n := int(binary.BigEndian.Uint32(view))
+	if n > pageantMaxMsgLen-4 {
+		return nil, errPageantMsgTooLong
+	}
+
+	res := make([]byte, 4+n)
+	copy(res, view)
+	return res, nil
+}
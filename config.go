@@ -2,19 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
 	"errors"
 	"fmt"
-	"io"
-	"iter"
+	"log"
 	"net"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/kevinburke/ssh_config"
+	"github.com/ysuzuki-bysystems/myssh/forward"
+	"github.com/ysuzuki-bysystems/myssh/knownhosts"
+	"github.com/ysuzuki-bysystems/myssh/prompt"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
@@ -44,35 +50,280 @@ func defaultGlobalKnownHostsFile() string {
 	return "/etc/ssh/ssh_known_hosts"
 }
 
-func loadSshConfig(path string) (*ssh_config.Config, error) {
-	fp, err := os.Open(path)
+// REF https://github.com/openssh/openssh-portable/blob/V_9_9_P1/misc.c (convtime)
+func parseTime(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		's': time.Second,
+		'S': time.Second,
+		'm': time.Minute,
+		'M': time.Minute,
+		'h': time.Hour,
+		'H': time.Hour,
+		'd': 24 * time.Hour,
+		'D': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+		'W': 7 * 24 * time.Hour,
+	}
+
+	if s == "" {
+		return 0, errors.New("Empty time.")
+	}
+
+	var total time.Duration
+	for len(s) > 0 {
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("Invalid time: %s", s)
+		}
+
+		n, err := strconv.ParseInt(s[:i], 10, 32)
+		if err != nil {
+			return 0, err
+		}
+
+		unit := time.Second
+		if i < len(s) {
+			u, ok := units[s[i]]
+			if !ok {
+				return 0, fmt.Errorf("Invalid time unit: %c", s[i])
+			}
+			unit = u
+			i++
+		}
+
+		total += time.Duration(n) * unit
+		s = s[i:]
+	}
+
+	return total, nil
+}
+
+type forwardSpec struct {
+	listen forward.Endpoint
+	// connect is the zero value for the dynamic (SOCKS) form.
+	connect forward.Endpoint
+}
+
+// splitForwardArg splits the colon separated forwarding argument, keeping
+// [IPv6] addresses together.
+func splitForwardArg(s string) []string {
+	var fields []string
+
+	for {
+		if strings.HasPrefix(s, "[") {
+			if end := strings.Index(s, "]"); end >= 0 && (end+1 == len(s) || s[end+1] == ':') {
+				fields = append(fields, s[1:end])
+				if end+1 == len(s) {
+					return fields
+				}
+				s = s[end+2:]
+				continue
+			}
+		}
+
+		field, rest, ok := strings.Cut(s, ":")
+		fields = append(fields, field)
+		if !ok {
+			return fields
+		}
+		s = rest
+	}
+}
+
+func isSocketPath(s string) bool {
+	return strings.HasPrefix(s, "/")
+}
+
+func parseBindPort(bind, port string) (forward.Endpoint, error) {
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return forward.Endpoint{}, fmt.Errorf("Bad port: %s", port)
+	}
+
+	if bind == "" || bind == "*" {
+		bind = "0.0.0.0"
+	}
+
+	return forward.Endpoint{Network: "tcp", Address: net.JoinHostPort(bind, port)}, nil
+}
+
+// parseListen parses the listen side, a port or a unix socket path.
+func parseListen(s string) (forward.Endpoint, error) {
+	if isSocketPath(s) {
+		return forward.Endpoint{Network: "unix", Address: s}, nil
+	}
+	return parseBindPort("localhost", s)
+}
+
+func parseConnect(host, port string) (forward.Endpoint, error) {
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return forward.Endpoint{}, fmt.Errorf("Bad port: %s", port)
+	}
+	return forward.Endpoint{Network: "tcp", Address: net.JoinHostPort(host, port)}, nil
+}
+
+// parseForwardArg parses the forwarding argument like ssh -L / -R.
+// REF https://github.com/openssh/openssh-portable/blob/V_9_9_P1/readconf.c (parse_forward)
+//
+//	[bind_address:]port
+//	[bind_address:]port:host:hostport
+//	[bind_address:]port:remote_socket
+//	local_socket:host:hostport
+//	local_socket:remote_socket
+func parseForwardArg(s string) (*forwardSpec, error) {
+	fields := splitForwardArg(s)
+
+	var spec forwardSpec
+	var err error
+	switch len(fields) {
+	case 1:
+		spec.listen, err = parseListen(fields[0])
+	case 2:
+		if isSocketPath(fields[1]) {
+			spec.listen, err = parseListen(fields[0])
+			spec.connect = forward.Endpoint{Network: "unix", Address: fields[1]}
+		} else {
+			spec.listen, err = parseBindPort(fields[0], fields[1])
+		}
+	case 3:
+		if isSocketPath(fields[2]) {
+			spec.listen, err = parseBindPort(fields[0], fields[1])
+			spec.connect = forward.Endpoint{Network: "unix", Address: fields[2]}
+		} else {
+			spec.listen, err = parseListen(fields[0])
+			if err == nil {
+				spec.connect, err = parseConnect(fields[1], fields[2])
+			}
+		}
+	case 4:
+		spec.listen, err = parseBindPort(fields[0], fields[1])
+		if err == nil {
+			spec.connect, err = parseConnect(fields[2], fields[3])
+		}
+	default:
+		err = errors.New("Too many fields.")
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Bad forwarding specification: %s: %w", s, err)
 	}
-	defer fp.Close()
 
-	cfg, err := ssh_config.Decode(fp)
+	return &spec, nil
+}
+
+// REF ssh_config(5) RemoteForward
+//
+//	RemoteForward [bind_address:]port host:hostport
+//	RemoteForward [bind_address:]port
+//	RemoteForward remote_socket local_socket
+func parseRemoteForward(s string) (*forwardSpec, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 1 && len(fields) != 2 {
+		return nil, fmt.Errorf("Bad forwarding specification: %s", s)
+	}
+
+	return parseForwardArg(strings.Join(fields, ":"))
+}
+
+// REF ssh_config(5) LocalForward
+//
+//	LocalForward [bind_address:]port host:hostport
+//	LocalForward local_socket remote_socket
+func parseLocalForward(s string) (*forwardSpec, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("Bad forwarding specification: %s", s)
+	}
+
+	return parseLocalForwardArg(strings.Join(fields, ":"))
+}
+
+// parseLocalForwardArg parses ssh -L, which has no dynamic form.
+func parseLocalForwardArg(s string) (*forwardSpec, error) {
+	spec, err := parseForwardArg(s)
 	if err != nil {
 		return nil, err
 	}
-
-	return cfg, nil
+	if spec.connect == (forward.Endpoint{}) {
+		return nil, fmt.Errorf("Bad forwarding specification: %s", s)
+	}
+	return spec, nil
 }
 
 type config struct {
-	user             string
-	hostname         string
-	port             string
-	userKnownHosts   string
-	globalKnownHosts string
-	forwardX11       bool
-	forwardAgent     bool
-	xAuthLocation    string
+	// host is the one given, the alias of the Host sections.
+	host              string
+	user              string
+	hostname          string
+	port              string
+	userKnownHosts    string
+	globalKnownHosts  string
+	forwardX11        bool
+	forwardX11Trusted bool
+	forwardX11Timeout time.Duration
+	forwardAgent      bool
+	xAuthLocation     string
+	localForwards     []*forwardSpec
+	remoteForwards    []*forwardSpec
+	passwordAuth      bool
+	kbdInteractive    bool
+	escapeChar        int
+	breakLength       time.Duration
+	hostKeyAlias      string
+	// pubkeyAcceptedAlgorithms restricts the signature algorithms. nil
+	// means the defaults.
+	pubkeyAcceptedAlgorithms []string
+	noAgent                  bool
+	httpProxy                string
+	bindAddress              string
+	// addressFamily is one of addressFamilyAny, addressFamilyInet and
+	// addressFamilyInet6.
+	addressFamily       string
+	connectTimeout      time.Duration
+	serverAliveInterval time.Duration
+	serverAliveCountMax int
+	serverAliveAction   string
+	controlMaster       bool
+	controlPath         string
+	terminalModes       ssh.TerminalModes
+	terminalSanitize    bool
+	identityFiles       []string
+	// identitiesOnly offers the agent keys of the identityFiles only.
+	identitiesOnly bool
+	addKeysToAgent string
+
+	x11Display        string
+	x11MaxConnections int
+	command           string
+	termSize          string
+	requestTTY        string
+	term              string
+	noCommand         bool
+	autoReconnect     bool
+	logLevel          int
+	verbose           bool
+	mouse             bool
+	translateVT       bool
+	sessionType       string
+	subsystem         string
+	// env is the KEY=VALUE of --env-file.
+	env []string
+	// tokens are the %-tokens of the connection, for the forwards of the
+	// command line.
+	tokens map[byte]string
+	// kexDebug reports the algorithms of the both sides, also on a handshake
+	// failure.
+	kexDebug bool
 
-	x11Display string
+	// insecureIgnoreLoopbackHostKey skips the host key verification for
+	// loopback servers. For the tests only.
+	insecureIgnoreLoopbackHostKey bool
 }
 
-func loadConfig(host, cfg string) (*config, error) {
+// loadConfig resolves the configuration for host. cli holds the keywords
+// given on the command line, which take precedence over the files.
+func loadConfig(host, cfg string, cli map[string]string) (*config, error) {
 	user, err := user.Current()
 	if err != nil {
 		return nil, err
@@ -82,105 +333,316 @@ func loadConfig(host, cfg string) (*config, error) {
 		cfg = defaultUserConfigLocation(user)
 	}
 
-	userConfig, _ := loadSshConfig(cfg)
-	systemConfig, _ := loadSshConfig(defaultSystemConfigLocation())
-
-	get := func(name string, fallback string) string {
-		var val string
+	opts := newSshOptions(host, user.Username)
+	for k, v := range cli {
+		opts.set(k, v)
+	}
 
-		if userConfig != nil {
-			val, _ = userConfig.Get(host, name)
+	for _, path := range []string{cfg, defaultSystemConfigLocation()} {
+		c, err := loadSshConfig(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
 		}
-		if val == "" && systemConfig != nil {
-			val, _ = systemConfig.Get(host, name)
+		if err != nil {
+			return nil, err
 		}
-		if val == "" {
-			val = fallback
+
+		if err := opts.apply(c); err != nil {
+			return nil, err
 		}
+	}
 
-		return val
+	get := func(name string, fallback string) string {
+		if val := opts.get(name); val != "" {
+			return val
+		}
+
+		return fallback
 	}
 
-	return &config{
-		user:             get("User", user.Username),
-		hostname:         get("Hostname", host),
-		port:             get("Port", "22"),
-		userKnownHosts:   get("UserKnownHostsFile", defaultUserKnownHostsFile(user)),
-		globalKnownHosts: get("GlobalKnownHostsFile", defaultGlobalKnownHostsFile()),
-		forwardX11:       get("ForwardX11", "no") == "yes",
-		forwardAgent:     get("ForwardAgent", "no") == "yes",
-		xAuthLocation:    get("XAuthLocation", "xauth"),
-
-		x11Display: os.Getenv("DISPLAY"),
-	}, nil
-}
+	getAll := opts.getAll
 
-type knownHostsEntry struct {
-	hosts  []string
-	pubKey ssh.PublicKey
-}
+	hostname, err := percentExpand(get("Hostname", host), map[byte]string{'h': host})
+	if err != nil {
+		return nil, err
+	}
+	port := get("Port", "22")
+
+	localHostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	shortHostname, _, _ := strings.Cut(localHostname, ".")
+
+	// REF ssh_config(5) TOKENS
+	remoteUser, err := percentExpand(get("User", user.Username), map[byte]string{
+		'd': user.HomeDir,
+		'h': hostname,
+		'i': user.Uid,
+		'L': shortHostname,
+		'l': localHostname,
+		'n': host,
+		'p': port,
+		'u': user.Username,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	forwardX11Timeout, err := parseTime(get("ForwardX11Timeout", "20m"))
+	if err != nil {
+		return nil, err
+	}
+
+	escapeChar, err := parseEscapeChar(get("EscapeChar", "~"))
+	if err != nil {
+		return nil, err
+	}
+
+	serverAliveInterval, err := parseTime(get("ServerAliveInterval", "0"))
+	if err != nil {
+		return nil, err
+	}
+
+	serverAliveCountMax, err := strconv.Atoi(get("ServerAliveCountMax", "3"))
+	if err != nil {
+		return nil, err
+	}
 
-func iterKnownHosts(r io.Reader) iter.Seq2[*knownHostsEntry, error] {
-	return func(yield func(*knownHostsEntry, error) bool) {
-		buf, err := io.ReadAll(r)
+	addressFamily := strings.ToLower(get("AddressFamily", addressFamilyAny))
+	switch addressFamily {
+	case addressFamilyAny, addressFamilyInet, addressFamilyInet6:
+	default:
+		return nil, fmt.Errorf("Unsupported AddressFamily: %s", addressFamily)
+	}
+
+	var connectTimeout time.Duration
+	if v := get("ConnectTimeout", "none"); v != "none" {
+		if connectTimeout, err = parseTime(v); err != nil {
+			return nil, err
+		}
+	}
+
+	// Not of OpenSSH, which needs IgnoreUnknown ServerAliveAction.
+	serverAliveAction := strings.ToLower(get("ServerAliveAction", serverAliveExit))
+	switch serverAliveAction {
+	case serverAliveExit, serverAliveReconnect:
+	default:
+		return nil, fmt.Errorf("Unsupported ServerAliveAction: %s", serverAliveAction)
+	}
+
+	// Not of OpenSSH, the milliseconds of the BREAK of ~B.
+	breakLength := defaultBreakLength
+	if v := get("BreakLength", ""); v != "" {
+		ms, err := strconv.ParseUint(v, 10, 32)
 		if err != nil {
-			yield(nil, err)
-			return
+			return nil, fmt.Errorf("Invalid BreakLength: %s", v)
 		}
+		breakLength = time.Duration(ms) * time.Millisecond
+	}
 
-		for len(buf) > 0 {
-			var hosts []string
-			var pubKey ssh.PublicKey
+	pubkeyAcceptedAlgorithms, err := parseAlgorithms("PubkeyAcceptedAlgorithms", get("PubkeyAcceptedAlgorithms", ""))
+	if err != nil {
+		return nil, err
+	}
 
-			_, hosts, pubKey, _, buf, err = ssh.ParseKnownHosts(buf)
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			if err != nil {
-				if !yield(nil, err) {
-					return
-				}
-			}
+	// ask / autoask are without the confirmation.
+	var controlMaster bool
+	switch strings.ToLower(get("ControlMaster", "no")) {
+	case "yes", "auto", "ask", "autoask":
+		controlMaster = true
+	case "no":
+	default:
+		return nil, fmt.Errorf("Unsupported ControlMaster: %s", get("ControlMaster", ""))
+	}
 
-			ent := knownHostsEntry{hosts, pubKey}
-			if !yield(&ent, nil) {
-				return
-			}
+	// The tokens of the file names, ControlPath and IdentityFile, and of the
+	// forwards.
+	fileTokens := map[byte]string{
+		'C': connectionHash(localHostname, hostname, port, remoteUser),
+		'd': user.HomeDir,
+		'h': hostname,
+		'i': user.Uid,
+		'L': shortHostname,
+		'l': localHostname,
+		'n': host,
+		'p': port,
+		'r': remoteUser,
+		'u': user.Username,
+	}
+	expandFile := func(v string) (string, error) {
+		path, err := percentExpand(v, fileTokens)
+		if err != nil {
+			return "", err
+		}
+		if rest, ok := strings.CutPrefix(path, "~/"); ok {
+			path = filepath.Join(user.HomeDir, rest)
 		}
+		return path, nil
 	}
-}
 
-func knownHostsHostKey(knownHosts, defaultPort string) ssh.HostKeyCallback {
-	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-		if strings.HasSuffix(hostname, fmt.Sprintf(":%s", defaultPort)) {
-			hostname = hostname[:len(hostname)-(1+len(defaultPort))]
+	// Like `RemoteForward 8080 %h:80`.
+	var localForwards []*forwardSpec
+	for _, v := range getAll("LocalForward") {
+		v, err := percentExpand(v, fileTokens)
+		if err != nil {
+			return nil, err
+		}
+		spec, err := parseLocalForward(v)
+		if err != nil {
+			return nil, err
 		}
+		localForwards = append(localForwards, spec)
+	}
 
-		fp, err := os.Open(knownHosts)
+	var remoteForwards []*forwardSpec
+	for _, v := range getAll("RemoteForward") {
+		v, err := percentExpand(v, fileTokens)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		spec, err := parseRemoteForward(v)
+		if err != nil {
+			return nil, err
 		}
-		defer fp.Close()
+		remoteForwards = append(remoteForwards, spec)
+	}
 
-		for ent, err := range iterKnownHosts(fp) {
-			if err != nil {
-				return err
-			}
+	var controlPath string
+	if v := get("ControlPath", "none"); v != "none" {
+		if controlPath, err = expandFile(v); err != nil {
+			return nil, err
+		}
+	}
 
-			if !slices.Contains(ent.hosts, hostname) {
-				continue
-			}
+	// Only the ones configured, not the defaults of ssh.
+	var identityFiles []string
+	for _, v := range getAll("IdentityFile") {
+		path, err := expandFile(v)
+		if err != nil {
+			return nil, err
+		}
+		identityFiles = append(identityFiles, path)
+	}
 
-			if key.Type() != ent.pubKey.Type() {
+	addKeysToAgent := strings.ToLower(get("AddKeysToAgent", addKeysNo))
+	switch addKeysToAgent {
+	case addKeysNo, addKeysYes, addKeysAsk, addKeysConfirm:
+	default:
+		return nil, fmt.Errorf("Unsupported AddKeysToAgent: %s", addKeysToAgent)
+	}
+
+	// Not of OpenSSH, the proxy of HTTP CONNECT, https_proxy by default.
+	httpProxy := get("HttpProxy", "")
+	switch httpProxy {
+	case "":
+		httpProxy = proxyFromEnv(os.Getenv, hostname)
+	case "none":
+		httpProxy = ""
+	}
+
+	// Not of OpenSSH, like ServerAliveAction. So is TerminalSanitize.
+	terminalModes, err := parseTerminalModes(get("TerminalModes", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	logLevel, err := parseLogLevel(get("LogLevel", "INFO"))
+	if err != nil {
+		return nil, err
+	}
+
+	sessionType := strings.ToLower(get("SessionType", sessionTypeDefault))
+	switch sessionType {
+	case sessionTypeDefault, sessionTypeNone, sessionTypeSubsystem:
+	default:
+		return nil, fmt.Errorf("Unsupported SessionType: %s", sessionType)
+	}
+
+	requestTTY := strings.ToLower(get("RequestTTY", requestTTYAuto))
+	switch requestTTY {
+	case requestTTYAuto, requestTTYNo, requestTTYYes, requestTTYForce:
+	default:
+		return nil, fmt.Errorf("Unsupported RequestTTY: %s", requestTTY)
+	}
+
+	return &config{
+		host:                host,
+		user:                remoteUser,
+		hostname:            hostname,
+		port:                port,
+		userKnownHosts:      get("UserKnownHostsFile", defaultUserKnownHostsFile(user)),
+		globalKnownHosts:    get("GlobalKnownHostsFile", defaultGlobalKnownHostsFile()),
+		forwardX11:          get("ForwardX11", "no") == "yes",
+		forwardX11Trusted:   get("ForwardX11Trusted", "no") == "yes",
+		forwardX11Timeout:   forwardX11Timeout,
+		forwardAgent:        get("ForwardAgent", "no") == "yes",
+		xAuthLocation:       get("XAuthLocation", "xauth"),
+		localForwards:       localForwards,
+		remoteForwards:      remoteForwards,
+		passwordAuth:        get("PasswordAuthentication", "yes") == "yes",
+		kbdInteractive:      get("KbdInteractiveAuthentication", "yes") == "yes",
+		escapeChar:          escapeChar,
+		breakLength:         breakLength,
+		httpProxy:           httpProxy,
+		bindAddress:         get("BindAddress", ""),
+		addressFamily:       addressFamily,
+		connectTimeout:      connectTimeout,
+		serverAliveInterval: serverAliveInterval,
+		serverAliveCountMax: serverAliveCountMax,
+		serverAliveAction:   serverAliveAction,
+		terminalModes:       terminalModes,
+		terminalSanitize:    get("TerminalSanitize", "yes") == "yes",
+		hostKeyAlias:        get("HostKeyAlias", ""),
+		identityFiles:       identityFiles,
+		identitiesOnly:      get("IdentitiesOnly", "no") == "yes",
+		addKeysToAgent:      addKeysToAgent,
+		noAgent:             get("IdentityAgent", "") == "none",
+
+		pubkeyAcceptedAlgorithms: pubkeyAcceptedAlgorithms,
+
+		x11Display:  os.Getenv("DISPLAY"),
+		requestTTY:  requestTTY,
+		sessionType: sessionType,
+		logLevel:    logLevel,
+		verbose:     logLevel >= logVerbose,
+
+		controlMaster: controlMaster,
+		controlPath:   controlPath,
+		tokens:        fileTokens,
+	}, nil
+}
+
+// connectionHash is %C, the SHA1 of %l%h%p%r.
+func connectionHash(localHostname, hostname, port, remoteUser string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(localHostname+hostname+port+remoteUser)))
+}
+
+func knownHostsHostKey(knownHosts string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		entries, err := knownhosts.Lookup(knownHosts, hostname)
+		if err != nil {
+			return err
+		}
+
+		matched := false
+		for _, ent := range entries {
+			if !bytes.Equal(key.Marshal(), ent.Key.Marshal()) {
 				continue
 			}
 
-			if bytes.Equal(key.Marshal(), ent.pubKey.Marshal()) {
-				return nil
+			switch ent.Marker {
+			case knownhosts.MarkerRevoked:
+				return fmt.Errorf("Host key revoked: %s", knownhosts.Normalize(hostname))
+			case "":
+				matched = true
 			}
 		}
+		if matched {
+			return nil
+		}
 
-		return fmt.Errorf("NO MATCH ENTRIES FOUND: %s", hostname)
+		return fmt.Errorf("NO MATCH ENTRIES FOUND: %s", knownhosts.Normalize(hostname))
 	}
 }
 
@@ -201,24 +663,370 @@ func combinedHostKey(fns ...ssh.HostKeyCallback) ssh.HostKeyCallback {
 	}
 }
 
-func dialSsh(cfg *config, agent agent.Agent) (*ssh.Client, error) {
+type prompter struct {
+	password func(msg string) (string, error)
+	line     func(msg string) (string, error)
+}
+
+// parseAlgorithms parses the algorithm list of ssh_config. nil means the
+// defaults. "+" / "^" only add to or reorder the defaults, which already
+// offer all the supported ones.
+func parseAlgorithms(keyword, s string) ([]string, error) {
+	if s == "" || strings.HasPrefix(s, "+") || strings.HasPrefix(s, "^") {
+		return nil, nil
+	}
+	if strings.HasPrefix(s, "-") {
+		return nil, fmt.Errorf("Unsupported %s: %s", keyword, s)
+	}
+
+	return strings.Split(s, ","), nil
+}
+
+// certAlgorithms maps the certificate algorithms to the underlying ones.
+var certAlgorithms = map[string]string{
+	ssh.CertAlgoRSAv01:        ssh.KeyAlgoRSA,
+	ssh.CertAlgoRSASHA256v01:  ssh.KeyAlgoRSASHA256,
+	ssh.CertAlgoRSASHA512v01:  ssh.KeyAlgoRSASHA512,
+	ssh.CertAlgoDSAv01:        ssh.KeyAlgoDSA,
+	ssh.CertAlgoECDSA256v01:   ssh.KeyAlgoECDSA256,
+	ssh.CertAlgoECDSA384v01:   ssh.KeyAlgoECDSA384,
+	ssh.CertAlgoECDSA521v01:   ssh.KeyAlgoECDSA521,
+	ssh.CertAlgoED25519v01:    ssh.KeyAlgoED25519,
+	ssh.CertAlgoSKECDSA256v01: ssh.KeyAlgoSKECDSA256,
+	ssh.CertAlgoSKED25519v01:  ssh.KeyAlgoSKED25519,
+}
+
+func underlyingAlgorithm(algo string) string {
+	if u, ok := certAlgorithms[algo]; ok {
+		return u
+	}
+	return algo
+}
+
+// signatureAlgorithms returns the signature algorithms for the key type.
+func signatureAlgorithms(keyType string) []string {
+	algo := underlyingAlgorithm(keyType)
+	if algo == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{algo}
+}
+
+// restrictSigners limits the signature algorithms of the signers to
+// PubkeyAcceptedAlgorithms. The signers left without one are dropped.
+func restrictSigners(signers []ssh.Signer, accepted []string) []ssh.Signer {
+	if accepted == nil {
+		return signers
+	}
+
+	var ret []ssh.Signer
+	for _, signer := range signers {
+		as, ok := signer.(ssh.AlgorithmSigner)
+		if !ok {
+			continue
+		}
+
+		var algos []string
+		for _, algo := range signatureAlgorithms(signer.PublicKey().Type()) {
+			for _, a := range accepted {
+				if underlyingAlgorithm(a) == algo && !slices.Contains(algos, algo) {
+					algos = append(algos, algo)
+				}
+			}
+		}
+		if len(algos) == 0 {
+			continue
+		}
+
+		ms, err := ssh.NewSignerWithAlgorithms(as, algos)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, ms)
+	}
+	return ret
+}
+
+func authMethods(cfg *config, agent agent.Agent, p *prompter) []ssh.AuthMethod {
+	var password *string
+	readPassword := func() (string, error) {
+		if password != nil {
+			return *password, nil
+		}
+
+		v, err := p.password(fmt.Sprintf("%s@%s's password: ", cfg.user, cfg.hostname))
+		if err != nil {
+			return "", err
+		}
+		password = &v
+		return v, nil
+	}
+
+	var methods []ssh.AuthMethod
+	if !cfg.noAgent || len(cfg.identityFiles) > 0 {
+		// One method, x/crypto/ssh tries each method once. The agent keys
+		// first, like ssh.
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			var signers []ssh.Signer
+			if !cfg.noAgent {
+				var err error
+				if signers, err = agent.Signers(); err != nil {
+					return nil, err
+				}
+				if cfg.identitiesOnly {
+					signers = onlyIdentities(cfg, signers)
+				}
+			}
+			signers = append(signers, identitySigners(cfg, agent, p, signers)...)
+			return restrictSigners(signers, cfg.pubkeyAcceptedAlgorithms), nil
+		}))
+	}
+
+	if cfg.kbdInteractive {
+		methods = append(methods, ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			// Some PAM setups expose password authentication only as a single
+			// "Password:" prompt. Answer it with the password like OpenSSH does.
+			if len(questions) == 1 && !echos[0] && cfg.passwordAuth {
+				v, err := readPassword()
+				if err != nil {
+					return nil, err
+				}
+				return []string{v}, nil
+			}
+
+			answers := make([]string, 0, len(questions))
+			for i, q := range questions {
+				read := p.password
+				if echos[i] {
+					read = p.line
+				}
+
+				v, err := read(q)
+				if err != nil {
+					return nil, err
+				}
+				answers = append(answers, v)
+			}
+			return answers, nil
+		}))
+	}
+
+	if cfg.passwordAuth {
+		methods = append(methods, ssh.PasswordCallback(readPassword))
+	}
+
+	return methods
+}
+
+// aliasHostKey verifies the key under alias instead of the host we connected
+// to. Like ssh, the alias is bare whatever the port, [alias]:port is never
+// looked up.
+// REF https://github.com/openssh/openssh-portable/blob/V_9_9_P1/sshconnect.c (get_hostfile_hostname_ipaddr)
+func aliasHostKey(alias string, fn ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return fn(net.JoinHostPort(alias, knownhosts.DefaultPort), remote, key)
+	}
+}
+
+func hostKeyCallback(cfg *config) ssh.HostKeyCallback {
 	hostkeycallbacks := make([]ssh.HostKeyCallback, 0)
 	if cfg.userKnownHosts != "" {
 		// TODO split " "
-		hostkeycallbacks = append(hostkeycallbacks, knownHostsHostKey(cfg.userKnownHosts, "22"))
+		hostkeycallbacks = append(hostkeycallbacks, knownHostsHostKey(cfg.userKnownHosts))
 	}
 	if cfg.globalKnownHosts != "" {
 		// TODO split " "
-		hostkeycallbacks = append(hostkeycallbacks, knownHostsHostKey(cfg.globalKnownHosts, "22"))
+		hostkeycallbacks = append(hostkeycallbacks, knownHostsHostKey(cfg.globalKnownHosts))
+	}
+	callback := combinedHostKey(hostkeycallbacks...)
+
+	if cfg.hostKeyAlias != "" {
+		callback = aliasHostKey(cfg.hostKeyAlias, callback)
+	}
+
+	if cfg.insecureIgnoreLoopbackHostKey {
+		callback = insecureLoopbackHostKey(callback)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := callback(hostname, remote, key); err != nil {
+			return &permanentError{err}
+		}
+		return nil
+	}
+}
+
+// insecureLoopbackHostKey accepts any host key of a loopback server, for the
+// tests against an ephemeral server. Never set from the command line or
+// the configuration files.
+func insecureLoopbackHostKey(fallback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if addr, ok := remote.(*net.TCPAddr); ok && addr.IP.IsLoopback() {
+			return nil
+		}
+
+		return fallback(hostname, remote, key)
+	}
+}
+
+func dialConn(ctx context.Context, cfg *config, addr string) (net.Conn, error) {
+	// ConnectTimeout is of the whole, all the addresses tried.
+	if cfg.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.connectTimeout)
+		defer cancel()
+	}
+
+	dialer := &net.Dialer{}
+	if cfg.bindAddress != "" {
+		local, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(cfg.bindAddress, "0"))
+		if err != nil {
+			return nil, &permanentError{err}
+		}
+		dialer.LocalAddr = local
+	}
+
+	if cfg.httpProxy != "" {
+		proxy, err := url.Parse(cfg.httpProxy)
+		if err != nil {
+			return nil, &permanentError{err}
+		}
+		return dialHttpProxy(ctx, dialer, proxy, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := resolveAddrs(ctx, host, cfg.addressFamily)
+	if err != nil {
+		return nil, err
 	}
-	hostKeyCallback := combinedHostKey(hostkeycallbacks...)
+	return dialAddrs(ctx, dialer.DialContext, addrs, port, connectionAttemptDelay, cfg.logf(logDebug))
+}
+
+// unixSocketPath returns the path of the hostname unix:/path/to/sock, for
+// sshd listening on a Unix-domain socket.
+func unixSocketPath(hostname string) (string, bool) {
+	path, ok := strings.CutPrefix(hostname, "unix:")
+	if !ok || path == "" {
+		return "", false
+	}
+	return path, true
+}
+
+// dialSsh connects and authenticates. ctx cancels the dial and the
+// handshake, the connection returned is not bound to it.
+//
+// A server disconnecting on too many authentication failures, the agent
+// offering more keys than its MaxAuthTries, is connected to again with the
+// IdentityFiles only, as IdentitiesOnly yes.
+func dialSsh(ctx context.Context, cfg *config, agent agent.Agent) (*ssh.Client, error) {
+	client, err := dialSshOnce(ctx, cfg, agent)
+	if err == nil || !isTooManyAuthFailures(err) {
+		return client, err
+	}
+	if cfg.identitiesOnly || cfg.noAgent || len(cfg.identityFiles) == 0 {
+		log.Printf("Too many authentication failures for %s@%s. Consider IdentitiesOnly yes with the IdentityFile of the host.", cfg.user, cfg.hostname)
+		return nil, err
+	}
+
+	log.Printf("Too many authentication failures for %s@%s, retrying with the IdentityFiles only. Consider IdentitiesOnly yes for the host.", cfg.user, cfg.hostname)
+	narrowed := *cfg
+	narrowed.identitiesOnly = true
+	return dialSshOnce(ctx, &narrowed, agent)
+}
 
+// isTooManyAuthFailures reports whether err is the disconnect of the server
+// on too many authentication attempts, MaxAuthTries of sshd_config(5).
+// x/crypto/ssh does not export the disconnect message.
+func isTooManyAuthFailures(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "too many authentication failures")
+}
+
+// permanentError is a failure of the dial that retrying never fixes, the host
+// key rejected or a bad configuration.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// isPermanent reports whether the dial failed for good, with a
+// permanentError or the authentication failed, the client offering the same
+// credentials again.
+func isPermanent(err error) bool {
+	var perm *permanentError
+	if errors.As(err, &perm) || isTooManyAuthFailures(err) {
+		return true
+	}
+	return strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+func dialSshOnce(ctx context.Context, cfg *config, agent agent.Agent) (*ssh.Client, error) {
 	sshcfg := &ssh.ClientConfig{
 		User: cfg.user,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeysCallback(agent.Signers),
-		},
-		HostKeyCallback: hostKeyCallback,
+		Auth: authMethods(cfg, agent, &prompter{
+			password: prompt.Password,
+			line:     prompt.Line,
+		}),
+		HostKeyCallback: hostKeyCallback(cfg),
+	}
+	addr := net.JoinHostPort(cfg.hostname, cfg.port)
+	var conn net.Conn
+	var err error
+	if path, ok := unixSocketPath(cfg.hostname); ok {
+		// The host keys are of the alias, the path names no host.
+		addr = net.JoinHostPort(cfg.host, cfg.port)
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "unix", path)
+	} else {
+		conn, err = dialConn(ctx, cfg, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logf := cfg.logf(logDebug2)
+	if logf == nil && cfg.kexDebug {
+		logf = log.Printf
+	}
+	var rec *kexInitRecorder
+	var hostKey ssh.PublicKey
+	if logf != nil {
+		rec = &kexInitRecorder{Conn: conn}
+		conn = rec
+		callback := sshcfg.HostKeyCallback
+		sshcfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return callback(hostname, remote, key)
+		}
+	}
+
+	// The handshake has no context, closing the connection aborts it.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshcfg)
+	if !stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		if logf != nil {
+			reportOffers(logf, rec)
+		}
+		return nil, err
+	}
+	if logf != nil {
+		reportHandshake(logf, c, rec, hostKey)
 	}
-	return ssh.Dial("tcp", fmt.Sprintf("%s:%s", cfg.hostname, cfg.port), sshcfg)
+	return ssh.NewClient(c, chans, reqs), nil
 }
@@ -0,0 +1,829 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ysuzuki-bysystems/myssh/forward"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestParseRemoteForward(t *testing.T) {
+	tests := []struct {
+		spec    string
+		listen  string
+		connect string
+	}{
+		{"8080 localhost:80", "localhost:8080", "localhost:80"},
+		{"*:8080 localhost:80", "0.0.0.0:8080", "localhost:80"},
+		{"1080", "localhost:1080", ""},
+		{"[::1]:1080", "[::1]:1080", ""},
+		{"/tmp/remote.sock /tmp/local.sock", "/tmp/remote.sock", "/tmp/local.sock"},
+		{"8080 /tmp/local.sock", "localhost:8080", "/tmp/local.sock"},
+	}
+
+	for _, tt := range tests {
+		spec, err := parseRemoteForward(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if spec.listen.String() != tt.listen || spec.connect.String() != tt.connect {
+			t.Fatalf("%s: %#v", tt.spec, spec)
+		}
+	}
+
+	if _, err := parseRemoteForward("x:y"); err == nil {
+		t.Fatal("must fail")
+	}
+}
+
+func TestParseLocalForwardArg(t *testing.T) {
+	tcp := func(addr string) forward.Endpoint {
+		return forward.Endpoint{Network: "tcp", Address: addr}
+	}
+	unix := func(path string) forward.Endpoint {
+		return forward.Endpoint{Network: "unix", Address: path}
+	}
+
+	tests := []struct {
+		spec    string
+		listen  forward.Endpoint
+		connect forward.Endpoint
+	}{
+		{"8080:localhost:80", tcp("localhost:8080"), tcp("localhost:80")},
+		{"127.0.0.1:8080:db:5432", tcp("127.0.0.1:8080"), tcp("db:5432")},
+		{"[::1]:8080:[2001:db8::1]:80", tcp("[::1]:8080"), tcp("[2001:db8::1]:80")},
+		{"3306:/var/run/mysqld/mysqld.sock", tcp("localhost:3306"), unix("/var/run/mysqld/mysqld.sock")},
+		{"*:3306:/var/run/mysqld/mysqld.sock", tcp("0.0.0.0:3306"), unix("/var/run/mysqld/mysqld.sock")},
+		{"/tmp/mysql.sock:/var/run/mysqld/mysqld.sock", unix("/tmp/mysql.sock"), unix("/var/run/mysqld/mysqld.sock")},
+		{"/tmp/web.sock:localhost:80", unix("/tmp/web.sock"), tcp("localhost:80")},
+	}
+
+	for _, tt := range tests {
+		spec, err := parseLocalForwardArg(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if spec.listen != tt.listen || spec.connect != tt.connect {
+			t.Errorf("%s: %#v", tt.spec, spec)
+		}
+	}
+
+	for _, spec := range []string{"8080", "localhost:8080", "8080:localhost:http", "a:b:c:d:e"} {
+		if _, err := parseLocalForwardArg(spec); err == nil {
+			t.Errorf("%s: must fail", spec)
+		}
+	}
+
+	spec, err := parseLocalForward("/tmp/mysql.sock /var/run/mysqld/mysqld.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.listen != unix("/tmp/mysql.sock") || spec.connect != unix("/var/run/mysqld/mysqld.sock") {
+		t.Fatalf("%#v", spec)
+	}
+}
+
+func TestLoadConfigForwardTokens(t *testing.T) {
+	cfgfile := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(cfgfile, []byte(`
+Host alias
+    HostName target.example.com
+    Port 2222
+    RemoteForward 8080 %h:80
+    LocalForward 9090 %h:%p
+Host bad
+    RemoteForward 8080 %z:80
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	opts, err := parseArgs("myssh", []string{"-config", cfgfile, "-R", "8081:%h:81", "alias"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := opts.loadConfig(opts.host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := func(addr string) forward.Endpoint {
+		return forward.Endpoint{Network: "tcp", Address: addr}
+	}
+	if len(cfg.remoteForwards) != 2 || cfg.remoteForwards[0].connect != tcp("target.example.com:80") || cfg.remoteForwards[1].connect != tcp("target.example.com:81") {
+		t.Fatalf("%v", cfg.remoteForwards)
+	}
+	if len(cfg.localForwards) != 1 || cfg.localForwards[0].connect != tcp("target.example.com:2222") {
+		t.Fatalf("%v", cfg.localForwards)
+	}
+
+	if _, err := loadConfig("bad", cfgfile, nil); err == nil {
+		t.Fatal("an unknown token must fail")
+	}
+}
+
+func TestAuthKeyboardInteractivePassword(t *testing.T) {
+	srvcfg := &ssh.ServerConfig{
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client("", "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+
+			if len(answers) != 1 || answers[0] != "secret" {
+				return nil, errors.New("denied")
+			}
+			return nil, nil
+		},
+	}
+	srv := newTestServer(t, srvcfg, nil)
+
+	cfg := &config{
+		user:           "user",
+		hostname:       "127.0.0.1",
+		passwordAuth:   true,
+		kbdInteractive: true,
+	}
+
+	prompts := 0
+	p := &prompter{
+		password: func(msg string) (string, error) {
+			prompts++
+			if msg != "user@127.0.0.1's password: " {
+				t.Errorf("%q", msg)
+			}
+			return "secret", nil
+		},
+		line: func(msg string) (string, error) {
+			t.Error("must not be called")
+			return "", nil
+		},
+	}
+
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            cfg.user,
+		Auth:            authMethods(cfg, agent.NewKeyring(), p),
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	if prompts != 1 {
+		t.Fatalf("%d", prompts)
+	}
+}
+
+func writeKnownHosts(t *testing.T, lines ...string) string {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(p, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestHostKeyAlias(t *testing.T) {
+	key := newHostKey(t).PublicKey()
+	knownHosts := writeKnownHosts(t, knownhosts.Line([]string{"myalias"}, key))
+
+	cfg := &config{
+		hostname:       "192.0.2.10",
+		port:           "22",
+		userKnownHosts: knownHosts,
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 22}
+	if err := hostKeyCallback(cfg)("192.0.2.10:22", remote, key); err == nil {
+		t.Fatal("must not match without HostKeyAlias")
+	}
+
+	cfg.hostKeyAlias = "myalias"
+	if err := hostKeyCallback(cfg)("192.0.2.10:22", remote, key); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newHostKey(t).PublicKey()
+	if err := hostKeyCallback(cfg)("192.0.2.10:22", remote, other); err == nil {
+		t.Fatal("must not match another key")
+	}
+
+	// Like ssh, the bare alias whatever the port.
+	cfg.port = "2222"
+	remote.Port = 2222
+	if err := hostKeyCallback(cfg)("192.0.2.10:2222", remote, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGlobalKnownHostsPort(t *testing.T) {
+	key := newHostKey(t).PublicKey()
+
+	cfg := &config{
+		hostname:         "192.0.2.10",
+		port:             "2222",
+		userKnownHosts:   writeKnownHosts(t),
+		globalKnownHosts: writeKnownHosts(t, knownhosts.Line([]string{"[192.0.2.10]:2222"}, key)),
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 2222}
+	if err := hostKeyCallback(cfg)("192.0.2.10:2222", remote, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entry is for port 2222 only.
+	remote.Port = 22
+	if err := hostKeyCallback(cfg)("192.0.2.10:22", remote, key); err == nil {
+		t.Fatal("must not match another port")
+	}
+}
+
+func TestHostKeyRevoked(t *testing.T) {
+	key := newHostKey(t).PublicKey()
+
+	cfg := &config{
+		hostname: "192.0.2.10",
+		port:     "22",
+		userKnownHosts: writeKnownHosts(t,
+			knownhosts.Line([]string{"192.0.2.10"}, key),
+			"@revoked "+knownhosts.Line([]string{"*"}, key),
+		),
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 22}
+	err := hostKeyCallback(cfg)("192.0.2.10:22", remote, key)
+	if err == nil {
+		t.Fatal("must not accept a revoked key")
+	}
+	// Not retried by --auto-reconnect.
+	if !isPermanent(fmt.Errorf("ssh: handshake failed: %w", err)) {
+		t.Fatal(err)
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&permanentError{errors.New("NO MATCH ENTRIES FOUND: example.com")}, true},
+		{errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password], no supported methods remain"), true},
+		{errors.New("ssh: disconnect, reason 2: Too many authentication failures"), true},
+		{io.EOF, false},
+		{errServerAliveTimeout, false},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, false},
+	}
+	for _, tt := range tests {
+		if got := isPermanent(tt.err); got != tt.want {
+			t.Errorf("%v: %v", tt.err, got)
+		}
+	}
+}
+
+func TestAuthNoAgent(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, noAgent := range []bool{false, true} {
+		offered := 0
+		srvcfg := &ssh.ServerConfig{
+			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				offered++
+				return nil, errors.New("denied")
+			},
+			PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				return nil, nil
+			},
+		}
+		srv := newTestServer(t, srvcfg, nil)
+
+		cfg := &config{user: "user", hostname: "127.0.0.1", passwordAuth: true, noAgent: noAgent}
+		p := &prompter{
+			password: func(msg string) (string, error) {
+				return "secret", nil
+			},
+		}
+
+		client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+			User:            cfg.user,
+			Auth:            authMethods(cfg, keyring, p),
+			HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+
+		if noAgent && offered != 0 {
+			t.Fatalf("offered %d keys with --no-agent", offered)
+		}
+		if !noAgent && offered == 0 {
+			t.Fatal("agent keys must be offered")
+		}
+	}
+}
+
+func TestAuthPubkeyAcceptedAlgorithms(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A modern server rejecting SHA-1.
+	srv := newTestServer(t, &ssh.ServerConfig{
+		PublicKeyAuthAlgorithms: []string{ssh.KeyAlgoRSASHA256},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}, nil)
+
+	tests := []struct {
+		accepted string
+		ok       bool
+	}{
+		{"", true},
+		{"+ssh-rsa", true},
+		{"rsa-sha2-256", true},
+		{"rsa-sha2-512,rsa-sha2-256", true},
+		{"rsa-sha2-512", false},
+		{"ssh-rsa", false},
+		{"ssh-ed25519", false},
+	}
+
+	for _, tt := range tests {
+		accepted, err := parseAlgorithms("PubkeyAcceptedAlgorithms", tt.accepted)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &config{user: "user", hostname: "127.0.0.1", pubkeyAcceptedAlgorithms: accepted}
+		client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+			User:            cfg.user,
+			Auth:            authMethods(cfg, keyring, &prompter{}),
+			HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+		})
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: %v", tt.accepted, err)
+		}
+		if err == nil {
+			client.Close()
+		}
+	}
+
+	if _, err := parseAlgorithms("PubkeyAcceptedAlgorithms", "-ssh-rsa"); err == nil {
+		t.Fatal("must fail")
+	}
+}
+
+func TestLoadConfigUser(t *testing.T) {
+	local, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfgfile := filepath.Join(t.TempDir(), "config")
+	err = os.WriteFile(cfgfile, []byte(`
+Host token.example.com
+    User %u-%n
+
+Host alias
+    HostName %h.example.com
+    User %%admin-%h-%p
+    Port 2222
+
+Match user bob
+    User robert
+
+Match originalhost match.example.com
+    User matched
+
+Host *
+    User fallback
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host     string
+		cli      map[string]string
+		user     string
+		hostname string
+	}{
+		{"token.example.com", nil, local.Username + "-token.example.com", "token.example.com"},
+		{"alias", nil, "%admin-alias.example.com-2222", "alias.example.com"},
+		{"other.example.com", nil, "fallback", "other.example.com"},
+		{"match.example.com", nil, "matched", "match.example.com"},
+		// user@host
+		{"token.example.com", map[string]string{"User": "alice"}, "alice", "token.example.com"},
+		// Match user sees the CLI user, but it still takes precedence.
+		{"other.example.com", map[string]string{"User": "bob"}, "bob", "other.example.com"},
+	}
+
+	for _, tt := range tests {
+		cfg, err := loadConfig(tt.host, cfgfile, tt.cli)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cfg.user != tt.user || cfg.hostname != tt.hostname {
+			t.Errorf("%s %v: %s@%s", tt.host, tt.cli, cfg.user, cfg.hostname)
+		}
+	}
+}
+
+func TestLoadConfigHostNegation(t *testing.T) {
+	cfgfile := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(cfgfile, []byte(`
+Host * !prod.example.com
+    Port 2222
+    ForwardAgent yes
+
+Host prod.example.com !*
+    User never
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig("dev.example.com", cfgfile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.port != "2222" || !cfg.forwardAgent {
+		t.Fatalf("%s %v", cfg.port, cfg.forwardAgent)
+	}
+
+	// The excluded host falls through to the defaults.
+	cfg, err = loadConfig("prod.example.com", cfgfile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.port != "22" || cfg.forwardAgent || cfg.user == "never" {
+		t.Fatalf("%s %v %s", cfg.port, cfg.forwardAgent, cfg.user)
+	}
+}
+
+func TestInsecureLoopbackHostKey(t *testing.T) {
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, nil)
+	_, port, err := net.SplitHostPort(srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config{
+		user:           "user",
+		hostname:       "127.0.0.1",
+		port:           port,
+		userKnownHosts: writeKnownHosts(t),
+		noAgent:        true,
+	}
+
+	if _, err := dialSsh(context.Background(), cfg, nil); err == nil {
+		t.Fatal("must fail without the host key in known_hosts")
+	}
+
+	cfg.insecureIgnoreLoopbackHostKey = true
+	client, err := dialSsh(context.Background(), cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	// Not loopback
+	callback := insecureLoopbackHostKey(func(string, net.Addr, ssh.PublicKey) error {
+		return errors.New("unknown host")
+	})
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	if err := callback("192.0.2.1:22", remote, srv.hostKey.PublicKey()); err == nil {
+		t.Fatal("must verify non-loopback servers")
+	}
+}
+
+func TestDialSshUnixSocket(t *testing.T) {
+	srv := newUnixTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, nil)
+
+	knownHosts := writeKnownHosts(t, knownhosts.Line([]string{"sock"}, srv.hostKey.PublicKey()))
+	cfgfile := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(cfgfile, []byte(fmt.Sprintf("Host sock\n  Hostname unix:%s\n  UserKnownHostsFile %s\n", srv.addr, knownHosts)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig("sock", cfgfile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.noAgent = true
+
+	client, err := dialSsh(context.Background(), cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	// Verified as the alias, not the path.
+	cfg.userKnownHosts = writeKnownHosts(t, knownhosts.Line([]string{"other"}, srv.hostKey.PublicKey()))
+	if _, err := dialSsh(context.Background(), cfg, nil); err == nil {
+		t.Fatal("must fail without the host key of the alias")
+	}
+
+	cfg.hostKeyAlias = "other"
+	client, err = dialSsh(context.Background(), cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
+
+func TestDialConnBindAddress(t *testing.T) {
+	var out strings.Builder
+	opts, err := parseArgs("myssh", []string{"-b", "127.0.0.1", "example.com"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cfg := &config{bindAddress: opts.bindAddress}
+	conn, err := dialConn(context.Background(), cfg, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("%s", ip)
+	}
+
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if accepted.RemoteAddr().String() != conn.LocalAddr().String() {
+		t.Fatalf("%s != %s", accepted.RemoteAddr(), conn.LocalAddr())
+	}
+
+	// Not an address of this host
+	cfg = &config{bindAddress: "192.0.2.1"}
+	if conn, err := dialConn(context.Background(), cfg, l.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("must fail to bind")
+	}
+}
+
+func TestDialSshCancel(t *testing.T) {
+	// Accepts, but never sends the version.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	cfg := &config{host: host, hostname: host, port: port, user: "user"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := dialSsh(ctx, cfg, nil)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not aborted")
+	}
+}
+
+func TestLoadConfigControlPath(t *testing.T) {
+	cfgfile := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(cfgfile, []byte(`
+Host example
+    HostName example.com
+    User alice
+    Port 2222
+    ControlMaster auto
+    ControlPath ~/.ssh/cm-%r@%h:%p
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig("example", cfgfile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.controlMaster || cfg.controlPath != filepath.Join(home, ".ssh", "cm-alice@example.com:2222") {
+		t.Fatalf("%v %s", cfg.controlMaster, cfg.controlPath)
+	}
+
+	cfg, err = loadConfig("other", cfgfile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.controlMaster || cfg.controlPath != "" {
+		t.Fatalf("%v %s", cfg.controlMaster, cfg.controlPath)
+	}
+}
+
+func TestLoadConfigServerAliveAction(t *testing.T) {
+	cfgfile := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(cfgfile, []byte(`
+Host flaky
+    ServerAliveAction reconnect
+
+Host bogus
+    ServerAliveAction retry
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig("flaky", cfgfile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.serverAliveAction != serverAliveReconnect {
+		t.Fatal(cfg.serverAliveAction)
+	}
+
+	cfg, err = loadConfig("other", cfgfile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.serverAliveAction != serverAliveExit {
+		t.Fatal(cfg.serverAliveAction)
+	}
+
+	if _, err := loadConfig("bogus", cfgfile, nil); err == nil {
+		t.Fatal("must fail")
+	}
+}
+
+func TestLoadConfigTerminalSanitize(t *testing.T) {
+	cfg, err := loadConfig("example.com", "/dev/null", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.terminalSanitize {
+		t.Fatal("must be on by default")
+	}
+
+	cfg, err = loadConfig("example.com", "/dev/null", map[string]string{"TerminalSanitize": "no"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.terminalSanitize {
+		t.Fatal("must be off")
+	}
+}
+
+func TestLoadConfigBreakLength(t *testing.T) {
+	cfg, err := loadConfig("example.com", "/dev/null", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.breakLength != 500*time.Millisecond {
+		t.Fatalf("%s", cfg.breakLength)
+	}
+
+	cfg, err = loadConfig("example.com", "/dev/null", map[string]string{"BreakLength": "1500"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.breakLength != 1500*time.Millisecond {
+		t.Fatalf("%s", cfg.breakLength)
+	}
+
+	if _, err := loadConfig("example.com", "/dev/null", map[string]string{"BreakLength": "-1"}); err == nil {
+		t.Fatal("must fail")
+	}
+}
+
+func TestLoadConfigAddressFamily(t *testing.T) {
+	var out strings.Builder
+	opts, err := parseArgs("myssh", []string{"-config", "/dev/null", "-6", "-o", "ConnectTimeout=10", "example.com"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := opts.loadConfig(opts.host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.addressFamily != addressFamilyInet6 || cfg.connectTimeout != 10*time.Second {
+		t.Fatalf("%s %s", cfg.addressFamily, cfg.connectTimeout)
+	}
+
+	cfg, err = loadConfig("example.com", "/dev/null", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.addressFamily != addressFamilyAny || cfg.connectTimeout != 0 {
+		t.Fatalf("%s %s", cfg.addressFamily, cfg.connectTimeout)
+	}
+
+	if _, err := loadConfig("example.com", "/dev/null", map[string]string{"AddressFamily": "inet5"}); err == nil {
+		t.Fatal("must fail")
+	}
+
+	opts, err = parseArgs("myssh", []string{"-config", "/dev/null", "-4", "-6", "example.com"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opts.loadConfig(opts.host); err == nil {
+		t.Fatal("-4 and -6 must not be combined")
+	}
+}
+
+func TestLoadConfigHttpProxy(t *testing.T) {
+	t.Setenv("https_proxy", "")
+	t.Setenv("HTTPS_PROXY", "proxy.example.com:8080")
+	t.Setenv("no_proxy", "")
+	t.Setenv("NO_PROXY", "internal")
+
+	cfgfile := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(cfgfile, []byte(`
+Host direct
+    HttpProxy none
+
+Host other
+    HttpProxy http://other.example.com:3128
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		cli  map[string]string
+		want string
+	}{
+		{"example.com", nil, "http://proxy.example.com:8080"},
+		{"host.internal", nil, ""},
+		{"direct", nil, ""},
+		{"other", nil, "http://other.example.com:3128"},
+		{"other", map[string]string{"HttpProxy": "http://cli.example.com:3128"}, "http://cli.example.com:3128"},
+		{"example.com", map[string]string{"HttpProxy": "none"}, ""},
+	}
+	for _, tt := range tests {
+		cfg, err := loadConfig(tt.host, cfgfile, tt.cli)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.httpProxy != tt.want {
+			t.Errorf("%s %v: %q", tt.host, tt.cli, cfg.httpProxy)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ysuzuki-bysystems/myssh/forward"
+)
+
+// The control commands of -O. Unlike ssh, the sessions are not multiplexed,
+// the master is commanded only.
+// REF https://github.com/openssh/openssh-portable/blob/V_9_9_P1/PROTOCOL.mux
+const (
+	controlCheck   = "check"
+	controlExit    = "exit"
+	controlStop    = "stop"
+	controlForward = "forward"
+	controlCancel  = "cancel"
+)
+
+// controlMaster serves the control commands on ControlPath, a line of
+// request and a line of reply ("ok message" or "error message") per
+// connection.
+type controlMaster struct {
+	l      net.Listener
+	client *ssh.Client
+	// exit closes the master connection.
+	exit func()
+
+	mu       sync.Mutex
+	forwards map[string]*forward.Listener
+}
+
+func startControlMaster(path string, client *ssh.Client, exit func()) (*controlMaster, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("ControlSocket %s already exists, disabling multiplexing: %w", path, err)
+	}
+
+	m := &controlMaster{
+		l:        l,
+		client:   client,
+		exit:     exit,
+		forwards: make(map[string]*forward.Listener),
+	}
+	go m.serve()
+	return m, nil
+}
+
+// Close stops the control socket and the forwards added by it.
+func (m *controlMaster) Close() error {
+	err := m.l.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, l := range m.forwards {
+		l.Close()
+		delete(m.forwards, k)
+	}
+
+	return err
+}
+
+func (m *controlMaster) serve() {
+	for {
+		conn, err := m.l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			msg, exit, err := m.handle(strings.TrimSpace(line))
+			if err != nil {
+				fmt.Fprintf(conn, "error %s\n", err)
+				return
+			}
+			fmt.Fprintf(conn, "ok %s\n", msg)
+
+			if exit {
+				m.exit()
+			}
+		}()
+	}
+}
+
+// handle runs a command, and reports whether the master is to exit.
+func (m *controlMaster) handle(line string) (string, bool, error) {
+	command, arg, _ := strings.Cut(line, " ")
+
+	switch command {
+	case controlCheck:
+		return fmt.Sprintf("Master running (pid=%d)", os.Getpid()), false, nil
+
+	case controlExit:
+		return "Exit request sent.", true, nil
+
+	case controlStop:
+		// The connection stays, no more commands.
+		m.l.Close()
+		return "Stop listening request sent.", false, nil
+
+	case controlForward:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if _, ok := m.forwards[arg]; ok {
+			return "", false, fmt.Errorf("Forwarding already exists: %s", arg)
+		}
+		l, err := startControlForward(m.client, arg)
+		if err != nil {
+			return "", false, err
+		}
+		m.forwards[arg] = l
+		return fmt.Sprintf("Forwarding added: %s", arg), false, nil
+
+	case controlCancel:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		l, ok := m.forwards[arg]
+		if !ok {
+			return "", false, fmt.Errorf("No such forwarding: %s", arg)
+		}
+		l.Close()
+		delete(m.forwards, arg)
+		return fmt.Sprintf("Forwarding cancelled: %s", arg), false, nil
+
+	default:
+		return "", false, fmt.Errorf("Unsupported control command: %s", command)
+	}
+}
+
+// startControlForward starts the forwarding of "-L spec" or "-R spec".
+func startControlForward(client *ssh.Client, arg string) (*forward.Listener, error) {
+	kind, spec, _ := strings.Cut(arg, " ")
+
+	switch kind {
+	case "-L":
+		fs, err := parseLocalForwardArg(spec)
+		if err != nil {
+			return nil, err
+		}
+		return forward.Local(client, fs.listen, fs.connect)
+	case "-R":
+		fs, err := parseRemoteForward(spec)
+		if err != nil {
+			return nil, err
+		}
+		return forward.Remote(client, fs.listen, fs.connect)
+	default:
+		return nil, fmt.Errorf("Bad forwarding specification: %s", arg)
+	}
+}
+
+// sendControlCommand sends a command to the master on path, and returns the
+// message of the reply.
+func sendControlCommand(path, command string) (string, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return "", fmt.Errorf("Control socket connect(%s): %w", path, err)
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintf(conn, "%s\n", command); err != nil {
+		return "", err
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", err
+	}
+
+	status, msg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if status != "ok" {
+		return "", errors.New(msg)
+	}
+	return msg, nil
+}
+
+// controlCommands returns the commands of -O ctl_cmd, one per forwarding
+// for forward and cancel.
+func (opts *options) controlCommands() ([]string, error) {
+	switch opts.control {
+	case controlCheck, controlExit, controlStop:
+		return []string{opts.control}, nil
+
+	case controlForward, controlCancel:
+		var commands []string
+		for _, s := range opts.localForward {
+			commands = append(commands, opts.control+" -L "+s)
+		}
+		if len(commands) == 0 {
+			return nil, errors.New("No forwardings specified.")
+		}
+		return commands, nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported control command: %s", opts.control)
+	}
+}
+
+// runControl runs -O ctl_cmd against the master of cfg.
+func runControl(opts *options, cfg *config, stderr io.Writer) error {
+	if cfg.controlPath == "" {
+		return errors.New("No ControlPath specified for \"-O\" command.")
+	}
+
+	commands, err := opts.controlCommands()
+	if err != nil {
+		return err
+	}
+
+	for _, command := range commands {
+		msg, err := sendControlCommand(cfg.controlPath, command)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stderr, msg)
+	}
+	return nil
+}
+
+// errControlExit is the end of the connection by "-O exit".
+var errControlExit = errors.New("Exit requested by the control command.")
+
+// startControl starts the master of cfg, if any, calling exit on "-O exit".
+// A failure is warned and the connection goes on without it, like ssh.
+func startControl(cfg *config, client *ssh.Client, exit func()) io.Closer {
+	if !cfg.controlMaster || cfg.controlPath == "" {
+		return nil
+	}
+
+	m, err := startControlMaster(cfg.controlPath, client, exit)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	return m
+}
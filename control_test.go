@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func controlPath(t *testing.T) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "myssh") // short enough for sun_path
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "ctl")
+}
+
+func TestControlCheck(t *testing.T) {
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, nil)
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	path := controlPath(t)
+	m, err := startControlMaster(path, client, func() {})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer m.Close()
+
+	msg, err := sendControlCommand(path, controlCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(msg, "Master running (pid=") {
+		t.Fatalf("%q", msg)
+	}
+
+	if _, err := sendControlCommand(path, "bogus"); err == nil {
+		t.Fatal("must fail")
+	}
+
+	// A second master on the same path.
+	if _, err := startControlMaster(path, client, func() {}); err == nil {
+		t.Fatal("must fail")
+	}
+
+	m.Close()
+	if _, err := sendControlCommand(path, controlCheck); err == nil {
+		t.Fatal("must fail after close")
+	}
+}
+
+func TestControlExit(t *testing.T) {
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, nil)
+
+	path := controlPath(t)
+	cfg := &config{
+		user:          "user",
+		hostname:      "127.0.0.1",
+		controlMaster: true,
+		controlPath:   path,
+		autoReconnect: true,
+	}
+	dial := func(context.Context) (*ssh.Client, error) {
+		return ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+			User:            "user",
+			HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+		})
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- runTunnel(context.Background(), cfg, dial)
+	}()
+
+	// Wait for the master.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := sendControlCommand(path, controlCheck)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	msg, err := sendControlCommand(path, controlExit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != "Exit request sent." {
+		t.Fatalf("%q", msg)
+	}
+
+	// Not reconnected.
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The master did not exit.")
+	}
+}
+
+func TestControlForward(t *testing.T) {
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, nil)
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	path := controlPath(t)
+	m, err := startControlMaster(path, client, func() {})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer m.Close()
+
+	// A free port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	opts := &options{control: controlForward, localForward: []string{addr + ":127.0.0.1:80"}}
+	commands, err := opts.controlCommands()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range commands {
+		if _, err := sendControlCommand(path, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	opts.control = controlCancel
+	commands, err = opts.controlCommands()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range commands {
+		if _, err := sendControlCommand(path, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("still forwarded")
+	}
+}
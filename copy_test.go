@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/ysuzuki-bysystems/myssh/forward"
+	"golang.org/x/crypto/ssh"
+)
+
+// bulkServer writes the bytes of the size given as the command, like cat of
+// a large file.
+func bulkServer(t testing.TB) *testServer {
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+	return newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, func(conn *ssh.ServerConn, newch ssh.NewChannel) {
+		ch, reqs, err := newch.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+
+		for req := range reqs {
+			if req.Type != "exec" {
+				req.Reply(false, nil)
+				continue
+			}
+			var msg struct{ Command string }
+			ssh.Unmarshal(req.Payload, &msg)
+			req.Reply(true, nil)
+
+			n, _ := strconv.Atoi(msg.Command)
+			for ; n > 0; n -= len(chunk) {
+				if _, err := ch.Write(chunk[:min(n, len(chunk))]); err != nil {
+					return
+				}
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+			return
+		}
+	})
+}
+
+// countingWriter counts the writes to the file, without ReadFrom.
+type countingWriter struct {
+	f      *os.File
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.f.Write(p)
+}
+
+// BenchmarkSessionOutput compares the copy of the session output with the
+// 32KB buffer of io.Copy and the 256KB of forward.Copy.
+func BenchmarkSessionOutput(b *testing.B) {
+	const size = 64 << 20
+
+	for _, bench := range []struct {
+		name string
+		copy func(dst io.Writer, src io.Reader) (int64, error)
+	}{
+		{"io.Copy", io.Copy},
+		{"forward.Copy", forward.Copy},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			srv := bulkServer(b)
+			client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+
+			devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer devnull.Close()
+			w := &countingWriter{f: devnull}
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			for range b.N {
+				sess, err := client.NewSession()
+				if err != nil {
+					b.Fatal(err)
+				}
+				stdout, err := sess.StdoutPipe()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := sess.Start(strconv.Itoa(size)); err != nil {
+					b.Fatal(err)
+				}
+				if n, err := bench.copy(w, stdout); err != nil || n != size {
+					b.Fatalf("%d %v", n, err)
+				}
+				sess.Wait()
+				sess.Close()
+			}
+			b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
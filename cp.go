@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ysuzuki-bysystems/myssh/agent"
+	"github.com/ysuzuki-bysystems/myssh/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// cpChunk is the size of a request in flight, cpRequests are in flight at
+// once so that the latency is paid once per window, not per request.
+const (
+	cpChunk    = 32 * 1024
+	cpRequests = 64
+)
+
+// cpPath is an operand of cp, [user@]host:path or a local path.
+type cpPath struct {
+	user string
+	host string
+	path string
+}
+
+func (p cpPath) remote() bool {
+	return p.host != ""
+}
+
+// parseCpPath parses the operand like scp. It is remote when a colon comes
+// before any slash, [host]:path for the IPv6 addresses, but a drive letter.
+func parseCpPath(s string) cpPath {
+	if filepath.VolumeName(s) != "" {
+		return cpPath{path: s}
+	}
+
+	i := strings.Index(s, ":")
+	if lb := strings.Index(s, "["); lb >= 0 && lb < i {
+		if j := strings.Index(s[lb:], "]:"); j >= 0 {
+			i = lb + j + 1
+		}
+	}
+	if i <= 0 || strings.Contains(s[:i], "/") {
+		return cpPath{path: s}
+	}
+
+	user, host := splitUserHost(s[:i])
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	remotePath := s[i+1:]
+	if remotePath == "" {
+		// The home directory.
+		remotePath = "."
+	}
+	return cpPath{user: user, host: host, path: remotePath}
+}
+
+// cpMain runs "cp", the copy over the SFTP subsystem, and returns the exit
+// status.
+func cpMain(name string, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet(name+" cp", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s cp [options] source... target\n\nsource and target are [user@]host:path or a local path, one side remote.\n\nOptions:\n", name)
+		fs.PrintDefaults()
+	}
+
+	var opts options
+	fs.StringVar(&opts.cfgloc, "config", "", "ssh_config")
+	fs.Func("o", "ssh_config keyword=value", func(s string) error {
+		opts.sshOptions = append(opts.sshOptions, s)
+		return nil
+	})
+	recursive := fs.Bool("r", false, "Copy the directories recursively")
+	preserve := fs.Bool("p", false, "Preserve the modification times (the permissions are always)")
+	quiet := fs.Bool("q", false, "No progress")
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return 2
+	}
+
+	var sources []cpPath
+	for _, s := range fs.Args()[:fs.NArg()-1] {
+		sources = append(sources, parseCpPath(s))
+	}
+	target := parseCpPath(fs.Arg(fs.NArg() - 1))
+
+	remote := target
+	for _, src := range sources {
+		switch {
+		case src.remote() && target.remote():
+			fmt.Fprintln(stderr, "Copying between the remote hosts is not supported.")
+			return 2
+		case !src.remote() && !target.remote():
+			fmt.Fprintln(stderr, "Either the sources or the target must be remote.")
+			return 2
+		case src.remote() && (src.host != sources[0].host || src.user != sources[0].user):
+			fmt.Fprintln(stderr, "The remote sources must be of a host.")
+			return 2
+		case src.remote():
+			remote = src
+		}
+	}
+
+	opts.user = remote.user
+	cfg, err := opts.loadConfig(remote.host)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	ctx := context.Background()
+	client, err := dialSsh(ctx, cfg, agent.NewAgent(ctx))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitStatusConnectionFailed
+	}
+	defer client.Close()
+
+	c, err := openSftp(client)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer c.Close()
+
+	cp := &copier{
+		c:         c,
+		recursive: *recursive,
+		preserve:  *preserve,
+		stderr:    stderr,
+	}
+	if f, ok := stderr.(*os.File); ok && !*quiet && cfg.logLevel != logQuiet && term.IsTerminal(int(f.Fd())) {
+		cp.progress = stderr
+	}
+
+	status := 0
+	for _, src := range sources {
+		if target.remote() {
+			err = cp.upload(src.path, target.path, len(sources) > 1)
+		} else {
+			err = cp.download(src.path, target.path, len(sources) > 1)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// openSftp starts the "sftp" subsystem.
+func openSftp(client *ssh.Client) (*sftp.Client, error) {
+	sess, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := sess.StdinPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	r, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	if err := sess.RequestSubsystem("sftp"); err != nil {
+		sess.Close()
+		return nil, fmt.Errorf("Subsystem request failed: sftp: %w", err)
+	}
+
+	c, err := sftp.NewClient(r, w)
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+type copier struct {
+	c         *sftp.Client
+	recursive bool
+	preserve  bool
+	// progress is the terminal of the progress line, nil for none.
+	progress io.Writer
+	// stderr receives the warnings of the entries skipped.
+	stderr io.Writer
+}
+
+// upload copies the local src to the remote dst, into dst when it is a
+// directory. intoDir requires dst to be a directory, for several sources.
+func (cp *copier) upload(src, dst string, intoDir bool) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if dfi, err := cp.c.Stat(dst); err == nil && dfi.IsDir() {
+		dst = path.Join(dst, filepath.Base(src))
+	} else if intoDir {
+		return fmt.Errorf("Target is not a directory: %s", dst)
+	}
+	return cp.uploadPath(src, dst, fi)
+}
+
+func (cp *copier) uploadPath(src, dst string, fi fs.FileInfo) error {
+	if fi.IsDir() {
+		if !cp.recursive {
+			return fmt.Errorf("Not a regular file, -r for the directories: %s", src)
+		}
+		if err := cp.c.Mkdir(dst, fi.Mode().Perm()|0700); err != nil {
+			if dfi, serr := cp.c.Stat(dst); serr != nil || !dfi.IsDir() {
+				return err
+			}
+		}
+
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name := filepath.Join(src, e.Name())
+			efi, err := os.Stat(name)
+			if err != nil {
+				return err
+			}
+			if err := cp.uploadPath(name, path.Join(dst, e.Name()), efi); err != nil {
+				return err
+			}
+		}
+		return cp.setAttrs(dst, fi)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("Not a regular file: %s", src)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := cp.c.Create(dst, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := cp.transfer(out, in, fi.Size(), filepath.Base(src)); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return cp.setAttrs(dst, fi)
+}
+
+// setAttrs sets the permissions, not of the umask of the server, and the
+// times with -p.
+func (cp *copier) setAttrs(dst string, fi fs.FileInfo) error {
+	if err := cp.c.Chmod(dst, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if cp.preserve {
+		return cp.c.Chtimes(dst, fi.ModTime(), fi.ModTime())
+	}
+	return nil
+}
+
+// download copies the remote src to the local dst, into dst when it is a
+// directory.
+func (cp *copier) download(src, dst string, intoDir bool) error {
+	fi, err := cp.c.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if dfi, err := os.Stat(dst); err == nil && dfi.IsDir() {
+		dst = filepath.Join(dst, path.Base(src))
+	} else if intoDir {
+		return fmt.Errorf("Target is not a directory: %s", dst)
+	}
+	return cp.downloadPath(src, dst, fi)
+}
+
+func (cp *copier) downloadPath(src, dst string, fi fs.FileInfo) error {
+	if fi.IsDir() {
+		if !cp.recursive {
+			return fmt.Errorf("Not a regular file, -r for the directories: %s", src)
+		}
+		if err := os.Mkdir(dst, fi.Mode().Perm()|0700); err != nil {
+			if dfi, serr := os.Stat(dst); serr != nil || !dfi.IsDir() {
+				return err
+			}
+		}
+
+		entries, err := cp.c.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := checkEntryName(e.Name()); err != nil {
+				return err
+			}
+			name := path.Join(src, e.Name())
+			fi := e
+			if e.Mode()&fs.ModeSymlink != 0 {
+				// Followed like scp, but for the directories, which may
+				// loop, like a link to "..".
+				if fi, err = cp.c.Stat(name); err != nil {
+					return err
+				}
+				if fi.IsDir() {
+					fmt.Fprintf(cp.stderr, "Skipping the symlink to a directory: %s\n", name)
+					continue
+				}
+			}
+			if err := cp.downloadPath(name, filepath.Join(dst, e.Name()), fi); err != nil {
+				return err
+			}
+		}
+		return setLocalAttrs(dst, fi, cp.preserve)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("Not a regular file: %s", src)
+	}
+
+	in, err := cp.c.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := cp.transfer(out, in, fi.Size(), path.Base(src)); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return setLocalAttrs(dst, fi, cp.preserve)
+}
+
+// checkEntryName rejects the names of a directory listing other than of a
+// single path element, sent by a hostile server to write outside the target.
+// REF https://nvd.nist.gov/vuln/detail/CVE-2019-6111
+func checkEntryName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("Invalid file name from the server: %q", name)
+	}
+	return nil
+}
+
+func setLocalAttrs(dst string, fi fs.FileInfo, preserve bool) error {
+	if err := os.Chmod(dst, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if preserve {
+		return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+	}
+	return nil
+}
+
+// transfer copies size bytes with cpRequests chunks in flight, by the
+// offsets.
+func (cp *copier) transfer(dst io.WriterAt, src io.ReaderAt, size int64, name string) error {
+	var (
+		mu       sync.Mutex
+		next     int64
+		done     int64
+		firstErr error
+	)
+	bar := newProgressBar(cp.progress, name, size)
+	defer bar.finish()
+
+	var wg sync.WaitGroup
+	for range min(cpRequests, int(size/cpChunk)+1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, cpChunk)
+			for {
+				mu.Lock()
+				off := next
+				next += cpChunk
+				failed := firstErr != nil
+				mu.Unlock()
+				if failed || off >= size {
+					return
+				}
+
+				p := buf[:min(cpChunk, size-off)]
+				n, err := src.ReadAt(p, off)
+				if err == io.EOF && n == len(p) {
+					err = nil
+				}
+				if err == nil {
+					_, err = dst.WriteAt(p, off)
+				} else if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				done += int64(n)
+				bar.update(done)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if errors.Is(firstErr, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("File truncated during the copy: %s", name)
+	}
+	return firstErr
+}
+
+// progressBar is the progress line, updated at most every 200ms.
+type progressBar struct {
+	w     io.Writer
+	name  string
+	size  int64
+	start time.Time
+	last  time.Time
+	done  int64
+}
+
+func newProgressBar(w io.Writer, name string, size int64) *progressBar {
+	now := time.Now()
+	return &progressBar{w: w, name: name, size: size, start: now}
+}
+
+func (b *progressBar) update(done int64) {
+	b.done = done
+	if b.w == nil {
+		return
+	}
+	if now := time.Now(); now.Sub(b.last) >= 200*time.Millisecond {
+		b.last = now
+		b.print(now)
+	}
+}
+
+func (b *progressBar) finish() {
+	if b.w == nil {
+		return
+	}
+	b.print(time.Now())
+	fmt.Fprint(b.w, "\r\n")
+}
+
+func (b *progressBar) print(now time.Time) {
+	percent := int64(100)
+	if b.size > 0 {
+		percent = b.done * 100 / b.size
+	}
+	rate := float64(0)
+	if elapsed := now.Sub(b.start).Seconds(); elapsed > 0 {
+		rate = float64(b.done) / elapsed
+	}
+	fmt.Fprintf(b.w, "\r%s %3d%% %s %s/s\x1b[K", b.name, percent, formatBytes(float64(b.done)), formatBytes(rate))
+}
+
+// formatBytes formats n with the binary units, like 1.5MB.
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
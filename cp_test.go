@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ysuzuki-bysystems/myssh/internal/sftptest"
+	"github.com/ysuzuki-bysystems/myssh/knownhosts"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseCpPath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want cpPath
+	}{
+		{"host:/tmp/a", cpPath{host: "host", path: "/tmp/a"}},
+		{"user@host:a", cpPath{user: "user", host: "host", path: "a"}},
+		{"a@b@host:", cpPath{user: "a@b", host: "host", path: "."}},
+		{"[::1]:/tmp", cpPath{host: "::1", path: "/tmp"}},
+		{"user@[::1]:x:y", cpPath{user: "user", host: "::1", path: "x:y"}},
+		{"local", cpPath{path: "local"}},
+		{"./a:b", cpPath{path: "./a:b"}},
+		{"dir/a:b", cpPath{path: "dir/a:b"}},
+		{":a", cpPath{path: ":a"}},
+	}
+	for _, tt := range tests {
+		if got := parseCpPath(tt.in); got != tt.want {
+			t.Errorf("%q: %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// sftpServer serves root on the "sftp" subsystem.
+func sftpServer(t *testing.T, root string) *testServer {
+	return sftpServerFunc(t, func(rw io.ReadWriter) error {
+		return sftptest.Serve(rw, root)
+	})
+}
+
+func sftpServerFunc(t *testing.T, serve func(rw io.ReadWriter) error) *testServer {
+	return newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, func(conn *ssh.ServerConn, newch ssh.NewChannel) {
+		ch, reqs, err := newch.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+
+		for req := range reqs {
+			var msg struct{ Name string }
+			if req.Type != "subsystem" || ssh.Unmarshal(req.Payload, &msg) != nil || msg.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			go ssh.DiscardRequests(reqs)
+			if err := serve(ch); err != nil {
+				t.Error(err)
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+			return
+		}
+	})
+}
+
+// cpConfig returns the ssh_config of srv as the host sftphost.
+func cpConfig(t *testing.T, srv *testServer) string {
+	_, port, _ := net.SplitHostPort(srv.addr)
+	knownHosts := writeKnownHosts(t, knownhosts.Line([]string{"[127.0.0.1]:" + port}, srv.hostKey.PublicKey()))
+	cfgfile := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(cfgfile, []byte(fmt.Sprintf("Host sftphost\n  Hostname 127.0.0.1\n  Port %s\n  UserKnownHostsFile %s\n  IdentityAgent none\n", port, knownHosts)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cfgfile
+}
+
+func TestCpMain(t *testing.T) {
+	remoteRoot := t.TempDir()
+	cfgfile := cpConfig(t, sftpServer(t, remoteRoot))
+
+	local := t.TempDir()
+	big := bytes.Repeat([]byte("myssh cp\n"), 100000) // some windows of requests
+	files := map[string][]byte{
+		"tree/big.bin":       big,
+		"tree/empty":         nil,
+		"tree/sub/small.txt": []byte("small\n"),
+	}
+	for name, b := range files {
+		p := filepath.Join(local, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(local, "tree", "sub", "small.txt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cp := func(args ...string) {
+		t.Helper()
+
+		var stdout, stderr bytes.Buffer
+		if status := cpMain("myssh", append([]string{"-config", cfgfile}, args...), &stdout, &stderr); status != 0 {
+			t.Fatalf("%v: %d %s", args, status, stderr.String())
+		}
+	}
+
+	// Without -r.
+	var stderr bytes.Buffer
+	if status := cpMain("myssh", []string{"-config", cfgfile, filepath.Join(local, "tree"), "sftphost:/"}, &stderr, &stderr); status == 0 {
+		t.Fatal("a directory must require -r")
+	}
+
+	cp("-r", filepath.Join(local, "tree"), "sftphost:/")
+	cp("-r", "sftphost:/tree", filepath.Join(local, "back"))
+
+	for name, want := range files {
+		for _, p := range []string{
+			filepath.Join(remoteRoot, filepath.FromSlash(name)),
+			filepath.Join(local, "back", filepath.FromSlash(name[len("tree/"):])),
+		} {
+			got, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: %d bytes, want %d", p, len(got), len(want))
+			}
+		}
+	}
+
+	if runtime.GOOS != "windows" {
+		for _, p := range []string{
+			filepath.Join(remoteRoot, "tree", "sub", "small.txt"),
+			filepath.Join(local, "back", "sub", "small.txt"),
+		} {
+			fi, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0600 {
+				t.Errorf("%s: %s", p, fi.Mode())
+			}
+		}
+	}
+
+	// Into an existing directory.
+	cp(filepath.Join(local, "tree", "sub", "small.txt"), "sftphost:/tree")
+	if _, err := os.Stat(filepath.Join(remoteRoot, "tree", "small.txt")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckEntryName(t *testing.T) {
+	for _, name := range []string{"a.txt", ".profile", "..a", "a b"} {
+		if err := checkEntryName(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	bad := []string{"", ".", "..", "../a", "a/b", `a\b`, "/etc/passwd"}
+	if runtime.GOOS == "windows" {
+		bad = append(bad, "C:a", `C:\a`)
+	}
+	for _, name := range bad {
+		if err := checkEntryName(name); err == nil {
+			t.Errorf("%q must be rejected", name)
+		}
+	}
+}
+
+func TestCpDownloadHostileName(t *testing.T) {
+	remoteRoot := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(remoteRoot, "tree"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Readable by the renamed path as well, the copy fails on the name only.
+	for _, name := range []string{"tree/a.txt", "escaped.txt"} {
+		if err := os.WriteFile(filepath.Join(remoteRoot, filepath.FromSlash(name)), []byte("evil\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := sftpServerFunc(t, func(rw io.ReadWriter) error {
+		return sftptest.ServeRenamed(rw, remoteRoot, func(name string) string {
+			if name == "a.txt" {
+				return "../escaped.txt"
+			}
+			return name
+		})
+	})
+	cfgfile := cpConfig(t, srv)
+
+	local := t.TempDir()
+	var stderr bytes.Buffer
+	if status := cpMain("myssh", []string{"-config", cfgfile, "-r", "sftphost:/tree", filepath.Join(local, "back")}, &stderr, &stderr); status == 0 {
+		t.Fatal("a name out of the target must fail")
+	}
+	if !strings.Contains(stderr.String(), `Invalid file name from the server: "../escaped.txt"`) {
+		t.Fatal(stderr.String())
+	}
+	if _, err := os.Stat(filepath.Join(local, "escaped.txt")); err == nil {
+		t.Fatal("written out of the target")
+	}
+}
+
+func TestCpDownloadSymlinkDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need the privilege")
+	}
+
+	remoteRoot := t.TempDir()
+	tree := filepath.Join(remoteRoot, "tree")
+	if err := os.MkdirAll(tree, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tree, "f.txt"), []byte("f\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{"loop": "..", "link.txt": "f.txt"} {
+		if err := os.Symlink(target, filepath.Join(tree, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfgfile := cpConfig(t, sftpServer(t, remoteRoot))
+
+	local := t.TempDir()
+	var stderr bytes.Buffer
+	if status := cpMain("myssh", []string{"-config", cfgfile, "-r", "sftphost:/tree", filepath.Join(local, "back")}, &stderr, &stderr); status != 0 {
+		t.Fatalf("%d %s", status, stderr.String())
+	}
+	if b, err := os.ReadFile(filepath.Join(local, "back", "link.txt")); err != nil || string(b) != "f\n" {
+		t.Fatalf("the symlink to a file must be followed: %q %v", b, err)
+	}
+	if _, err := os.Lstat(filepath.Join(local, "back", "loop")); err == nil {
+		t.Fatal("the symlink to a directory must not be followed")
+	}
+	if !strings.Contains(stderr.String(), "Skipping the symlink to a directory: /tree/loop") {
+		t.Fatal(stderr.String())
+	}
+}
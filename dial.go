@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	addressFamilyAny   = "any"
+	addressFamilyInet  = "inet"
+	addressFamilyInet6 = "inet6"
+)
+
+// connectionAttemptDelay is the head start of an address over the next one.
+// REF https://www.rfc-editor.org/rfc/rfc8305#section-5
+var connectionAttemptDelay = 300 * time.Millisecond
+
+// dialFunc is of net.Dialer.DialContext.
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// resolveAddrs returns the addresses of host of the family, in the order to
+// be tried: IPv6 and IPv4 interleaved, IPv6 first.
+// REF https://www.rfc-editor.org/rfc/rfc8305#section-4
+func resolveAddrs(ctx context.Context, host, family string) ([]net.IPAddr, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return sortAddrs(addrs, family, host)
+}
+
+func sortAddrs(addrs []net.IPAddr, family, host string) ([]net.IPAddr, error) {
+	var v6, v4 []net.IPAddr
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			if family != addressFamilyInet6 {
+				v4 = append(v4, a)
+			}
+		} else if family != addressFamilyInet {
+			v6 = append(v6, a)
+		}
+	}
+	if len(v6) == 0 && len(v4) == 0 {
+		return nil, fmt.Errorf("No address of %s for AddressFamily %s.", host, family)
+	}
+
+	sorted := make([]net.IPAddr, 0, len(v6)+len(v4))
+	for i := range max(len(v6), len(v4)) {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+	return sorted, nil
+}
+
+type dialResult struct {
+	addr net.IPAddr
+	conn net.Conn
+	err  error
+}
+
+// dialAddrs connects to port of the addrs, starting an attempt every delay,
+// or as soon as the last one failed, and returns the first connected. The
+// attempts left are cancelled, and closed if they connect nonetheless. The
+// error is of the first attempt when all fail.
+func dialAddrs(ctx context.Context, dial dialFunc, addrs []net.IPAddr, port string, delay time.Duration, logf func(format string, args ...any)) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult)
+	pending := 0
+	start := func() {
+		addr := addrs[0]
+		addrs = addrs[1:]
+		pending++
+		go func() {
+			conn, err := dial(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+			results <- dialResult{addr, conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) {
+					for range n {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				if logf != nil {
+					logf("Connected to [%s] port %s.", r.addr.String(), port)
+				}
+				return r.conn, nil
+			}
+			if logf != nil {
+				logf("Connect to address %s port %s: %v", r.addr.String(), port, r.err)
+			}
+			errs = append(errs, r.err)
+			if len(addrs) > 0 {
+				start()
+				timer.Reset(delay)
+			}
+
+		case <-timer.C:
+			if len(addrs) > 0 {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+
+	return nil, errs[0]
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ipAddrs(ss ...string) []net.IPAddr {
+	var addrs []net.IPAddr
+	for _, s := range ss {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(s)})
+	}
+	return addrs
+}
+
+func TestSortAddrs(t *testing.T) {
+	addrs := ipAddrs("192.0.2.1", "192.0.2.2", "2001:db8::1", "192.0.2.3", "2001:db8::2")
+	tests := []struct {
+		family string
+		want   []net.IPAddr
+	}{
+		{addressFamilyAny, ipAddrs("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3")},
+		{addressFamilyInet, ipAddrs("192.0.2.1", "192.0.2.2", "192.0.2.3")},
+		{addressFamilyInet6, ipAddrs("2001:db8::1", "2001:db8::2")},
+	}
+	for _, tt := range tests {
+		got, err := sortAddrs(addrs, tt.family, "host")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.EqualFunc(got, tt.want, func(a, b net.IPAddr) bool { return a.IP.Equal(b.IP) }) {
+			t.Errorf("%s: %v", tt.family, got)
+		}
+	}
+
+	if _, err := sortAddrs(ipAddrs("192.0.2.1"), addressFamilyInet6, "host"); err == nil {
+		t.Fatal("no address must be an error")
+	}
+}
+
+// fakeDial connects the live address to l, fails the refused one right away
+// and leaves the others hanging until cancelled.
+type fakeDial struct {
+	l       net.Listener
+	live    string
+	refused string
+
+	mu        sync.Mutex
+	dialed    []string
+	cancelled []string
+}
+
+func (d *fakeDial) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(address)
+	d.mu.Lock()
+	d.dialed = append(d.dialed, host)
+	d.mu.Unlock()
+
+	switch host {
+	case d.live:
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, d.l.Addr().String())
+	case d.refused:
+		return nil, errors.New("refused")
+	}
+	<-ctx.Done()
+	d.mu.Lock()
+	d.cancelled = append(d.cancelled, host)
+	d.mu.Unlock()
+	return nil, ctx.Err()
+}
+
+func listenDiscard(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+func TestDialAddrsStaggered(t *testing.T) {
+	d := &fakeDial{l: listenDiscard(t), live: "192.0.2.1"}
+
+	begin := time.Now()
+	conn, err := dialAddrs(context.Background(), d.dial, ipAddrs("2001:db8::1", "192.0.2.1"), "22", 50*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(begin); elapsed < 50*time.Millisecond {
+		t.Fatalf("the second started after %v", elapsed)
+	}
+
+	// The hanging one is cancelled.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mu.Lock()
+		cancelled := slices.Clone(d.cancelled)
+		d.mu.Unlock()
+		if slices.Equal(cancelled, []string{"2001:db8::1"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q", cancelled)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialAddrsFailureStartsNext(t *testing.T) {
+	d := &fakeDial{l: listenDiscard(t), live: "192.0.2.1", refused: "2001:db8::1"}
+
+	// Not waiting for the delay.
+	begin := time.Now()
+	conn, err := dialAddrs(context.Background(), d.dial, ipAddrs("2001:db8::1", "192.0.2.1", "192.0.2.2"), "22", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(begin); elapsed > 10*time.Second {
+		t.Fatalf("%v", elapsed)
+	}
+	if !slices.Equal(d.dialed, []string{"2001:db8::1", "192.0.2.1"}) {
+		t.Fatalf("%q", d.dialed)
+	}
+}
+
+func TestDialAddrsAllFailed(t *testing.T) {
+	d := &fakeDial{refused: "192.0.2.1"}
+	if _, err := dialAddrs(context.Background(), d.dial, ipAddrs("192.0.2.1"), "22", time.Minute, nil); err == nil || err.Error() != "refused" {
+		t.Fatal(err)
+	}
+
+	// The budget is of all the attempts.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	_, err := dialAddrs(ctx, d.dial, ipAddrs("2001:db8::1", "192.0.2.2", "192.0.2.3"), "22", 40*time.Millisecond, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Fatalf("%v", elapsed)
+	}
+}
+
+func TestDialConnAddressFamily(t *testing.T) {
+	l := listenDiscard(t)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	cfg := &config{addressFamily: addressFamilyInet, connectTimeout: 5 * time.Second}
+	conn, err := dialConn(context.Background(), cfg, net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	cfg.addressFamily = addressFamilyInet6
+	if _, err := dialConn(context.Background(), cfg, net.JoinHostPort("127.0.0.1", port)); err == nil {
+		t.Fatal("an IPv4 address must not be dialed with inet6")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// readEnvFile reads the KEY=VALUE lines of --env-file. The blank lines and
+// the comments (#) are skipped, and the value is the rest after the first
+// "=", as is.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		name, _, ok := strings.Cut(line, "=")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("Bad environment at %s:%d: %s", path, n, line)
+		}
+		env = append(env, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// sendEnv offers the variables in order. Like SendEnv of ssh, the ones the
+// server does not accept (AcceptEnv) are only logged.
+func sendEnv(sess *ssh.Session, env []string, logf func(format string, args ...any)) {
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		if err := sess.Setenv(name, value); err != nil && logf != nil {
+			logf("Environment %s not accepted: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "env")
+	err := os.WriteFile(path, []byte("# CI\nFOO=bar\n\n  # indented comment\nURL=https://example.com/?a=1&b=2\r\nEMPTY=\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := readEnvFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"FOO=bar", "URL=https://example.com/?a=1&b=2", "EMPTY="}
+	if strings.Join(env, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("%q", env)
+	}
+
+	for _, bad := range []string{"NOVALUE\n", "=value\n", "BAD NAME=x\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readEnvFile(path); err == nil {
+			t.Errorf("%q: must fail", bad)
+		}
+	}
+}
+
+func TestSendEnv(t *testing.T) {
+	type envMsg struct {
+		Name  string
+		Value string
+	}
+	received := make(chan envMsg, 3)
+
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, func(conn *ssh.ServerConn, newch ssh.NewChannel) {
+		ch, reqs, err := newch.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+
+		for req := range reqs {
+			if req.Type != "env" {
+				req.Reply(false, nil)
+				continue
+			}
+			var msg envMsg
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				t.Error(err)
+			}
+			received <- msg
+			// AcceptEnv LANG CI_*
+			req.Reply(msg.Name == "LANG" || strings.HasPrefix(msg.Name, "CI_"), nil)
+		}
+	})
+
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	var rejected []string
+	sendEnv(sess, []string{"CI_TOKEN=a=b", "SECRET=x", "LANG=C.UTF-8"}, func(format string, args ...any) {
+		rejected = append(rejected, args[0].(string))
+	})
+
+	for _, want := range []envMsg{{"CI_TOKEN", "a=b"}, {"SECRET", "x"}, {"LANG", "C.UTF-8"}} {
+		if got := <-received; got != want {
+			t.Fatalf("%#v", got)
+		}
+	}
+	if strings.Join(rejected, " ") != "SECRET" {
+		t.Fatalf("%q", rejected)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const noEscapeChar = -1
+
+// REF ssh_config(5) EscapeChar
+func parseEscapeChar(s string) (int, error) {
+	switch {
+	case s == "none":
+		return noEscapeChar, nil
+	case len(s) == 1:
+		return int(s[0]), nil
+	case len(s) == 2 && s[0] == '^':
+		return int(s[1] & 0x1f), nil
+	default:
+		return 0, fmt.Errorf("Bad escape character: %s", s)
+	}
+}
+
+func formatEscapeChar(c byte) string {
+	if c < 0x20 {
+		return fmt.Sprintf("^%c", c+'@')
+	}
+	return string(c)
+}
+
+// escapeReader filters the escape sequences (e.g. "~.") typed at the
+// beginning of a line out of the input.
+//
+// REF https://github.com/openssh/openssh-portable/blob/V_9_9_P1/clientloop.c (process_escapes)
+type escapeReader struct {
+	r   io.Reader
+	esc byte
+	// handle runs the escape command c and reports whether it is known.
+	handle func(c byte) bool
+
+	lineStart bool
+	escaped   bool
+
+	buf []byte
+	rem []byte
+	err error
+}
+
+func newEscapeReader(r io.Reader, esc byte, handle func(c byte) bool) *escapeReader {
+	return &escapeReader{
+		r:         r,
+		esc:       esc,
+		handle:    handle,
+		lineStart: true,
+	}
+}
+
+func (e *escapeReader) filter(out, in []byte) []byte {
+	for _, b := range in {
+		if e.escaped {
+			e.escaped = false
+
+			if b == e.esc {
+				out = append(out, b)
+				e.lineStart = false
+				continue
+			}
+
+			if e.handle(b) {
+				continue
+			}
+
+			// Unknown commands are sent as typed.
+			out = append(out, e.esc)
+		} else if e.lineStart && b == e.esc {
+			e.escaped = true
+			continue
+		}
+
+		out = append(out, b)
+		e.lineStart = b == '\r' || b == '\n'
+	}
+
+	return out
+}
+
+func (e *escapeReader) Read(p []byte) (int, error) {
+	for len(e.rem) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+
+		if len(e.buf) < len(p) {
+			e.buf = make([]byte, len(p))
+		}
+
+		n, err := e.r.Read(e.buf[:len(p)])
+		e.rem = e.filter(e.rem[:0], e.buf[:n])
+		e.err = err
+	}
+
+	n := copy(p, e.rem)
+	e.rem = e.rem[n:]
+	return n, nil
+}
+
+// escapeCommands are the actions of the escape commands. The nil ones are
+// unknown.
+type escapeCommands struct {
+	terminate  func()
+	help       func()
+	background func()
+	sendBreak  func()
+}
+
+func (e *escapeCommands) handle(c byte) bool {
+	var fn func()
+	switch c {
+	case '.':
+		fn = e.terminate
+	case '?':
+		fn = e.help
+	case '&':
+		fn = e.background
+	case 'B':
+		fn = e.sendBreak
+	}
+
+	if fn == nil {
+		return false
+	}
+	fn()
+	return true
+}
+
+func escapeHelp(esc byte, background bool) string {
+	c := formatEscapeChar(esc)
+
+	lines := []string{
+		"Supported escape sequences:",
+		fmt.Sprintf(" %s.   - terminate connection", c),
+		fmt.Sprintf(" %sB   - send a BREAK to the remote system", c),
+	}
+	if background {
+		lines = append(lines, fmt.Sprintf(" %s&   - background myssh (when waiting for connections to terminate)", c))
+	}
+	lines = append(lines,
+		fmt.Sprintf(" %s?   - this message", c),
+		fmt.Sprintf(" %s%s   - send the escape character by typing it twice", c, c),
+		"(Note that escapes are only recognized immediately after newline.)",
+	)
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// defaultBreakLength is the length of the BREAK of ~B, BreakLength.
+const defaultBreakLength = 500 * time.Millisecond
+
+// breakRequest is the payload of the "break" request, the break-length in
+// milliseconds.
+// REF https://datatracker.ietf.org/doc/html/rfc4335#section-3
+func breakRequest(length time.Duration) []byte {
+	return ssh.Marshal(struct{ BreakLength uint32 }{uint32(length.Milliseconds())})
+}
+
+// sendBreak sends a BREAK, for the serial consoles. It returns whether the
+// server performed it.
+func sendBreak(sess *ssh.Session, length time.Duration) (bool, error) {
+	return sess.SendRequest("break", true, breakRequest(length))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestParseEscapeChar(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"~", '~'},
+		{"none", noEscapeChar},
+		{"^]", 0x1d},
+		{"%", '%'},
+	}
+
+	for _, tt := range tests {
+		got, err := parseEscapeChar(tt.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Fatalf("%s: %d", tt.s, got)
+		}
+	}
+
+	if _, err := parseEscapeChar("ab"); err == nil {
+		t.Fatal("must fail")
+	}
+}
+
+func TestEscapeReader(t *testing.T) {
+	tests := []struct {
+		esc      byte
+		input    string
+		output   string
+		commands string
+	}{
+		{'~', "~.", "", "."},
+		{'~', "ls\r~.", "ls\r", "."},
+		{'~', "a~.", "a~.", ""},
+		{'~', "~~x", "~x", ""},
+		{'~', "~x", "~x", ""},
+		{'~', "\r~?\r", "\r\r", "?"},
+		{0x1d, "\x1d.", "", "."},
+		{0x1d, "~.", "~.", ""},
+	}
+
+	for _, tt := range tests {
+		var commands string
+		handle := func(c byte) bool {
+			if c != '.' && c != '?' {
+				return false
+			}
+			commands += string(c)
+			return true
+		}
+
+		// One byte per read to exercise the state kept between reads.
+		r := newEscapeReader(iotest.OneByteReader(strings.NewReader(tt.input)), tt.esc, handle)
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != tt.output || commands != tt.commands {
+			t.Fatalf("%q: %q %q", tt.input, b, commands)
+		}
+	}
+}
+
+func TestEscapeCommands(t *testing.T) {
+	var called string
+	commands := &escapeCommands{
+		terminate:  func() { called += "." },
+		background: func() { called += "&" },
+		sendBreak:  func() { called += "B" },
+	}
+
+	input := "ls\r~&\r~B\r~?\r~."
+	r := newEscapeReader(strings.NewReader(input), '~', commands.handle)
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if called != "&B." {
+		t.Fatalf("%q", called)
+	}
+	// ~? without help is unknown, sent as typed.
+	if string(out) != "ls\r\r\r~?\r" {
+		t.Fatalf("%q", out)
+	}
+
+	if !strings.Contains(escapeHelp('~', true), "~&") || strings.Contains(escapeHelp('~', false), "~&") {
+		t.Fatal("help")
+	}
+}
+
+func TestBreakRequest(t *testing.T) {
+	tests := []struct {
+		length time.Duration
+		want   []byte
+	}{
+		{defaultBreakLength, []byte{0, 0, 0x01, 0xf4}},
+		{0, []byte{0, 0, 0, 0}},
+		{70 * time.Second, []byte{0, 0x01, 0x11, 0x70}},
+	}
+	for _, tt := range tests {
+		if got := breakRequest(tt.length); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: %x", tt.length, got)
+		}
+	}
+}
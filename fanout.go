@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fanoutWorkers bounds the concurrent connections of --hosts.
+const fanoutWorkers = 8
+
+// exitStatusConnectionFailed is the status for a host not reached, like ssh.
+const exitStatusConnectionFailed = 255
+
+// prefixWriter writes each complete line prefixed. The lines of the writers
+// sharing mu are never interleaved.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+
+	i := bytes.LastIndexByte(p.buf, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+
+	var out []byte
+	for _, line := range bytes.SplitAfter(p.buf[:i+1], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		out = append(out, p.prefix...)
+		out = append(out, line...)
+	}
+	p.buf = append(p.buf[:0], p.buf[i+1:]...)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush writes the last line not terminated by a newline.
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+
+	_, err := p.Write([]byte("\n"))
+	return err
+}
+
+func runFanoutHost(client *ssh.Client, command string, stdout, stderr io.Writer) (int, error) {
+	sess, err := client.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer sess.Close()
+
+	sess.Stdout = stdout
+	sess.Stderr = stderr
+
+	err = sess.Run(command)
+	if code, ok := remoteExitCode(err); ok {
+		return code, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// fanout runs command on each host concurrently, prefixing the output lines
+// with the host name. It returns the highest exit status of the hosts.
+func fanout(hosts []string, command string, dial func(host string) (*ssh.Client, error), stdout, stderr io.Writer) int {
+	var outmu, errmu sync.Mutex
+
+	statuses := make([]int, len(hosts))
+	sem := make(chan struct{}, fanoutWorkers)
+	var wg sync.WaitGroup
+
+	for i, host := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			prefix := host + ": "
+			out := &prefixWriter{mu: &outmu, w: stdout, prefix: prefix}
+			errout := &prefixWriter{mu: &errmu, w: stderr, prefix: prefix}
+			defer out.Flush()
+			defer errout.Flush()
+
+			client, err := dial(host)
+			if err != nil {
+				fmt.Fprintln(errout, err)
+				statuses[i] = exitStatusConnectionFailed
+				return
+			}
+			defer client.Close()
+
+			status, err := runFanoutHost(client, command, out, errout)
+			if err != nil {
+				fmt.Fprintln(errout, err)
+				status = exitStatusConnectionFailed
+			}
+			statuses[i] = status
+		}()
+	}
+	wg.Wait()
+
+	status := 0
+	for _, s := range statuses {
+		status = max(status, s)
+	}
+	return status
+}
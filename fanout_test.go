@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// execServer answers exec with output and the exit status.
+func execServer(t *testing.T, output string, status uint32) *testServer {
+	return newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, func(conn *ssh.ServerConn, newch ssh.NewChannel) {
+		if newch.ChannelType() != "session" {
+			newch.Reject(ssh.UnknownChannelType, "")
+			return
+		}
+
+		ch, reqs, err := newch.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+
+		for req := range reqs {
+			if req.Type != "exec" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			ch.Write([]byte(output))
+			ch.Stderr().Write([]byte("warning\n"))
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		}
+	})
+}
+
+func sortedLines(s string) []string {
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func TestFanout(t *testing.T) {
+	servers := map[string]*testServer{
+		"h1": execServer(t, "one\ntwo\n", 0),
+		"h2": execServer(t, "three\nfour", 3),
+	}
+
+	dial := func(host string) (*ssh.Client, error) {
+		srv, ok := servers[host]
+		if !ok {
+			return nil, errors.New("No such host.")
+		}
+		return ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+			User:            "user",
+			HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+		})
+	}
+
+	var stdout, stderr bytes.Buffer
+	status := fanout([]string{"h1", "h2"}, "uptime", dial, &stdout, &stderr)
+	if status != 3 {
+		t.Fatalf("%d", status)
+	}
+
+	want := []string{"h1: one", "h1: two", "h2: four", "h2: three"}
+	if got := sortedLines(stdout.String()); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("%q", stdout.String())
+	}
+	if got := sortedLines(stderr.String()); strings.Join(got, "|") != "h1: warning|h2: warning" {
+		t.Fatalf("%q", stderr.String())
+	}
+
+	stderr.Reset()
+	if status := fanout([]string{"h1", "h3"}, "uptime", dial, &bytes.Buffer{}, &stderr); status != exitStatusConnectionFailed {
+		t.Fatalf("%d", status)
+	}
+	if !strings.Contains(stderr.String(), "h3: No such host.") {
+		t.Fatalf("%q", stderr.String())
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &prefixWriter{mu: new(sync.Mutex), w: &buf, prefix: "h: "}
+
+	for _, s := range []string{"a", "b\nc\n", "\nd"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := buf.String(); got != "h: ab\nh: c\nh: \nh: d\n" {
+		t.Fatalf("%q", got)
+	}
+}
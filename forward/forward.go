@@ -0,0 +1,158 @@
+package forward
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type dialFunc func(network, addr string) (net.Conn, error)
+
+func closeWrite(c net.Conn) error {
+	if v, ok := c.(interface{ CloseWrite() error }); ok {
+		return v.CloseWrite()
+	}
+	return c.Close()
+}
+
+// copyBufferSize is of the bulk transfers. A read returns what has arrived,
+// the small interactive writes are not held back by the size.
+const copyBufferSize = 256 * 1024
+
+var copyBuffers = sync.Pool{
+	New: func() any { return new([copyBufferSize]byte) },
+}
+
+// Copy is io.Copy with a pooled buffer of 256KB, fewer reads and writes
+// than the 32KB of io.Copy on the bulk transfers.
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[copyBufferSize]byte)
+	defer copyBuffers.Put(buf)
+
+	// Hide WriterTo and ReaderFrom, those of *net.TCPConn copy with their
+	// own 32KB buffer to an ssh.Channel.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf[:])
+}
+
+func pipe(a, b net.Conn) error {
+	defer a.Close()
+	defer b.Close()
+
+	errChan := make(chan error)
+	go func() {
+		defer closeWrite(b)
+
+		_, err := Copy(b, a)
+		errChan <- err
+	}()
+	go func() {
+		defer closeWrite(a)
+
+		_, err := Copy(a, b)
+		errChan <- err
+	}()
+
+	var result error
+	for range 2 {
+		if err := <-errChan; err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Listener is the listener of a forwarding. Closing it stops accepting the
+// connections, and Wait waits for the ones accepted to finish.
+type Listener struct {
+	net.Listener
+	wg sync.WaitGroup
+}
+
+func (l *Listener) Wait() {
+	l.wg.Wait()
+}
+
+func serve(l *Listener, handle func(net.Conn) error) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+
+			if err := handle(conn); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+}
+
+// Endpoint is a forwarding endpoint, "tcp" host:port or "unix" path.
+type Endpoint struct {
+	Network string
+	Address string
+}
+
+func (e Endpoint) String() string {
+	return e.Address
+}
+
+// Remote requests the server to listen on addr and forwards the accepted
+// connections to target, dialed from this side. The zero target serves the
+// connections as SOCKS (RemoteForward [bind_address:]port).
+//
+// Closing the returned listener cancels the remote forwarding.
+func Remote(client *ssh.Client, addr, target Endpoint) (*Listener, error) {
+	rl, err := client.Listen(addr.Network, addr.Address)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{Listener: rl}
+
+	if target == (Endpoint{}) {
+		go serve(l, func(conn net.Conn) error {
+			return ServeSocks(conn, net.Dial)
+		})
+		return l, nil
+	}
+
+	go serve(l, func(conn net.Conn) error {
+		remote, err := net.Dial(target.Network, target.Address)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+
+		return pipe(conn, remote)
+	})
+	return l, nil
+}
+
+// Local listens on addr and forwards the accepted connections to target,
+// dialed from the server (LocalForward).
+//
+// Closing the returned listener stops the forwarding.
+func Local(client *ssh.Client, addr, target Endpoint) (*Listener, error) {
+	ll, err := net.Listen(addr.Network, addr.Address)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{Listener: ll}
+
+	go serve(l, func(conn net.Conn) error {
+		remote, err := client.Dial(target.Network, target.Address)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+
+		return pipe(conn, remote)
+	})
+	return l, nil
+}
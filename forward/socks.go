@@ -0,0 +1,229 @@
+package forward
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// REF https://datatracker.ietf.org/doc/html/rfc1928
+// REF https://www.openssh.com/txt/socks4.protocol
+// REF https://www.openssh.com/txt/socks4a.protocol
+
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	socksCmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5CommandNotSupported = 0x07
+	socks5AtypNotSupported    = 0x08
+)
+
+func readSocks4Request(r *bufio.Reader) (string, error) {
+	var b [7]byte // CD DSTPORT DSTIP
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return "", err
+	}
+	if b[0] != socksCmdConnect {
+		return "", fmt.Errorf("Unsupported SOCKS4 command: %d", b[0])
+	}
+
+	port := binary.BigEndian.Uint16(b[1:3])
+	ip := net.IP(b[3:7])
+
+	// USERID
+	if _, err := r.ReadString(0); err != nil {
+		return "", err
+	}
+
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		// SOCKS4A
+		name, err := r.ReadString(0)
+		if err != nil {
+			return "", err
+		}
+		host = name[:len(name)-1]
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func serveSocks4(conn net.Conn, r *bufio.Reader, dial dialFunc) error {
+	reply := func(code byte) error {
+		_, err := conn.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+
+	addr, err := readSocks4Request(r)
+	if err != nil {
+		reply(socks4Rejected)
+		conn.Close()
+		return err
+	}
+
+	remote, err := dial("tcp", addr)
+	if err != nil {
+		reply(socks4Rejected)
+		conn.Close()
+		return err
+	}
+
+	if err := reply(socks4Granted); err != nil {
+		remote.Close()
+		conn.Close()
+		return err
+	}
+
+	return pipe(&BufferedConn{Conn: conn, Reader: r}, remote)
+}
+
+func readSocks5Methods(r *bufio.Reader) error {
+	var n [1]byte // NMETHODS
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return err
+	}
+
+	// Only NO AUTHENTICATION REQUIRED is offered whatever the client lists.
+	_, err := io.ReadFull(r, make([]byte, n[0]))
+	return err
+}
+
+func readSocks5Connect(r *bufio.Reader) (string, byte, error) {
+	var b [4]byte // VER CMD RSV ATYP
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return "", socks5GeneralFailure, err
+	}
+	if b[0] != socks5Version {
+		return "", socks5GeneralFailure, fmt.Errorf("Incorrect SOCKS version: %d", b[0])
+	}
+	if b[1] != socksCmdConnect {
+		return "", socks5CommandNotSupported, fmt.Errorf("Unsupported SOCKS5 command: %d", b[1])
+	}
+
+	var host string
+	switch b[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		l := net.IPv4len
+		if b[3] == socks5AtypIPv6 {
+			l = net.IPv6len
+		}
+		ip := make(net.IP, l)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", socks5GeneralFailure, err
+		}
+		host = ip.String()
+
+	case socks5AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", socks5GeneralFailure, err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", socks5GeneralFailure, err
+		}
+		host = string(name)
+
+	default:
+		return "", socks5AtypNotSupported, fmt.Errorf("Unsupported address type: %d", b[3])
+	}
+
+	var port uint16
+	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+		return "", socks5GeneralFailure, err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), 0, nil
+}
+
+func serveSocks5(conn net.Conn, r *bufio.Reader, dial dialFunc) error {
+	reply := func(code byte) error {
+		// BND.ADDR / BND.PORT are not meaningful for us.
+		_, err := conn.Write([]byte{socks5Version, code, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+
+	if err := readSocks5Methods(r); err != nil {
+		conn.Close()
+		return err
+	}
+	// NO AUTHENTICATION REQUIRED
+	if _, err := conn.Write([]byte{socks5Version, 0x00}); err != nil {
+		conn.Close()
+		return err
+	}
+
+	addr, code, err := readSocks5Connect(r)
+	if err != nil {
+		reply(code)
+		conn.Close()
+		return err
+	}
+
+	remote, err := dial("tcp", addr)
+	if err != nil {
+		reply(socks5GeneralFailure)
+		conn.Close()
+		return err
+	}
+
+	if err := reply(socks5Succeeded); err != nil {
+		remote.Close()
+		conn.Close()
+		return err
+	}
+
+	return pipe(&BufferedConn{Conn: conn, Reader: r}, remote)
+}
+
+// ServeSocks serves a single SOCKS4(A) / SOCKS5 CONNECT request on conn,
+// connecting to the requested destination with dial.
+func ServeSocks(conn net.Conn, dial func(network, addr string) (net.Conn, error)) error {
+	r := bufio.NewReader(conn)
+
+	ver, err := r.ReadByte()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	switch ver {
+	case socks4Version:
+		return serveSocks4(conn, r, dial)
+	case socks5Version:
+		return serveSocks5(conn, r, dial)
+	default:
+		conn.Close()
+		return errors.New("Unsupported SOCKS version.")
+	}
+}
+
+// BufferedConn reads through Reader, used while parsing a request or a
+// response on Conn, so that the data sent right after it isn't lost.
+type BufferedConn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+func (c *BufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
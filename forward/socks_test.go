@@ -0,0 +1,88 @@
+package forward
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestServeSocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		reply   []byte
+		addr    string
+	}{
+		{
+			"socks5 domain",
+			[]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, 0x0b, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x00, 0x50},
+			[]byte{0x05, 0x00, 0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			"example.com:80",
+		},
+		{
+			"socks5 ipv6",
+			append(append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x04}, net.ParseIP("2001:db8::1")...), 0x1f, 0x90),
+			[]byte{0x05, 0x00, 0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			"[2001:db8::1]:8080",
+		},
+		{
+			"socks4",
+			[]byte{0x04, 0x01, 0x00, 0x16, 192, 0, 2, 1, 'u', 0x00},
+			[]byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0},
+			"192.0.2.1:22",
+		},
+		{
+			"socks4a",
+			[]byte{0x04, 0x01, 0x00, 0x16, 0, 0, 0, 1, 0x00, 'h', 'o', 's', 't', 0x00},
+			[]byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0},
+			"host:22",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+
+			var dialed string
+			dial := func(network, addr string) (net.Conn, error) {
+				dialed = addr
+
+				// echo
+				a, b := net.Pipe()
+				go func() {
+					defer b.Close()
+					io.Copy(b, b)
+				}()
+				return a, nil
+			}
+
+			done := make(chan error)
+			go func() {
+				done <- ServeSocks(server, dial)
+			}()
+
+			// The request and the first payload arrive in one write.
+			go client.Write(append(tt.request, []byte("hello")...))
+
+			got := make([]byte, len(tt.reply)+len("hello"))
+			if _, err := io.ReadFull(client, got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got[:len(tt.reply)], tt.reply) {
+				t.Fatalf("%x", got[:len(tt.reply)])
+			}
+			if string(got[len(tt.reply):]) != "hello" {
+				t.Fatalf("%q", got[len(tt.reply):])
+			}
+			if dialed != tt.addr {
+				t.Fatalf("%s", dialed)
+			}
+
+			client.Close()
+			<-done
+		})
+	}
+}
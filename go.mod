@@ -4,7 +4,6 @@ go 1.23.6
 
 require (
 	github.com/Microsoft/go-winio v0.6.2
-	github.com/kevinburke/ssh_config v1.2.0
 	golang.org/x/crypto v0.32.0
 	golang.org/x/sys v0.29.0
 	golang.org/x/term v0.28.0
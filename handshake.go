@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// REF https://datatracker.ietf.org/doc/html/rfc4253#section-7.1
+type kexInitMsg struct {
+	Cookie                  [16]byte `sshtype:"20"`
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+// maxKexInitPacket gives up the packets larger, not of a sane KEXINIT.
+const maxKexInitPacket = 64 * 1024
+
+// kexInitStream picks the first KEXINIT out of the bytes of a direction,
+// after the version line.
+type kexInitStream struct {
+	buf     []byte
+	version bool
+	done    bool
+	msg     *kexInitMsg
+}
+
+func (s *kexInitStream) feed(p []byte) {
+	if s.done {
+		return
+	}
+	s.buf = append(s.buf, p...)
+
+	for !s.done {
+		if !s.version {
+			// The server may send other lines before the version.
+			i := bytes.IndexByte(s.buf, '\n')
+			if i < 0 {
+				break
+			}
+			s.version = bytes.HasPrefix(s.buf, []byte("SSH-"))
+			s.buf = s.buf[i+1:]
+			continue
+		}
+
+		if len(s.buf) < 5 {
+			break
+		}
+		n := binary.BigEndian.Uint32(s.buf)
+		if n > maxKexInitPacket || int(s.buf[4])+1 > int(n) {
+			s.done = true
+			break
+		}
+		if len(s.buf) < 4+int(n) {
+			break
+		}
+
+		var msg kexInitMsg
+		if err := ssh.Unmarshal(s.buf[5:4+int(n)-int(s.buf[4])], &msg); err == nil {
+			s.msg = &msg
+		}
+		s.done = true
+	}
+
+	if s.done || len(s.buf) > maxKexInitPacket {
+		s.done = true
+		s.buf = nil
+	}
+}
+
+// kexInitRecorder records the first KEXINIT of the both sides, in the clear
+// before the keys are exchanged. x/crypto/ssh does not tell the negotiated
+// algorithms.
+type kexInitRecorder struct {
+	net.Conn
+
+	mu     sync.Mutex
+	client kexInitStream
+	server kexInitStream
+}
+
+func (r *kexInitRecorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.mu.Lock()
+	r.server.feed(p[:n])
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *kexInitRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	r.client.feed(p)
+	r.mu.Unlock()
+	return r.Conn.Write(p)
+}
+
+type negotiatedAlgorithms struct {
+	kex      string
+	hostKey  string
+	cipherCS string
+	cipherSC string
+	macCS    string
+	macSC    string
+	recorded bool
+}
+
+// negotiated returns the algorithms chosen as RFC 4253 7.1, the first of the
+// client also of the server.
+func (r *kexInitRecorder) negotiated() negotiatedAlgorithms {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, s := r.client.msg, r.server.msg
+	if c == nil || s == nil {
+		return negotiatedAlgorithms{}
+	}
+
+	algs := negotiatedAlgorithms{
+		kex:      firstCommon(c.KexAlgos, s.KexAlgos),
+		hostKey:  firstCommon(c.ServerHostKeyAlgos, s.ServerHostKeyAlgos),
+		cipherCS: firstCommon(c.CiphersClientServer, s.CiphersClientServer),
+		cipherSC: firstCommon(c.CiphersServerClient, s.CiphersServerClient),
+		macCS:    firstCommon(c.MACsClientServer, s.MACsClientServer),
+		macSC:    firstCommon(c.MACsServerClient, s.MACsServerClient),
+		recorded: true,
+	}
+	// The AEAD ciphers have the MAC of their own.
+	if isAEAD(algs.cipherCS) {
+		algs.macCS = "<implicit>"
+	}
+	if isAEAD(algs.cipherSC) {
+		algs.macSC = "<implicit>"
+	}
+	return algs
+}
+
+func firstCommon(client, server []string) string {
+	for _, a := range client {
+		if slices.Contains(server, a) {
+			return a
+		}
+	}
+	return ""
+}
+
+func isAEAD(cipher string) bool {
+	return strings.HasSuffix(cipher, "-gcm@openssh.com") || cipher == "chacha20-poly1305@openssh.com"
+}
+
+// reportHandshake logs the result of the handshake, for diagnosing the
+// algorithm mismatches.
+func reportHandshake(logf func(format string, args ...any), conn ssh.Conn, rec *kexInitRecorder, hostKey ssh.PublicKey) {
+	logf("Remote protocol version: %s", conn.ServerVersion())
+	logf("Local version string: %s", conn.ClientVersion())
+	if hostKey != nil {
+		logf("Server host key: %s %s", hostKey.Type(), ssh.FingerprintSHA256(hostKey))
+	}
+
+	algs := rec.negotiated()
+	if !algs.recorded {
+		logf("kex: negotiated algorithms unknown")
+		return
+	}
+	logf("kex: algorithm: %s", algs.kex)
+	logf("kex: host key algorithm: %s", algs.hostKey)
+	logf("kex: server->client cipher: %s MAC: %s", algs.cipherSC, algs.macSC)
+	logf("kex: client->server cipher: %s MAC: %s", algs.cipherCS, algs.macCS)
+}
+
+// reportOffers logs the algorithms offered by the both sides, for the
+// handshake failed with no common algorithm.
+func reportOffers(logf func(format string, args ...any), rec *kexInitRecorder) {
+	rec.mu.Lock()
+	c, s := rec.client.msg, rec.server.msg
+	rec.mu.Unlock()
+	if c == nil || s == nil {
+		logf("kex: offers unknown, the handshake failed before the key exchange")
+		return
+	}
+
+	aead := isAEAD(firstCommon(c.CiphersClientServer, s.CiphersClientServer)) && isAEAD(firstCommon(c.CiphersServerClient, s.CiphersServerClient))
+	lists := []struct {
+		name           string
+		client, server []string
+		// implicit is of the MACs, not needed for the AEAD ciphers.
+		implicit bool
+	}{
+		{"key exchange", c.KexAlgos, s.KexAlgos, false},
+		{"host key", c.ServerHostKeyAlgos, s.ServerHostKeyAlgos, false},
+		{"client->server cipher", c.CiphersClientServer, s.CiphersClientServer, false},
+		{"server->client cipher", c.CiphersServerClient, s.CiphersServerClient, false},
+		{"client->server MAC", c.MACsClientServer, s.MACsClientServer, aead},
+		{"server->client MAC", c.MACsServerClient, s.MACsServerClient, aead},
+	}
+	for _, l := range lists {
+		if firstCommon(l.client, l.server) == "" && !l.implicit {
+			logf("kex: %s: no common algorithm", l.name)
+		}
+		logf("kex: %s: client offers %s", l.name, strings.Join(l.client, ","))
+		logf("kex: %s: server offers %s", l.name, strings.Join(l.server, ","))
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestReportHandshake(t *testing.T) {
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, nil)
+	_, port, err := net.SplitHostPort(srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, level := range []int{logDebug, logDebug2} {
+		var out bytes.Buffer
+		log.SetOutput(&out)
+
+		cfg := &config{
+			user:                          "user",
+			hostname:                      "127.0.0.1",
+			port:                          port,
+			noAgent:                       true,
+			logLevel:                      level,
+			insecureIgnoreLoopbackHostKey: true,
+		}
+		client, err := dialSsh(context.Background(), cfg, nil)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+
+		report := out.String()
+		if level < logDebug2 {
+			if strings.Contains(report, "kex: ") {
+				t.Fatalf("reported at DEBUG: %q", report)
+			}
+			continue
+		}
+		for _, want := range []string{
+			"Remote protocol version: SSH-2.0-Go",
+			"Server host key: ssh-ed25519 " + ssh.FingerprintSHA256(srv.hostKey.PublicKey()),
+			"kex: host key algorithm: ssh-ed25519",
+		} {
+			if !strings.Contains(report, want) {
+				t.Errorf("%q not in %q", want, report)
+			}
+		}
+		for _, prefix := range []string{"kex: algorithm: ", "server->client cipher: ", "client->server cipher: "} {
+			i := strings.Index(report, prefix)
+			if i < 0 || strings.HasPrefix(report[i+len(prefix):], " ") {
+				t.Errorf("%q not negotiated in %q", prefix, report)
+			}
+		}
+	}
+}
+
+func TestKexInitStream(t *testing.T) {
+	msg := ssh.Marshal(&kexInitMsg{
+		KexAlgos:            []string{"curve25519-sha256"},
+		ServerHostKeyAlgos:  []string{"ssh-ed25519"},
+		CiphersClientServer: []string{"aes128-ctr"},
+		CiphersServerClient: []string{"aes128-ctr"},
+		MACsClientServer:    []string{"hmac-sha2-256"},
+		MACsServerClient:    []string{"hmac-sha2-256"},
+	})
+	padding := 4
+	packet := []byte{0, 0, 0, byte(1 + len(msg) + padding), byte(padding)}
+	packet = append(append(packet, msg...), make([]byte, padding)...)
+	stream := append([]byte("banner\r\nSSH-2.0-test\r\n"), packet...)
+
+	// Fed a byte at a time, as split across the reads.
+	var s kexInitStream
+	for i := range stream {
+		s.feed(stream[i : i+1])
+	}
+	if s.msg == nil || s.msg.KexAlgos[0] != "curve25519-sha256" || s.msg.MACsServerClient[0] != "hmac-sha2-256" {
+		t.Fatalf("%#v", s.msg)
+	}
+
+	// Not a KEXINIT
+	s = kexInitStream{}
+	s.feed([]byte("SSH-2.0-test\r\n\x00\x00\x00\x0c\x0a\x05\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+	if s.msg != nil || !s.done {
+		t.Fatalf("%#v", s)
+	}
+}
+
+func TestKexDebugMismatch(t *testing.T) {
+	srvcfg := &ssh.ServerConfig{NoClientAuth: true}
+	// Not offered by the client by default.
+	srvcfg.KeyExchanges = []string{"diffie-hellman-group1-sha1"}
+	srv := newTestServer(t, srvcfg, nil)
+	_, port, err := net.SplitHostPort(srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := &config{
+		user:                          "user",
+		hostname:                      "127.0.0.1",
+		port:                          port,
+		noAgent:                       true,
+		kexDebug:                      true,
+		insecureIgnoreLoopbackHostKey: true,
+	}
+	if _, err := dialSsh(context.Background(), cfg, nil); err == nil {
+		t.Fatal("must fail")
+	}
+
+	report := out.String()
+	for _, want := range []string{
+		"kex: key exchange: no common algorithm",
+		"kex: key exchange: client offers curve25519-sha256",
+		"kex: key exchange: server offers diffie-hellman-group1-sha1",
+		"kex: host key: server offers ssh-ed25519",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("%q not in %q", want, report)
+		}
+	}
+	if strings.Contains(report, "cipher: no common") || strings.Contains(report, "MAC: no common") {
+		t.Errorf("only the key exchange mismatches: %q", report)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AddKeysToAgent
+const (
+	addKeysNo      = "no"
+	addKeysYes     = "yes"
+	addKeysAsk     = "ask"
+	addKeysConfirm = "confirm"
+)
+
+// identitySigner is the key of an IdentityFile. It is read, and decrypted
+// with the passphrase, on the first signature, that is only when the server
+// accepts the public key.
+type identitySigner struct {
+	path string
+	pub  ssh.PublicKey
+	// load returns the raw private key.
+	load func() (any, error)
+	// used is called once with the key signed with first.
+	used func(key any)
+
+	mu     sync.Mutex
+	signer ssh.AlgorithmSigner
+}
+
+func (s *identitySigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *identitySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *identitySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.signer == nil {
+		key, err := s.load()
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, err
+		}
+		as, ok := signer.(ssh.AlgorithmSigner)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported key: %s", s.path)
+		}
+
+		sig, err := as.SignWithAlgorithm(rand, data, algorithm)
+		if err != nil {
+			return nil, err
+		}
+		s.signer = as
+		if s.used != nil {
+			s.used(key)
+		}
+		return sig, nil
+	}
+
+	return s.signer.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// loadIdentity reads the public key of the IdentityFile path, from the key
+// itself or, for the encrypted ones of the old format, path.pub. The PuTTY
+// key files, .ppk, are read too.
+func loadIdentity(path string, p *prompter, used func(key any)) (*identitySigner, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &identitySigner{path: path, used: used}
+
+	var key any
+	if isPPK(b) {
+		key, err = parsePPK(b)
+	} else {
+		key, err = ssh.ParseRawPrivateKey(b)
+	}
+	var missing *ssh.PassphraseMissingError
+	switch {
+	case err == nil:
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, err
+		}
+		s.pub = signer.PublicKey()
+		s.load = func() (any, error) { return key, nil }
+		return s, nil
+
+	case errors.As(err, &missing):
+		s.pub = missing.PublicKey
+		if s.pub == nil {
+			pubBytes, err := os.ReadFile(path + ".pub")
+			if err != nil {
+				return nil, err
+			}
+			if s.pub, _, _, _, err = ssh.ParseAuthorizedKey(pubBytes); err != nil {
+				return nil, err
+			}
+		}
+		s.load = func() (any, error) {
+			passphrase, err := p.password(fmt.Sprintf("Enter passphrase for key '%s': ", path))
+			if err != nil {
+				return nil, err
+			}
+			return ssh.ParseRawPrivateKeyWithPassphrase(b, []byte(passphrase))
+		}
+		return s, nil
+
+	default:
+		return nil, err
+	}
+}
+
+// identitySigners returns the keys of the IdentityFiles not in the agent
+// already. The files missing or unreadable are skipped, like ssh.
+func identitySigners(cfg *config, ag agent.Agent, p *prompter, inAgent []ssh.Signer) []ssh.Signer {
+	var signers []ssh.Signer
+	for _, path := range cfg.identityFiles {
+		s, err := loadIdentity(path, p, func(key any) {
+			addKeyToAgent(cfg, ag, p, path, key)
+		})
+		if err != nil {
+			if logf := cfg.logf(logDebug); logf != nil {
+				logf("IdentityFile %s: %s", path, err)
+			}
+			continue
+		}
+
+		dup := false
+		for _, a := range inAgent {
+			if string(a.PublicKey().Marshal()) == string(s.pub.Marshal()) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			signers = append(signers, s)
+		}
+	}
+	return signers
+}
+
+// onlyIdentities keeps the agent keys of the IdentityFiles, for
+// IdentitiesOnly.
+func onlyIdentities(cfg *config, signers []ssh.Signer) []ssh.Signer {
+	var pubs []string
+	for _, path := range cfg.identityFiles {
+		s, err := loadIdentity(path, nil, nil)
+		if err != nil {
+			continue
+		}
+		pubs = append(pubs, string(s.pub.Marshal()))
+	}
+
+	return slices.DeleteFunc(signers, func(s ssh.Signer) bool {
+		return !slices.Contains(pubs, string(s.PublicKey().Marshal()))
+	})
+}
+
+// addKeyToAgent adds the key just used to the agent, as AddKeysToAgent. With
+// ask, the answer other than yes, an EOF or no terminal, is no.
+func addKeyToAgent(cfg *config, ag agent.Agent, p *prompter, path string, key any) {
+	if cfg.noAgent || ag == nil {
+		return
+	}
+
+	switch cfg.addKeysToAgent {
+	case addKeysYes, addKeysConfirm:
+	case addKeysAsk:
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			return
+		}
+		answer, err := p.line(fmt.Sprintf("Add key %s (%s) to agent? (yes/no) ", path, ssh.FingerprintSHA256(signer.PublicKey())))
+		if err != nil {
+			return
+		}
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "yes" && a != "y" {
+			return
+		}
+	default:
+		return
+	}
+
+	if err := ag.Add(agent.AddedKey{
+		PrivateKey:       key,
+		Comment:          path,
+		ConfirmBeforeUse: cfg.addKeysToAgent == addKeysConfirm,
+	}); err != nil {
+		log.Printf("Warning: adding %s to the agent: %s", path, err)
+	}
+}
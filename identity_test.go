@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func writeIdentity(t *testing.T, passphrase string) (string, ssh.PublicKey) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(priv, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, sshPub
+}
+
+// pubkeyServer accepts the key only.
+func pubkeyServer(t *testing.T, accepted ssh.PublicKey) *testServer {
+	return newTestServer(t, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(accepted.Marshal()) {
+				return nil, errors.New("denied")
+			}
+			return nil, nil
+		},
+	}, nil)
+}
+
+func TestAuthIdentityFile(t *testing.T) {
+	path, pub := writeIdentity(t, "secret")
+	srv := pubkeyServer(t, pub)
+
+	prompts := 0
+	p := &prompter{
+		password: func(msg string) (string, error) {
+			prompts++
+			if msg != "Enter passphrase for key '"+path+"': " {
+				t.Errorf("%q", msg)
+			}
+			return "secret", nil
+		},
+	}
+
+	cfg := &config{user: "user", hostname: "127.0.0.1", noAgent: true, identityFiles: []string{filepath.Join(t.TempDir(), "missing"), path}}
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            cfg.user,
+		Auth:            authMethods(cfg, nil, p),
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if prompts != 1 {
+		t.Fatalf("%d prompts", prompts)
+	}
+
+	// Not decrypted for a server rejecting it.
+	prompts = 0
+	_, other := writeIdentity(t, "")
+	srv = pubkeyServer(t, other)
+	if _, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            cfg.user,
+		Auth:            authMethods(cfg, nil, p),
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	}); err == nil {
+		t.Fatal("must fail")
+	}
+	if prompts != 0 {
+		t.Fatalf("%d prompts", prompts)
+	}
+}
+
+func TestTooManyAuthFailures(t *testing.T) {
+	path, pub := writeIdentity(t, "")
+	var attempts atomic.Int32
+	srv := newTestServer(t, &ssh.ServerConfig{
+		MaxAuthTries: 3,
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			attempts.Add(1)
+			if string(key.Marshal()) != string(pub.Marshal()) {
+				return nil, errors.New("denied")
+			}
+			return nil, nil
+		},
+	}, nil)
+	_, port, _ := net.SplitHostPort(srv.addr)
+
+	// The agent offers more keys than MaxAuthTries before the IdentityFile.
+	keyring := agent.NewKeyring()
+	for range 5 {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := &config{
+		user:                          "user",
+		hostname:                      "127.0.0.1",
+		port:                          port,
+		identityFiles:                 []string{path},
+		insecureIgnoreLoopbackHostKey: true,
+	}
+	client, err := dialSsh(context.Background(), cfg, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	if !strings.Contains(out.String(), "Consider IdentitiesOnly yes") {
+		t.Errorf("%q", out.String())
+	}
+	if cfg.identitiesOnly {
+		t.Error("the config must be left as is")
+	}
+
+	// Narrowed from the first.
+	out.Reset()
+	attempts.Store(0)
+	cfg.identitiesOnly = true
+	client, err = dialSsh(context.Background(), cfg, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if out.Len() != 0 || attempts.Load() != 1 {
+		t.Errorf("%d attempts, %q", attempts.Load(), out.String())
+	}
+}
+
+func TestAddKeysToAgentAsk(t *testing.T) {
+	path, pub := writeIdentity(t, "")
+	srv := pubkeyServer(t, pub)
+
+	tests := []struct {
+		mode   string
+		answer string
+		err    error
+		asked  bool
+		added  bool
+	}{
+		{addKeysAsk, "no", nil, true, false},
+		{addKeysAsk, "", io.EOF, true, false},
+		{addKeysAsk, "yes", nil, true, true},
+		{addKeysNo, "", nil, false, false},
+		{addKeysYes, "", nil, false, true},
+	}
+	for _, tt := range tests {
+		keyring := agent.NewKeyring()
+		asked := false
+		p := &prompter{
+			line: func(msg string) (string, error) {
+				asked = true
+				if !strings.HasPrefix(msg, "Add key "+path+" (SHA256:") {
+					t.Errorf("%q", msg)
+				}
+				return tt.answer, tt.err
+			},
+		}
+
+		cfg := &config{user: "user", hostname: "127.0.0.1", identityFiles: []string{path}, addKeysToAgent: tt.mode}
+		client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+			User:            cfg.user,
+			Auth:            authMethods(cfg, keyring, p),
+			HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+
+		keys, err := keyring.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if asked != tt.asked || (len(keys) == 1) != tt.added {
+			t.Errorf("%s %q: asked %v, %d keys", tt.mode, tt.answer, asked, len(keys))
+		}
+	}
+}
+
+func TestLoadConfigIdentityFile(t *testing.T) {
+	cfgfile := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(cfgfile, []byte(`
+Host example
+    IdentityFile ~/.ssh/id_%h
+    AddKeysToAgent ask
+    IdentitiesOnly yes
+Host *
+    IdentityFile /keys/default
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig("example", cfgfile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(home, ".ssh", "id_example"), "/keys/default"}
+	if strings.Join(cfg.identityFiles, " ") != strings.Join(want, " ") || cfg.addKeysToAgent != addKeysAsk || !cfg.identitiesOnly {
+		t.Fatalf("%q %s %v", cfg.identityFiles, cfg.addKeysToAgent, cfg.identitiesOnly)
+	}
+
+	if _, err := loadConfig("example", cfgfile, map[string]string{"AddKeysToAgent": "1h"}); err == nil {
+		t.Fatal("must fail")
+	}
+}
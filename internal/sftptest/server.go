@@ -0,0 +1,373 @@
+// Package sftptest is a minimal SFTP server for the tests of myssh cp and
+// of package sftp.
+package sftptest
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ysuzuki-bysystems/myssh/internal/sftpwire"
+)
+
+// Serve serves the directory root on rw, the streams of the "sftp"
+// subsystem, until the client closes. The paths are of root, "/" being root
+// itself.
+func Serve(rw io.ReadWriter, root string) error {
+	return serve(rw, &server{root: root, handles: map[string]any{}})
+}
+
+// ServeRenamed is Serve with the names of the directory listings replaced by
+// rename, like a hostile server sending "../x".
+func ServeRenamed(rw io.ReadWriter, root string, rename func(name string) string) error {
+	return serve(rw, &server{root: root, rename: rename, handles: map[string]any{}})
+}
+
+func serve(rw io.ReadWriter, s *server) error {
+	typ, _, err := sftpwire.ReadPacket(rw)
+	if err != nil {
+		return err
+	}
+	if typ != sftpwire.FxpInit {
+		return errors.New("sftp: expected init")
+	}
+
+	version := sftpwire.NewBuffer()
+	version.Byte(sftpwire.FxpVersion)
+	version.Uint32(3)
+	if _, err := rw.Write(version.Bytes()); err != nil {
+		return err
+	}
+
+	for {
+		typ, data, err := sftpwire.ReadPacket(rw)
+		if err != nil {
+			s.closeAll()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		r := sftpwire.NewReader(data)
+		id := r.Uint32()
+		resp := s.handle(typ, id, r)
+		if _, err := rw.Write(resp.Bytes()); err != nil {
+			s.closeAll()
+			return err
+		}
+	}
+}
+
+// maxRead bounds the data of a read, 32KB like the servers.
+const maxRead = 32 * 1024
+
+type server struct {
+	root   string
+	rename func(name string) string
+
+	mu      sync.Mutex
+	next    int
+	handles map[string]any // *os.File or *dirHandle
+}
+
+type dirHandle struct {
+	entries []fs.DirEntry
+	done    bool
+}
+
+func (s *server) local(p []byte) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+string(p))))
+}
+
+func (s *server) add(h any) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.next++
+	name := strconv.Itoa(s.next)
+	s.handles[name] = h
+	return name
+}
+
+func (s *server) get(name []byte) any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.handles[string(name)]
+}
+
+func (s *server) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, h := range s.handles {
+		if f, ok := h.(*os.File); ok {
+			f.Close()
+		}
+		delete(s.handles, name)
+	}
+}
+
+func statusPacket(id uint32, err error) *sftpwire.Buffer {
+	code := uint32(sftpwire.FxOK)
+	msg := ""
+	switch {
+	case err == nil:
+	case errors.Is(err, io.EOF):
+		code = sftpwire.FxEOF
+	case errors.Is(err, fs.ErrNotExist):
+		code, msg = sftpwire.FxNoSuchFile, err.Error()
+	case errors.Is(err, fs.ErrPermission):
+		code, msg = sftpwire.FxPermissionDenied, err.Error()
+	default:
+		code, msg = sftpwire.FxFailure, err.Error()
+	}
+
+	b := sftpwire.NewPacket(sftpwire.FxpStatus, id)
+	b.Uint32(code)
+	b.String([]byte(msg))
+	b.String(nil) // language tag
+	return b
+}
+
+func attrsOf(fi fs.FileInfo) *sftpwire.Attrs {
+	perm := sftpwire.PosixPerm(fi.Mode())
+	switch {
+	case fi.IsDir():
+		perm |= sftpwire.ModeDir
+	case fi.Mode()&fs.ModeSymlink != 0:
+		perm |= sftpwire.ModeSymlink
+	case fi.Mode().IsRegular():
+		perm |= sftpwire.ModeRegular
+	}
+	mtime := uint32(fi.ModTime().Unix())
+	return &sftpwire.Attrs{
+		Flags: sftpwire.AttrSize | sftpwire.AttrPermissions | sftpwire.AttrACModTime,
+		Size:  uint64(fi.Size()),
+		Perm:  perm,
+		Atime: mtime,
+		Mtime: mtime,
+	}
+}
+
+func attrsPacket(id uint32, fi fs.FileInfo, err error) *sftpwire.Buffer {
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	b := sftpwire.NewPacket(sftpwire.FxpAttrs, id)
+	b.Attrs(attrsOf(fi))
+	return b
+}
+
+func handlePacket(id uint32, h string) *sftpwire.Buffer {
+	b := sftpwire.NewPacket(sftpwire.FxpHandle, id)
+	b.String([]byte(h))
+	return b
+}
+
+func setstat(name string, a sftpwire.Attrs) error {
+	if a.Flags&sftpwire.AttrPermissions != 0 {
+		if err := os.Chmod(name, a.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if a.Flags&sftpwire.AttrACModTime != 0 {
+		if err := os.Chtimes(name, time.Unix(int64(a.Atime), 0), time.Unix(int64(a.Mtime), 0)); err != nil {
+			return err
+		}
+	}
+	if a.Flags&sftpwire.AttrSize != 0 {
+		return os.Truncate(name, int64(a.Size))
+	}
+	return nil
+}
+
+func (s *server) handle(typ byte, id uint32, r *sftpwire.Reader) *sftpwire.Buffer {
+	switch typ {
+	case sftpwire.FxpOpen:
+		name := s.local(r.String())
+		pflags := r.Uint32()
+		a := r.Attrs()
+		if r.Err() != nil {
+			return statusPacket(id, r.Err())
+		}
+
+		flag := os.O_RDONLY
+		switch {
+		case pflags&sftpwire.FxfRead != 0 && pflags&sftpwire.FxfWrite != 0:
+			flag = os.O_RDWR
+		case pflags&sftpwire.FxfWrite != 0:
+			flag = os.O_WRONLY
+		}
+		if pflags&sftpwire.FxfAppend != 0 {
+			flag |= os.O_APPEND
+		}
+		if pflags&sftpwire.FxfCreat != 0 {
+			flag |= os.O_CREATE
+		}
+		if pflags&sftpwire.FxfTrunc != 0 {
+			flag |= os.O_TRUNC
+		}
+		if pflags&sftpwire.FxfExcl != 0 {
+			flag |= os.O_EXCL
+		}
+		perm := fs.FileMode(0644)
+		if a.Flags&sftpwire.AttrPermissions != 0 {
+			perm = a.FileMode().Perm()
+		}
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+		return handlePacket(id, s.add(f))
+
+	case sftpwire.FxpOpendir:
+		name := s.local(r.String())
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+		return handlePacket(id, s.add(&dirHandle{entries: entries}))
+
+	case sftpwire.FxpClose:
+		h := r.String()
+		s.mu.Lock()
+		v, ok := s.handles[string(h)]
+		delete(s.handles, string(h))
+		s.mu.Unlock()
+		if !ok {
+			return statusPacket(id, fs.ErrInvalid)
+		}
+		if f, ok := v.(*os.File); ok {
+			return statusPacket(id, f.Close())
+		}
+		return statusPacket(id, nil)
+
+	case sftpwire.FxpRead:
+		f, _ := s.get(r.String()).(*os.File)
+		off := r.Uint64()
+		n := r.Uint32()
+		if f == nil || r.Err() != nil {
+			return statusPacket(id, fs.ErrInvalid)
+		}
+		buf := make([]byte, min(n, maxRead))
+		m, err := f.ReadAt(buf, int64(off))
+		if m == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return statusPacket(id, err)
+		}
+		b := sftpwire.NewPacket(sftpwire.FxpData, id)
+		b.String(buf[:m])
+		return b
+
+	case sftpwire.FxpWrite:
+		f, _ := s.get(r.String()).(*os.File)
+		off := r.Uint64()
+		data := r.String()
+		if f == nil || r.Err() != nil {
+			return statusPacket(id, fs.ErrInvalid)
+		}
+		_, err := f.WriteAt(data, int64(off))
+		return statusPacket(id, err)
+
+	case sftpwire.FxpReaddir:
+		d, _ := s.get(r.String()).(*dirHandle)
+		if d == nil {
+			return statusPacket(id, fs.ErrInvalid)
+		}
+		if d.done {
+			return statusPacket(id, io.EOF)
+		}
+		d.done = true
+
+		var infos []fs.FileInfo
+		for _, e := range d.entries {
+			if fi, err := e.Info(); err == nil {
+				infos = append(infos, fi)
+			}
+		}
+		b := sftpwire.NewPacket(sftpwire.FxpName, id)
+		b.Uint32(uint32(len(infos)))
+		for _, fi := range infos {
+			name := fi.Name()
+			if s.rename != nil {
+				name = s.rename(name)
+			}
+			b.String([]byte(name))
+			b.String([]byte(name))
+			b.Attrs(attrsOf(fi))
+		}
+		return b
+
+	case sftpwire.FxpStat:
+		fi, err := os.Stat(s.local(r.String()))
+		return attrsPacket(id, fi, err)
+
+	case sftpwire.FxpLstat:
+		fi, err := os.Lstat(s.local(r.String()))
+		return attrsPacket(id, fi, err)
+
+	case sftpwire.FxpFstat:
+		f, _ := s.get(r.String()).(*os.File)
+		if f == nil {
+			return statusPacket(id, fs.ErrInvalid)
+		}
+		fi, err := f.Stat()
+		return attrsPacket(id, fi, err)
+
+	case sftpwire.FxpSetstat:
+		name := s.local(r.String())
+		a := r.Attrs()
+		if r.Err() != nil {
+			return statusPacket(id, r.Err())
+		}
+		return statusPacket(id, setstat(name, a))
+
+	case sftpwire.FxpFsetstat:
+		f, _ := s.get(r.String()).(*os.File)
+		a := r.Attrs()
+		if f == nil || r.Err() != nil {
+			return statusPacket(id, fs.ErrInvalid)
+		}
+		return statusPacket(id, setstat(f.Name(), a))
+
+	case sftpwire.FxpMkdir:
+		name := s.local(r.String())
+		a := r.Attrs()
+		perm := fs.FileMode(0755)
+		if a.Flags&sftpwire.AttrPermissions != 0 {
+			perm = a.FileMode().Perm()
+		}
+		return statusPacket(id, os.Mkdir(name, perm))
+
+	case sftpwire.FxpRemove:
+		return statusPacket(id, os.Remove(s.local(r.String())))
+
+	case sftpwire.FxpRmdir:
+		return statusPacket(id, os.Remove(s.local(r.String())))
+
+	case sftpwire.FxpRealpath:
+		p := path.Clean("/" + string(r.String()))
+		b := sftpwire.NewPacket(sftpwire.FxpName, id)
+		b.Uint32(1)
+		b.String([]byte(p))
+		b.String([]byte(p))
+		b.Attrs(&sftpwire.Attrs{})
+		return b
+	}
+
+	b := sftpwire.NewPacket(sftpwire.FxpStatus, id)
+	b.Uint32(sftpwire.FxOpUnsupported)
+	b.String([]byte("unsupported"))
+	b.String(nil)
+	return b
+}
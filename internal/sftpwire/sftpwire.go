@@ -0,0 +1,303 @@
+// Package sftpwire is the packet encoding of the SFTP version 3, shared by
+// the client of package sftp and the server of the tests.
+package sftpwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// REF https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02
+
+const (
+	FxpInit     = 1
+	FxpVersion  = 2
+	FxpOpen     = 3
+	FxpClose    = 4
+	FxpRead     = 5
+	FxpWrite    = 6
+	FxpLstat    = 7
+	FxpFstat    = 8
+	FxpSetstat  = 9
+	FxpFsetstat = 10
+	FxpOpendir  = 11
+	FxpReaddir  = 12
+	FxpRemove   = 13
+	FxpMkdir    = 14
+	FxpRmdir    = 15
+	FxpRealpath = 16
+	FxpStat     = 17
+	FxpStatus   = 101
+	FxpHandle   = 102
+	FxpData     = 103
+	FxpName     = 104
+	FxpAttrs    = 105
+)
+
+// The pflags of SSH_FXP_OPEN.
+const (
+	FxfRead   = 0x01
+	FxfWrite  = 0x02
+	FxfAppend = 0x04
+	FxfCreat  = 0x08
+	FxfTrunc  = 0x10
+	FxfExcl   = 0x20
+)
+
+// The status codes.
+const (
+	FxOK               = 0
+	FxEOF              = 1
+	FxNoSuchFile       = 2
+	FxPermissionDenied = 3
+	FxFailure          = 4
+	FxBadMessage       = 5
+	FxOpUnsupported    = 8
+)
+
+// The flags of ATTRS.
+const (
+	AttrSize        = 0x01
+	AttrUIDGID      = 0x02
+	AttrPermissions = 0x04
+	AttrACModTime   = 0x08
+	AttrExtended    = 0x80000000
+)
+
+// The file types of the permissions, as POSIX.
+const (
+	ModeType    = 0170000
+	ModeDir     = 0040000
+	ModeRegular = 0100000
+	ModeSymlink = 0120000
+)
+
+// MaxPacket bounds the packets read. 34000 is the least of the servers must
+// accept, the reads are of 32KB.
+const MaxPacket = 256 * 1024
+
+var ErrShortPacket = errors.New("sftp: short packet")
+
+// Attrs is ATTRS, the fields of Flags.
+type Attrs struct {
+	Flags uint32
+	Size  uint64
+	UID   uint32
+	GID   uint32
+	// Perm is of POSIX, the file type included.
+	Perm  uint32
+	Atime uint32
+	Mtime uint32
+}
+
+// FileMode converts the POSIX permissions.
+func (a *Attrs) FileMode() fs.FileMode {
+	mode := fs.FileMode(a.Perm & 0777)
+	if a.Perm&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if a.Perm&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if a.Perm&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+
+	switch a.Perm & ModeType {
+	case ModeDir:
+		mode |= fs.ModeDir
+	case ModeSymlink:
+		mode |= fs.ModeSymlink
+	case ModeRegular, 0:
+	default:
+		mode |= fs.ModeIrregular
+	}
+	return mode
+}
+
+// PosixPerm converts the permission bits of mode to POSIX, no file type.
+func PosixPerm(mode fs.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm |= 01000
+	}
+	return perm
+}
+
+// Buffer builds a packet. The methods append the data types of the
+// protocol, named after them.
+type Buffer struct {
+	b []byte
+}
+
+// NewBuffer returns an empty packet, SSH_FXP_INIT and SSH_FXP_VERSION having
+// no request id.
+func NewBuffer() *Buffer {
+	return &Buffer{b: make([]byte, 4, 64)}
+}
+
+// NewPacket returns a packet of typ and the request id.
+func NewPacket(typ byte, id uint32) *Buffer {
+	// The length is filled by Bytes.
+	b := NewBuffer()
+	b.Byte(typ)
+	b.Uint32(id)
+	return b
+}
+
+func (b *Buffer) Byte(v byte) {
+	b.b = append(b.b, v)
+}
+
+func (b *Buffer) Uint32(v uint32) {
+	b.b = binary.BigEndian.AppendUint32(b.b, v)
+}
+
+func (b *Buffer) Uint64(v uint64) {
+	b.b = binary.BigEndian.AppendUint64(b.b, v)
+}
+
+func (b *Buffer) String(s []byte) {
+	b.Uint32(uint32(len(s)))
+	b.b = append(b.b, s...)
+}
+
+func (b *Buffer) Attrs(a *Attrs) {
+	b.Uint32(a.Flags &^ AttrExtended)
+	if a.Flags&AttrSize != 0 {
+		b.Uint64(a.Size)
+	}
+	if a.Flags&AttrUIDGID != 0 {
+		b.Uint32(a.UID)
+		b.Uint32(a.GID)
+	}
+	if a.Flags&AttrPermissions != 0 {
+		b.Uint32(a.Perm)
+	}
+	if a.Flags&AttrACModTime != 0 {
+		b.Uint32(a.Atime)
+		b.Uint32(a.Mtime)
+	}
+}
+
+// Bytes returns the packet with the length.
+func (b *Buffer) Bytes() []byte {
+	binary.BigEndian.PutUint32(b.b, uint32(len(b.b)-4))
+	return b.b
+}
+
+// Reader parses a packet. The first error sticks, checked by Err once read.
+type Reader struct {
+	b   []byte
+	err error
+}
+
+func NewReader(b []byte) *Reader {
+	return &Reader{b: b}
+}
+
+// Err returns the first error.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Rest returns the data not read yet.
+func (r *Reader) Rest() []byte {
+	return r.b
+}
+
+func (r *Reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = ErrShortPacket
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *Reader) Byte() byte {
+	if v := r.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *Reader) Uint32() uint32 {
+	if v := r.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *Reader) Uint64() uint64 {
+	if v := r.take(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (r *Reader) String() []byte {
+	n := r.Uint32()
+	if int(n) > len(r.b) {
+		r.err = ErrShortPacket
+		return nil
+	}
+	return r.take(int(n))
+}
+
+func (r *Reader) Attrs() Attrs {
+	var a Attrs
+	a.Flags = r.Uint32()
+	if a.Flags&AttrSize != 0 {
+		a.Size = r.Uint64()
+	}
+	if a.Flags&AttrUIDGID != 0 {
+		a.UID = r.Uint32()
+		a.GID = r.Uint32()
+	}
+	if a.Flags&AttrPermissions != 0 {
+		a.Perm = r.Uint32()
+	}
+	if a.Flags&AttrACModTime != 0 {
+		a.Atime = r.Uint32()
+		a.Mtime = r.Uint32()
+	}
+	if a.Flags&AttrExtended != 0 {
+		for n := r.Uint32(); n > 0 && r.err == nil; n-- {
+			r.String()
+			r.String()
+		}
+	}
+	return a
+}
+
+// ReadPacket reads a packet, the type and the rest.
+func ReadPacket(rd io.Reader) (byte, []byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(rd, l[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n == 0 || n > MaxPacket {
+		return 0, nil, fmt.Errorf("sftp: bad packet length %d", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rd, b); err != nil {
+		return 0, nil, err
+	}
+	return b[0], b[1:], nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ysuzuki-bysystems/myssh/knownhosts"
+)
+
+// weakHostKeyAlgorithms are the key types of known_hosts worth replacing.
+var weakHostKeyAlgorithms = []string{ssh.KeyAlgoRSA, ssh.KeyAlgoDSA}
+
+type knownHostsProblem struct {
+	line int
+	msg  string
+}
+
+// checkKnownHosts reports the lines failed to parse, the duplicates and the
+// weak keys of a known_hosts file.
+func checkKnownHosts(r io.Reader) ([]knownHostsProblem, error) {
+	var problems []knownHostsProblem
+
+	seen := map[string]int{}
+	for ent, err := range knownhosts.Parse(r) {
+		var perr *knownhosts.ParseError
+		if errors.As(err, &perr) {
+			problems = append(problems, knownHostsProblem{perr.Line, perr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, host := range ent.Hosts {
+			if !strings.HasPrefix(host, "|") {
+				host = strings.ToLower(host)
+			}
+			key := ent.Marker + " " + host + " " + string(ent.Key.Marshal())
+			if line, ok := seen[key]; ok {
+				problems = append(problems, knownHostsProblem{ent.Line, fmt.Sprintf("Duplicate of line %d: %s", line, host)})
+				continue
+			}
+			seen[key] = ent.Line
+		}
+
+		for _, alg := range weakHostKeyAlgorithms {
+			if ent.Key.Type() == alg {
+				problems = append(problems, knownHostsProblem{ent.Line, fmt.Sprintf("Weak key algorithm: %s", alg)})
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+// knownHostsMain runs "known-hosts check" over the known_hosts files
+// configured for the host, and returns the exit status.
+func knownHostsMain(name string, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet(name+" known-hosts check", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s known-hosts check [options] [host]\n\nOptions:\n", name)
+		fs.PrintDefaults()
+	}
+
+	cfgloc := fs.String("config", "", "ssh_config")
+	removeHost := fs.String("remove-host", "", "Remove the entries of the host ([host]:port for other than 22)")
+
+	if len(args) == 0 || args[0] != "check" {
+		fs.Usage()
+		return 2
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	// The files of "Host *" unless a host is given.
+	host := fs.Arg(0)
+	if host == "" {
+		host = "*"
+	}
+	cfg, err := loadConfig(host, *cfgloc, nil)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	status := 0
+	for _, path := range []string{cfg.userKnownHosts, cfg.globalKnownHosts} {
+		if path == "" {
+			continue
+		}
+
+		if *removeHost != "" {
+			n, err := knownhosts.Remove(path, removeHostAddress(*removeHost))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+				status = 1
+				continue
+			}
+			if n > 0 {
+				fmt.Fprintf(stdout, "%s: Removed %d entries of %s (original kept as %s.old)\n", path, n, *removeHost, path)
+			}
+			continue
+		}
+
+		problems, err := checkKnownHostsFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			status = 1
+			continue
+		}
+		for _, p := range problems {
+			fmt.Fprintf(stdout, "%s:%d: %s\n", path, p.line, p.msg)
+			status = 1
+		}
+	}
+
+	return status
+}
+
+func checkKnownHostsFile(path string) ([]knownHostsProblem, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return checkKnownHosts(fp)
+}
+
+// removeHostAddress returns the host:port of the host as written for
+// ssh-keygen -R, the host or [host]:port.
+func removeHostAddress(host string) string {
+	if strings.HasPrefix(host, "[") {
+		return host
+	}
+	return net.JoinHostPort(host, knownhosts.DefaultPort)
+}
+
+// removeKnownHost removes opts.removeHost from the user known_hosts, like
+// ssh-keygen -R.
+func (opts *options) removeKnownHost(stdout io.Writer) error {
+	host := opts.removeHost
+	if h, _, err := net.SplitHostPort(host); err == nil && strings.HasPrefix(host, "[") {
+		host = h
+	}
+	cfg, err := opts.loadConfig(host)
+	if err != nil {
+		return err
+	}
+
+	n, err := knownhosts.Remove(cfg.userKnownHosts, removeHostAddress(opts.removeHost))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("Host %s not found in %s.", opts.removeHost, cfg.userKnownHosts)
+	}
+
+	fmt.Fprintf(stdout, "%s updated.\nOriginal contents retained as %s.old\n", cfg.userKnownHosts, cfg.userKnownHosts)
+	return nil
+}
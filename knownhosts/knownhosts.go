@@ -0,0 +1,299 @@
+// Package knownhosts reads and writes the OpenSSH known_hosts files.
+package knownhosts
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// REF https://man.openbsd.org/sshd.8#SSH_KNOWN_HOSTS_FILE_FORMAT
+
+// DefaultPort is the port written without brackets.
+const DefaultPort = "22"
+
+const (
+	MarkerCertAuthority = "cert-authority"
+	MarkerRevoked       = "revoked"
+)
+
+const hashMagic = "|1|"
+
+// Entry is a line of known_hosts.
+type Entry struct {
+	// Line is the line number, from 1.
+	Line int
+	// Marker is MarkerCertAuthority, MarkerRevoked or empty.
+	Marker  string
+	Hosts   []string
+	Key     ssh.PublicKey
+	Comment string
+}
+
+// ParseError is a line failed to parse.
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("Line %d: %s", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Parse iterates over the entries of r. The lines failed to parse are yielded
+// as *ParseError and the iteration goes on.
+func Parse(r io.Reader) iter.Seq2[*Entry, error] {
+	return func(yield func(*Entry, error) bool) {
+		s := bufio.NewScanner(r)
+		s.Buffer(nil, 1024*1024)
+
+		n := 0
+		for s.Scan() {
+			n++
+
+			marker, hosts, key, comment, _, err := ssh.ParseKnownHosts(s.Bytes())
+			if errors.Is(err, io.EOF) {
+				// Empty or a comment.
+				continue
+			}
+			if err != nil {
+				if !yield(nil, &ParseError{n, err}) {
+					return
+				}
+				continue
+			}
+
+			ent := &Entry{
+				Line:    n,
+				Marker:  marker,
+				Hosts:   hosts,
+				Key:     key,
+				Comment: comment,
+			}
+			if !yield(ent, nil) {
+				return
+			}
+		}
+
+		if err := s.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// Normalize returns the known_hosts form of address, host:port as for
+// ssh.HostKeyCallback. It is the bare host on DefaultPort, and [host]:port
+// otherwise.
+func Normalize(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return strings.ToLower(address)
+	}
+	host = strings.ToLower(host)
+	if port == DefaultPort {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// Match reports whether the entry is for name, the normalized address. The
+// patterns may be hashed, have wildcards and be negated with "!".
+// REF https://github.com/openssh/openssh-portable/blob/V_9_9_P1/match.c (match_hostname)
+func (e *Entry) Match(name string) bool {
+	matched := false
+	for _, pattern := range e.Hosts {
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+
+		if !matchHost(pattern, name) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+func matchHost(pattern, name string) bool {
+	if strings.HasPrefix(pattern, hashMagic) {
+		return matchHashed(pattern, name)
+	}
+	return matchWildcard(strings.ToLower(pattern), name)
+}
+
+// matchHashed matches |1|base64(salt)|base64(HMAC-SHA1(salt, name)).
+// REF https://github.com/openssh/openssh-portable/blob/V_9_9_P1/hostfile.c (host_hash)
+func matchHashed(pattern, name string) bool {
+	salt64, hash64, ok := strings.Cut(pattern[len(hashMagic):], "|")
+	if !ok {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(hash64)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// matchWildcard matches "*" for any run and "?" for a character. Unlike
+// path.Match, "[" is an ordinary character, as in [host]:port.
+func matchWildcard(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchWildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// Lookup returns the entries of the file for address, host:port as for
+// ssh.HostKeyCallback.
+func Lookup(path, address string) ([]*Entry, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	name := Normalize(address)
+
+	var entries []*Entry
+	for ent, err := range Parse(fp) {
+		if err != nil {
+			return nil, err
+		}
+		if ent.Match(name) {
+			entries = append(entries, ent)
+		}
+	}
+	return entries, nil
+}
+
+// Line returns the known_hosts line of key for the addresses, without the
+// trailing newline.
+func Line(addresses []string, key ssh.PublicKey) string {
+	names := make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		names = append(names, Normalize(a))
+	}
+
+	return strings.Join(names, ",") + " " + string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key)))
+}
+
+// Add appends the line of key for the addresses to the file, creating it.
+func Add(path string, addresses []string, key ssh.PublicKey) error {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintln(fp, Line(addresses, key)); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// Remove deletes the lines for address from the file, like ssh-keygen -R,
+// and returns their number. The original is kept as path.old.
+func Remove(path, address string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	name := Normalize(address)
+	remove := map[int]bool{}
+	for ent, err := range Parse(bytes.NewReader(b)) {
+		if err != nil {
+			// The lines failed to parse are kept as is.
+			continue
+		}
+		if ent.Match(name) {
+			remove[ent.Line] = true
+		}
+	}
+	if len(remove) == 0 {
+		return 0, nil
+	}
+
+	var out []byte
+	for i, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if !remove[i+1] {
+			out = append(out, line...)
+		}
+	}
+
+	if err := os.WriteFile(path+".old", b, info.Mode().Perm()); err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+
+	return len(remove), nil
+}
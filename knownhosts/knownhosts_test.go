@@ -0,0 +1,209 @@
+package knownhosts
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	xknownhosts "golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writeFile(t *testing.T, lines ...string) string {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(p, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"example.com:22":   "example.com",
+		"Example.COM:22":   "example.com",
+		"example.com:2222": "[example.com]:2222",
+		"[2001:db8::1]:22": "2001:db8::1",
+		"[2001:db8::1]:23": "[2001:db8::1]:23",
+		"example.com":      "example.com",
+	}
+	for in, want := range tests {
+		if got := Normalize(in); got != want {
+			t.Errorf("%s: %s", in, got)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts []string
+		addr  string
+		want  bool
+	}{
+		{"plain", []string{"example.com"}, "example.com:22", true},
+		{"plain other", []string{"example.com"}, "example.org:22", false},
+		{"plain port", []string{"[example.com]:2222"}, "example.com:2222", true},
+		{"plain wrong port", []string{"example.com"}, "example.com:2222", false},
+		{"case", []string{"EXAMPLE.com"}, "example.COM:22", true},
+		{"list", []string{"a.example.com", "example.com"}, "example.com:22", true},
+		{"hashed", []string{xknownhosts.HashHostname("example.com")}, "example.com:22", true},
+		{"hashed other", []string{xknownhosts.HashHostname("example.com")}, "example.org:22", false},
+		{"hashed port", []string{xknownhosts.HashHostname("[example.com]:2222")}, "example.com:2222", true},
+		{"star", []string{"*.example.com"}, "www.example.com:22", true},
+		{"star apex", []string{"*.example.com"}, "example.com:22", false},
+		{"question", []string{"192.0.2.?"}, "192.0.2.7:22", true},
+		{"question two", []string{"192.0.2.?"}, "192.0.2.17:22", false},
+		{"star port", []string{"[*.example.com]:2222"}, "www.example.com:2222", true},
+		{"negated", []string{"*.example.com", "!bad.example.com"}, "bad.example.com:22", false},
+		{"negated order", []string{"!bad.example.com", "*.example.com"}, "bad.example.com:22", false},
+		{"negated only", []string{"!bad.example.com"}, "good.example.com:22", false},
+	}
+
+	for _, tt := range tests {
+		ent := &Entry{Hosts: tt.hosts}
+		if got := ent.Match(Normalize(tt.addr)); got != tt.want {
+			t.Errorf("%s: %v", tt.name, got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	host, ca := newKey(t), newKey(t)
+	p := writeFile(t,
+		"# comment",
+		"",
+		"example.com "+authorizedKey(host)+" my comment",
+		"not a key line",
+		"@cert-authority *.example.com "+authorizedKey(ca),
+		"@revoked revoked.example.com "+authorizedKey(host),
+	)
+
+	fp, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	var entries []*Entry
+	var errs []error
+	for ent, err := range Parse(fp) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		entries = append(entries, ent)
+	}
+
+	var perr *ParseError
+	if len(errs) != 1 || !errors.As(errs[0], &perr) || perr.Line != 4 {
+		t.Fatalf("%v", errs)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("%d", len(entries))
+	}
+
+	if ent := entries[0]; ent.Line != 3 || ent.Marker != "" || ent.Comment != "my comment" || ent.Key.Type() != ssh.KeyAlgoED25519 {
+		t.Errorf("%+v", ent)
+	}
+
+	if ent := entries[1]; ent.Line != 5 || ent.Marker != MarkerCertAuthority || !ent.Match("www.example.com") {
+		t.Errorf("%+v", ent)
+	}
+	if string(entries[1].Key.Marshal()) != string(ca.Marshal()) {
+		t.Error("cert-authority key")
+	}
+
+	if ent := entries[2]; ent.Line != 6 || ent.Marker != MarkerRevoked {
+		t.Errorf("%+v", ent)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	key, other := newKey(t), newKey(t)
+	p := writeFile(t,
+		"example.com "+authorizedKey(key),
+		xknownhosts.HashHostname("[example.com]:2222")+" "+authorizedKey(other),
+		"@cert-authority *.example.com "+authorizedKey(other),
+	)
+
+	entries, err := Lookup(p, "example.com:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Line != 1 {
+		t.Fatalf("%+v", entries)
+	}
+
+	entries, err = Lookup(p, "example.com:2222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Line != 2 {
+		t.Fatalf("%+v", entries)
+	}
+
+	entries, err = Lookup(p, "www.example.com:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Marker != MarkerCertAuthority {
+		t.Fatalf("%+v", entries)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	key := newKey(t)
+	p := filepath.Join(t.TempDir(), "known_hosts")
+
+	if err := Add(p, []string{"example.com:2222", "192.0.2.1:2222"}, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := Add(p, []string{"example.org:22"}, key); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[example.com]:2222,[192.0.2.1]:2222 " + authorizedKey(key) + "\n" +
+		"example.org " + authorizedKey(key) + "\n"
+	if string(b) != want {
+		t.Fatalf("%q", b)
+	}
+
+	// Readable by x/crypto as well.
+	cb, err := xknownhosts.New(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb("example.com:2222", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2222}, key); err != nil {
+		t.Fatal(err)
+	}
+}
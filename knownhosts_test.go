@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestCheckKnownHosts(t *testing.T) {
+	key := newHostKey(t).PublicKey()
+	other := newHostKey(t).PublicKey()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	known := strings.Join([]string{
+		knownhosts.Line([]string{"a.example.com"}, key),
+		knownhosts.Line([]string{"b.example.com"}, key),
+		knownhosts.Line([]string{"c.example.com", "A.example.com"}, key),
+		knownhosts.Line([]string{"a.example.com"}, other),
+		"@revoked " + knownhosts.Line([]string{"a.example.com"}, key),
+		"d.example.com ssh-ed25519 !!!",
+		knownhosts.Line([]string{"e.example.com"}, rsaKey),
+	}, "\n")
+
+	problems, err := checkKnownHosts(strings.NewReader(known))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(problems) != 3 {
+		t.Fatalf("%+v", problems)
+	}
+	if p := problems[0]; p.line != 3 || p.msg != "Duplicate of line 1: a.example.com" {
+		t.Errorf("%+v", p)
+	}
+	if p := problems[1]; p.line != 6 {
+		t.Errorf("%+v", p)
+	}
+	if p := problems[2]; p.line != 7 || p.msg != "Weak key algorithm: ssh-rsa" {
+		t.Errorf("%+v", p)
+	}
+}
+
+func TestKnownHostsRemoveHost(t *testing.T) {
+	key := newHostKey(t).PublicKey()
+
+	dir := t.TempDir()
+	known := filepath.Join(dir, "known_hosts")
+	lines := []string{
+		knownhosts.Line([]string{"a.example.com"}, key),
+		knownhosts.Line([]string{knownhosts.HashHostname("a.example.com")}, key),
+		knownhosts.Line([]string{"[a.example.com]:2222"}, key),
+		knownhosts.Line([]string{"b.example.com"}, key),
+	}
+	if err := os.WriteFile(known, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfgfile := filepath.Join(dir, "config")
+	if err := os.WriteFile(cfgfile, []byte("UserKnownHostsFile "+known+"\nGlobalKnownHostsFile "+filepath.Join(dir, "none")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if status := knownHostsMain("myssh", []string{"check", "-config", cfgfile, "-remove-host", "a.example.com"}, &stdout, &stderr); status != 0 {
+		t.Fatalf("%d %s", status, stderr.String())
+	}
+
+	b, err := os.ReadFile(known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := lines[2] + "\n" + lines[3] + "\n"; string(b) != want {
+		t.Fatalf("%q", b)
+	}
+
+	if _, err := os.Stat(known + ".old"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Now clean.
+	stdout.Reset()
+	if status := knownHostsMain("myssh", []string{"check", "-config", cfgfile}, &stdout, &stderr); status != 0 {
+		t.Fatalf("%d %s %s", status, stdout.String(), stderr.String())
+	}
+}
+
+func TestRemoveKnownHost(t *testing.T) {
+	key := newHostKey(t).PublicKey()
+
+	dir := t.TempDir()
+	known := filepath.Join(dir, "known_hosts")
+	lines := []string{
+		"# kept",
+		knownhosts.Line([]string{"a.example.com"}, key),
+		"",
+		knownhosts.Line([]string{knownhosts.HashHostname("a.example.com")}, key) + " hashed",
+		knownhosts.Line([]string{"b.example.com"}, key),
+	}
+	if err := os.WriteFile(known, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfgfile := filepath.Join(dir, "config")
+	if err := os.WriteFile(cfgfile, []byte("UserKnownHostsFile "+known+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	opts, err := parseArgs("myssh", []string{"-config", cfgfile, "--remove-known-host", "a.example.com"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.removeKnownHost(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# kept\n\n" + lines[4] + "\n"; string(b) != want {
+		t.Fatalf("%q", b)
+	}
+
+	if err := opts.removeKnownHost(&out); err == nil {
+		t.Fatal("removed twice")
+	}
+}
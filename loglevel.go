@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ssh_config LogLevel, from the least.
+const (
+	logQuiet = iota
+	logFatal
+	logError
+	logInfo
+	logVerbose
+	logDebug
+	logDebug2
+	logDebug3
+)
+
+var logLevels = map[string]int{
+	"QUIET":   logQuiet,
+	"FATAL":   logFatal,
+	"ERROR":   logError,
+	"INFO":    logInfo,
+	"VERBOSE": logVerbose,
+	"DEBUG":   logDebug,
+	"DEBUG1":  logDebug,
+	"DEBUG2":  logDebug2,
+	"DEBUG3":  logDebug3,
+}
+
+func parseLogLevel(s string) (int, error) {
+	level, ok := logLevels[strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("Unsupported LogLevel: %s", s)
+	}
+	return level, nil
+}
+
+// logf returns the logger of level, nil (discarded) when cfg.logLevel is
+// below it.
+func (cfg *config) logf(level int) func(format string, args ...any) {
+	if cfg.logLevel < level {
+		return nil
+	}
+	return log.Printf
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"QUIET", logQuiet},
+		{"quiet", logQuiet},
+		{"INFO", logInfo},
+		{"VERBOSE", logVerbose},
+		{"DEBUG1", logDebug},
+		{"DEBUG2", logDebug2},
+		{"debug3", logDebug3},
+	}
+	for _, tt := range tests {
+		got, err := parseLogLevel(tt.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: %d", tt.s, got)
+		}
+	}
+
+	if _, err := parseLogLevel("LOUD"); err == nil {
+		t.Fatal("must fail")
+	}
+}
+
+func TestLogf(t *testing.T) {
+	// The tty failures, like restoring the terminal, are of debug.
+	if (&config{logLevel: logQuiet}).logf(logDebug) != nil {
+		t.Fatal("logged at QUIET")
+	}
+	if (&config{logLevel: logInfo}).logf(logDebug) != nil {
+		t.Fatal("logged at INFO")
+	}
+	if (&config{logLevel: logDebug}).logf(logDebug) == nil {
+		t.Fatal("not logged at DEBUG")
+	}
+}
+
+func TestQuietOption(t *testing.T) {
+	opts, err := parseArgs("myssh", []string{"-q", "-v", "-config", "/dev/null", "example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := opts.loadConfig(opts.host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.logLevel != logQuiet || cfg.verbose {
+		t.Fatalf("%d %v", cfg.logLevel, cfg.verbose)
+	}
+}
+
+func TestVerboseOption(t *testing.T) {
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"-v"}, logDebug},
+		{[]string{"-vv"}, logDebug2},
+		{[]string{"-v", "-v"}, logDebug2},
+		{[]string{"-vv", "-v"}, logDebug3},
+	}
+	for _, tt := range tests {
+		opts, err := parseArgs("myssh", append(tt.args, "-config", "/dev/null", "example.com"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := opts.loadConfig(opts.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.logLevel != tt.want || !cfg.verbose {
+			t.Errorf("%v: %d %v", tt.args, cfg.logLevel, cfg.verbose)
+		}
+	}
+}
@@ -1,121 +1,902 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/ysuzuki-bysystems/myssh/agent"
+	"github.com/ysuzuki-bysystems/myssh/forward"
 	"github.com/ysuzuki-bysystems/myssh/tty"
 	"github.com/ysuzuki-bysystems/myssh/x11"
 	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
 )
 
-func proc(cfg *config) error {
-	ag := agent.NewAgent()
+// proc runs the session, or the tunnel with -N, until it ends or ctx is done.
+// Once ctx is done, the cause of it is returned whatever the connection ended
+// with.
+func proc(ctx context.Context, cfg *config) error {
+	ag := agent.NewAgent(ctx)
 
-	client, err := dialSsh(cfg, ag)
+	var err error
+	if cfg.noCommand {
+		err = runTunnel(ctx, cfg, func(ctx context.Context) (*ssh.Client, error) {
+			return dialSsh(ctx, cfg, ag)
+		})
+	} else {
+		for {
+			err = session(ctx, cfg, ag)
+			if !errors.Is(err, errServerAliveTimeout) || !shouldReconnect(cfg, err) {
+				break
+			}
+			log.Printf("Connection to %s lost: %s. Reconnecting.", cfg.hostname, err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+// session connects and runs the session. It returns errServerAliveTimeout
+// when the server stops answering the keepalives.
+//
+// The session ends with the shutdown, on the exit of the remote or when ctx
+// is done, before the terminal is restored.
+func session(ctx context.Context, cfg *config, ag sshagent.ExtendedAgent) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	client, err := dialSsh(ctx, cfg, ag)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
+	sd := newShutdown(ctx, client, shutdownGrace)
+	defer sd.run()
+
+	forwards := append(startLocalForwards(sd.ctx, client, cfg), startRemoteForwards(sd.ctx, client, cfg)...)
+	for _, l := range forwards {
+		sd.listener(l)
+	}
+	var backgrounded atomic.Bool
+
+	var controlExited atomic.Bool
+	if m := startControl(cfg, client, func() {
+		controlExited.Store(true)
+		client.Close()
+	}); m != nil {
+		defer m.Close()
+	}
+
+	var aliveTimeout atomic.Bool
+	if cfg.serverAliveInterval > 0 {
+		go func() {
+			if err := keepalive(ctx, client, cfg.serverAliveInterval, cfg.serverAliveCountMax); errors.Is(err, errServerAliveTimeout) {
+				aliveTimeout.Store(true)
+				client.Close()
+			}
+		}()
+	}
+
+	if cfg.subsystem != "" {
+		return runSubsystem(client, cfg.subsystem, os.Stdin, os.Stdout, os.Stderr)
+	}
 
 	sess, err := client.NewSession()
 	if err != nil {
 		return err
 	}
-	defer sess.Close()
+	sd.closeFirst(sess)
 
 	if cfg.forwardX11 {
-		x11.ForwardX11(client, sess, cfg.x11Display, cfg.xAuthLocation)
+		if x11fwd := startX11(sd.ctx, client, sess, cfg, log.Printf); x11fwd != nil {
+			sd.drain(func() { x11fwd.Close() })
+			defer func() {
+				if cfg.verbose {
+					st := x11fwd.Stats()
+					log.Printf("X11 forwarding: %d accepted, %d rejected, %d auth failed, %d dial failed, %d bytes to / %d bytes from the display",
+						st.Accepted, st.Rejected, st.AuthFailed, st.DialFailed, st.BytesToDisplay, st.BytesFromDisplay)
+				}
+			}()
+		}
 	}
 	if cfg.forwardAgent {
-		agent.ForwardAgent(client, sess, ag)
+		if err := agent.ForwardAgent(sd.ctx, client, sess, ag); err != nil {
+			log.Printf("Warning: agent forwarding failed: %s", err)
+		}
 	}
+	sendEnv(sess, cfg.env, cfg.logf(logDebug))
 
-	sigwinchCh := make(chan interface{})
-	defer close(sigwinchCh)
+	stdinTerminal := tty.IsTerminal(os.Stdin.Fd())
+	pty, warn := wantPty(cfg.requestTTY, cfg.command != "", stdinTerminal)
+	if warn {
+		log.Printf("Pseudo-terminal will not be allocated because stdin is not a terminal.")
+	}
+	wiring := wireTty(pty, stdinTerminal, tty.IsTerminal(os.Stdout.Fd()))
+	// abnormal is the session ended with an error, a non-zero exit status
+	// or the connection lost.
+	var abnormal bool
 
-	t, err := tty.OpenTty(sigwinchCh)
-	if err != nil {
-		return err
+	sess.Stdout = os.Stdout
+	sess.Stderr = os.Stderr
+
+	termType := terminalType(cfg.term, os.Getenv)
+	if pty && cfg.verbose {
+		log.Printf("Requesting PTY with TERM=%s", termType)
 	}
-	defer t.Close()
 
-	go func() {
-		for range sigwinchCh {
-			m, err := t.Size()
-			if err != nil {
-				continue
+	if pty && !wiring.raw {
+		// Forced (-tt) without the local terminal for the input. No raw
+		// mode, the output is wired directly.
+		query := func() (tty.Winsize, error) {
+			return tty.Winsize{}, tty.ErrNotATerminal
+		}
+		if wiring.stdoutSize {
+			query = func() (tty.Winsize, error) {
+				w, h, err := term.GetSize(int(os.Stdout.Fd()))
+				return tty.Winsize{W: w, H: h}, err
 			}
+		}
+		size, err := terminalSize(query, cfg.termSize, os.Getenv)
+		if err != nil {
+			size = tty.Winsize{H: 24, W: 80}
+		}
 
-			sess.WindowChange(m.H, m.W)
+		ok, err := requestPty(sess, termType, size, overrideTerminalModes(ssh.TerminalModes{}, cfg.terminalModes))
+		if err != nil {
+			return err
 		}
-	}()
+		if !ok {
+			log.Printf("PTY allocation request failed")
+		}
+	} else if pty {
+		t, err := tty.OpenTty(&tty.Options{
+			Logf:            cfg.logf(logDebug),
+			ExitOnSignal:    true,
+			SignalExitDelay: signalExitDelay,
+		})
+		if err != nil {
+			return err
+		}
+		// Deferred calls run on a panic as well, so the terminal is restored
+		// before the panic is reported.
+		defer func() {
+			if t != nil {
+				// The remote program may have died leaving its modes, like
+				// the alternate screen. Not on the clean exits, no flicker.
+				if abnormal && cfg.terminalSanitize && !backgrounded.Load() {
+					if err := t.Sanitize(); err != nil {
+						log.Printf("Sanitizing the terminal: %s", err)
+					}
+				}
+				t.Close()
+			}
+		}()
+
+		size, err := terminalSize(t.Size, cfg.termSize, os.Getenv)
+		if err != nil {
+			return err
+		}
+
+		ok, err := requestPty(sess, termType, size, overrideTerminalModes(t.Modes(), cfg.terminalModes))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// Like ssh, go on without a PTY.
+			t.Close()
+			t = nil
+			log.Printf("PTY allocation request failed")
+		} else {
+			if cfg.mouse {
+				if err := t.EnableMouse(); err != nil {
+					log.Printf("Warning: mouse input disabled: %s", err)
+				}
+			}
+			if cfg.translateVT {
+				if err := t.TranslateOutput(); err != nil {
+					log.Printf("Warning: VT output translation disabled: %s", err)
+				}
+			}
+
+			go func() {
+				for size := range t.Resize() {
+					windowChange(sess, size)
+				}
+			}()
 
-	termmodes := ssh.TerminalModes{
-		ssh.ECHO:          1,
-		ssh.TTY_OP_ISPEED: 14400,
-		ssh.TTY_OP_OSPEED: 14400,
+			sess.Stdin = t
+			if cfg.escapeChar != noEscapeChar {
+				esc := byte(cfg.escapeChar)
+				commands := &escapeCommands{
+					terminate: func() {
+						fmt.Fprintf(t, "%s.\r\nConnection to %s closed.\r\n", formatEscapeChar(esc), cfg.hostname)
+						client.Close()
+					},
+					help: func() {
+						fmt.Fprintf(t, "%s?\r\n%s", formatEscapeChar(esc), escapeHelp(esc, canBackground))
+					},
+					sendBreak: func() {
+						fmt.Fprintf(t, "%sB\r\n", formatEscapeChar(esc))
+						// Not to block the input on the reply.
+						go func() {
+							ok, err := sendBreak(sess, cfg.breakLength)
+							switch {
+							case err != nil:
+								fmt.Fprintf(t, "BREAK failed: %s\r\n", err)
+							case !ok:
+								fmt.Fprintf(t, "BREAK not supported by the server.\r\n")
+							default:
+								fmt.Fprintf(t, "BREAK of %s acknowledged by the server.\r\n", cfg.breakLength)
+							}
+						}()
+					},
+				}
+				if canBackground {
+					commands.background = func() {
+						fmt.Fprintf(t, "%s& [backgrounded]\r\n", formatEscapeChar(esc))
+						backgrounded.Store(true)
+						background(t, forwards)
+					}
+				}
+				sess.Stdin = newEscapeReader(t, esc, commands.handle)
+			}
+			if wiring.ttyOutput {
+				sess.Stdout = t
+			}
+			// The remote PTY merges stderr into stdout. Without a PTY the
+			// streams stay separate, for `myssh host make 2>err.log`.
+			sess.Stderr = sess.Stdout
+		}
 	}
 
-	size, err := t.Size()
-	if err != nil {
-		return err
+	// The terminal is read by the session itself.
+	var stdin io.Reader
+	if sess.Stdin == nil {
+		stdin = os.Stdin
+	}
+	err = runSession(sess, cfg.command, stdin)
+	abnormal = err != nil
+	if backgrounded.Load() {
+		for _, l := range forwards {
+			l.Wait()
+		}
+	}
+	sd.run()
+	if controlExited.Load() {
+		return nil
+	}
+	if aliveTimeout.Load() {
+		return errServerAliveTimeout
 	}
+	return err
+}
 
-	if err := sess.RequestPty("xterm-256color", size.H, size.W, termmodes); err != nil {
-		return err
+// canBackground reports whether ~& is supported. Windows has no job control
+// to return the console to.
+const canBackground = runtime.GOOS != "windows"
+
+// background detaches from the terminal for ~&, like ssh: the terminal is
+// restored and the remote gets the EOF, the new forwarded connections are
+// refused, and the ones open are served until they finish. Unlike ssh, which
+// forks, the process stays the job of the shell. It survives the hangup of
+// the terminal, and ^Z then bg returns the prompt.
+// REF https://github.com/openssh/openssh-portable/blob/V_9_9_P1/clientloop.c (process_escapes)
+func background(t io.Closer, forwards []*forward.Listener) {
+	signal.Ignore(syscall.SIGHUP)
+
+	for _, l := range forwards {
+		l.Close()
 	}
 
-	sess.Stdin = t
-	sess.Stdout = t
-	sess.Stderr = sess.Stdout
+	if err := t.Close(); err != nil {
+		log.Print(err)
+	}
+}
 
-	if err := sess.Shell(); err != nil {
-		return err
+// runSession runs the command, or the shell when empty, and waits for it.
+// The EOF of stdin is sent to the remote as the channel EOF, while the output
+// goes on until it exits, like `cat cmds.txt | ssh host bash`.
+func runSession(sess *ssh.Session, command string, stdin io.Reader) error {
+	var w io.WriteCloser
+	if stdin != nil {
+		var err error
+		w, err = sess.StdinPipe()
+		if err != nil {
+			return err
+		}
 	}
 
-	if err := sess.Wait(); err != nil {
-		return err
+	if command != "" {
+		if err := sess.Start(command); err != nil {
+			return err
+		}
+	} else {
+		if err := sess.Shell(); err != nil {
+			return err
+		}
+	}
+
+	if w != nil {
+		go func() {
+			// The remote may exit without reading it all.
+			if _, err := io.Copy(w, stdin); err != nil && !errors.Is(err, io.EOF) {
+				log.Print(err)
+			}
+			w.Close()
+		}()
 	}
 
+	return sess.Wait()
+}
+
+// startX11 requests X11 forwarding. Like ssh, a failure is warned and the
+// session goes on without it.
+func startX11(ctx context.Context, client *ssh.Client, sess *ssh.Session, cfg *config, logf func(format string, args ...any)) x11.Forwarding {
+	x11opts := &x11.Options{
+		Display:        cfg.x11Display,
+		XAuthLocation:  cfg.xAuthLocation,
+		Trusted:        cfg.forwardX11Trusted,
+		Timeout:        cfg.forwardX11Timeout,
+		MaxConnections: cfg.x11MaxConnections,
+	}
+	if cfg.verbose {
+		x11opts.Logf = logf
+	}
+
+	x11fwd, err := x11.ForwardX11(ctx, client, sess, x11opts)
+	if err != nil {
+		logf("Warning: X11 forwarding disabled: %s", err)
+		return nil
+	}
+	return x11fwd
+}
+
+var ErrNoHost = errors.New("No host specified.")
+
+// countFlag is a boolean flag counting the occurrences, like -tt.
+type countFlag int
+
+func (c *countFlag) String() string {
+	if c == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*c))
+}
+
+func (c *countFlag) Set(string) error {
+	*c++
 	return nil
 }
 
-func main() {
-	var cfgloc string
-	var display string
-	var forwardX11 bool
-	var forwardAgent bool
+func (c *countFlag) IsBoolFlag() bool {
+	return true
+}
 
-	flag.StringVar(&cfgloc, "config", "", "ssh_config")
-	flag.StringVar(&display, "display", "", "X11 DISPLAY")
-	flag.BoolVar(&forwardX11, "X", false, "Forward X11")
-	flag.BoolVar(&forwardAgent, "A", false, "Forward Agent")
-	flag.Parse()
+type options struct {
+	cfgloc        string
+	display       string
+	escapeChar    string
+	forwardX11    bool
+	trustedX11    bool
+	forwardAgent  bool
+	noAgent       bool
+	httpProxy     string
+	bindAddress   string
+	inet          bool
+	inet6         bool
+	tag           string
+	termSize      string
+	noCommand     bool
+	reconnect     bool
+	verbose       countFlag
+	quiet         bool
+	subsystem     bool
+	localForward  []string
+	remoteForward []string
+	hosts         []string
+	mouse         bool
+	translateVT   bool
+	forceTty      countFlag
+	noTty         bool
+	script        string
+	term          string
+	x11MaxConns   int
+	removeHost    string
+	control       string
+	master        bool
+	sshOptions    []string
+	envFile       string
+	kexDebug      bool
+
+	user    string
+	host    string
+	command []string
+}
 
-	host := flag.Arg(0)
-	if host == "" {
-		log.Fatal("No host")
+func parseArgs(name string, args []string, output io.Writer) (*options, error) {
+	var opts options
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [options] host [command]\n       %s [options] --hosts host,... command\n       %s known-hosts check [options] [host]\n       %s cp [options] source... target\n       %s ping [options] host\n\nOptions:\n", name, name, name, name, name)
+		fs.PrintDefaults()
 	}
 
-	cfg, err := loadConfig(host, cfgloc)
+	fs.StringVar(&opts.cfgloc, "config", "", "ssh_config")
+	fs.StringVar(&opts.display, "display", "", "X11 DISPLAY")
+	fs.StringVar(&opts.escapeChar, "e", "", "Escape character (\"none\" to disable)")
+	fs.BoolVar(&opts.forwardX11, "X", false, "Forward X11")
+	fs.BoolVar(&opts.trustedX11, "Y", false, "Forward X11 (trusted)")
+	fs.IntVar(&opts.x11MaxConns, "x11-max-connections", 0, fmt.Sprintf("Maximum concurrent X11 connections (default %d, -1 for no limit)", x11.DefaultMaxConnections))
+	fs.BoolVar(&opts.forwardAgent, "A", false, "Forward Agent")
+	fs.BoolVar(&opts.noAgent, "no-agent", false, "Do not authenticate with the agent")
+	fs.StringVar(&opts.httpProxy, "http-proxy", "", "Connect through the HTTP proxy (http://[user:password@]host:port, HttpProxy), https_proxy by default")
+	fs.StringVar(&opts.bindAddress, "b", "", "Source address of the connection")
+	fs.BoolVar(&opts.inet, "4", false, "Use IPv4 addresses only (AddressFamily inet)")
+	fs.BoolVar(&opts.inet6, "6", false, "Use IPv6 addresses only (AddressFamily inet6)")
+	fs.StringVar(&opts.termSize, "term-size", "", "Terminal size (COLSxROWS) used when it cannot be determined")
+	fs.BoolVar(&opts.noCommand, "N", false, "Do not execute a remote command, forwarding only (SessionType none)")
+	fs.BoolVar(&opts.reconnect, "auto-reconnect", false, "Reconnect with -N when the connection is lost")
+	fs.BoolVar(&opts.subsystem, "s", false, "Request the subsystem named by the command, like sftp or netconf (SessionType subsystem)")
+	fs.Func("L", "Local forwarding ([bind:]port:host:hostport, [bind:]port:remote_socket, local_socket:remote_socket)", func(s string) error {
+		opts.localForward = append(opts.localForward, s)
+		return nil
+	})
+	fs.Func("R", "Remote forwarding ([bind:]port:host:hostport, remote_socket:local_socket, ...; [bind:]port alone for SOCKS, dialing from this side)", func(s string) error {
+		opts.remoteForward = append(opts.remoteForward, s)
+		return nil
+	})
+	fs.Var(&opts.forceTty, "t", "Force PTY allocation (-t -t even if stdin is not a terminal)")
+	fs.BoolFunc("tt", "Same as -t -t", func(string) error {
+		opts.forceTty += 2
+		return nil
+	})
+	fs.BoolVar(&opts.noTty, "T", false, "Disable PTY allocation")
+	fs.StringVar(&opts.term, "term", "", "TERM of the PTY (default: the local TERM)")
+	fs.StringVar(&opts.script, "script", "", "Read the remote command from the file")
+	fs.StringVar(&opts.envFile, "env-file", "", "Send the KEY=VALUE lines of the file as the environment, as far as the server accepts (AcceptEnv)")
+	fs.BoolVar(&opts.mouse, "mouse", false, "Forward the mouse input of the Windows console")
+	fs.BoolVar(&opts.translateVT, "translate-vt", false, "Translate the VT output with the console API, for the Windows consoles whose VT processing is broken")
+	fs.Var(&opts.verbose, "v", "Verbose mode (LogLevel DEBUG, -v -v for DEBUG2 with the handshake, -v -v -v for DEBUG3)")
+	fs.BoolFunc("vv", "Same as -v -v", func(string) error {
+		opts.verbose += 2
+		return nil
+	})
+	fs.BoolVar(&opts.kexDebug, "kex-debug", false, "Report the algorithms offered by the both sides and the ones chosen, also when the handshake fails")
+	fs.BoolVar(&opts.quiet, "q", false, "Quiet mode (LogLevel QUIET), no warnings nor diagnostics")
+	fs.StringVar(&opts.tag, "P", "", "Tag name for Match tagged")
+	fs.Func("o", "ssh_config keyword=value, like -o TerminalModes=ICANON=0", func(s string) error {
+		opts.sshOptions = append(opts.sshOptions, s)
+		return nil
+	})
+	fs.StringVar(&opts.control, "O", "", "Control the master of ControlPath (check, exit, stop, forward, cancel)")
+	fs.BoolVar(&opts.master, "M", false, "Serve the control commands on ControlPath (ControlMaster yes)")
+	fs.StringVar(&opts.removeHost, "remove-known-host", "", "Remove the host ([host]:port for other than 22) from the user known_hosts and exit")
+	fs.Func("hosts", "Run the command on the comma separated hosts, prefixing the output with the host name", func(s string) error {
+		for _, h := range strings.Split(s, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				opts.hosts = append(opts.hosts, h)
+			}
+		}
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if opts.removeHost != "" {
+		return &opts, nil
+	}
+
+	if len(opts.hosts) > 0 {
+		if fs.NArg() == 0 {
+			err := errors.New("No command specified.")
+			fmt.Fprintln(fs.Output(), err)
+			fs.Usage()
+			return nil, err
+		}
+		opts.command = fs.Args()
+		return &opts, nil
+	}
+
+	opts.user, opts.host = splitUserHost(fs.Arg(0))
+	if opts.host == "" {
+		fmt.Fprintln(fs.Output(), ErrNoHost)
+		fs.Usage()
+		return nil, ErrNoHost
+	}
+	opts.command = fs.Args()[1:]
+
+	return &opts, nil
+}
+
+// splitUserHost splits [user@]host, the user may have "@" in it.
+func splitUserHost(s string) (string, string) {
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return "", s
+}
+
+// remoteCommand returns the command of the arguments, or the content of the
+// script file.
+func (opts *options) remoteCommand() (string, error) {
+	command := strings.Join(opts.command, " ")
+	if opts.script == "" {
+		return command, nil
+	}
+
+	if command != "" {
+		return "", errors.New("Both a command and a script specified.")
+	}
+	b, err := os.ReadFile(opts.script)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+	return string(b), nil
+}
+
+// loadConfig loads the config for host, overridden by the options.
+func (opts *options) loadConfig(host string) (*config, error) {
+	cli := map[string]string{}
+	// The specific options take precedence.
+	for _, s := range opts.sshOptions {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok {
+			k, v, ok = strings.Cut(strings.TrimSpace(s), " ")
+		}
+		if !ok || k == "" {
+			return nil, fmt.Errorf("Bad -o option: %s", s)
+		}
+		cli[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	if opts.user != "" {
+		cli["User"] = opts.user
+	}
+	if opts.tag != "" {
+		cli["Tag"] = opts.tag
+	}
+	if opts.master {
+		cli["ControlMaster"] = "yes"
+	}
+	if opts.httpProxy != "" {
+		cli["HttpProxy"] = opts.httpProxy
+	}
+	switch {
+	case opts.subsystem && opts.noCommand:
+		return nil, errors.New("-s and -N cannot be combined.")
+	case opts.subsystem:
+		cli["SessionType"] = sessionTypeSubsystem
+	case opts.noCommand:
+		cli["SessionType"] = sessionTypeNone
+	}
+	switch {
+	case opts.inet && opts.inet6:
+		return nil, errors.New("-4 and -6 cannot be combined.")
+	case opts.inet:
+		cli["AddressFamily"] = addressFamilyInet
+	case opts.inet6:
+		cli["AddressFamily"] = addressFamilyInet6
+	}
+	switch {
+	case opts.quiet:
+		cli["LogLevel"] = "QUIET"
+	case opts.verbose > 2:
+		cli["LogLevel"] = "DEBUG3"
+	case opts.verbose == 2:
+		cli["LogLevel"] = "DEBUG2"
+	case opts.verbose == 1:
+		cli["LogLevel"] = "DEBUG"
+	}
+	switch {
+	case opts.noTty:
+		cli["RequestTTY"] = requestTTYNo
+	case opts.forceTty > 1:
+		cli["RequestTTY"] = requestTTYForce
+	case opts.forceTty == 1:
+		cli["RequestTTY"] = requestTTYYes
 	}
 
-	if display != "" {
-		cfg.x11Display = display
+	cfg, err := loadConfig(host, opts.cfgloc, cli)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.display != "" {
+		cfg.x11Display = opts.display
 		cfg.forwardX11 = true
 	}
-	if forwardX11 {
+	if opts.forwardX11 {
 		cfg.forwardX11 = true
 	}
-	if forwardAgent {
+	if opts.trustedX11 {
+		cfg.forwardX11 = true
+		cfg.forwardX11Trusted = true
+	}
+	if opts.forwardAgent {
 		cfg.forwardAgent = true
 	}
+	if opts.noAgent {
+		cfg.noAgent = true
+	}
+	cfg.kexDebug = opts.kexDebug
+	if opts.bindAddress != "" {
+		cfg.bindAddress = opts.bindAddress
+	}
+	if opts.escapeChar != "" {
+		esc, err := parseEscapeChar(opts.escapeChar)
+		if err != nil {
+			return nil, err
+		}
+		cfg.escapeChar = esc
+	}
+	if opts.termSize != "" {
+		if _, err := parseTermSize(opts.termSize); err != nil {
+			return nil, err
+		}
+		cfg.termSize = opts.termSize
+	}
+	for _, s := range opts.localForward {
+		s, err := percentExpand(s, cfg.tokens)
+		if err != nil {
+			return nil, err
+		}
+		spec, err := parseLocalForwardArg(s)
+		if err != nil {
+			return nil, err
+		}
+		cfg.localForwards = append(cfg.localForwards, spec)
+	}
+	for _, s := range opts.remoteForward {
+		s, err := percentExpand(s, cfg.tokens)
+		if err != nil {
+			return nil, err
+		}
+		// [bind_address:]port alone is the dynamic form.
+		spec, err := parseForwardArg(s)
+		if err != nil {
+			return nil, err
+		}
+		cfg.remoteForwards = append(cfg.remoteForwards, spec)
+	}
+	if cfg.sessionType == sessionTypeNone {
+		cfg.noCommand = true
+	}
+	if opts.reconnect {
+		cfg.autoReconnect = true
+	}
+	cfg.mouse = opts.mouse
+	cfg.translateVT = opts.translateVT
+	cfg.term = opts.term
+	cfg.x11MaxConnections = opts.x11MaxConns
+	if opts.envFile != "" {
+		if cfg.env, err = readEnvFile(opts.envFile); err != nil {
+			return nil, err
+		}
+	}
+	cfg.command, err = opts.remoteCommand()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.sessionType == sessionTypeSubsystem {
+		if cfg.command == "" {
+			return nil, errors.New("No subsystem specified.")
+		}
+		// The subsystem speaks its protocol on the raw streams, never on a
+		// PTY.
+		if opts.forceTty > 0 {
+			return nil, errors.New("-t cannot be combined with a subsystem.")
+		}
+		cfg.subsystem = cfg.command
+	}
 
-	if err := proc(cfg); err != nil {
+	return cfg, nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "known-hosts" {
+		os.Exit(knownHostsMain(os.Args[0], os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cp" {
+		os.Exit(cpMain(os.Args[0], os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ping" {
+		os.Exit(pingMain(os.Args[0], os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	opts, err := parseArgs(os.Args[0], os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+
+	if opts.removeHost != "" {
+		if err := opts.removeKnownHost(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if len(opts.hosts) > 0 {
+		command, err := opts.remoteCommand()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx := context.Background()
+		ag := agent.NewAgent(ctx)
+		os.Exit(fanout(opts.hosts, command, func(host string) (*ssh.Client, error) {
+			cfg, err := opts.loadConfig(host)
+			if err != nil {
+				return nil, err
+			}
+			return dialSsh(ctx, cfg, ag)
+		}, os.Stdout, os.Stderr))
+	}
+
+	cfg, err := opts.loadConfig(opts.host)
+	if err != nil {
 		log.Fatal(err)
 	}
+	if cfg.logLevel == logQuiet {
+		log.SetOutput(io.Discard)
+	}
+
+	if opts.control != "" {
+		if err := runControl(opts, cfg, os.Stderr); err != nil {
+			log.Print(err)
+			os.Exit(exitStatusConnectionFailed)
+		}
+		os.Exit(0)
+	}
+
+	// Ctrl-C aborts a slow connect, and shuts the session down without a
+	// PTY. In the raw mode it is sent to the remote as the byte. SIGTERM and
+	// SIGHUP shut it down as well, the terminal restored by the deferred
+	// Close, rather than by the exit of the tty after signalExitDelay.
+	ctx, stop := interruptContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	err = proc(ctx, cfg)
+	stop()
+
+	code, summary := exitStatus(err)
+	if summary != "" && cfg.logLevel != logQuiet {
+		fmt.Fprintln(os.Stderr, summary)
+	}
+	os.Exit(code)
+}
+
+// interruptedError is the cause of the shutdown on a local signal.
+type interruptedError struct {
+	signal syscall.Signal
+}
+
+func (e *interruptedError) Error() string {
+	for name, n := range signalNumbers {
+		if n == int(e.signal) {
+			return fmt.Sprintf("Interrupted by signal %d (SIG%s).", n, name)
+		}
+	}
+	return fmt.Sprintf("Interrupted by signal %d.", int(e.signal))
+}
+
+// interruptContext returns a context cancelled by the signals, with an
+// *interruptedError as the cause, until stop is called. stop leaves the
+// context as it is.
+func interruptContext(parent context.Context, sigs ...os.Signal) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+
+	caught := make(chan os.Signal, 1)
+	signal.Notify(caught, sigs...)
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-caught:
+			n, _ := sig.(syscall.Signal)
+			cancel(&interruptedError{signal: n})
+		case <-stopped:
+		}
+	}()
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			signal.Stop(caught)
+			close(stopped)
+		})
+	}
+}
+
+// exitStatus returns the exit status of myssh for the error of proc, and the
+// one line to report, if any: the status of the remote command, 128+N when
+// it or myssh is killed by a signal, or 255 when the connection failed.
+func exitStatus(err error) (int, string) {
+	if err == nil {
+		return 0, ""
+	}
+
+	var interrupted *interruptedError
+	if errors.As(err, &interrupted) {
+		return 128 + int(interrupted.signal), interrupted.Error()
+	}
+	if code, ok := remoteExitCode(err); ok {
+		msg, _ := remoteSignal(err)
+		return code, msg
+	}
+	return exitStatusConnectionFailed, err.Error()
+}
+
+// remoteExitCode returns the exit status of the remote command, passed
+// through as that of myssh like ssh.
+func remoteExitCode(err error) (int, bool) {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		if sig := exitErr.Signal(); sig != "" {
+			// Killed, 128+N like the shells.
+			if n, ok := signalNumbers[sig]; ok {
+				return 128 + n, true
+			}
+			return exitStatusConnectionFailed, true
+		}
+		return exitErr.ExitStatus(), true
+	}
+	var statusErr *exitStatusError
+	if errors.As(err, &statusErr) {
+		return int(statusErr.status), true
+	}
+	return 0, false
+}
+
+// signalNumbers are the numbers of the signal names of exit-signal, as on
+// Linux.
+// REF https://www.rfc-editor.org/rfc/rfc4254#section-6.10
+var signalNumbers = map[string]int{
+	"HUP":  1,
+	"INT":  2,
+	"QUIT": 3,
+	"ILL":  4,
+	"ABRT": 6,
+	"FPE":  8,
+	"KILL": 9,
+	"USR1": 10,
+	"SEGV": 11,
+	"USR2": 12,
+	"PIPE": 13,
+	"ALRM": 14,
+	"TERM": 15,
+}
+
+// remoteSignal returns the message of the remote command killed by a signal,
+// sent as exit-signal instead of exit-status.
+func remoteSignal(err error) (string, bool) {
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Signal() == "" {
+		return "", false
+	}
+
+	msg := fmt.Sprintf("Killed by signal %s.", exitErr.Signal())
+	if n, ok := signalNumbers[exitErr.Signal()]; ok {
+		msg = fmt.Sprintf("Killed by signal %d (SIG%s).", n, exitErr.Signal())
+	}
+	if exitErr.Msg() != "" {
+		msg += " " + exitErr.Msg()
+	}
+	return msg, true
 }
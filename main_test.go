@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ysuzuki-bysystems/myssh/x11"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseArgsNoHost(t *testing.T) {
+	var out bytes.Buffer
+
+	_, err := parseArgs("myssh", []string{"-A"}, &out)
+	if !errors.Is(err, ErrNoHost) {
+		t.Fatalf("%v", err)
+	}
+
+	if !strings.Contains(out.String(), "Usage: myssh [options] host [command]") {
+		t.Fatalf("%q", out.String())
+	}
+}
+
+func TestParseArgsCommand(t *testing.T) {
+	var out bytes.Buffer
+
+	opts, err := parseArgs("myssh", []string{"-X", "example.com", "ls", "-l"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.host != "example.com" || !opts.forwardX11 {
+		t.Fatalf("%#v", opts)
+	}
+	if !slices.Equal(opts.command, []string{"ls", "-l"}) {
+		t.Fatalf("%#v", opts.command)
+	}
+}
+
+func TestParseArgsUserAtHost(t *testing.T) {
+	var out bytes.Buffer
+
+	opts, err := parseArgs("myssh", []string{"alice@example.com"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.user != "alice" || opts.host != "example.com" {
+		t.Fatalf("%#v", opts)
+	}
+
+	opts, err = parseArgs("myssh", []string{"a@b@example.com"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.user != "a@b" || opts.host != "example.com" {
+		t.Fatalf("%#v", opts)
+	}
+}
+
+func TestParseArgsHosts(t *testing.T) {
+	var out bytes.Buffer
+
+	opts, err := parseArgs("myssh", []string{"--hosts", "h1, h2,,h3", "uptime", "-p"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(opts.hosts, "|") != "h1|h2|h3" || strings.Join(opts.command, " ") != "uptime -p" {
+		t.Fatalf("%#v", opts)
+	}
+
+	if _, err := parseArgs("myssh", []string{"--hosts", "h1,h2"}, &out); err == nil {
+		t.Fatal("must fail without a command")
+	}
+}
+
+func TestParseArgsRequestTTY(t *testing.T) {
+	tests := []struct {
+		args     []string
+		forceTty countFlag
+		noTty    bool
+	}{
+		{[]string{"host"}, 0, false},
+		{[]string{"-t", "host"}, 1, false},
+		{[]string{"-t", "-t", "host"}, 2, false},
+		{[]string{"-tt", "host"}, 2, false},
+		{[]string{"-T", "host"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		opts, err := parseArgs("myssh", tt.args, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.forceTty != tt.forceTty || opts.noTty != tt.noTty {
+			t.Errorf("%v: %d %v", tt.args, opts.forceTty, opts.noTty)
+		}
+	}
+}
+
+// shellServer runs exec requests with the local sh.
+func shellServer(t *testing.T) *testServer {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip(err)
+	}
+
+	return newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, func(conn *ssh.ServerConn, newch ssh.NewChannel) {
+		if newch.ChannelType() != "session" {
+			newch.Reject(ssh.UnknownChannelType, "")
+			return
+		}
+
+		ch, reqs, err := newch.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+
+		for req := range reqs {
+			if req.Type != "exec" {
+				req.Reply(false, nil)
+				continue
+			}
+
+			var msg struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			cmd := exec.Command("sh", "-c", msg.Command)
+			cmd.Stdin = ch
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+
+			var status uint32
+			if err := cmd.Run(); err != nil {
+				var exitErr *exec.ExitError
+				if !errors.As(err, &exitErr) {
+					t.Error(err)
+				}
+				status = uint32(exitErr.ExitCode())
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		}
+	})
+}
+
+func TestScriptCommand(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "provision.sh")
+	err := os.WriteFile(script, []byte(`greeting='hello "world"'
+echo "$greeting"
+for i in 1 2; do
+    echo "step $i"
+done
+exit 3
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	opts, err := parseArgs("myssh", []string{"-script", script, "host"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	command, err := opts.remoteCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := shellServer(t)
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	var stdout bytes.Buffer
+	sess.Stdout = &stdout
+	err = sess.Run(command)
+
+	if code, ok := remoteExitCode(err); !ok || code != 3 {
+		t.Fatalf("%v %d", err, code)
+	}
+	if got := stdout.String(); got != "hello \"world\"\nstep 1\nstep 2\n" {
+		t.Fatalf("%q", got)
+	}
+
+	opts, err = parseArgs("myssh", []string{"-script", script, "host", "uptime"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opts.remoteCommand(); err == nil {
+		t.Fatal("must fail with both a command and a script")
+	}
+}
+
+func TestRunSessionStdinEOF(t *testing.T) {
+	srv := shellServer(t)
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	var stdout bytes.Buffer
+	sess.Stdout = &stdout
+
+	// wc exits only on the EOF.
+	done := make(chan error)
+	go func() {
+		done <- runSession(sess, "wc -l", strings.NewReader("a\nb\nc\n"))
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The remote never saw the EOF.")
+	}
+
+	if got := strings.TrimSpace(stdout.String()); got != "3" {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestRunSessionStderr(t *testing.T) {
+	srv := shellServer(t)
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	var stdout, stderr bytes.Buffer
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+
+	if err := runSession(sess, "echo out; echo err >&2", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Fatalf("%q %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestRemoteExitSignal(t *testing.T) {
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, func(conn *ssh.ServerConn, newch ssh.NewChannel) {
+		ch, reqs, err := newch.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+
+		for req := range reqs {
+			req.Reply(req.Type == "exec", nil)
+			if req.Type != "exec" {
+				continue
+			}
+
+			ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+				Signal     string
+				CoreDumped bool
+				Error      string
+				Lang       string
+			}{"KILL", false, "oom", ""}))
+			return
+		}
+	})
+
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	err = sess.Run("sleep 100")
+	if code, ok := remoteExitCode(err); !ok || code != 128+9 {
+		t.Fatalf("%v %d", err, code)
+	}
+	if msg, ok := remoteSignal(err); !ok || msg != "Killed by signal 9 (SIGKILL). oom" {
+		t.Fatalf("%q", msg)
+	}
+
+	if _, ok := remoteSignal(&ssh.ExitMissingError{}); ok {
+		t.Fatal("not a signal")
+	}
+}
+
+func TestStartX11NoDisplay(t *testing.T) {
+	var logs []string
+	logf := func(format string, args ...any) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	cfg := &config{forwardX11: true, x11Display: ""}
+	if x11fwd := startX11(context.Background(), nil, nil, cfg, logf); x11fwd != nil {
+		t.Fatalf("%#v", x11fwd)
+	}
+
+	if len(logs) != 1 || logs[0] != "Warning: X11 forwarding disabled: X11 forwarding requested but DISPLAY not set." {
+		t.Fatalf("%q", logs)
+	}
+}
+
+func TestStartX11UntrustedNoXauth(t *testing.T) {
+	// The display's own cookie, not to be used by -X.
+	xauthfile := filepath.Join(t.TempDir(), "Xauthority")
+	err := x11.WriteXauthority(xauthfile, []*x11.XauthorityEntry{
+		{Family: x11.FamilyWild, Number: "0", Name: "MIT-MAGIC-COOKIE-1", Data: bytes.Repeat([]byte{0x42}, 16)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("XAUTHORITY", xauthfile)
+
+	reqTypes := make(chan string, 10)
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, func(conn *ssh.ServerConn, newch ssh.NewChannel) {
+		ch, reqs, err := newch.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+
+		for req := range reqs {
+			reqTypes <- req.Type
+			req.Reply(true, nil)
+		}
+	})
+
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	var logs []string
+	logf := func(format string, args ...any) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	cfg := &config{forwardX11: true, x11Display: ":0", xAuthLocation: "myssh-no-such-xauth"}
+	if x11fwd := startX11(context.Background(), client, sess, cfg, logf); x11fwd != nil {
+		x11fwd.Close()
+		t.Fatal("X11 forwarding must be disabled")
+	}
+	if len(logs) != 1 || !strings.HasPrefix(logs[0], "Warning: X11 forwarding disabled: Untrusted X11 forwarding setup failed: ") {
+		t.Fatalf("%q", logs)
+	}
+
+	// The requests are in order, no x11-req before the env.
+	if err := sess.Setenv("LANG", "C"); err != nil {
+		t.Fatal(err)
+	}
+	if typ := <-reqTypes; typ != "env" {
+		t.Fatal(typ)
+	}
+}
+
+func TestBadSshOption(t *testing.T) {
+	opts, err := parseArgs("myssh", []string{"-o", "=x", "example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opts.loadConfig(opts.host); err == nil {
+		t.Fatal("must fail")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ysuzuki-bysystems/myssh/agent"
+	"golang.org/x/crypto/ssh"
+)
+
+// keepaliveRTT sends a keepalive and returns the time until its reply, or
+// errServerAliveTimeout after timeout.
+func keepaliveRTT(conn ssh.Conn, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := conn.SendRequest(keepaliveRequest, true, nil)
+		reply <- err
+	}()
+
+	select {
+	case err := <-reply:
+		if err != nil {
+			return 0, err
+		}
+		return time.Since(start), nil
+	case <-time.After(timeout):
+		return 0, errServerAliveTimeout
+	}
+}
+
+// pingMain runs "ping", that connects and authenticates to the host, reports
+// the time of it and the round trips of the keepalives, and disconnects.
+// It returns the exit status.
+func pingMain(name string, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet(name+" ping", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ping [options] [user@]host\n\nOptions:\n", name)
+		fs.PrintDefaults()
+	}
+
+	var opts options
+	fs.StringVar(&opts.cfgloc, "config", "", "ssh_config")
+	fs.Func("o", "ssh_config keyword=value", func(s string) error {
+		opts.sshOptions = append(opts.sshOptions, s)
+		return nil
+	})
+	count := fs.Int("c", 3, "Number of the keepalives")
+	interval := fs.Duration("i", time.Second, "Interval of the keepalives")
+	timeout := fs.Duration("W", 10*time.Second, "Timeout of a keepalive")
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 1 || *count < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	opts.user, opts.host = splitUserHost(fs.Arg(0))
+	cfg, err := opts.loadConfig(opts.host)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	start := time.Now()
+	ctx := context.Background()
+	client, err := dialSsh(ctx, cfg, agent.NewAgent(ctx))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitStatusConnectionFailed
+	}
+	defer client.Close()
+	fmt.Fprintf(stdout, "Connected to %s (%s) in %s\n", opts.host, client.RemoteAddr(), roundDuration(time.Since(start)))
+
+	var minRTT, maxRTT, total time.Duration
+	for i := range *count {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+
+		rtt, err := keepaliveRTT(client, *timeout)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitStatusConnectionFailed
+		}
+		fmt.Fprintf(stdout, "keepalive seq=%d time=%s\n", i+1, roundDuration(rtt))
+
+		if i == 0 || rtt < minRTT {
+			minRTT = rtt
+		}
+		if rtt > maxRTT {
+			maxRTT = rtt
+		}
+		total += rtt
+	}
+	fmt.Fprintf(stdout, "rtt min/avg/max = %s/%s/%s\n", roundDuration(minRTT), roundDuration(total/time.Duration(*count)), roundDuration(maxRTT))
+
+	return 0
+}
+
+// roundDuration rounds d for the report, 1.234ms.
+func roundDuration(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/ysuzuki-bysystems/myssh/knownhosts"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPingMain(t *testing.T) {
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, nil)
+
+	_, port, _ := net.SplitHostPort(srv.addr)
+	knownHosts := writeKnownHosts(t, knownhosts.Line([]string{"[127.0.0.1]:" + port}, srv.hostKey.PublicKey()))
+	cfgfile := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(cfgfile, []byte(fmt.Sprintf("Host pinghost\n  Hostname 127.0.0.1\n  Port %s\n  UserKnownHostsFile %s\n  IdentityAgent none\n", port, knownHosts)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if status := pingMain("myssh", []string{"-config", cfgfile, "-c", "2", "-i", "10ms", "pinghost"}, &stdout, &stderr); status != 0 {
+		t.Fatalf("%d %s", status, stderr.String())
+	}
+
+	want := regexp.MustCompile(`^Connected to pinghost \(127\.0\.0\.1:\d+\) in \S+s
+keepalive seq=1 time=\S+s
+keepalive seq=2 time=\S+s
+rtt min/avg/max = \S+s/\S+s/\S+s
+$`)
+	if !want.Match(stdout.Bytes()) {
+		t.Errorf("%q", stdout.String())
+	}
+
+	stdout.Reset()
+	srv.unresponsive.Store(true)
+	if status := pingMain("myssh", []string{"-config", cfgfile, "-c", "1", "-W", "100ms", "pinghost"}, &stdout, &stderr); status != exitStatusConnectionFailed {
+		t.Errorf("unanswered: %d %q", status, stdout.String())
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The private key files of PuTTY, .ppk.
+// REF https://the.earth.li/~sgtatham/putty/0.81/htmldoc/AppendixC.html
+
+const ppkHeader = "PuTTY-User-Key-File-"
+
+var errPPKEncrypted = errors.New("Encrypted PuTTY keys are not supported, convert it with puttygen.")
+
+// isPPK reports whether b is a PuTTY key file, by the header.
+func isPPK(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(ppkHeader))
+}
+
+type ppkFile struct {
+	version    int
+	algorithm  string
+	encryption string
+	comment    string
+	public     []byte
+	private    []byte
+	mac        []byte
+}
+
+// ppkReader reads the "Name: value" lines of a key file in order.
+type ppkReader struct {
+	lines []string
+}
+
+func (r *ppkReader) field(name string) (string, error) {
+	if len(r.lines) == 0 {
+		return "", fmt.Errorf("PuTTY key: %s missing.", name)
+	}
+	k, v, ok := strings.Cut(r.lines[0], ": ")
+	if !ok || k != name {
+		return "", fmt.Errorf("PuTTY key: %s expected, got %q.", name, r.lines[0])
+	}
+	r.lines = r.lines[1:]
+	return v, nil
+}
+
+// blob reads the base64 lines counted by the field name.
+func (r *ppkReader) blob(name string) ([]byte, error) {
+	v, err := r.field(name)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > len(r.lines) {
+		return nil, fmt.Errorf("PuTTY key: bad %s: %s.", name, v)
+	}
+	s := strings.Join(r.lines[:n], "")
+	r.lines = r.lines[n:]
+	return base64.StdEncoding.DecodeString(s)
+}
+
+func readPPK(b []byte) (*ppkFile, error) {
+	r := &ppkReader{lines: strings.Split(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n")}
+
+	f := &ppkFile{}
+	header, algorithm, _ := strings.Cut(r.lines[0], ": ")
+	switch strings.TrimPrefix(header, ppkHeader) {
+	case "2":
+		f.version = 2
+	case "3":
+		f.version = 3
+	default:
+		return nil, fmt.Errorf("Unsupported PuTTY key: %s.", header)
+	}
+	f.algorithm = algorithm
+	r.lines = r.lines[1:]
+
+	var err error
+	if f.encryption, err = r.field("Encryption"); err != nil {
+		return nil, err
+	}
+	if f.encryption != "none" {
+		return nil, errPPKEncrypted
+	}
+	if f.comment, err = r.field("Comment"); err != nil {
+		return nil, err
+	}
+	if f.public, err = r.blob("Public-Lines"); err != nil {
+		return nil, err
+	}
+	if f.private, err = r.blob("Private-Lines"); err != nil {
+		return nil, err
+	}
+	mac, err := r.field("Private-MAC")
+	if err != nil {
+		return nil, err
+	}
+	if f.mac, err = hex.DecodeString(mac); err != nil {
+		return nil, fmt.Errorf("PuTTY key: bad Private-MAC: %s.", mac)
+	}
+
+	return f, nil
+}
+
+// verifyMAC checks the MAC of an unencrypted key, whose MAC key is derived
+// from the empty passphrase.
+func (f *ppkFile) verifyMAC() error {
+	var h hash.Hash
+	switch f.version {
+	case 2:
+		k := sha1.Sum([]byte("putty-private-key-file-mac-key"))
+		h = hmac.New(sha1.New, k[:])
+	default:
+		h = hmac.New(sha256.New, nil)
+	}
+	h.Write(ssh.Marshal(struct {
+		Algorithm  string
+		Encryption string
+		Comment    string
+		Public     []byte
+		Private    []byte
+	}{f.algorithm, f.encryption, f.comment, f.public, f.private}))
+
+	if !hmac.Equal(h.Sum(nil), f.mac) {
+		return errors.New("PuTTY key: MAC mismatch, the file is corrupted.")
+	}
+	return nil
+}
+
+// privateKey returns the key like ssh.ParseRawPrivateKey does.
+func (f *ppkFile) privateKey() (any, error) {
+	pub, err := ssh.ParsePublicKey(f.public)
+	if err != nil {
+		return nil, err
+	}
+	if pub.Type() != f.algorithm {
+		return nil, fmt.Errorf("PuTTY key: %s, but the public key is %s.", f.algorithm, pub.Type())
+	}
+	cpub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported PuTTY key: %s.", f.algorithm)
+	}
+
+	switch k := cpub.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		var priv struct {
+			D, P, Q, Iqmp *big.Int
+			Rest          []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(f.private, &priv); err != nil {
+			return nil, err
+		}
+		key := &rsa.PrivateKey{PublicKey: *k, D: priv.D, Primes: []*big.Int{priv.P, priv.Q}}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		return key, nil
+
+	case *dsa.PublicKey:
+		var priv struct {
+			X    *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(f.private, &priv); err != nil {
+			return nil, err
+		}
+		return &dsa.PrivateKey{PublicKey: *k, X: priv.X}, nil
+
+	case *ecdsa.PublicKey:
+		var priv struct {
+			D    *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(f.private, &priv); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PrivateKey{PublicKey: *k, D: priv.D}, nil
+
+	case ed25519.PublicKey:
+		// The seed as an mpint, read little-endian.
+		var priv struct {
+			Seed *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(f.private, &priv); err != nil {
+			return nil, err
+		}
+		if priv.Seed.Sign() < 0 || priv.Seed.BitLen() > 8*ed25519.SeedSize {
+			return nil, errors.New("PuTTY key: bad ed25519 key.")
+		}
+		seed := priv.Seed.FillBytes(make([]byte, ed25519.SeedSize))
+		slices.Reverse(seed)
+		key := ed25519.NewKeyFromSeed(seed)
+		if !k.Equal(key.Public()) {
+			return nil, errors.New("PuTTY key: the private key does not match the public key.")
+		}
+		return &key, nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported PuTTY key: %s.", f.algorithm)
+	}
+}
+
+// parsePPK returns the raw private key of an unencrypted PuTTY key file,
+// version 2 or 3.
+func parsePPK(b []byte) (any, error) {
+	f, err := readPPK(b)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.verifyMAC(); err != nil {
+		return nil, err
+	}
+	return f.privateKey()
+}
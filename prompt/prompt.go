@@ -0,0 +1,65 @@
+package prompt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/ysuzuki-bysystems/myssh/tty"
+)
+
+var ErrNotATerminal = errors.New("Not a terminal.")
+
+// openTerminal opens the controlling terminal, so that the prompts work with
+// stdin / stdout redirected, like ssh. Without one, stdin and stderr are used
+// if stdin is a terminal.
+func openTerminal() (*os.File, *os.File, io.Closer, error) {
+	if in, out, closer, err := tty.OpenConsole(); err == nil {
+		return in, out, closer, nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, nil, nil, ErrNotATerminal
+	}
+	return os.Stdin, os.Stderr, io.NopCloser(os.Stdin), nil
+}
+
+// Password prints msg and reads a line from the terminal without echo.
+func Password(msg string) (string, error) {
+	in, out, closer, err := openTerminal()
+	if err != nil {
+		return "", err
+	}
+	defer closer.Close()
+
+	fmt.Fprint(out, msg)
+	defer fmt.Fprintln(out)
+
+	b, err := term.ReadPassword(int(in.Fd()))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Line prints msg and reads a line from the terminal.
+func Line(msg string) (string, error) {
+	in, out, closer, err := openTerminal()
+	if err != nil {
+		return "", err
+	}
+	defer closer.Close()
+
+	fmt.Fprint(out, msg)
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
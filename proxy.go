@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ysuzuki-bysystems/myssh/forward"
+)
+
+// proxyFromEnv returns the proxy of https_proxy (HTTPS_PROXY) for host, ""
+// when none is set or host is of no_proxy (NO_PROXY), like curl. A proxy
+// without the scheme is of http.
+func proxyFromEnv(getenv func(string) string, host string) string {
+	proxy := getenv("https_proxy")
+	if proxy == "" {
+		proxy = getenv("HTTPS_PROXY")
+	}
+	if proxy == "" {
+		return ""
+	}
+
+	noProxy := getenv("no_proxy")
+	if noProxy == "" {
+		noProxy = getenv("NO_PROXY")
+	}
+	if noProxyMatch(noProxy, host) {
+		return ""
+	}
+
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	return proxy
+}
+
+// noProxyMatch reports whether host is of the comma separated no_proxy,
+// "*" for all, the domains with their subdomains and the addresses.
+func noProxyMatch(noProxy, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range strings.Split(noProxy, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "*" {
+			return true
+		}
+		p = strings.TrimPrefix(strings.TrimSuffix(p, "."), ".")
+		if p != "" && (host == p || strings.HasSuffix(host, "."+p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialHttpProxy opens a tunnel to addr with HTTP CONNECT. ctx cancels the
+// dial and the exchange with the proxy.
+func dialHttpProxy(ctx context.Context, dialer *net.Dialer, proxy *url.URL, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch proxy.Scheme {
+	case "http":
+		port := proxy.Port()
+		if port == "" {
+			port = "80"
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(proxy.Hostname(), port))
+	case "https":
+		port := proxy.Port()
+		if port == "" {
+			port = "443"
+		}
+		tlsDialer := &tls.Dialer{NetDialer: dialer}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", net.JoinHostPort(proxy.Hostname(), port))
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme: %s", proxy.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy CONNECT failed: %s", resp.Status)
+	}
+	if !stop() {
+		// Closed by the cancel.
+		return nil, ctx.Err()
+	}
+
+	return &forward.BufferedConn{Conn: conn, Reader: r}, nil
+}
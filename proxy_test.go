@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newConnectProxy starts a minimal HTTP CONNECT proxy requiring the given
+// Proxy-Authorization.
+func newConnectProxy(t *testing.T, auth string) (string, <-chan string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	targets := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				req, err := http.ReadRequest(r)
+				if err != nil {
+					return
+				}
+
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != auth {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				targets <- req.Host
+
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+				go func() {
+					defer upstream.(*net.TCPConn).CloseWrite()
+					io.Copy(upstream, r)
+				}()
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return l.Addr().String(), targets
+}
+
+func TestMain(m *testing.M) {
+	// The test servers are not to be dialed through the proxy of the
+	// environment, the default of HttpProxy.
+	for _, k := range []string{"https_proxy", "HTTPS_PROXY"} {
+		os.Unsetenv(k)
+	}
+	os.Exit(m.Run())
+}
+
+func TestDialHttpProxy(t *testing.T) {
+	srvcfg := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	srv := newTestServer(t, srvcfg, nil)
+
+	// user:pass
+	proxy, targets := newConnectProxy(t, "Basic dXNlcjpwYXNz")
+
+	cfg := &config{httpProxy: "http://user:pass@" + proxy}
+	conn, err := dialConn(context.Background(), cfg, srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, srv.addr, &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssh.NewClient(c, chans, reqs).Close()
+
+	if target := <-targets; target != srv.addr {
+		t.Fatalf("%s", target)
+	}
+
+	cfg = &config{httpProxy: "http://user:wrong@" + proxy}
+	if _, err := dialConn(context.Background(), cfg, srv.addr); err == nil {
+		t.Fatal("must fail with wrong credentials")
+	}
+}
+
+func TestProxyFromEnv(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		host string
+		want string
+	}{
+		{nil, "example.com", ""},
+		{map[string]string{"https_proxy": "http://proxy:8080"}, "example.com", "http://proxy:8080"},
+		{map[string]string{"HTTPS_PROXY": "proxy:8080"}, "example.com", "http://proxy:8080"},
+		{map[string]string{"https_proxy": "http://a:1", "HTTPS_PROXY": "http://b:1"}, "example.com", "http://a:1"},
+		{map[string]string{"https_proxy": "proxy:8080", "no_proxy": "*"}, "example.com", ""},
+		{map[string]string{"https_proxy": "proxy:8080", "no_proxy": "other.com, example.com"}, "example.com", ""},
+		{map[string]string{"https_proxy": "proxy:8080", "NO_PROXY": ".example.com"}, "host.example.com", ""},
+		{map[string]string{"https_proxy": "proxy:8080", "no_proxy": "example.com"}, "Host.Example.com", ""},
+		{map[string]string{"https_proxy": "proxy:8080", "no_proxy": "example.com"}, "badexample.com", "http://proxy:8080"},
+		{map[string]string{"https_proxy": "proxy:8080", "no_proxy": "192.0.2.1"}, "192.0.2.1", ""},
+	}
+	for _, tt := range tests {
+		if got := proxyFromEnv(func(k string) string { return tt.env[k] }, tt.host); got != tt.want {
+			t.Errorf("%v %s: %q", tt.env, tt.host, got)
+		}
+	}
+}
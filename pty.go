@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ysuzuki-bysystems/myssh/tty"
+)
+
+// REF https://datatracker.ietf.org/doc/html/rfc4254#section-6.2
+type ptyRequestMsg struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	Width    uint32
+	Height   uint32
+	Modelist string
+}
+
+// REF https://datatracker.ietf.org/doc/html/rfc4254#section-8
+func encodeTerminalModes(modes ssh.TerminalModes) string {
+	var b []byte
+	for k, v := range modes {
+		b = append(b, ssh.Marshal(struct {
+			Key byte
+			Val uint32
+		}{k, v})...)
+	}
+	// TTY_OP_END
+	b = append(b, 0)
+
+	return string(b)
+}
+
+// terminalModeOpcodes are the names of the terminal modes for TerminalModes.
+// REF https://datatracker.ietf.org/doc/html/rfc4254#section-8
+var terminalModeOpcodes = map[string]uint8{
+	"VINTR":         ssh.VINTR,
+	"VQUIT":         ssh.VQUIT,
+	"VERASE":        ssh.VERASE,
+	"VKILL":         ssh.VKILL,
+	"VEOF":          ssh.VEOF,
+	"VEOL":          ssh.VEOL,
+	"VEOL2":         ssh.VEOL2,
+	"VSTART":        ssh.VSTART,
+	"VSTOP":         ssh.VSTOP,
+	"VSUSP":         ssh.VSUSP,
+	"VDSUSP":        ssh.VDSUSP,
+	"VREPRINT":      ssh.VREPRINT,
+	"VWERASE":       ssh.VWERASE,
+	"VLNEXT":        ssh.VLNEXT,
+	"VFLUSH":        ssh.VFLUSH,
+	"VSWTCH":        ssh.VSWTCH,
+	"VSTATUS":       ssh.VSTATUS,
+	"VDISCARD":      ssh.VDISCARD,
+	"IGNPAR":        ssh.IGNPAR,
+	"PARMRK":        ssh.PARMRK,
+	"INPCK":         ssh.INPCK,
+	"ISTRIP":        ssh.ISTRIP,
+	"INLCR":         ssh.INLCR,
+	"IGNCR":         ssh.IGNCR,
+	"ICRNL":         ssh.ICRNL,
+	"IUCLC":         ssh.IUCLC,
+	"IXON":          ssh.IXON,
+	"IXANY":         ssh.IXANY,
+	"IXOFF":         ssh.IXOFF,
+	"IMAXBEL":       ssh.IMAXBEL,
+	"IUTF8":         ssh.IUTF8,
+	"ISIG":          ssh.ISIG,
+	"ICANON":        ssh.ICANON,
+	"XCASE":         ssh.XCASE,
+	"ECHO":          ssh.ECHO,
+	"ECHOE":         ssh.ECHOE,
+	"ECHOK":         ssh.ECHOK,
+	"ECHONL":        ssh.ECHONL,
+	"NOFLSH":        ssh.NOFLSH,
+	"TOSTOP":        ssh.TOSTOP,
+	"IEXTEN":        ssh.IEXTEN,
+	"ECHOCTL":       ssh.ECHOCTL,
+	"ECHOKE":        ssh.ECHOKE,
+	"PENDIN":        ssh.PENDIN,
+	"OPOST":         ssh.OPOST,
+	"OLCUC":         ssh.OLCUC,
+	"ONLCR":         ssh.ONLCR,
+	"OCRNL":         ssh.OCRNL,
+	"ONOCR":         ssh.ONOCR,
+	"ONLRET":        ssh.ONLRET,
+	"CS7":           ssh.CS7,
+	"CS8":           ssh.CS8,
+	"PARENB":        ssh.PARENB,
+	"PARODD":        ssh.PARODD,
+	"TTY_OP_ISPEED": ssh.TTY_OP_ISPEED,
+	"TTY_OP_OSPEED": ssh.TTY_OP_OSPEED,
+}
+
+// parseTerminalModes parses TerminalModes, the opcode=value separated by
+// the commas or the spaces, like "ICANON=0,ISIG=0". The opcode is the name
+// or the number, the value is in decimal or 0x hex.
+func parseTerminalModes(s string) (ssh.TerminalModes, error) {
+	modes := ssh.TerminalModes{}
+
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		name, val, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("Bad TerminalModes: %s", f)
+		}
+
+		op, ok := terminalModeOpcodes[strings.ToUpper(name)]
+		if !ok {
+			// 0 is TTY_OP_END, 160 to 255 are not defined.
+			n, err := strconv.ParseUint(name, 10, 8)
+			if err != nil || n == 0 || n >= 160 {
+				return nil, fmt.Errorf("Unsupported terminal mode: %s", name)
+			}
+			op = uint8(n)
+		}
+
+		v, err := strconv.ParseUint(val, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Bad terminal mode value: %s", f)
+		}
+		modes[op] = uint32(v)
+	}
+
+	return modes, nil
+}
+
+// overrideTerminalModes returns modes with the configured ones replaced.
+func overrideTerminalModes(modes, overrides ssh.TerminalModes) ssh.TerminalModes {
+	merged := maps.Clone(modes)
+	if merged == nil {
+		merged = ssh.TerminalModes{}
+	}
+	maps.Copy(merged, overrides)
+	return merged
+}
+
+// requestPty sends pty-req. Unlike ssh.Session.RequestPty, a refusal by the
+// server is reported as false rather than an error, so that the session can
+// continue without a PTY.
+func requestPty(sess *ssh.Session, term string, size tty.Winsize, modes ssh.TerminalModes) (bool, error) {
+	req := ptyRequestMsg{
+		Term:     term,
+		Columns:  uint32(size.W),
+		Rows:     uint32(size.H),
+		Width:    uint32(size.Wpx),
+		Height:   uint32(size.Hpx),
+		Modelist: encodeTerminalModes(modes),
+	}
+
+	return sess.SendRequest("pty-req", true, ssh.Marshal(&req))
+}
+
+// REF https://datatracker.ietf.org/doc/html/rfc4254#section-6.7
+type windowChangeMsg struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+// windowChange sends window-change with the pixels, which
+// ssh.Session.WindowChange leaves zero.
+func windowChange(sess *ssh.Session, size tty.Winsize) error {
+	req := windowChangeMsg{
+		Columns: uint32(size.W),
+		Rows:    uint32(size.H),
+		Width:   uint32(size.Wpx),
+		Height:  uint32(size.Hpx),
+	}
+
+	_, err := sess.SendRequest("window-change", false, ssh.Marshal(&req))
+	return err
+}
+
+const defaultTerm = "xterm-256color"
+
+// terminalType returns TERM for pty-req: the override, the local TERM, or
+// defaultTerm when unset such as on the Windows console.
+func terminalType(override string, getenv func(string) string) string {
+	if override != "" {
+		return override
+	}
+	if term := getenv("TERM"); term != "" {
+		return term
+	}
+	return defaultTerm
+}
+
+// ssh_config RequestTTY
+const (
+	requestTTYAuto  = "auto"
+	requestTTYNo    = "no"
+	requestTTYYes   = "yes"
+	requestTTYForce = "force"
+)
+
+// ttyWiring is how the local streams are wired to the session with a PTY.
+// The streams not terminals are wired directly.
+type ttyWiring struct {
+	// raw opens the local terminal in raw mode, for the input.
+	raw bool
+	// ttyOutput writes the output to the terminal opened, with stdout a
+	// terminal.
+	ttyOutput bool
+	// stdoutSize takes the PTY size of stdout, for the PTY forced without
+	// the input terminal, like `cmd | myssh -tt host`.
+	stdoutSize bool
+}
+
+func wireTty(pty, stdinTerminal, stdoutTerminal bool) ttyWiring {
+	switch {
+	case !pty:
+		return ttyWiring{}
+	case stdinTerminal:
+		// The output redirected stays in the file, like ssh.
+		return ttyWiring{raw: true, ttyOutput: stdoutTerminal}
+	default:
+		return ttyWiring{stdoutSize: stdoutTerminal}
+	}
+}
+
+// wantPty decides the PTY allocation like ssh. warn reports the request
+// dropped for stdin not being a terminal.
+// REF https://github.com/openssh/openssh-portable/blob/V_9_9_P1/ssh.c (tty_flag)
+func wantPty(requestTTY string, hasCommand, stdinTerminal bool) (pty bool, warn bool) {
+	switch requestTTY {
+	case requestTTYNo:
+		return false, false
+	case requestTTYForce:
+		return true, false
+	case requestTTYYes:
+		pty = true
+	default:
+		pty = !hasCommand
+	}
+
+	if pty && !stdinTerminal {
+		return false, true
+	}
+	return pty, false
+}
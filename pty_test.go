@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/ysuzuki-bysystems/myssh/tty"
+)
+
+// sessionServer accepts sessions answering pty-req with ptyOk, and exec with
+// the command echoed back. window-change is reported as a pty-req without Term.
+func sessionServer(t *testing.T, ptyOk bool, ptyreqs chan<- ptyRequestMsg) *testServer {
+	srvcfg := &ssh.ServerConfig{NoClientAuth: true}
+
+	return newTestServer(t, srvcfg, func(conn *ssh.ServerConn, newch ssh.NewChannel) {
+		if newch.ChannelType() != "session" {
+			newch.Reject(ssh.UnknownChannelType, "")
+			return
+		}
+
+		ch, reqs, err := newch.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+
+		for req := range reqs {
+			switch req.Type {
+			case "pty-req":
+				var msg ptyRequestMsg
+				if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+					t.Error(err)
+				}
+				ptyreqs <- msg
+				req.Reply(ptyOk, nil)
+
+			case "window-change":
+				var msg windowChangeMsg
+				if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+					t.Error(err)
+				}
+				ptyreqs <- ptyRequestMsg{Columns: msg.Columns, Rows: msg.Rows, Width: msg.Width, Height: msg.Height}
+
+			case "exec":
+				var msg struct{ Command string }
+				ssh.Unmarshal(req.Payload, &msg)
+				req.Reply(true, nil)
+
+				ch.Write([]byte(msg.Command))
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				return
+
+			default:
+				req.Reply(false, nil)
+			}
+		}
+	})
+}
+
+func TestRequestPtyRejected(t *testing.T) {
+	for _, ptyOk := range []bool{true, false} {
+		ptyreqs := make(chan ptyRequestMsg, 1)
+		srv := sessionServer(t, ptyOk, ptyreqs)
+
+		client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+			User:            "user",
+			HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+
+		modes := ssh.TerminalModes{ssh.ECHO: 1}
+		ok, err := requestPty(sess, "xterm-256color", tty.Winsize{H: 24, W: 80, Hpx: 384, Wpx: 640}, modes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != ptyOk {
+			t.Fatalf("%v", ok)
+		}
+
+		msg := <-ptyreqs
+		if msg.Term != "xterm-256color" || msg.Rows != 24 || msg.Columns != 80 || msg.Height != 384 || msg.Width != 640 {
+			t.Fatalf("%#v", msg)
+		}
+		// ECHO 1, TTY_OP_END
+		if !bytes.Equal([]byte(msg.Modelist), []byte{53, 0, 0, 0, 1, 0}) {
+			t.Fatalf("%x", msg.Modelist)
+		}
+
+		if err := windowChange(sess, tty.Winsize{H: 30, W: 100, Hpx: 480, Wpx: 800}); err != nil {
+			t.Fatal(err)
+		}
+		msg = <-ptyreqs
+		if msg.Rows != 30 || msg.Columns != 100 || msg.Height != 480 || msg.Width != 800 {
+			t.Fatalf("%#v", msg)
+		}
+
+		// The session is still usable.
+		out, err := sess.Output("echo ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "echo ok" {
+			t.Fatalf("%q", out)
+		}
+	}
+}
+
+func TestWantPty(t *testing.T) {
+	tests := []struct {
+		requestTTY    string
+		hasCommand    bool
+		stdinTerminal bool
+		pty           bool
+		warn          bool
+	}{
+		// myssh host
+		{requestTTYAuto, false, true, true, false},
+		// echo uptime | myssh host
+		{requestTTYAuto, false, false, false, true},
+		// myssh host uptime
+		{requestTTYAuto, true, true, false, false},
+		// myssh host uptime < script.sh
+		{requestTTYAuto, true, false, false, false},
+		// myssh -t host top
+		{requestTTYYes, true, true, true, false},
+		{requestTTYYes, true, false, false, true},
+		{requestTTYYes, false, false, false, true},
+		// myssh -t -t host top < /dev/null
+		{requestTTYForce, true, false, true, false},
+		{requestTTYForce, false, true, true, false},
+		// myssh -T host
+		{requestTTYNo, false, true, false, false},
+		{requestTTYNo, true, false, false, false},
+	}
+
+	for _, tt := range tests {
+		pty, warn := wantPty(tt.requestTTY, tt.hasCommand, tt.stdinTerminal)
+		if pty != tt.pty || warn != tt.warn {
+			t.Errorf("%s command=%v terminal=%v: %v %v", tt.requestTTY, tt.hasCommand, tt.stdinTerminal, pty, warn)
+		}
+	}
+}
+
+func TestWireTty(t *testing.T) {
+	tests := []struct {
+		stdinTerminal  bool
+		stdoutTerminal bool
+		requestTTY     string
+		want           ttyWiring
+	}{
+		// myssh host
+		{true, true, requestTTYAuto, ttyWiring{raw: true, ttyOutput: true}},
+		// myssh host > session.log
+		{true, false, requestTTYAuto, ttyWiring{raw: true}},
+		// yes | myssh host cat
+		{false, true, requestTTYAuto, ttyWiring{}},
+		{false, true, requestTTYForce, ttyWiring{stdoutSize: true}},
+		// yes | myssh host cat > file
+		{false, false, requestTTYAuto, ttyWiring{}},
+		{false, false, requestTTYForce, ttyWiring{}},
+	}
+
+	for _, tt := range tests {
+		pty, _ := wantPty(tt.requestTTY, false, tt.stdinTerminal)
+		if got := wireTty(pty, tt.stdinTerminal, tt.stdoutTerminal); got != tt.want {
+			t.Errorf("stdin=%v stdout=%v %s: %+v", tt.stdinTerminal, tt.stdoutTerminal, tt.requestTTY, got)
+		}
+	}
+}
+
+func TestTerminalType(t *testing.T) {
+	env := func(term string) func(string) string {
+		return func(key string) string {
+			if key == "TERM" {
+				return term
+			}
+			return ""
+		}
+	}
+
+	tests := []struct {
+		override string
+		term     string
+		want     string
+	}{
+		{"", "tmux-256color", "tmux-256color"},
+		{"", "dumb", "dumb"},
+		// Unset, like the Windows console.
+		{"", "", "xterm-256color"},
+		{"vt100", "tmux-256color", "vt100"},
+	}
+
+	for _, tt := range tests {
+		if got := terminalType(tt.override, env(tt.term)); got != tt.want {
+			t.Errorf("%q %q: %s", tt.override, tt.term, got)
+		}
+	}
+}
+
+func TestParseTerminalModes(t *testing.T) {
+	modes, err := parseTerminalModes("icanon=0, ISIG=0 VERASE=0x08,42=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ssh.TerminalModes{ssh.ICANON: 0, ssh.ISIG: 0, ssh.VERASE: 0x08, ssh.IUTF8: 1}
+	if !maps.Equal(modes, want) {
+		t.Fatalf("%v", modes)
+	}
+
+	for _, s := range []string{"ICANON", "BOGUS=1", "0=1", "160=1", "ECHO=x"} {
+		if _, err := parseTerminalModes(s); err == nil {
+			t.Errorf("%s: must fail", s)
+		}
+	}
+}
+
+func TestTerminalModesInPtyRequest(t *testing.T) {
+	opts, err := parseArgs("myssh", []string{"-config", "/dev/null", "-o", "TerminalModes=ICANON=0", "example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := opts.loadConfig(opts.host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptyreqs := make(chan ptyRequestMsg, 1)
+	srv := sessionServer(t, true, ptyreqs)
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	modes := overrideTerminalModes(ssh.TerminalModes{ssh.ICANON: 1}, cfg.terminalModes)
+	if _, err := requestPty(sess, "xterm", tty.Winsize{H: 24, W: 80}, modes); err != nil {
+		t.Fatal(err)
+	}
+
+	// ICANON 0, TTY_OP_END
+	msg := <-ptyreqs
+	if !bytes.Equal([]byte(msg.Modelist), []byte{ssh.ICANON, 0, 0, 0, 0, 0}) {
+		t.Fatalf("%x", msg.Modelist)
+	}
+}
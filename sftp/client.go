@@ -0,0 +1,478 @@
+// Package sftp is a minimal client of the SFTP version 3, for myssh cp.
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/ysuzuki-bysystems/myssh/internal/sftpwire"
+)
+
+// maxData is the data of a read or a write request, 32KB that all the
+// servers accept.
+const maxData = 32 * 1024
+
+// ErrClosed is of the requests after the session ended.
+var ErrClosed = errors.New("sftp: session closed")
+
+type response struct {
+	typ  byte
+	data []byte
+}
+
+// Client is an SFTP session on the streams of the "sftp" subsystem. The
+// requests may be issued concurrently, the responses are matched by the id.
+type Client struct {
+	w   io.WriteCloser
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan response
+	err     error
+}
+
+// NewClient initializes the session with the server on r and w, the stdout
+// and the stdin of the subsystem. Closing the client closes w.
+func NewClient(r io.Reader, w io.WriteCloser) (*Client, error) {
+	init := sftpwire.NewBuffer()
+	init.Byte(sftpwire.FxpInit)
+	init.Uint32(3)
+	if _, err := w.Write(init.Bytes()); err != nil {
+		return nil, err
+	}
+
+	typ, data, err := sftpwire.ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != sftpwire.FxpVersion {
+		return nil, fmt.Errorf("sftp: unexpected packet %d for the version", typ)
+	}
+	rd := sftpwire.NewReader(data)
+	if v := rd.Uint32(); rd.Err() != nil || v < 3 {
+		return nil, fmt.Errorf("sftp: unsupported version %d", v)
+	}
+
+	c := &Client{w: w, pending: map[uint32]chan response{}}
+	go c.recv(r)
+	return c, nil
+}
+
+func (c *Client) recv(r io.Reader) {
+	for {
+		typ, data, err := sftpwire.ReadPacket(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = ErrClosed
+			}
+			c.fail(err)
+			return
+		}
+
+		rd := sftpwire.NewReader(data)
+		id := rd.Uint32()
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ok {
+			ch <- response{typ, rd.Rest()}
+		}
+	}
+}
+
+// fail ends the requests waiting, and the ones to come.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// Close ends the session. The requests waiting fail with ErrClosed.
+func (c *Client) Close() error {
+	err := c.w.Close()
+	c.fail(ErrClosed)
+	return err
+}
+
+// request sends the packet built by fill and waits for the response.
+func (c *Client) request(typ byte, fill func(b *sftpwire.Buffer)) (response, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return response{}, err
+	}
+	c.nextID++
+	id := c.nextID
+	ch := make(chan response, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	b := sftpwire.NewPacket(typ, id)
+	fill(b)
+
+	c.wmu.Lock()
+	_, err := c.w.Write(b.Bytes())
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+
+	resp, ok := <-ch
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return response{}, c.err
+	}
+	return resp, nil
+}
+
+// status returns the error of SSH_FXP_STATUS, nil for SSH_FX_OK.
+func status(resp response) error {
+	if resp.typ != sftpwire.FxpStatus {
+		return fmt.Errorf("sftp: unexpected packet %d", resp.typ)
+	}
+
+	r := sftpwire.NewReader(resp.data)
+	code := r.Uint32()
+	msg := r.String()
+	if r.Err() != nil {
+		return r.Err()
+	}
+	switch code {
+	case sftpwire.FxOK:
+		return nil
+	case sftpwire.FxEOF:
+		return io.EOF
+	}
+	return &StatusError{Code: code, Msg: string(msg)}
+}
+
+func (c *Client) statusRequest(typ byte, fill func(b *sftpwire.Buffer)) error {
+	resp, err := c.request(typ, fill)
+	if err != nil {
+		return err
+	}
+	return status(resp)
+}
+
+func (c *Client) handleRequest(typ byte, fill func(b *sftpwire.Buffer)) (string, error) {
+	resp, err := c.request(typ, fill)
+	if err != nil {
+		return "", err
+	}
+	if resp.typ != sftpwire.FxpHandle {
+		return "", status(resp)
+	}
+
+	r := sftpwire.NewReader(resp.data)
+	h := r.String()
+	return string(h), r.Err()
+}
+
+func (c *Client) attrsRequest(typ byte, fill func(b *sftpwire.Buffer)) (Attrs, error) {
+	resp, err := c.request(typ, fill)
+	if err != nil {
+		return Attrs{}, err
+	}
+	if resp.typ != sftpwire.FxpAttrs {
+		if err := status(resp); err != nil {
+			return Attrs{}, err
+		}
+		return Attrs{}, fmt.Errorf("sftp: unexpected status for the attributes")
+	}
+
+	r := sftpwire.NewReader(resp.data)
+	a := r.Attrs()
+	return a, r.Err()
+}
+
+func pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Stat returns the attributes of name, the symbolic links followed.
+func (c *Client) Stat(name string) (fs.FileInfo, error) {
+	a, err := c.attrsRequest(sftpwire.FxpStat, func(b *sftpwire.Buffer) { b.String([]byte(name)) })
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return &fileInfo{name: path.Base(name), attrs: a}, nil
+}
+
+// Lstat returns the attributes of name, not following the symbolic link.
+func (c *Client) Lstat(name string) (fs.FileInfo, error) {
+	a, err := c.attrsRequest(sftpwire.FxpLstat, func(b *sftpwire.Buffer) { b.String([]byte(name)) })
+	if err != nil {
+		return nil, pathError("lstat", name, err)
+	}
+	return &fileInfo{name: path.Base(name), attrs: a}, nil
+}
+
+// Setstat sets the attributes of a.Flags.
+func (c *Client) Setstat(name string, a *Attrs) error {
+	return pathError("setstat", name, c.statusRequest(sftpwire.FxpSetstat, func(b *sftpwire.Buffer) {
+		b.String([]byte(name))
+		b.Attrs(a)
+	}))
+}
+
+// Chmod sets the permission bits.
+func (c *Client) Chmod(name string, mode fs.FileMode) error {
+	return c.Setstat(name, &Attrs{Flags: sftpwire.AttrPermissions, Perm: sftpwire.PosixPerm(mode)})
+}
+
+// Chtimes sets the access and the modification times, in seconds.
+func (c *Client) Chtimes(name string, atime, mtime time.Time) error {
+	return c.Setstat(name, &Attrs{Flags: sftpwire.AttrACModTime, Atime: uint32(atime.Unix()), Mtime: uint32(mtime.Unix())})
+}
+
+// Mkdir creates the directory.
+func (c *Client) Mkdir(name string, perm fs.FileMode) error {
+	return pathError("mkdir", name, c.statusRequest(sftpwire.FxpMkdir, func(b *sftpwire.Buffer) {
+		b.String([]byte(name))
+		b.Attrs(&Attrs{Flags: sftpwire.AttrPermissions, Perm: sftpwire.PosixPerm(perm)})
+	}))
+}
+
+// Remove removes the file.
+func (c *Client) Remove(name string) error {
+	return pathError("remove", name, c.statusRequest(sftpwire.FxpRemove, func(b *sftpwire.Buffer) { b.String([]byte(name)) }))
+}
+
+// RealPath canonicalizes name, "." being the home directory.
+func (c *Client) RealPath(name string) (string, error) {
+	resp, err := c.request(sftpwire.FxpRealpath, func(b *sftpwire.Buffer) { b.String([]byte(name)) })
+	if err != nil {
+		return "", pathError("realpath", name, err)
+	}
+	if resp.typ != sftpwire.FxpName {
+		return "", pathError("realpath", name, status(resp))
+	}
+
+	r := sftpwire.NewReader(resp.data)
+	if n := r.Uint32(); n != 1 {
+		return "", fmt.Errorf("sftp: %d names for realpath", n)
+	}
+	p := r.String()
+	return string(p), r.Err()
+}
+
+// ReadDir returns the entries of the directory but "." and "..".
+func (c *Client) ReadDir(name string) ([]fs.FileInfo, error) {
+	h, err := c.handleRequest(sftpwire.FxpOpendir, func(b *sftpwire.Buffer) { b.String([]byte(name)) })
+	if err != nil {
+		return nil, pathError("opendir", name, err)
+	}
+	defer c.closeHandle(h)
+
+	var entries []fs.FileInfo
+	for {
+		resp, err := c.request(sftpwire.FxpReaddir, func(b *sftpwire.Buffer) { b.String([]byte(h)) })
+		if err != nil {
+			return nil, pathError("readdir", name, err)
+		}
+		if resp.typ != sftpwire.FxpName {
+			err := status(resp)
+			if err == io.EOF {
+				return entries, nil
+			}
+			return nil, pathError("readdir", name, err)
+		}
+
+		r := sftpwire.NewReader(resp.data)
+		for n := r.Uint32(); n > 0 && r.Err() == nil; n-- {
+			filename := string(r.String())
+			r.String() // longname
+			a := r.Attrs()
+			if filename != "." && filename != ".." {
+				entries = append(entries, &fileInfo{name: filename, attrs: a})
+			}
+		}
+		if r.Err() != nil {
+			return nil, pathError("readdir", name, r.Err())
+		}
+	}
+}
+
+func (c *Client) closeHandle(h string) error {
+	return c.statusRequest(sftpwire.FxpClose, func(b *sftpwire.Buffer) { b.String([]byte(h)) })
+}
+
+// Open opens the file for reading.
+func (c *Client) Open(name string) (*File, error) {
+	return c.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates the file for writing.
+func (c *Client) Create(name string, perm fs.FileMode) (*File, error) {
+	return c.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+// OpenFile opens the file with the flags of os.OpenFile. perm is for the
+// file created, before the umask of the server.
+func (c *Client) OpenFile(name string, flag int, perm fs.FileMode) (*File, error) {
+	var pflags uint32
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		pflags = sftpwire.FxfRead
+	case os.O_WRONLY:
+		pflags = sftpwire.FxfWrite
+	case os.O_RDWR:
+		pflags = sftpwire.FxfRead | sftpwire.FxfWrite
+	}
+	if flag&os.O_APPEND != 0 {
+		pflags |= sftpwire.FxfAppend
+	}
+	if flag&os.O_CREATE != 0 {
+		pflags |= sftpwire.FxfCreat
+	}
+	if flag&os.O_TRUNC != 0 {
+		pflags |= sftpwire.FxfTrunc
+	}
+	if flag&os.O_EXCL != 0 {
+		pflags |= sftpwire.FxfExcl
+	}
+
+	h, err := c.handleRequest(sftpwire.FxpOpen, func(b *sftpwire.Buffer) {
+		b.String([]byte(name))
+		b.Uint32(pflags)
+		b.Attrs(&Attrs{Flags: sftpwire.AttrPermissions, Perm: sftpwire.PosixPerm(perm)})
+	})
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return &File{c: c, name: name, handle: h}, nil
+}
+
+// File is a file opened. ReadAt and WriteAt may be called concurrently,
+// for the requests in flight together.
+type File struct {
+	c      *Client
+	name   string
+	handle string
+
+	mu  sync.Mutex
+	off int64
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) Close() error {
+	return pathError("close", f.name, f.c.closeHandle(f.handle))
+}
+
+// Stat returns the attributes of the file opened.
+func (f *File) Stat() (fs.FileInfo, error) {
+	a, err := f.c.attrsRequest(sftpwire.FxpFstat, func(b *sftpwire.Buffer) { b.String([]byte(f.handle)) })
+	if err != nil {
+		return nil, pathError("fstat", f.name, err)
+	}
+	return &fileInfo{name: path.Base(f.name), attrs: a}, nil
+}
+
+// ReadAt reads len(p) bytes at off with the requests of 32KB.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		m, err := f.readAt(p[n:min(len(p), n+maxData)], off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readAt is a request, that may return less than len(p).
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	resp, err := f.c.request(sftpwire.FxpRead, func(b *sftpwire.Buffer) {
+		b.String([]byte(f.handle))
+		b.Uint64(uint64(off))
+		b.Uint32(uint32(len(p)))
+	})
+	if err != nil {
+		return 0, pathError("read", f.name, err)
+	}
+	if resp.typ != sftpwire.FxpData {
+		err := status(resp)
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, pathError("read", f.name, err)
+	}
+
+	r := sftpwire.NewReader(resp.data)
+	data := r.String()
+	if r.Err() != nil {
+		return 0, pathError("read", f.name, r.Err())
+	}
+	if len(data) > len(p) {
+		return 0, pathError("read", f.name, errors.New("sftp: too much data"))
+	}
+	return copy(p, data), nil
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.readAt(p[:min(len(p), maxData)], f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+// WriteAt writes p at off with the requests of 32KB.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		chunk := p[n:min(len(p), n+maxData)]
+		err := f.c.statusRequest(sftpwire.FxpWrite, func(b *sftpwire.Buffer) {
+			b.String([]byte(f.handle))
+			b.Uint64(uint64(off + int64(n)))
+			b.String(chunk)
+		})
+		if err != nil {
+			return n, pathError("write", f.name, err)
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.WriteAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+// Chmod sets the permission bits of the file opened.
+func (f *File) Chmod(mode fs.FileMode) error {
+	return pathError("fsetstat", f.name, f.c.statusRequest(sftpwire.FxpFsetstat, func(b *sftpwire.Buffer) {
+		b.String([]byte(f.handle))
+		b.Attrs(&Attrs{Flags: sftpwire.AttrPermissions, Perm: sftpwire.PosixPerm(mode)})
+	}))
+}
@@ -0,0 +1,143 @@
+package sftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/ysuzuki-bysystems/myssh/internal/sftptest"
+)
+
+type pipeRW struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func newTestClient(t *testing.T, root string) *Client {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		err := sftptest.Serve(pipeRW{sr, sw}, root)
+		sw.Close()
+		done <- err
+	}()
+
+	c, err := NewClient(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return c
+}
+
+func TestClient(t *testing.T) {
+	root := t.TempDir()
+	c := newTestClient(t, root)
+
+	// Larger than maxData, for the requests split.
+	data := bytes.Repeat([]byte("0123456789abcdef"), maxData/8+3)
+
+	f, err := c.Create("/a.txt", 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Chmod(0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(root, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("wrote %d bytes, want %d", len(b), len(data))
+	}
+
+	fi, err := c.Stat("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(data)) || fi.Mode() != 0600 {
+		t.Errorf("stat: %d %s", fi.Size(), fi.Mode())
+	}
+
+	f, err = c.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if n, err := f.ReadAt(got, 0); err != nil || n != len(data) {
+		t.Fatalf("ReadAt: %d %v", n, err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("read differs")
+	}
+	if _, err := f.ReadAt(got[:1], int64(len(data))); err != io.EOF {
+		t.Errorf("ReadAt at the end: %v", err)
+	}
+	all, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(all, data) {
+		t.Errorf("ReadAll: %d %v", len(all), err)
+	}
+	f.Close()
+
+	if err := c.Mkdir("/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Chmod("/d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := c.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+		if e.Name() == "d" && (!e.IsDir() || e.Mode().Perm() != 0700) {
+			t.Errorf("d: %s", e.Mode())
+		}
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "a.txt" || names[1] != "d" {
+		t.Errorf("ReadDir: %v", names)
+	}
+
+	if p, err := c.RealPath("d/../a.txt"); err != nil || p != "/a.txt" {
+		t.Errorf("RealPath: %q %v", p, err)
+	}
+
+	if _, err := c.Stat("/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat missing: %v", err)
+	}
+	if err := c.Remove("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientClosed(t *testing.T) {
+	c := newTestClient(t, t.TempDir())
+	c.Close()
+
+	if _, err := c.Stat("/"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Stat after Close: %v", err)
+	}
+}
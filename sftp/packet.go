@@ -0,0 +1,48 @@
+package sftp
+
+import (
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/ysuzuki-bysystems/myssh/internal/sftpwire"
+)
+
+// Attrs is ATTRS, the fields of Flags.
+type Attrs = sftpwire.Attrs
+
+// StatusError is SSH_FXP_STATUS of a failure.
+type StatusError struct {
+	Code uint32
+	Msg  string
+}
+
+func (e *StatusError) Error() string {
+	if e.Msg != "" {
+		return fmt.Sprintf("sftp: %s (%d)", e.Msg, e.Code)
+	}
+	return fmt.Sprintf("sftp: status %d", e.Code)
+}
+
+func (e *StatusError) Is(target error) bool {
+	switch e.Code {
+	case sftpwire.FxNoSuchFile:
+		return target == fs.ErrNotExist
+	case sftpwire.FxPermissionDenied:
+		return target == fs.ErrPermission
+	}
+	return false
+}
+
+// fileInfo is fs.FileInfo of a name and its attributes.
+type fileInfo struct {
+	name  string
+	attrs Attrs
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.attrs.Size) }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.attrs.FileMode() }
+func (fi *fileInfo) ModTime() time.Time { return time.Unix(int64(fi.attrs.Mtime), 0) }
+func (fi *fileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *fileInfo) Sys() any           { return &fi.attrs }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ysuzuki-bysystems/myssh/forward"
+)
+
+// shutdownGrace is how long the forwarded connections in flight are given to
+// finish once the session ended.
+var shutdownGrace = 2 * time.Second
+
+// signalExitDelay is how long the session is given to shut down on SIGTERM
+// and SIGHUP before the tty terminates the process, the forwards with their
+// grace included.
+var signalExitDelay = 2 * shutdownGrace
+
+// shutdown tears a connection down in order, at the end of the session or on
+// a local interrupt: the session and the listeners are closed first, so that
+// no new forwarded connection is accepted, then the ones in flight are given
+// the grace to finish before the client is closed.
+type shutdown struct {
+	// ctx is of the forwardings, done once the client is closed. It is not
+	// done with the parent, the connections in flight are drained first.
+	ctx    context.Context
+	cancel context.CancelFunc
+	client io.Closer
+	grace  time.Duration
+
+	once    sync.Once
+	mu      sync.Mutex
+	started bool
+	closers []io.Closer
+	drains  []func()
+}
+
+// newShutdown returns the shutdown of client, run when parent is done.
+func newShutdown(parent context.Context, client io.Closer, grace time.Duration) *shutdown {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+	s := &shutdown{ctx: ctx, cancel: cancel, client: client, grace: grace}
+	context.AfterFunc(parent, s.run)
+	return s
+}
+
+// closeFirst registers c, a session or a listener, to be closed first. It is
+// closed right away once the shutdown started.
+func (s *shutdown) closeFirst(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		c.Close()
+		return
+	}
+	s.closers = append(s.closers, c)
+}
+
+// drain registers wait, returning when the connections in flight finish.
+func (s *shutdown) drain(wait func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.started {
+		s.drains = append(s.drains, wait)
+	}
+}
+
+// listener registers a forwarding.
+func (s *shutdown) listener(l *forward.Listener) {
+	s.closeFirst(l)
+	s.drain(l.Wait)
+}
+
+// run shuts down, once. The other calls wait for the first to finish.
+func (s *shutdown) run() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.started = true
+		closers, drains := s.closers, s.drains
+		s.mu.Unlock()
+
+		for _, c := range closers {
+			c.Close()
+		}
+
+		drained := make(chan struct{})
+		go func() {
+			var wg sync.WaitGroup
+			for _, wait := range drains {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					wait()
+				}()
+			}
+			wg.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(s.grace):
+		}
+
+		s.client.Close()
+		s.cancel()
+	})
+}
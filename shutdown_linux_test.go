@@ -0,0 +1,108 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// ptyStdio replaces os.Stdin and os.Stdout with the slave of a new pty, and
+// returns it.
+func ptyStdio(t *testing.T) *os.File {
+	t.Helper()
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("No pty: %s", err)
+	}
+	t.Cleanup(func() { master.Close() })
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetUint32(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { slave.Close() })
+	go io.Copy(io.Discard, master)
+
+	stdin, stdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = slave, slave
+	t.Cleanup(func() { os.Stdin, os.Stdout = stdin, stdout })
+	return slave
+}
+
+func canonical(t *testing.T, f *os.File) bool {
+	termios, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+	return termios.Lflag&(unix.ICANON|unix.ECHO) == unix.ICANON|unix.ECHO
+}
+
+func TestProcTerminateRestoresTerminal(t *testing.T) {
+	withStdio(t)
+	slave := ptyStdio(t)
+
+	// Not to exit the test on the signal.
+	orig := signalExitDelay
+	signalExitDelay = time.Minute
+	t.Cleanup(func() { signalExitDelay = orig })
+
+	closed := make(chan struct{})
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, func(conn *ssh.ServerConn, newch ssh.NewChannel) {
+		ch, reqs, err := newch.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+
+		for req := range reqs {
+			req.Reply(req.Type == "pty-req" || req.Type == "exec", nil)
+			if req.Type == "exec" {
+				go ssh.DiscardRequests(reqs)
+				if canonical(t, slave) {
+					t.Error("not in raw mode")
+				}
+				if err := unix.Kill(unix.Getpid(), unix.SIGTERM); err != nil {
+					t.Error(err)
+				}
+				io.Copy(io.Discard, ch)
+				close(closed)
+				return
+			}
+		}
+	})
+
+	cfg := procConfig(t, srv.addr)
+	cfg.requestTTY = requestTTYForce
+	cfg.escapeChar = noEscapeChar
+
+	ctx, stop := interruptContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer stop()
+	if code := runProc(t, ctx, cfg); code != 128+int(syscall.SIGTERM) {
+		t.Fatal(code)
+	}
+	if !canonical(t, slave) {
+		t.Fatal("the terminal is not restored")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session is left open")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// orderCloser records the order of the closes.
+type orderCloser struct {
+	name  string
+	mu    *sync.Mutex
+	order *[]string
+}
+
+func (c *orderCloser) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.order = append(*c.order, c.name)
+	return nil
+}
+
+func TestShutdownOrder(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	closer := func(name string) *orderCloser {
+		return &orderCloser{name: name, mu: &mu, order: &order}
+	}
+
+	parent, cancel := context.WithCancel(context.Background())
+	sd := newShutdown(parent, closer("client"), time.Minute)
+	sd.closeFirst(closer("session"))
+	release := make(chan struct{})
+	sd.drain(func() {
+		<-release
+		closer("drained").Close()
+	})
+
+	// On the parent, but not before the drain.
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	if sd.ctx.Err() != nil {
+		t.Fatal("the forwardings must outlive the parent")
+	}
+	close(release)
+	sd.run()
+
+	if got := []string{"session", "drained", "client"}; !slices.Equal(order, got) {
+		t.Fatalf("%q", order)
+	}
+	if sd.ctx.Err() == nil {
+		t.Fatal("the forwardings must be done")
+	}
+
+	// Registered after, closed right away.
+	sd.closeFirst(closer("late"))
+	if order[len(order)-1] != "late" {
+		t.Fatalf("%q", order)
+	}
+}
+
+func TestShutdownGrace(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	sd := newShutdown(context.Background(), &orderCloser{name: "client", mu: &mu, order: &order}, 50*time.Millisecond)
+	sd.drain(func() { select {} })
+
+	done := make(chan struct{})
+	go func() {
+		sd.run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the grace must not be exceeded")
+	}
+	if len(order) != 1 {
+		t.Fatalf("%q", order)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		err     error
+		code    int
+		summary string
+	}{
+		{nil, 0, ""},
+		{&exitStatusError{3}, 3, ""},
+		{&interruptedError{syscall.SIGINT}, 130, "Interrupted by signal 2 (SIGINT)."},
+		{io.EOF, exitStatusConnectionFailed, "EOF"},
+	}
+	for _, tt := range tests {
+		code, summary := exitStatus(tt.err)
+		if code != tt.code || summary != tt.summary {
+			t.Errorf("%v: %d %q", tt.err, code, summary)
+		}
+	}
+}
+
+// withStdio replaces os.Stdin, left open, os.Stdout and os.Stderr for proc.
+func withStdio(t *testing.T) {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, stdout, stderr := os.Stdin, os.Stdout, os.Stderr
+	os.Stdin, os.Stdout, os.Stderr = r, out, out
+	t.Cleanup(func() {
+		os.Stdin, os.Stdout, os.Stderr = stdin, stdout, stderr
+		w.Close()
+		r.Close()
+		out.Close()
+	})
+}
+
+// hangingServer accepts exec, calls onExec, and leaves the command running
+// until the session is closed by the client. closed is closed then.
+func hangingServer(t *testing.T, onExec func()) (srv *testServer, closed <-chan struct{}) {
+	c := make(chan struct{})
+	var once sync.Once
+	srv = newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, func(conn *ssh.ServerConn, newch ssh.NewChannel) {
+		ch, reqs, err := newch.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+
+		for req := range reqs {
+			req.Reply(req.Type == "exec", nil)
+			if req.Type == "exec" {
+				go ssh.DiscardRequests(reqs)
+				onExec()
+				io.Copy(io.Discard, ch)
+				once.Do(func() { close(c) })
+				return
+			}
+		}
+	})
+	return srv, c
+}
+
+func procConfig(t *testing.T, addr string) *config {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &config{
+		user:                          "user",
+		hostname:                      "127.0.0.1",
+		port:                          port,
+		command:                       "true",
+		requestTTY:                    requestTTYNo,
+		noAgent:                       true,
+		insecureIgnoreLoopbackHostKey: true,
+	}
+}
+
+// runProc runs proc and returns its exit status.
+func runProc(t *testing.T, ctx context.Context, cfg *config) int {
+	t.Helper()
+
+	done := make(chan int, 1)
+	go func() {
+		code, _ := exitStatus(proc(ctx, cfg))
+		done <- code
+	}()
+	select {
+	case code := <-done:
+		return code
+	case <-time.After(10 * time.Second):
+		t.Fatal("not shut down")
+		return 0
+	}
+}
+
+// interrupt sends SIGINT to the process itself, caught by interruptContext.
+func interrupt(t *testing.T) {
+	p, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = p.Signal(os.Interrupt)
+	}
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProcRemoteExit(t *testing.T) {
+	withStdio(t)
+	srv := execServer(t, "", 3)
+
+	if code := runProc(t, context.Background(), procConfig(t, srv.addr)); code != 3 {
+		t.Fatal(code)
+	}
+}
+
+func TestProcConnectionDrop(t *testing.T) {
+	withStdio(t)
+	started := make(chan struct{}, 1)
+	srv, _ := hangingServer(t, func() { started <- struct{}{} })
+	go func() {
+		<-started
+		srv.dropConns()
+	}()
+
+	if code := runProc(t, context.Background(), procConfig(t, srv.addr)); code != exitStatusConnectionFailed {
+		t.Fatal(code)
+	}
+}
+
+func TestProcInterruptBeforeSession(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGINT to send")
+	}
+
+	// Accepts, but never sends the version.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		interrupt(t)
+		io.Copy(io.Discard, conn)
+	}()
+
+	ctx, stop := interruptContext(context.Background(), os.Interrupt)
+	defer stop()
+	if code := runProc(t, ctx, procConfig(t, l.Addr().String())); code != 128+int(syscall.SIGINT) {
+		t.Fatal(code)
+	}
+}
+
+func TestProcInterruptSession(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGINT to send")
+	}
+	withStdio(t)
+
+	srv, closed := hangingServer(t, func() { interrupt(t) })
+
+	ctx, stop := interruptContext(context.Background(), os.Interrupt)
+	defer stop()
+	if code := runProc(t, ctx, procConfig(t, srv.addr)); code != 128+int(syscall.SIGINT) {
+		t.Fatal(code)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session is left open")
+	}
+}
+
+func TestInterruptContextStop(t *testing.T) {
+	ctx, stop := interruptContext(context.Background(), os.Interrupt)
+	stop()
+	stop()
+	if ctx.Err() != nil {
+		t.Fatal(ctx.Err())
+	}
+}
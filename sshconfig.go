@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// REF ssh_config(5)
+// REF https://github.com/openssh/openssh-portable/blob/V_9_9_P1/readconf.c
+
+type sshConfigLine struct {
+	keyword string // lower case
+	args    []string
+	pos     string
+}
+
+type sshConfig struct {
+	lines []*sshConfigLine
+	// includeDir is where relative Include paths are looked up.
+	includeDir string
+}
+
+func splitConfigArgs(s string) ([]string, error) {
+	var args []string
+
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return args, nil
+		}
+
+		if s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				return nil, errors.New("Unterminated quote.")
+			}
+			args = append(args, s[1:end+1])
+			s = s[end+2:]
+			continue
+		}
+
+		end := strings.IndexAny(s, " \t")
+		if end < 0 {
+			end = len(s)
+		}
+		args = append(args, s[:end])
+		s = s[end:]
+	}
+}
+
+func parseSshConfig(r io.Reader, name, includeDir string) (*sshConfig, error) {
+	cfg := &sshConfig{includeDir: includeDir}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Keyword [=] arguments
+		end := strings.IndexAny(line, " \t=")
+		if end < 0 {
+			end = len(line)
+		}
+		keyword := line[:end]
+		rest := strings.TrimLeft(line[end:], " \t")
+		rest = strings.TrimPrefix(rest, "=")
+
+		args, err := splitConfigArgs(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+		}
+
+		cfg.lines = append(cfg.lines, &sshConfigLine{
+			keyword: strings.ToLower(keyword),
+			args:    args,
+			pos:     fmt.Sprintf("%s:%d", name, n),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func loadSshConfig(path string) (*sshConfig, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return parseSshConfig(fp, path, filepath.Dir(path))
+}
+
+// matchPattern matches s against an ssh_config pattern consisting of `*' and `?'.
+func matchPattern(s, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = pattern[1:]
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(s[i:], pattern) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if s == "" {
+				return false
+			}
+
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+
+		s = s[1:]
+		pattern = pattern[1:]
+	}
+
+	return s == ""
+}
+
+// matchPatternList returns true when s matches any of the patterns and none
+// of the negated ones.
+func matchPatternList(s string, patterns []string) bool {
+	matched := false
+	for _, p := range patterns {
+		if negated, ok := strings.CutPrefix(p, "!"); ok {
+			if matchPattern(s, negated) {
+				return false
+			}
+			continue
+		}
+
+		if matchPattern(s, p) {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// multiValueKeywords accumulate values instead of using the first one.
+var multiValueKeywords = map[string]bool{
+	"certificatefile": true,
+	"dynamicforward":  true,
+	"identityfile":    true,
+	"localforward":    true,
+	"remoteforward":   true,
+	"sendenv":         true,
+	"setenv":          true,
+}
+
+// sshOptions is the result of evaluating configuration files for a host.
+// Like OpenSSH, the first obtained value is used.
+type sshOptions struct {
+	host      string
+	localUser string
+	values    map[string][]string
+}
+
+func newSshOptions(host, localUser string) *sshOptions {
+	return &sshOptions{
+		host:      host,
+		localUser: localUser,
+		values:    make(map[string][]string),
+	}
+}
+
+func (o *sshOptions) get(keyword string) string {
+	v := o.values[strings.ToLower(keyword)]
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
+func (o *sshOptions) getAll(keyword string) []string {
+	return o.values[strings.ToLower(keyword)]
+}
+
+func (o *sshOptions) set(keyword, value string) {
+	keyword = strings.ToLower(keyword)
+	if multiValueKeywords[keyword] {
+		o.values[keyword] = append(o.values[keyword], value)
+		return
+	}
+
+	if _, ok := o.values[keyword]; ok {
+		return
+	}
+	o.values[keyword] = []string{value}
+}
+
+// matchHost is the host name Match host is evaluated against.
+func (o *sshOptions) matchHost() string {
+	if h := o.get("HostName"); h != "" {
+		return strings.ReplaceAll(h, "%h", o.host)
+	}
+	return o.host
+}
+
+func (o *sshOptions) matchCriteria(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, errors.New("Missing Match criteria.")
+	}
+
+	result := true
+	for len(args) > 0 {
+		criterion := strings.ToLower(args[0])
+		args = args[1:]
+
+		negated := false
+		if c, ok := strings.CutPrefix(criterion, "!"); ok {
+			criterion = c
+			negated = true
+		}
+
+		var matched bool
+		switch criterion {
+		case "all":
+			matched = true
+		case "canonical":
+			// No hostname canonicalization. Every pass is the final one.
+			matched = false
+		case "final":
+			matched = true
+
+		default:
+			if len(args) == 0 {
+				return false, fmt.Errorf("Missing argument for Match %s.", criterion)
+			}
+			arg := args[0]
+			args = args[1:]
+			patterns := strings.Split(arg, ",")
+
+			switch criterion {
+			case "host":
+				matched = matchPatternList(strings.ToLower(o.matchHost()), patterns)
+			case "originalhost":
+				matched = matchPatternList(strings.ToLower(o.host), patterns)
+			case "user":
+				user := o.get("User")
+				if user == "" {
+					user = o.localUser
+				}
+				matched = matchPatternList(user, patterns)
+			case "localuser":
+				matched = matchPatternList(o.localUser, patterns)
+			case "tagged":
+				matched = matchPatternList(o.get("Tag"), patterns)
+			case "exec":
+				var cmd *exec.Cmd
+				if runtime.GOOS == "windows" {
+					cmd = exec.Command("cmd", "/c", arg)
+				} else {
+					cmd = exec.Command("/bin/sh", "-c", arg)
+				}
+				matched = cmd.Run() == nil
+			default:
+				return false, fmt.Errorf("Unsupported Match criteria: %s", criterion)
+			}
+		}
+
+		if matched == negated {
+			result = false
+		}
+	}
+
+	return result, nil
+}
+
+func (o *sshOptions) apply(cfg *sshConfig) error {
+	return o.applyDepth(cfg, 0)
+}
+
+func (o *sshOptions) applyDepth(cfg *sshConfig, depth int) error {
+	if depth > 16 {
+		return errors.New("Too many recursive configuration includes.")
+	}
+
+	active := true
+	for _, l := range cfg.lines {
+		switch l.keyword {
+		case "host":
+			active = matchPatternList(strings.ToLower(o.host), l.args)
+
+		case "match":
+			m, err := o.matchCriteria(l.args)
+			if err != nil {
+				return fmt.Errorf("%s: %w", l.pos, err)
+			}
+			active = m
+
+		case "include":
+			if !active {
+				continue
+			}
+
+			for _, arg := range l.args {
+				if strings.HasPrefix(arg, "~/") {
+					if home, err := os.UserHomeDir(); err == nil {
+						arg = filepath.Join(home, arg[2:])
+					}
+				}
+				if !filepath.IsAbs(arg) {
+					arg = filepath.Join(cfg.includeDir, arg)
+				}
+
+				paths, err := filepath.Glob(arg)
+				if err != nil {
+					return fmt.Errorf("%s: %w", l.pos, err)
+				}
+
+				for _, path := range paths {
+					inc, err := loadSshConfig(path)
+					if err != nil {
+						return err
+					}
+					inc.includeDir = cfg.includeDir
+
+					if err := o.applyDepth(inc, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+
+		default:
+			if active {
+				o.set(l.keyword, strings.Join(l.args, " "))
+			}
+		}
+	}
+
+	return nil
+}
+
+// percentExpand expands the %-tokens of ssh_config(5) TOKENS.
+func percentExpand(s string, tokens map[byte]string) (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		if i >= len(s) {
+			return "", fmt.Errorf("Invalid %%-token at the end: %s", s)
+		}
+		if s[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+
+		v, ok := tokens[s[i]]
+		if !ok {
+			return "", fmt.Errorf("Unknown %%-token %%%c: %s", s[i], s)
+		}
+		b.WriteString(v)
+	}
+
+	return b.String(), nil
+}
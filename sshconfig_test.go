@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchPatternList(t *testing.T) {
+	tests := []struct {
+		s        string
+		patterns string
+		want     bool
+	}{
+		{"example.com", "*", true},
+		{"example.com", "*.com", true},
+		{"example.com", "exampl?.com", true},
+		{"example.com", "example.?om", true},
+		{"example.com", "example.c", false},
+		{"example.com", "*,!example.com", false},
+		{"example.org", "*,!example.com", true},
+		{"example.com", "!example.com", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPatternList(tt.s, strings.Split(tt.patterns, ",")); got != tt.want {
+			t.Errorf("%s %s: %v", tt.s, tt.patterns, got)
+		}
+	}
+}
+
+func applyConfig(t *testing.T, host, tag, config string) *sshOptions {
+	t.Helper()
+
+	cfg, err := parseSshConfig(strings.NewReader(config), "config", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := newSshOptions(host, "me")
+	if tag != "" {
+		opts.set("Tag", tag)
+	}
+	if err := opts.apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	return opts
+}
+
+func TestSshConfigFirstValue(t *testing.T) {
+	opts := applyConfig(t, "example.com", "", `
+Host example.com
+    User alice
+    RemoteForward 8080 localhost:80
+
+Host *
+    User bob
+    Port=2222
+    RemoteForward "9090 localhost:90"
+`)
+
+	if v := opts.get("user"); v != "alice" {
+		t.Fatal(v)
+	}
+	if v := opts.get("Port"); v != "2222" {
+		t.Fatal(v)
+	}
+	if v := opts.getAll("RemoteForward"); len(v) != 2 || v[1] != "9090 localhost:90" {
+		t.Fatal(v)
+	}
+}
+
+func TestSshConfigMatchTagged(t *testing.T) {
+	config := `
+Host example.com
+    Tag work
+
+Match tagged work
+    ForwardAgent yes
+
+Match all
+    ForwardAgent no
+`
+
+	if v := applyConfig(t, "example.com", "", config).get("ForwardAgent"); v != "yes" {
+		t.Fatalf("tagged by Tag: %s", v)
+	}
+	if v := applyConfig(t, "other.example.com", "", config).get("ForwardAgent"); v != "no" {
+		t.Fatalf("untagged: %s", v)
+	}
+	if v := applyConfig(t, "other.example.com", "work", config).get("ForwardAgent"); v != "yes" {
+		t.Fatalf("tagged by -P: %s", v)
+	}
+}
+
+func TestSshConfigMatch(t *testing.T) {
+	config := `
+Host alias
+    HostName example.com
+
+Match host example.com user me
+    User alice
+
+Match originalhost alias !localuser me
+    Port 2222
+
+Match originalhost alias
+    Port 2200
+`
+
+	opts := applyConfig(t, "alias", "", config)
+	if v := opts.get("User"); v != "alice" {
+		t.Fatal(v)
+	}
+	if v := opts.get("Port"); v != "2200" {
+		t.Fatal(v)
+	}
+
+	cfg, err := parseSshConfig(strings.NewReader("Match localnetwork 192.0.2.0/24\n"), "config", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newSshOptions("example.com", "me").apply(cfg); err == nil {
+		t.Fatal("must fail with an unsupported criteria")
+	}
+}
+
+func TestPercentExpand(t *testing.T) {
+	tokens := map[byte]string{'h': "example.com", 'u': "me"}
+
+	tests := []struct {
+		s    string
+		want string
+		err  bool
+	}{
+		{"%u@%h", "me@example.com", false},
+		{"100%%", "100%", false},
+		{"%x", "", true},
+		{"trailing%", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := percentExpand(tt.s, tokens)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: must fail", tt.s)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: %s %v", tt.s, got, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is a minimal loopback SSH server for the tests.
+type testServer struct {
+	addr    string
+	hostKey ssh.Signer
+
+	l  net.Listener
+	wg sync.WaitGroup
+
+	mu    sync.Mutex
+	conns []net.Conn
+
+	// unresponsive leaves the global requests, like keepalives, unanswered.
+	unresponsive atomic.Bool
+	// globalRequest answers the global requests instead of the failure.
+	globalRequest atomic.Pointer[func(conn *ssh.ServerConn, req *ssh.Request)]
+}
+
+// dropConns closes the accepted connections without an SSH disconnect.
+func (s *testServer) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func newHostKey(t testing.TB) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newTestServer(t testing.TB, cfg *ssh.ServerConfig, handle func(conn *ssh.ServerConn, ch ssh.NewChannel)) *testServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveTestServer(t, l, cfg, handle)
+}
+
+// newUnixTestServer is newTestServer on a Unix-domain socket.
+func newUnixTestServer(t testing.TB, cfg *ssh.ServerConfig, handle func(conn *ssh.ServerConn, ch ssh.NewChannel)) *testServer {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "myssh") // short enough for sun_path
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	l, err := net.Listen("unix", filepath.Join(dir, "sshd.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveTestServer(t, l, cfg, handle)
+}
+
+func serveTestServer(t testing.TB, l net.Listener, cfg *ssh.ServerConfig, handle func(conn *ssh.ServerConn, ch ssh.NewChannel)) *testServer {
+	hostKey := newHostKey(t)
+	cfg.AddHostKey(hostKey)
+
+	srv := &testServer{
+		addr:    l.Addr().String(),
+		hostKey: hostKey,
+		l:       l,
+	}
+
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, c)
+			srv.mu.Unlock()
+
+			srv.wg.Add(1)
+			go func() {
+				defer srv.wg.Done()
+				defer c.Close()
+
+				conn, chans, reqs, err := ssh.NewServerConn(c, cfg)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				go func() {
+					for req := range reqs {
+						if h := srv.globalRequest.Load(); h != nil {
+							(*h)(conn, req)
+							continue
+						}
+						if req.WantReply && !srv.unresponsive.Load() {
+							req.Reply(false, nil)
+						}
+					}
+				}()
+				for ch := range chans {
+					if handle == nil {
+						ch.Reject(ssh.UnknownChannelType, "")
+						continue
+					}
+					go handle(conn, ch)
+				}
+			}()
+		}
+	}()
+
+	t.Cleanup(func() {
+		l.Close()
+		srv.wg.Wait()
+	})
+
+	return srv
+}
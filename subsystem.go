@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ysuzuki-bysystems/myssh/forward"
+	"golang.org/x/crypto/ssh"
+)
+
+// SessionType
+const (
+	sessionTypeDefault   = "default"
+	sessionTypeNone      = "none"
+	sessionTypeSubsystem = "subsystem"
+)
+
+// exitStatusError is the non-zero exit status of the remote.
+type exitStatusError struct {
+	status uint32
+}
+
+func (e *exitStatusError) Error() string {
+	return fmt.Sprintf("Process exited with status %d", e.status)
+}
+
+// runSubsystem opens a session channel and starts the subsystem. No PTY is
+// requested and the bytes are passed through as they are, so that framed
+// protocols such as netconf survive.
+//
+// ssh.Session.RequestSubsystem does not start the session, so the channel
+// is driven here.
+func runSubsystem(conn ssh.Conn, name string, stdin io.Reader, stdout, stderr io.Writer) error {
+	ch, reqs, err := conn.OpenChannel("session", nil)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	statusCh := make(chan *uint32, 1)
+	go func() {
+		var status *uint32
+		for req := range reqs {
+			if req.Type == "exit-status" {
+				var msg struct{ Status uint32 }
+				if err := ssh.Unmarshal(req.Payload, &msg); err == nil {
+					status = &msg.Status
+				}
+			}
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+		statusCh <- status
+	}()
+
+	ok, err := ch.SendRequest("subsystem", true, ssh.Marshal(struct{ Name string }{name}))
+	if err == nil && !ok {
+		err = fmt.Errorf("Subsystem request failed: %s", name)
+	}
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		// EOF on stdin is sent as the channel EOF.
+		forward.Copy(ch, stdin)
+		ch.CloseWrite()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(stderr, ch.Stderr())
+	}()
+
+	_, err = forward.Copy(stdout, ch)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+
+	ch.Close()
+	if status := <-statusCh; status == nil {
+		return fmt.Errorf("Subsystem %s exited without status", name)
+	} else if *status != 0 {
+		return &exitStatusError{*status}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// subsystemServer runs an echo for the named subsystem, reporting the
+// requests of the session.
+func subsystemServer(t *testing.T, subsystem string, requests chan<- string) *testServer {
+	return newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, func(conn *ssh.ServerConn, newch ssh.NewChannel) {
+		ch, reqs, err := newch.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+
+		for req := range reqs {
+			requests <- req.Type
+			if req.Type != "subsystem" {
+				req.Reply(false, nil)
+				continue
+			}
+
+			var msg struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &msg); err != nil || msg.Name != subsystem {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			io.Copy(ch, ch)
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+			return
+		}
+	})
+}
+
+func TestRunSubsystemNetconf(t *testing.T) {
+	requests := make(chan string, 16)
+	srv := subsystemServer(t, "netconf", requests)
+
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// NETCONF 1.0 end-of-message framing and 1.1 chunked framing, with CR LF
+	// and bytes that must not be translated.
+	input := "<hello xmlns=\"urn:ietf:params:xml:ns:netconf:base:1.0\"/>\r\n]]>]]>" +
+		"\n#4\n<rpc\n#2\r\n\n##\n\x00\xff"
+
+	var stdout, stderr bytes.Buffer
+	if err := runSubsystem(client, "netconf", bytes.NewBufferString(input), &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+
+	if stdout.String() != input {
+		t.Fatalf("%q", stdout.String())
+	}
+
+	close(requests)
+	var got []string
+	for r := range requests {
+		got = append(got, r)
+	}
+	if len(got) != 1 || got[0] != "subsystem" {
+		t.Fatalf("%v", got)
+	}
+}
+
+func TestRunSubsystemRejected(t *testing.T) {
+	srv := subsystemServer(t, "netconf", make(chan string, 16))
+
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := runSubsystem(client, "unknown", &bytes.Buffer{}, io.Discard, io.Discard); err == nil {
+		t.Fatal("must fail")
+	}
+}
+
+func TestSubsystemOption(t *testing.T) {
+	tests := []struct {
+		args      []string
+		subsystem string
+		noCommand bool
+		ok        bool
+	}{
+		{[]string{"-s", "host", "sftp"}, "sftp", false, true},
+		{[]string{"-o", "SessionType=subsystem", "host", "netconf"}, "netconf", false, true},
+		{[]string{"-o", "SessionType=none", "host"}, "", true, true},
+		{[]string{"-N", "host"}, "", true, true},
+		{[]string{"-s", "host"}, "", false, false},
+		{[]string{"-s", "-t", "host", "sftp"}, "", false, false},
+		{[]string{"-s", "-N", "host", "sftp"}, "", false, false},
+		{[]string{"-o", "SessionType=shell", "host"}, "", false, false},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		opts, err := parseArgs("myssh", append([]string{"-config", "/dev/null"}, tt.args...), &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := opts.loadConfig(opts.host)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: %v", tt.args, err)
+			continue
+		}
+		if err == nil && (cfg.subsystem != tt.subsystem || cfg.noCommand != tt.noCommand) {
+			t.Errorf("%v: %q %v", tt.args, cfg.subsystem, cfg.noCommand)
+		}
+	}
+}
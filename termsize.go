@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ysuzuki-bysystems/myssh/tty"
+)
+
+// parseTermSize parses COLSxROWS.
+func parseTermSize(s string) (tty.Winsize, error) {
+	cols, rows, ok := strings.Cut(strings.ToLower(s), "x")
+	if !ok {
+		return tty.Winsize{}, fmt.Errorf("Invalid terminal size: %s", s)
+	}
+
+	w, err := strconv.Atoi(cols)
+	if err != nil || w <= 0 {
+		return tty.Winsize{}, fmt.Errorf("Invalid terminal size: %s", s)
+	}
+	h, err := strconv.Atoi(rows)
+	if err != nil || h <= 0 {
+		return tty.Winsize{}, fmt.Errorf("Invalid terminal size: %s", s)
+	}
+
+	return tty.Winsize{H: h, W: w}, nil
+}
+
+// terminalSize queries the terminal size. When it cannot be determined,
+// the override (COLSxROWS) or COLUMNS / LINES are used instead.
+func terminalSize(query func() (tty.Winsize, error), override string, getenv func(string) string) (tty.Winsize, error) {
+	size, err := query()
+	if err == nil {
+		return size, nil
+	}
+
+	if override != "" {
+		return parseTermSize(override)
+	}
+
+	cols, lines := getenv("COLUMNS"), getenv("LINES")
+	if cols != "" && lines != "" {
+		return parseTermSize(cols + "x" + lines)
+	}
+
+	return tty.Winsize{}, err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ysuzuki-bysystems/myssh/tty"
+)
+
+func TestTerminalSize(t *testing.T) {
+	failed := func() (tty.Winsize, error) {
+		return tty.Winsize{}, errors.New("inappropriate ioctl for device")
+	}
+	env := func(vals map[string]string) func(string) string {
+		return func(k string) string {
+			return vals[k]
+		}
+	}
+
+	tests := []struct {
+		name     string
+		query    func() (tty.Winsize, error)
+		override string
+		env      map[string]string
+		want     tty.Winsize
+		err      bool
+	}{
+		{
+			name: "terminal",
+			query: func() (tty.Winsize, error) {
+				return tty.Winsize{H: 24, W: 80}, nil
+			},
+			override: "100x30",
+			want:     tty.Winsize{H: 24, W: 80},
+		},
+		{
+			name:     "override",
+			query:    failed,
+			override: "132x43",
+			env:      map[string]string{"COLUMNS": "100", "LINES": "30"},
+			want:     tty.Winsize{H: 43, W: 132},
+		},
+		{
+			name:  "env",
+			query: failed,
+			env:   map[string]string{"COLUMNS": "100", "LINES": "30"},
+			want:  tty.Winsize{H: 30, W: 100},
+		},
+		{
+			name:  "columns only",
+			query: failed,
+			env:   map[string]string{"COLUMNS": "100"},
+			err:   true,
+		},
+		{
+			name:     "invalid",
+			query:    failed,
+			override: "100",
+			err:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := terminalSize(tt.query, tt.override, env(tt.env))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: must fail", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: %v", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package tty
+
+// codePageUTF8 is CP_UTF8.
+const codePageUTF8 = 65001
+
+// codePager is the output code page of the console.
+type codePager interface {
+	outputCP() (uint32, error)
+	setOutputCP(cp uint32) error
+}
+
+// switchToUTF8 sets the output code page to UTF-8, for the bytes written to
+// the console other than by WriteConsoleW, and returns the function
+// restoring the original. The restore does nothing when it was UTF-8
+// already.
+func switchToUTF8(cp codePager) (func() error, error) {
+	orig, err := cp.outputCP()
+	if err != nil {
+		return nil, err
+	}
+	if orig == codePageUTF8 {
+		return func() error { return nil }, nil
+	}
+
+	if err := cp.setOutputCP(codePageUTF8); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return cp.setOutputCP(orig)
+	}, nil
+}
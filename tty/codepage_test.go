@@ -0,0 +1,65 @@
+package tty
+
+import (
+	"errors"
+	"testing"
+)
+
+type fakeCodePager struct {
+	cp     uint32
+	setErr error
+	sets   int
+}
+
+func (c *fakeCodePager) outputCP() (uint32, error) {
+	return c.cp, nil
+}
+
+func (c *fakeCodePager) setOutputCP(cp uint32) error {
+	if c.setErr != nil {
+		return c.setErr
+	}
+	c.cp = cp
+	c.sets++
+	return nil
+}
+
+func TestSwitchToUTF8(t *testing.T) {
+	// Japanese (Shift_JIS)
+	c := &fakeCodePager{cp: 932}
+	restore, err := switchToUTF8(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.cp != codePageUTF8 {
+		t.Fatalf("%d", c.cp)
+	}
+	if err := restore(); err != nil {
+		t.Fatal(err)
+	}
+	if c.cp != 932 {
+		t.Fatalf("not restored: %d", c.cp)
+	}
+
+	// UTF-8 already, left alone.
+	c = &fakeCodePager{cp: codePageUTF8}
+	restore, err = switchToUTF8(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(); err != nil {
+		t.Fatal(err)
+	}
+	if c.sets != 0 {
+		t.Fatalf("%d sets", c.sets)
+	}
+
+	// Not changeable, the original stays.
+	c = &fakeCodePager{cp: 936, setErr: errors.New("denied")}
+	if _, err := switchToUTF8(c); err == nil {
+		t.Fatal("must fail")
+	}
+	if c.cp != 936 {
+		t.Fatalf("%d", c.cp)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package tty
+
+import "golang.org/x/sys/windows"
+
+// consoleCodePage is the code page of the console attached to the process.
+type consoleCodePage struct{}
+
+func (consoleCodePage) outputCP() (uint32, error) {
+	return windows.GetConsoleOutputCP()
+}
+
+func (consoleCodePage) setOutputCP(cp uint32) error {
+	return windows.SetConsoleOutputCP(cp)
+}
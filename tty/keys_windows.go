@@ -0,0 +1,192 @@
+//go:build windows
+
+package tty
+
+import (
+	"slices"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// REF https://learn.microsoft.com/en-us/windows/console/key-event-record-str
+const (
+	rightAltPressed  = 0x0001
+	leftAltPressed   = 0x0002
+	rightCtrlPressed = 0x0004
+	leftCtrlPressed  = 0x0008
+	shiftPressed     = 0x0010
+)
+
+// REF https://learn.microsoft.com/en-us/windows/win32/inputdev/virtual-key-codes
+const (
+	vkSpace  = 0x20
+	vkPrior  = 0x21
+	vkNext   = 0x22
+	vkEnd    = 0x23
+	vkHome   = 0x24
+	vkLeft   = 0x25
+	vkUp     = 0x26
+	vkRight  = 0x27
+	vkDown   = 0x28
+	vkInsert = 0x2d
+	vkDelete = 0x2e
+	vk2      = 0x32
+	vkF1     = 0x70
+	vkF12    = 0x7b
+	vkPacket = 0xe7
+)
+
+// REF https://invisible-island.net/xterm/ctlseqs/ctlseqs.html#h2-PC-Style-Function-Keys
+var (
+	// CSI <final>, CSI 1 ; <modifier> <final>
+	vtCursorKeys = map[word]byte{
+		vkUp:    'A',
+		vkDown:  'B',
+		vkRight: 'C',
+		vkLeft:  'D',
+		vkHome:  'H',
+		vkEnd:   'F',
+	}
+	// CSI <number> ~, CSI <number> ; <modifier> ~
+	vtTildeKeys = map[word]int{
+		vkInsert:  2,
+		vkDelete:  3,
+		vkPrior:   5,
+		vkNext:    6,
+		vkF1 + 4:  15,
+		vkF1 + 5:  17,
+		vkF1 + 6:  18,
+		vkF1 + 7:  19,
+		vkF1 + 8:  20,
+		vkF1 + 9:  21,
+		vkF1 + 10: 23,
+		vkF12:     24,
+	}
+)
+
+// vtModifier is the xterm modifier parameter. 1 means no modifier.
+func vtModifier(state dword) int {
+	m := 1
+	if state&shiftPressed != 0 {
+		m += 1
+	}
+	if state&(leftAltPressed|rightAltPressed) != 0 {
+		m += 2
+	}
+	if state&(leftCtrlPressed|rightCtrlPressed) != 0 {
+		m += 4
+	}
+	return m
+}
+
+// vtKeySequence translates a key without a character into the xterm escape
+// sequence, for consoles without ENABLE_VIRTUAL_TERMINAL_INPUT. It returns
+// nil for keys not translated.
+func vtKeySequence(vk word, state dword) []byte {
+	mod := vtModifier(state)
+
+	if final, ok := vtCursorKeys[vk]; ok {
+		if mod == 1 {
+			return []byte{0x1b, '[', final}
+		}
+		return []byte("\x1b[1;" + strconv.Itoa(mod) + string(final))
+	}
+
+	if vk >= vkF1 && vk < vkF1+4 {
+		final := byte('P' + (vk - vkF1))
+		if mod == 1 {
+			return []byte{0x1b, 'O', final}
+		}
+		return []byte("\x1b[1;" + strconv.Itoa(mod) + string(final))
+	}
+
+	if n, ok := vtTildeKeys[vk]; ok {
+		if mod == 1 {
+			return []byte("\x1b[" + strconv.Itoa(n) + "~")
+		}
+		return []byte("\x1b[" + strconv.Itoa(n) + ";" + strconv.Itoa(mod) + "~")
+	}
+
+	return nil
+}
+
+// isCtrlNul reports whether the key is Ctrl+Space or Ctrl+@, which type NUL
+// but are reported without a character.
+func isCtrlNul(kr *keyEventRecord) bool {
+	if kr.keyDown == 0 || kr.unicodeChar != 0 {
+		return false
+	}
+	if kr.controlKeyState&(leftCtrlPressed|rightCtrlPressed) == 0 {
+		return false
+	}
+	return kr.virtualKeyCode == vkSpace || kr.virtualKeyCode == vk2
+}
+
+// altPrefixed reports whether the character is typed with Alt, to be sent with
+// the ESC prefix like xterm's metaSendsEscape. AltGr, reported as Ctrl+Alt,
+// types the characters of international layouts and passes through. So
+// does the character composed on the Alt release (Alt+numpad).
+func altPrefixed(kr *keyEventRecord) bool {
+	if kr.keyDown == 0 || kr.virtualKeyCode == vkMenu || kr.unicodeChar == 0 {
+		return false
+	}
+
+	alt := kr.controlKeyState&(leftAltPressed|rightAltPressed) != 0
+	ctrl := kr.controlKeyState&(leftCtrlPressed|rightCtrlPressed) != 0
+	return alt && !ctrl
+}
+
+// maxPacketDowns bounds the characters waiting for their key up.
+const maxPacketDowns = 16
+
+// packetKeyUp reports whether the key up types the character, for the
+// characters without a key, like the IME composition and SendInput with
+// KEYEVENTF_UNICODE. Some IMEs report them on the key up only. downs tracks
+// the ones already typed on the key down, so that they are typed once.
+func packetKeyUp(kr *keyEventRecord, downs *[]wchar) bool {
+	if kr.unicodeChar == 0 || (kr.virtualKeyCode != vkPacket && kr.virtualKeyCode != 0) {
+		return false
+	}
+
+	if kr.keyDown != 0 {
+		if len(*downs) == maxPacketDowns {
+			*downs = (*downs)[1:]
+		}
+		*downs = append(*downs, kr.unicodeChar)
+		return false
+	}
+
+	if i := slices.Index(*downs, kr.unicodeChar); i >= 0 {
+		*downs = slices.Delete(*downs, i, i+1)
+		return false
+	}
+	return true
+}
+
+// appendUTF16 appends the UTF-8 of a UTF-16 code unit. high is the high
+// surrogate pending from the previous unit, and the one pending after c is
+// returned. An unpaired surrogate becomes U+FFFD, never WTF-8, and the unit
+// after it is kept.
+func appendUTF16(buf []byte, high rune, c wchar) ([]byte, rune) {
+	r := rune(c)
+
+	if high != 0 {
+		if isLowSurrogate(r) {
+			return utf8.AppendRune(buf, utf16.DecodeRune(high, r)), 0
+		}
+		buf = utf8.AppendRune(buf, utf8.RuneError)
+	}
+
+	switch {
+	case utf16.IsSurrogate(r) && !isLowSurrogate(r):
+		return buf, r
+	case isLowSurrogate(r):
+		return utf8.AppendRune(buf, utf8.RuneError), 0
+	}
+	return utf8.AppendRune(buf, r), 0
+}
+
+func isLowSurrogate(r rune) bool {
+	return 0xdc00 <= r && r < 0xe000
+}
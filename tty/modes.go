@@ -0,0 +1,45 @@
+package tty
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultSpeed = 38400
+
+// defaultModes are the terminal modes sent when the local terminal has no
+// termios, like the Windows console: the usual cooked mode of a Unix tty.
+func defaultModes() ssh.TerminalModes {
+	return ssh.TerminalModes{
+		ssh.VINTR:    0x03, // ^C
+		ssh.VQUIT:    0x1c, // ^\
+		ssh.VERASE:   0x7f, // DEL
+		ssh.VKILL:    0x15, // ^U
+		ssh.VEOF:     0x04, // ^D
+		ssh.VSTART:   0x11, // ^Q
+		ssh.VSTOP:    0x13, // ^S
+		ssh.VSUSP:    0x1a, // ^Z
+		ssh.VREPRINT: 0x12, // ^R
+		ssh.VWERASE:  0x17, // ^W
+		ssh.VLNEXT:   0x16, // ^V
+		ssh.VDISCARD: 0x0f, // ^O
+
+		ssh.ICRNL:   1,
+		ssh.IXON:    1,
+		ssh.IMAXBEL: 1,
+		ssh.IUTF8:   1,
+		ssh.ISIG:    1,
+		ssh.ICANON:  1,
+		ssh.ECHO:    1,
+		ssh.ECHOE:   1,
+		ssh.ECHOK:   1,
+		ssh.IEXTEN:  1,
+		ssh.ECHOCTL: 1,
+		ssh.ECHOKE:  1,
+		ssh.OPOST:   1,
+		ssh.ONLCR:   1,
+		ssh.CS8:     1,
+
+		ssh.TTY_OP_ISPEED: defaultSpeed,
+		ssh.TTY_OP_OSPEED: defaultSpeed,
+	}
+}
@@ -0,0 +1,15 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package tty
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const ioctlReadTermios = unix.TIOCGETA
+
+var osInputFlags = map[uint8]uint64{}
+
+func termiosSpeed(tio *unix.Termios) (uint32, uint32) {
+	return uint32(tio.Ispeed), uint32(tio.Ospeed)
+}
@@ -0,0 +1,11 @@
+//go:build unix && !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package tty
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+func readModes(fd int) ssh.TerminalModes {
+	return defaultModes()
+}
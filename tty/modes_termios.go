@@ -0,0 +1,123 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package tty
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// REF https://datatracker.ietf.org/doc/html/rfc4254#section-8
+var (
+	termiosChars = map[uint8]int{
+		ssh.VINTR:    unix.VINTR,
+		ssh.VQUIT:    unix.VQUIT,
+		ssh.VERASE:   unix.VERASE,
+		ssh.VKILL:    unix.VKILL,
+		ssh.VEOF:     unix.VEOF,
+		ssh.VEOL:     unix.VEOL,
+		ssh.VEOL2:    unix.VEOL2,
+		ssh.VSTART:   unix.VSTART,
+		ssh.VSTOP:    unix.VSTOP,
+		ssh.VSUSP:    unix.VSUSP,
+		ssh.VREPRINT: unix.VREPRINT,
+		ssh.VWERASE:  unix.VWERASE,
+		ssh.VLNEXT:   unix.VLNEXT,
+		ssh.VDISCARD: unix.VDISCARD,
+	}
+	termiosInputFlags = map[uint8]uint64{
+		ssh.IGNPAR:  unix.IGNPAR,
+		ssh.PARMRK:  unix.PARMRK,
+		ssh.INPCK:   unix.INPCK,
+		ssh.ISTRIP:  unix.ISTRIP,
+		ssh.INLCR:   unix.INLCR,
+		ssh.IGNCR:   unix.IGNCR,
+		ssh.ICRNL:   unix.ICRNL,
+		ssh.IXON:    unix.IXON,
+		ssh.IXANY:   unix.IXANY,
+		ssh.IXOFF:   unix.IXOFF,
+		ssh.IMAXBEL: unix.IMAXBEL,
+	}
+	termiosLocalFlags = map[uint8]uint64{
+		ssh.ISIG:    unix.ISIG,
+		ssh.ICANON:  unix.ICANON,
+		ssh.ECHO:    unix.ECHO,
+		ssh.ECHOE:   unix.ECHOE,
+		ssh.ECHOK:   unix.ECHOK,
+		ssh.ECHONL:  unix.ECHONL,
+		ssh.NOFLSH:  unix.NOFLSH,
+		ssh.TOSTOP:  unix.TOSTOP,
+		ssh.IEXTEN:  unix.IEXTEN,
+		ssh.ECHOCTL: unix.ECHOCTL,
+		ssh.ECHOKE:  unix.ECHOKE,
+		ssh.PENDIN:  unix.PENDIN,
+	}
+	termiosOutputFlags = map[uint8]uint64{
+		ssh.OPOST:  unix.OPOST,
+		ssh.ONLCR:  unix.ONLCR,
+		ssh.OCRNL:  unix.OCRNL,
+		ssh.ONOCR:  unix.ONOCR,
+		ssh.ONLRET: unix.ONLRET,
+	}
+	termiosControlFlags = map[uint8]uint64{
+		ssh.PARENB: unix.PARENB,
+		ssh.PARODD: unix.PARODD,
+	}
+)
+
+func flagModes(modes ssh.TerminalModes, table map[uint8]uint64, flags uint64) {
+	for op, mask := range table {
+		modes[op] = 0
+		if flags&mask != 0 {
+			modes[op] = 1
+		}
+	}
+}
+
+func boolMode(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// termiosModes translates termios to the terminal modes like ssh.
+// REF https://github.com/openssh/openssh-portable/blob/V_9_9_P1/ttymodes.c (ssh_tty_make_modes)
+func termiosModes(tio *unix.Termios) ssh.TerminalModes {
+	modes := ssh.TerminalModes{}
+
+	for op, i := range termiosChars {
+		modes[op] = uint32(tio.Cc[i])
+	}
+
+	flagModes(modes, termiosInputFlags, uint64(tio.Iflag))
+	flagModes(modes, osInputFlags, uint64(tio.Iflag))
+	flagModes(modes, termiosLocalFlags, uint64(tio.Lflag))
+	flagModes(modes, termiosOutputFlags, uint64(tio.Oflag))
+	flagModes(modes, termiosControlFlags, uint64(tio.Cflag))
+
+	csize := uint64(tio.Cflag) & unix.CSIZE
+	modes[ssh.CS7] = boolMode(csize == unix.CS7)
+	modes[ssh.CS8] = boolMode(csize == unix.CS8)
+
+	ispeed, ospeed := termiosSpeed(tio)
+	if ispeed == 0 {
+		ispeed = defaultSpeed
+	}
+	if ospeed == 0 {
+		ospeed = defaultSpeed
+	}
+	modes[ssh.TTY_OP_ISPEED] = ispeed
+	modes[ssh.TTY_OP_OSPEED] = ospeed
+
+	return modes
+}
+
+// readModes reads the terminal modes of fd, defaultModes if it cannot.
+func readModes(fd int) ssh.TerminalModes {
+	tio, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	if err != nil {
+		return defaultModes()
+	}
+	return termiosModes(tio)
+}
@@ -0,0 +1,151 @@
+//go:build windows
+
+package tty
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+const mouseEvent = 0x2
+
+type coord struct {
+	x int16
+	y int16
+}
+
+// REF https://learn.microsoft.com/en-us/windows/console/mouse-event-record-str
+type mouseEventRecord struct {
+	mousePosition   coord
+	buttonState     dword
+	controlKeyState dword
+	eventFlags      dword
+}
+
+const (
+	fromLeft1stButtonPressed = 0x0001
+	rightmostButtonPressed   = 0x0002
+	fromLeft2ndButtonPressed = 0x0004
+
+	mouseButtonsMask = fromLeft1stButtonPressed | rightmostButtonPressed | fromLeft2ndButtonPressed
+)
+
+const (
+	mouseMoved    = 0x0001
+	doubleClick   = 0x0002
+	mouseWheeled  = 0x0004
+	mouseHwheeled = 0x0008
+)
+
+// REF https://invisible-island.net/xterm/ctlseqs/ctlseqs.html#h2-Mouse-Tracking
+var sgrButtons = []struct {
+	mask dword
+	code int
+}{
+	{fromLeft1stButtonPressed, 0},
+	{fromLeft2ndButtonPressed, 1},
+	{rightmostButtonPressed, 2},
+}
+
+func sgrModifiers(state dword) int {
+	code := 0
+	if state&shiftPressed != 0 {
+		code |= 4
+	}
+	if state&(leftAltPressed|rightAltPressed) != 0 {
+		code |= 8
+	}
+	if state&(leftCtrlPressed|rightCtrlPressed) != 0 {
+		code |= 16
+	}
+	return code
+}
+
+func appendSgrMouse(buf []byte, code, x, y int, press bool) []byte {
+	final := 'M'
+	if !press {
+		final = 'm'
+	}
+	return fmt.Appendf(buf, "\x1b[<%d;%d;%d%c", code, x, y, final)
+}
+
+// sgrMouse appends the SGR 1006 sequences for the mouse event. prev is the
+// button state of the previous event, x and y the 1-based window position.
+//
+// The console reports the button state only, so the presses and releases
+// are told from the change.
+func sgrMouse(buf []byte, mr *mouseEventRecord, prev dword, x, y int) []byte {
+	mods := sgrModifiers(mr.controlKeyState)
+
+	switch {
+	case mr.eventFlags&mouseWheeled != 0:
+		// The high word is the signed distance, positive for away from the user.
+		code := 65
+		if int16(mr.buttonState>>16) > 0 {
+			code = 64
+		}
+		return appendSgrMouse(buf, code|mods, x, y, true)
+
+	case mr.eventFlags&mouseHwheeled != 0:
+		code := 66
+		if int16(mr.buttonState>>16) > 0 {
+			code = 67
+		}
+		return appendSgrMouse(buf, code|mods, x, y, true)
+
+	case mr.eventFlags&mouseMoved != 0:
+		// Drags only. The motion without buttons needs the any-event
+		// tracking the remote may not have asked for.
+		for _, b := range sgrButtons {
+			if mr.buttonState&b.mask != 0 {
+				return appendSgrMouse(buf, (b.code+32)|mods, x, y, true)
+			}
+		}
+		return buf
+
+	default:
+		for _, b := range sgrButtons {
+			pressed := mr.buttonState&b.mask != 0
+			if pressed == (prev&b.mask != 0) {
+				continue
+			}
+			buf = appendSgrMouse(buf, b.code|mods, x, y, pressed)
+		}
+		return buf
+	}
+}
+
+func (t *tty) enableMouse() error {
+	// mintty reports the mouse by itself.
+	if t.msys {
+		return nil
+	}
+
+	h := windows.Handle(t.in.Fd())
+
+	var mode uint32
+	if err := windows.GetConsoleMode(h, &mode); err != nil {
+		return err
+	}
+
+	// Quick edit takes the mouse for the selection.
+	mode |= windows.ENABLE_MOUSE_INPUT | windows.ENABLE_EXTENDED_FLAGS
+	mode &^= windows.ENABLE_QUICK_EDIT_MODE
+	if err := windows.SetConsoleMode(h, mode); err != nil {
+		return err
+	}
+
+	t.mouse = true
+	return nil
+}
+
+// consoleWindowOrigin returns the buffer position of the window, as the
+// mouse events are in the buffer coordinates.
+func (t *tty) consoleWindowOrigin() (int, int, error) {
+	var info windows.ConsoleScreenBufferInfo
+	if err := windows.GetConsoleScreenBufferInfo(windows.Handle(t.out.Fd()), &info); err != nil {
+		return 0, 0, err
+	}
+	return int(info.Window.Left), int(info.Window.Top), nil
+}
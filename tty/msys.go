@@ -0,0 +1,38 @@
+package tty
+
+import (
+	"fmt"
+	"strings"
+)
+
+// isMsysPtyName reports whether the pipe name is of the pty of MSYS2 or
+// Cygwin, like mintty, \msys-dd50a72ab4668b33-pty0-to-master.
+// REF https://github.com/mattn/go-isatty/blob/v0.0.20/isatty_windows.go
+func isMsysPtyName(name string) bool {
+	name = strings.TrimPrefix(name, `\`)
+
+	rest, ok := strings.CutPrefix(name, "msys-")
+	if !ok {
+		rest, ok = strings.CutPrefix(name, "cygwin-")
+	}
+	if !ok {
+		return false
+	}
+
+	// The hash, ptyN and the direction.
+	parts := strings.Split(rest, "-")
+	if len(parts) < 4 || !strings.HasPrefix(parts[1], "pty") {
+		return false
+	}
+	dir := strings.Join(parts[2:], "-")
+	return dir == "from-master" || dir == "to-master"
+}
+
+// parseSttySize parses the output of `stty size`, the rows and the columns.
+func parseSttySize(s string) (Winsize, error) {
+	var ws Winsize
+	if _, err := fmt.Sscanf(s, "%d %d", &ws.H, &ws.W); err != nil {
+		return Winsize{}, fmt.Errorf("Bad stty size: %q", s)
+	}
+	return ws, nil
+}
@@ -0,0 +1,39 @@
+package tty
+
+import (
+	"testing"
+)
+
+func TestIsMsysPtyName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{`\msys-dd50a72ab4668b33-pty0-to-master`, true},
+		{`\msys-dd50a72ab4668b33-pty1-from-master`, true},
+		{`\cygwin-e022582115c10879-pty4-from-master`, true},
+		{`\msys-dd50a72ab4668b33-pty0-from-master-cyg`, false},
+		{`\msys-dd50a72ab4668b33-pipe-0x1`, false},
+		{`\Device\NamedPipe\other`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		if got := isMsysPtyName(tt.name); got != tt.want {
+			t.Errorf("%s: %v", tt.name, got)
+		}
+	}
+}
+
+func TestParseSttySize(t *testing.T) {
+	ws, err := parseSttySize("24 80\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws != (Winsize{H: 24, W: 80}) {
+		t.Fatalf("%#v", ws)
+	}
+
+	if _, err := parseSttySize("stty: standard input: Not a tty\n"); err == nil {
+		t.Fatal("must fail")
+	}
+}
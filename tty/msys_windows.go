@@ -0,0 +1,82 @@
+//go:build windows
+
+package tty
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/term"
+)
+
+// isMsysPty reports whether h is the pty of MSYS2 or Cygwin, a named pipe
+// rather than a console.
+func isMsysPty(h uintptr) bool {
+	ft, err := windows.GetFileType(windows.Handle(h))
+	if err != nil || ft != windows.FILE_TYPE_PIPE {
+		return false
+	}
+
+	// FILE_NAME_INFO, the length in bytes then the name.
+	var buf [4 + windows.MAX_PATH*2]byte
+	if err := windows.GetFileInformationByHandleEx(windows.Handle(h), windows.FileNameInfo, &buf[0], uint32(len(buf))); err != nil {
+		return false
+	}
+	n := min(*(*uint32)(unsafe.Pointer(&buf[0]))/2, windows.MAX_PATH)
+	name := unsafe.Slice((*uint16)(unsafe.Pointer(&buf[4])), n)
+	return isMsysPtyName(windows.UTF16ToString(name))
+}
+
+func isTerminal(fd uintptr) bool {
+	return term.IsTerminal(int(fd)) || isMsysPty(fd)
+}
+
+// stty runs the stty of MSYS2 / Cygwin on in, the only way to the modes of
+// its pty.
+func stty(in *os.File, args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = in
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// openMsysTty opens the pty of MSYS2 / Cygwin, like mintty. It speaks VT
+// already, the bytes are passed through. The window changes are not
+// notified, and a pending read is not canceled by close.
+func openMsysTty(in, out *os.File, sigwinchCh chan struct{}, opts Options) (*tty, error) {
+	saved, err := stty(in, "-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty(in, "raw", "-echo"); err != nil {
+		return nil, err
+	}
+
+	cx, cancel := context.WithCancel(context.Background())
+	t := &tty{
+		in:         in,
+		opts:       opts,
+		out:        out,
+		cancel:     cancel,
+		wg:         new(sync.WaitGroup),
+		sigwinchCh: sigwinchCh,
+		msys:       true,
+		sttyState:  saved,
+	}
+	t.watch(cx)
+
+	return t, nil
+}
+
+func (t *tty) msysSize() (Winsize, error) {
+	s, err := stty(t.in, "size")
+	if err != nil {
+		return Winsize{}, err
+	}
+	return parseSttySize(s)
+}
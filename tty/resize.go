@@ -0,0 +1,47 @@
+package tty
+
+import (
+	"time"
+)
+
+// resizeDebounce is the wait for a burst of resizes, like dragging the
+// window edge, to settle.
+var resizeDebounce = 50 * time.Millisecond
+
+// watchResize delivers the size on resize once per burst of notifications,
+// until done. Only the latest size is kept when the receiver lags. resize is
+// closed on return.
+func watchResize(notify <-chan struct{}, done <-chan struct{}, size func() (Winsize, error), resize chan Winsize) {
+	defer close(resize)
+
+	for {
+		select {
+		case <-notify:
+		case <-done:
+			return
+		}
+
+		select {
+		case <-time.After(resizeDebounce):
+		case <-done:
+			return
+		}
+		// Folded into this one.
+		select {
+		case <-notify:
+		default:
+		}
+
+		ws, err := size()
+		if err != nil {
+			continue
+		}
+
+		// Replace the pending one, if any.
+		select {
+		case <-resize:
+		default:
+		}
+		resize <- ws
+	}
+}
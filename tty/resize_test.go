@@ -0,0 +1,76 @@
+package tty
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWatchResizeCoalesces(t *testing.T) {
+	defer func(d time.Duration) { resizeDebounce = d }(resizeDebounce)
+	resizeDebounce = 20 * time.Millisecond
+
+	notify := make(chan struct{}, 1)
+	done := make(chan struct{})
+	resize := make(chan Winsize, 1)
+
+	var calls int
+	size := func() (Winsize, error) {
+		calls++
+		if calls == 2 {
+			return Winsize{}, errors.New("failed")
+		}
+		return Winsize{H: 24, W: 80 + calls}, nil
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		watchResize(notify, done, size, resize)
+	}()
+
+	// A burst, sent like the tty does.
+	for range 100 {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+
+	select {
+	case ws := <-resize:
+		if ws != (Winsize{H: 24, W: 81}) {
+			t.Fatalf("%#v", ws)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not resized")
+	}
+	select {
+	case <-resize:
+		t.Fatal("resized twice for a burst")
+	case <-time.After(5 * resizeDebounce):
+	}
+
+	// The size failed to be taken is skipped.
+	notify <- struct{}{}
+	select {
+	case <-resize:
+		t.Fatal("resized on the failure")
+	case <-time.After(5 * resizeDebounce):
+	}
+
+	// Only the latest is kept while not received.
+	notify <- struct{}{}
+	time.Sleep(5 * resizeDebounce)
+	notify <- struct{}{}
+	time.Sleep(5 * resizeDebounce)
+	if ws := <-resize; ws != (Winsize{H: 24, W: 84}) {
+		t.Fatalf("%#v", ws)
+	}
+
+	close(done)
+	<-exited
+	if _, ok := <-resize; ok {
+		t.Fatal("not closed")
+	}
+}
@@ -2,47 +2,245 @@ package tty
 
 import (
 	"errors"
+	"io"
 	"os"
+	"sync"
+	"syscall"
+	"time"
 
-	"golang.org/x/term"
+	"github.com/ysuzuki-bysystems/myssh/forward"
+	"golang.org/x/crypto/ssh"
 )
 
+// Winsize is the window size in characters, and in pixels when known (zero
+// otherwise) for the image protocols like sixel.
 type Winsize struct {
-	H int
-	W int
+	H   int
+	W   int
+	Hpx int
+	Wpx int
 }
 
 type Tty struct {
 	tty *tty
+
+	resize    chan Winsize
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newTty(tty *tty, notify <-chan struct{}) *Tty {
+	t := &Tty{
+		tty:    tty,
+		resize: make(chan Winsize, 1),
+		done:   make(chan struct{}),
+	}
+	go watchResize(notify, t.done, tty.size, t.resize)
+	return t
 }
 
 var ErrNotATerminal = errors.New("Not a terminal.")
 
-func OpenTty(sigwinchCh chan interface{}) (*Tty, error) {
-	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+func (t *tty) debugf(format string, args ...any) {
+	if t.opts.Logf != nil {
+		t.opts.Logf(format, args...)
+	}
+}
+
+// Options are of OpenTty and OpenTtyFd, nil of the zero value.
+type Options struct {
+	// Logf receives the failures of no use but for debugging, like
+	// restoring the terminal. nil discards them.
+	Logf func(format string, args ...any)
+
+	// ExitOnSignal terminates the process on SIGINT, SIGTERM and SIGHUP
+	// (the console close on Windows) with 128+signal, unless the Tty is
+	// closed within SignalExitDelay. Otherwise the terminal is restored and
+	// the signal left to the caller, or to its default action.
+	ExitOnSignal bool
+	// SignalExitDelay is how long the caller shutting down on the signals
+	// by itself is given. Zero terminates the process at once.
+	SignalExitDelay time.Duration
+}
+
+// exit terminates the process on the signals, after the terminal is restored.
+var exit = os.Exit
+
+// exitOnSignal terminates the process killed by sig, unless done is closed
+// within delay. exit is read here, on the goroutine of the signals that
+// Close waits for, not by the one left waiting.
+func exitOnSignal(sig syscall.Signal, delay time.Duration, done <-chan struct{}) {
+	code, exit := 128+int(sig), exit
+	if delay <= 0 {
+		exit(code)
+		return
+	}
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+			exit(code)
+		}
+	}()
+}
+
+// OpenTty opens the terminal on stdin / stdout. If either of them is
+// redirected, the controlling terminal (/dev/tty, CONIN$ / CONOUT$) is used instead.
+//
+// The window size changes are delivered on Resize.
+func OpenTty(opts *Options) (*Tty, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	var console io.Closer
+
+	in, out := os.Stdin, os.Stdout
+	if !isTerminal(in.Fd()) || !isTerminal(out.Fd()) {
+		cin, cout, closer, err := openConsole()
+		if err != nil {
+			return nil, ErrNotATerminal
+		}
+		in, out, console = cin, cout, closer
+	}
+
+	notify := make(chan struct{}, 1)
+	tty, err := openTty(in, out, notify, *opts)
+	if err != nil {
+		if console != nil {
+			console.Close()
+		}
+		return nil, err
+	}
+	tty.console = console
+
+	return newTty(tty, notify), nil
+}
+
+// IsTerminal reports whether fd (a handle on Windows) is a terminal, the
+// pty of MSYS2 / Cygwin like mintty included.
+func IsTerminal(fd uintptr) bool {
+	return isTerminal(fd)
+}
+
+// OpenConsole opens the controlling terminal, /dev/tty (CONIN$ / CONOUT$ on
+// Windows), whatever stdin / stdout are redirected to. Closing the closer
+// closes both files.
+func OpenConsole() (in, out *os.File, closer io.Closer, err error) {
+	return openConsole()
+}
+
+type consoleCloser struct {
+	in  *os.File
+	out *os.File
+}
+
+func (c *consoleCloser) Close() error {
+	err1 := c.in.Close()
+	err2 := c.out.Close()
+
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// OpenTtyFd opens the terminal on the given descriptors (handles on
+// Windows), such as the slave of a pty pair. They stay owned by the caller.
+func OpenTtyFd(in, out uintptr, opts *Options) (*Tty, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if !isTerminal(in) || !isTerminal(out) {
 		return nil, ErrNotATerminal
 	}
 
-	tty, err := openTty(sigwinchCh)
+	fin, err := dupFile(in, "tty-in")
+	if err != nil {
+		return nil, err
+	}
+	fout, err := dupFile(out, "tty-out")
+	if err != nil {
+		fin.Close()
+		return nil, err
+	}
+	console := &consoleCloser{fin, fout}
+
+	notify := make(chan struct{}, 1)
+	tty, err := openTty(fin, fout, notify, *opts)
 	if err != nil {
+		console.Close()
 		return nil, err
 	}
+	tty.console = console
 
-	return &Tty { tty: tty }, nil
+	return newTty(tty, notify), nil
 }
 
 func (t *Tty) Close() error {
-	return t.tty.close()
+	err := t.tty.close()
+	t.closeOnce.Do(func() { close(t.done) })
+	return err
 }
 
 func (t *Tty) Read(b []byte) (int, error) {
 	return t.tty.read(b)
 }
 
+// EnableMouse forwards the mouse input of the Windows console as SGR 1006
+// sequences.
+func (t *Tty) EnableMouse() error {
+	return t.tty.enableMouse()
+}
+
+// TranslateOutput interprets the VT sequences of the output with the console
+// API, for the Windows consoles whose VT processing is broken. It is on
+// already when the console lacks VT processing.
+func (t *Tty) TranslateOutput() error {
+	return t.tty.translateOutput()
+}
+
 func (t *Tty) Write(b []byte) (int, error) {
 	return t.tty.write(b)
 }
 
+// sanitizeSequence resets the modes a remote program may leave behind when
+// it dies: the alternate screen, the hidden cursor, the mouse reporting, the
+// bracketed paste, the application cursor keys and keypad, and the SGR.
+const sanitizeSequence = "\x1b[?1049l" + // normal screen
+	"\x1b[?25h" + // cursor shown
+	"\x1b[?1000l\x1b[?1002l\x1b[?1003l\x1b[?1006l" + // no mouse reporting
+	"\x1b[?2004l" + // no bracketed paste
+	"\x1b[?1l\x1b>" + // normal cursor keys and keypad
+	"\x1b[m" // SGR reset
+
+// Sanitize writes the resets of the modes a remote program may have left,
+// like the alternate screen, for the session ended abnormally.
+func (t *Tty) Sanitize() error {
+	_, err := io.WriteString(t, sanitizeSequence)
+	return err
+}
+
+// ReadFrom copies the session output to the terminal, for io.Copy, with the
+// larger buffer of forward.Copy, fewer writes on the bulk output. Each read
+// is written at once, the interactive output is not held.
+func (t *Tty) ReadFrom(src io.Reader) (int64, error) {
+	return forward.Copy(t, src)
+}
+
+// Modes returns the terminal modes for the PTY request, taken from the local
+// terminal before raw mode.
+func (t *Tty) Modes() ssh.TerminalModes {
+	return t.tty.modes()
+}
+
 func (t *Tty) Size() (Winsize, error) {
 	return t.tty.size()
 }
+
+// Resize delivers the new size on the window changes, once per burst. A
+// size not received yet is replaced by the newer one. It is closed by Close.
+func (t *Tty) Resize() <-chan Winsize {
+	return t.resize
+}
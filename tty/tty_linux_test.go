@@ -0,0 +1,518 @@
+//go:build linux
+
+package tty
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+func openpty(t *testing.T) (*os.File, *os.File) {
+	t.Helper()
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("No pty: %s", err)
+	}
+	t.Cleanup(func() { master.Close() })
+
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetUint32(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { slave.Close() })
+
+	return master, slave
+}
+
+func TestOpenTtyFd(t *testing.T) {
+	master, slave := openpty(t)
+
+	if err := unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: 24, Col: 80, Xpixel: 640, Ypixel: 384}); err != nil {
+		t.Fatal(err)
+	}
+
+	tty, err := OpenTtyFd(slave.Fd(), slave.Fd(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := tty.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != (Winsize{H: 24, W: 80, Hpx: 384, Wpx: 640}) {
+		t.Fatalf("%#v", size)
+	}
+
+	// Raw mode: read without a newline, no echo.
+	if _, err := master.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	var b [16]byte
+	n, err := tty.Read(b[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b[:n]); got != "abc" {
+		t.Fatalf("%q", got)
+	}
+
+	if _, err := tty.Write([]byte("out")); err != nil {
+		t.Fatal(err)
+	}
+	n, err = master.Read(b[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b[:n]); got != "out" {
+		t.Fatalf("%q", got)
+	}
+
+	if err := tty.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restored, and the descriptor is left open for the caller.
+	termios, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Lflag&unix.ICANON == 0 {
+		t.Fatal("not restored")
+	}
+
+	if _, err := OpenTtyFd(master.Fd()+100, slave.Fd(), nil); err != ErrNotATerminal {
+		t.Fatal(err)
+	}
+	if !term.IsTerminal(int(slave.Fd())) {
+		t.Fatal("closed")
+	}
+}
+
+func TestRestoreOnSignal(t *testing.T) {
+	_, slave := openpty(t)
+
+	exited := make(chan int, 1)
+	orig := exit
+	exit = func(code int) {
+		exited <- code
+	}
+	t.Cleanup(func() { exit = orig })
+
+	// Exited at once without the delay.
+	tty, err := OpenTtyFd(slave.Fd(), slave.Fd(), &Options{ExitOnSignal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+
+	if err := unix.Kill(unix.Getpid(), unix.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case code := <-exited:
+		if code != 128+int(unix.SIGTERM) {
+			t.Fatalf("%d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not exited")
+	}
+
+	termios, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Lflag&(unix.ICANON|unix.ECHO) != unix.ICANON|unix.ECHO {
+		t.Fatal("not restored")
+	}
+}
+
+func TestModes(t *testing.T) {
+	_, slave := openpty(t)
+
+	tio, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tio.Cc[unix.VERASE] = 0x08
+	tio.Iflag &^= unix.IXON
+	tio.Lflag |= unix.ECHO | unix.ICANON
+	tio.Cflag = tio.Cflag&^unix.CBAUD | unix.B9600
+	if err := unix.IoctlSetTermios(int(slave.Fd()), unix.TCSETS, tio); err != nil {
+		t.Fatal(err)
+	}
+
+	tty, err := OpenTtyFd(slave.Fd(), slave.Fd(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+
+	modes := tty.Modes()
+	want := map[uint8]uint32{
+		ssh.VERASE:        0x08,
+		ssh.VINTR:         uint32(tio.Cc[unix.VINTR]),
+		ssh.IXON:          0,
+		ssh.ECHO:          1,
+		ssh.ICANON:        1,
+		ssh.TTY_OP_ISPEED: 9600,
+		ssh.TTY_OP_OSPEED: 9600,
+	}
+	for op, v := range want {
+		if modes[op] != v {
+			t.Errorf("%d: %d != %d", op, modes[op], v)
+		}
+	}
+}
+
+func TestReadUnblockedByClose(t *testing.T) {
+	_, slave := openpty(t)
+
+	tty, err := OpenTtyFd(slave.Fd(), slave.Fd(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		var b [16]byte
+		_, err := tty.Read(b[:])
+		done <- err
+	}()
+
+	// Let the read block.
+	time.Sleep(50 * time.Millisecond)
+
+	if err := tty.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read not unblocked by Close.")
+	}
+
+	var b [16]byte
+	if _, err := tty.Read(b[:]); err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	defer func(d time.Duration) { resizeDebounce = d }(resizeDebounce)
+	resizeDebounce = time.Millisecond
+
+	master, slave := openpty(t)
+
+	tty, err := OpenTtyFd(slave.Fd(), slave.Fd(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: 50, Col: 132}); err != nil {
+		t.Fatal(err)
+	}
+	// Not the controlling terminal, no SIGWINCH from the pty itself.
+	if err := unix.Kill(unix.Getpid(), unix.SIGWINCH); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case size := <-tty.Resize():
+		if size != (Winsize{H: 50, W: 132}) {
+			t.Fatalf("%#v", size)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not resized")
+	}
+
+	if err := tty.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-tty.Resize():
+		if ok {
+			t.Fatal("resized after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not closed")
+	}
+}
+
+func TestRestoreErrorLogged(t *testing.T) {
+	for _, quiet := range []bool{false, true} {
+		_, slave := openpty(t)
+
+		var logged []string
+		logf := func(format string, args ...any) {
+			logged = append(logged, fmt.Sprintf(format, args...))
+		}
+		if quiet {
+			logf = nil
+		}
+
+		var std bytes.Buffer
+		log.SetOutput(&std)
+
+		tty, err := OpenTtyFd(slave.Fd(), slave.Fd(), &Options{Logf: logf})
+		if err != nil {
+			log.SetOutput(os.Stderr)
+			t.Fatal(err)
+		}
+		// Restoring fails on the closed descriptor.
+		tty.tty.in.Close()
+		tty.Close()
+		log.SetOutput(os.Stderr)
+
+		if std.Len() != 0 {
+			t.Fatalf("%v: %q", quiet, std.String())
+		}
+		if quiet != (len(logged) == 0) {
+			t.Fatalf("%v: %q", quiet, logged)
+		}
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	master, slave := openpty(t)
+
+	tty, err := OpenTtyFd(slave.Fd(), slave.Fd(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(tty, r)
+		done <- err
+	}()
+
+	// The interactive output is written at once, not held for the buffer.
+	go w.Write([]byte("$ "))
+	var b [16]byte
+	n, err := master.Read(b[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b[:n]); got != "$ " {
+		t.Fatalf("%q", got)
+	}
+
+	bulk := bytes.Repeat([]byte("x"), 300*1024)
+	go func() {
+		w.Write(bulk)
+		w.Close()
+	}()
+	got, err := io.ReadAll(io.LimitReader(master, int64(len(bulk))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bulk) {
+		t.Fatalf("%d bytes", len(got))
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	master, slave := openpty(t)
+
+	tty, err := OpenTtyFd(slave.Fd(), slave.Fd(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+
+	if err := tty.Sanitize(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(io.LimitReader(master, int64(len(sanitizeSequence))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reset := range []string{
+		"\x1b[?1049l", // alternate screen
+		"\x1b[?25h",   // cursor
+		"\x1b[?1000l", // mouse
+		"\x1b[?1006l",
+		"\x1b[?2004l", // bracketed paste
+		"\x1b>",       // keypad
+	} {
+		if !bytes.Contains(got, []byte(reset)) {
+			t.Errorf("%q not in %q", reset, got)
+		}
+	}
+	// The SGR last, after the screen switched back.
+	if !bytes.HasSuffix(got, []byte("\x1b[m")) {
+		t.Errorf("%q", got)
+	}
+}
+
+func TestSignalExitDelay(t *testing.T) {
+	_, slave := openpty(t)
+
+	exited := make(chan int, 1)
+	orig := exit
+	exit = func(code int) {
+		exited <- code
+	}
+	t.Cleanup(func() { exit = orig })
+	opts := &Options{ExitOnSignal: true, SignalExitDelay: 100 * time.Millisecond}
+
+	// Closed by the caller in time, not exited.
+	tty, err := OpenTtyFd(slave.Fd(), slave.Fd(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Kill(unix.Getpid(), unix.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		termios, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if termios.Lflag&unix.ICANON != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not restored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tty.Close()
+	select {
+	case code := <-exited:
+		t.Fatalf("exited %d", code)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// Exited after the delay otherwise.
+	tty, err = OpenTtyFd(slave.Fd(), slave.Fd(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+	if err := unix.Kill(unix.Getpid(), unix.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-exited:
+		if code != 128+int(unix.SIGHUP) {
+			t.Fatalf("%d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not exited")
+	}
+}
+
+func TestSignalRaised(t *testing.T) {
+	_, slave := openpty(t)
+
+	exited := make(chan int, 1)
+	orig := exit
+	exit = func(code int) {
+		exited <- code
+	}
+	t.Cleanup(func() { exit = orig })
+
+	// The caller's own handling, not to be killed by the default action.
+	caught := make(chan os.Signal, 2)
+	signal.Notify(caught, unix.SIGHUP)
+	defer signal.Stop(caught)
+
+	tty, err := OpenTtyFd(slave.Fd(), slave.Fd(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+	if err := unix.Kill(unix.Getpid(), unix.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	// The signal itself, and raised again with the terminal restored.
+	for range 2 {
+		select {
+		case <-caught:
+		case <-time.After(time.Second):
+			t.Fatal("not raised")
+		}
+	}
+	termios, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Lflag&unix.ICANON == 0 {
+		t.Fatal("not restored")
+	}
+
+	select {
+	case code := <-exited:
+		t.Fatalf("exited %d", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReadHighFd(t *testing.T) {
+	master, slave := openpty(t)
+
+	// Take the fds up to past FD_SETSIZE, the tty and its pipe are beyond.
+	for {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Skip(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		if f.Fd() > 1100 {
+			break
+		}
+	}
+
+	tty, err := OpenTtyFd(slave.Fd(), slave.Fd(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+
+	if _, err := master.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	var b [16]byte
+	n, err := tty.Read(b[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "x" {
+		t.Fatalf("%q", b[:n])
+	}
+}
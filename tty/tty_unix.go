@@ -4,41 +4,111 @@ package tty
 
 import (
 	"context"
-	"log"
+	"io"
+	"maps"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
 	"golang.org/x/term"
 )
 
 type tty struct {
-	cancel context.CancelFunc
-	wg     *sync.WaitGroup
+	in      *os.File
+	out     *os.File
+	console io.Closer
+	cancel  context.CancelFunc
+	wg      *sync.WaitGroup
+	opts    Options
+
+	// mu serializes the terminal mode changes of suspend / resume and close.
+	mu       sync.Mutex
+	prev     *term.State
+	restored bool
+
+	// termModes are the modes before raw mode.
+	termModes ssh.TerminalModes
+
+	// closeW is closed by close to wake the read waiting on closeR. closeR
+	// is closed once no read waits, under readMu.
+	closeR *os.File
+	closeW *os.File
+	readMu sync.RWMutex
+	closed atomic.Bool
+}
+
+func openConsole() (*os.File, *os.File, io.Closer, error) {
+	f, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return f, f, f, nil
+}
+
+func isTerminal(fd uintptr) bool {
+	return term.IsTerminal(int(fd))
 }
 
-func openTty(sigwinchCh chan interface{}) (*tty, error) {
+func dupFile(fd uintptr, name string) (*os.File, error) {
+	dup, err := syscall.Dup(int(fd))
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(dup)
+	return os.NewFile(uintptr(dup), name), nil
+}
+
+func openTty(in, out *os.File, sigwinchCh chan struct{}, opts Options) (*tty, error) {
 	wg := new(sync.WaitGroup)
 	cx, cancel := context.WithCancel(context.Background())
 
-	prev, err := term.MakeRaw(int(os.Stdin.Fd()))
+	termModes := readModes(int(in.Fd()))
+
+	closeR, closeW, err := os.Pipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	prev, err := term.MakeRaw(int(in.Fd()))
 	if err != nil {
+		closeR.Close()
+		closeW.Close()
 		cancel()
 		return nil, err
 	}
+
+	t := &tty{
+		in:        in,
+		opts:      opts,
+		out:       out,
+		cancel:    cancel,
+		wg:        wg,
+		prev:      prev,
+		termModes: termModes,
+		closeR:    closeR,
+		closeW:    closeW,
+	}
+
 	wg.Add(1)
 	context.AfterFunc(cx, func() {
 		defer wg.Done()
 
-		if err := term.Restore(int(os.Stdin.Fd()), prev); err != nil {
-			log.Println(err)
-		}
+		t.restore()
 	})
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGWINCH)
+	c := make(chan os.Signal, 4)
+	signal.Notify(c, syscall.SIGWINCH, syscall.SIGTSTP, syscall.SIGCONT)
+	// The terminating signals apart, to be stopped alone.
+	killed := make(chan os.Signal, 1)
+	signal.Notify(killed, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	context.AfterFunc(cx, func() {
+		signal.Stop(killed)
 		signal.Stop(c)
 		close(c)
 	})
@@ -47,44 +117,176 @@ func openTty(sigwinchCh chan interface{}) (*tty, error) {
 	go func() {
 		defer wg.Done()
 
-		for sig := range c {
-			if sig != syscall.SIGWINCH {
+		for {
+			var sig os.Signal
+			select {
+			case s, ok := <-c:
+				if !ok {
+					return
+				}
+				sig = s
+			case s := <-killed:
+				// Killed with the terminal in raw mode. The deferred Close
+				// runs only if the caller shuts down on the signal as well.
+				t.restore()
+				if t.opts.ExitOnSignal {
+					exitOnSignal(s.(syscall.Signal), t.opts.SignalExitDelay, cx.Done())
+					continue
+				}
+				// Raised again without ours, for the handling of the
+				// caller or the default action.
+				signal.Stop(killed)
+				if err := syscall.Kill(syscall.Getpid(), s.(syscall.Signal)); err != nil {
+					t.debugf("Raising %s: %s", s, err)
+				}
+				continue
+			}
+
+			switch sig {
+			case syscall.SIGTSTP:
+				t.suspend(c)
+			case syscall.SIGCONT:
+				// Stopped by other than SIGTSTP, like SIGSTOP. The shell may
+				// have reset the terminal.
+				t.makeRaw()
+			case syscall.SIGWINCH:
+			default:
 				continue
 			}
 
+			// The remote repaints on the window change.
 			select {
-			case sigwinchCh <- nil:
+			case sigwinchCh <- struct{}{}:
 			default:
 			}
 		}
 	}()
 
-	return &tty{
-		cancel: cancel,
-		wg:     wg,
-	}, nil
+	return t, nil
+}
+
+// restore leaves raw mode for good.
+func (t *tty) restore() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.restored {
+		return
+	}
+	t.restored = true
+
+	if err := term.Restore(int(t.in.Fd()), t.prev); err != nil {
+		t.debugf("Restoring the terminal: %s", err)
+	}
+}
+
+// suspend stops the process with the terminal restored, like a shell
+// foreground job, and enters raw mode again when continued.
+func (t *tty) suspend(c chan<- os.Signal) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.restored {
+		return
+	}
+
+	if err := term.Restore(int(t.in.Fd()), t.prev); err != nil {
+		t.debugf("Restoring the terminal: %s", err)
+	}
+
+	// Re-raise with the default action, which stops the process until SIGCONT.
+	signal.Reset(syscall.SIGTSTP)
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTSTP); err != nil {
+		t.debugf("Suspending: %s", err)
+	}
+	signal.Notify(c, syscall.SIGTSTP)
+
+	if _, err := term.MakeRaw(int(t.in.Fd())); err != nil {
+		t.debugf("Entering raw mode: %s", err)
+	}
+}
+
+// makeRaw enters raw mode again, unless closed.
+func (t *tty) makeRaw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.restored {
+		return
+	}
+
+	if _, err := term.MakeRaw(int(t.in.Fd())); err != nil {
+		t.debugf("Entering raw mode: %s", err)
+	}
 }
 
 func (t *tty) close() error {
+	if t.closed.Swap(true) {
+		return nil
+	}
+
+	// Wake the pending read first, it stops consuming the input.
+	t.closeW.Close()
+	t.readMu.Lock()
+	t.closeR.Close()
+	t.readMu.Unlock()
+
 	t.cancel()
 
 	t.wg.Wait()
+
+	if t.console != nil {
+		return t.console.Close()
+	}
 	return nil
 }
 
+// read waits for the input with waitInput, so that close wakes it with
+// io.EOF. A blocking read of the terminal is never interrupted by closing
+// it.
 func (t *tty) read(p []byte) (int, error) {
-	return os.Stdin.Read(p)
+	t.readMu.RLock()
+	defer t.readMu.RUnlock()
+
+	if t.closed.Load() {
+		return 0, io.EOF
+	}
+
+	closed, err := waitInput(int(t.in.Fd()), int(t.closeR.Fd()))
+	if err != nil {
+		return 0, err
+	}
+	if closed {
+		return 0, io.EOF
+	}
+	return t.in.Read(p)
+}
+
+func (t *tty) modes() ssh.TerminalModes {
+	return maps.Clone(t.termModes)
+}
+
+// enableMouse is a no-op. The terminal reports the mouse by itself when
+// the remote asks.
+func (t *tty) enableMouse() error {
+	return nil
+}
+
+// translateOutput is a no-op. The terminals interpret the VT sequences.
+func (t *tty) translateOutput() error {
+	return nil
 }
 
 func (t *tty) write(p []byte) (int, error) {
-	return os.Stdout.Write(p)
+	return t.out.Write(p)
 }
 
 func (t *tty) size() (Winsize, error) {
-	w, h, err := term.GetSize(int(os.Stdout.Fd()))
+	// The whole winsize, term.GetSize drops the pixels.
+	ws, err := unix.IoctlGetWinsize(int(t.out.Fd()), unix.TIOCGWINSZ)
 	if err != nil {
 		return Winsize{}, err
 	}
 
-	return Winsize{W: w, H: h}, nil
+	return Winsize{W: int(ws.Col), H: int(ws.Row), Wpx: int(ws.Xpixel), Hpx: int(ws.Ypixel)}, nil
 }
@@ -0,0 +1,57 @@
+//go:build unix
+
+package tty
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOpenControllingTerminal(t *testing.T) {
+	in, out, console, err := openConsole()
+	if err != nil {
+		t.Skipf("No controlling terminal: %s", err)
+	}
+
+	tty, err := openTty(in, out, make(chan struct{}), Options{})
+	if err != nil {
+		console.Close()
+		t.Fatal(err)
+	}
+	tty.console = console
+
+	if _, err := tty.size(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tty.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContinueNotifiesResize(t *testing.T) {
+	in, out, console, err := openConsole()
+	if err != nil {
+		t.Skipf("No controlling terminal: %s", err)
+	}
+
+	sigwinchCh := make(chan struct{}, 1)
+	tty, err := openTty(in, out, sigwinchCh, Options{})
+	if err != nil {
+		console.Close()
+		t.Fatal(err)
+	}
+	tty.console = console
+	defer tty.close()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGCONT); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-sigwinchCh:
+	case <-time.After(time.Second):
+		t.Fatal("No window change on SIGCONT.")
+	}
+}
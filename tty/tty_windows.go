@@ -4,14 +4,16 @@ package tty
 
 import (
 	"context"
-	"log"
+	"errors"
+	"io"
 	"os"
+	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
-	"unicode/utf16"
-	"unicode/utf8"
 	"unsafe"
 
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/sys/windows"
 	"golang.org/x/term"
 )
@@ -19,7 +21,9 @@ import (
 var kernel32 = syscall.NewLazyDLL("kernel32.dll")
 
 var (
-	procReadConsoleInput = kernel32.NewProc("ReadConsoleInputW")
+	procReadConsoleInput              = kernel32.NewProc("ReadConsoleInputW")
+	procGetNumberOfConsoleInputEvents = kernel32.NewProc("GetNumberOfConsoleInputEvents")
+	procGetCurrentConsoleFont         = kernel32.NewProc("GetCurrentConsoleFont")
 )
 
 const (
@@ -58,9 +62,64 @@ func readConsoleInput(h uintptr, buf []inputRecord) (int, error) {
 	return int(nr), err
 }
 
+func getNumberOfConsoleInputEvents(h uintptr) (int, error) {
+	var n uint32
+	r, _, err := procGetNumberOfConsoleInputEvents.Call(h, uintptr(unsafe.Pointer(&n)))
+	if r == 0 {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// REF https://learn.microsoft.com/en-us/windows/console/console-font-info-str
+type consoleFontInfo struct {
+	font     dword
+	fontSize coord
+}
+
+func getCurrentConsoleFont(h uintptr, info *consoleFontInfo) error {
+	r, _, err := procGetCurrentConsoleFont.Call(h, 0, uintptr(unsafe.Pointer(info)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// waitConsoleInput waits until h has input records or closeEvent is
+// signaled, so that ReadConsoleInputW never blocks. It returns the number of
+// the records queued.
+// REF https://github.com/PowerShell/openssh-portable/blob/8fe096c7b7c7c51afd1d18654ec652187e85921b/contrib/win32/win32compat/tncon.c#L95-L104
+func waitConsoleInput(h uintptr, closeEvent windows.Handle) (int, error) {
+	// The close event comes first to win over the pending input.
+	handles := []windows.Handle{closeEvent, windows.Handle(h)}
+
+	for {
+		ev, err := windows.WaitForMultipleObjects(handles, false, windows.INFINITE)
+		if err != nil {
+			return 0, err
+		}
+		if ev == windows.WAIT_OBJECT_0 {
+			return 0, io.EOF
+		}
+
+		// The handle is signaled by the events read never returns, such as focus.
+		n, err := getNumberOfConsoleInputEvents(h)
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
 type termState struct {
 	stin  uint32
 	stout uint32
+	// vtInput reports whether the console translates the keys itself.
+	vtInput bool
+	// vtOutput reports whether the console interprets the VT sequences.
+	vtOutput bool
 }
 
 func makeRaw(stdinfd, stdoutfd int) (*termState, error) {
@@ -77,8 +136,14 @@ func makeRaw(stdinfd, stdoutfd int) (*termState, error) {
 	raw = stin &^ (windows.ENABLE_LINE_INPUT | windows.ENABLE_ECHO_INPUT | windows.ENABLE_PROCESSED_INPUT | windows.ENABLE_MOUSE_INPUT)
 	raw |= windows.ENABLE_WINDOW_INPUT | windows.ENABLE_VIRTUAL_TERMINAL_INPUT
 
+	vtInput := true
 	if err := windows.SetConsoleMode(windows.Handle(stdinfd), raw); err != nil {
-		return nil, err
+		// Older consoles lack VT input. The keys are translated by read.
+		vtInput = false
+		raw &^= windows.ENABLE_VIRTUAL_TERMINAL_INPUT
+		if err := windows.SetConsoleMode(windows.Handle(stdinfd), raw); err != nil {
+			return nil, err
+		}
 	}
 
 	var stout uint32
@@ -89,12 +154,18 @@ func makeRaw(stdinfd, stdoutfd int) (*termState, error) {
 	}
 	raw = stout | windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING | windows.DISABLE_NEWLINE_AUTO_RETURN
 
+	vtOutput := true
 	if err := windows.SetConsoleMode(windows.Handle(stdoutfd), raw); err != nil {
-		_ = windows.SetConsoleMode(windows.Handle(stdinfd), stin)
-		return nil, err
+		// Older consoles, like Windows 8.1, reject the flags. The sequences
+		// are translated by write.
+		if !errors.Is(err, windows.ERROR_INVALID_PARAMETER) {
+			_ = windows.SetConsoleMode(windows.Handle(stdinfd), stin)
+			return nil, err
+		}
+		vtOutput = false
 	}
 
-	return &termState{stin: stin, stout: stout}, nil
+	return &termState{stin: stin, stout: stout, vtInput: vtInput, vtOutput: vtOutput}, nil
 }
 
 func termRestore(stdinfd, stdoutfd int, state *termState) error {
@@ -112,123 +183,400 @@ func termRestore(stdinfd, stdoutfd int, state *termState) error {
 }
 
 type tty struct {
+	in         *os.File
+	out        *os.File
+	console    io.Closer
 	cancel     context.CancelFunc
 	wg         *sync.WaitGroup
-	sigwinchCh chan interface{}
-
-	rem      []byte
+	opts       Options
+	sigwinchCh chan struct{}
+	readInput  func(h uintptr, buf []inputRecord) (int, error)
+	vtInput    bool
+	// vtOut translates the output for the console without VT processing.
+	vtOut *vtWriter
+
+	// closeEvent is a manual-reset event signaled by close to cancel the
+	// pending read. Zero when not waiting.
+	closeEvent windows.Handle
+	closed     atomic.Bool
+
+	prev        *termState
+	restoreOnce sync.Once
+	// restoreCP restores the output code page switched to UTF-8.
+	restoreCP func() error
+
+	// mouse reports the mouse events as SGR 1006 sequences.
+	mouse        bool
+	mouseButtons dword
+	windowOrigin func() (int, int, error)
+
+	rem []byte
+	// buf and recs are reused across the reads.
+	buf  []byte
+	recs []inputRecord
+	// fragment is the high surrogate waiting for the low one, possibly in
+	// the next read.
 	fragment rune
+	// packetDowns are the characters without a key typed on the key down.
+	packetDowns []wchar
+
+	// msys is the pty of MSYS2 / Cygwin, sttyState its modes to restore.
+	msys      bool
+	sttyState string
+}
+
+func openConsole() (*os.File, *os.File, io.Closer, error) {
+	in, err := os.OpenFile("CONIN$", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	out, err := os.OpenFile("CONOUT$", os.O_RDWR, 0)
+	if err != nil {
+		in.Close()
+		return nil, nil, nil, err
+	}
+
+	return in, out, &consoleCloser{in, out}, nil
 }
 
-func openTty(sigwinchCh chan interface{}) (*tty, error) {
+func dupFile(fd uintptr, name string) (*os.File, error) {
+	proc := windows.CurrentProcess()
+
+	var dup windows.Handle
+	if err := windows.DuplicateHandle(proc, windows.Handle(fd), proc, &dup, 0, false, windows.DUPLICATE_SAME_ACCESS); err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(dup), name), nil
+}
+
+func openTty(in, out *os.File, sigwinchCh chan struct{}, opts Options) (*tty, error) {
+	if isMsysPty(in.Fd()) && isMsysPty(out.Fd()) {
+		return openMsysTty(in, out, sigwinchCh, opts)
+	}
+
 	wg := new(sync.WaitGroup)
 	cx, cancel := context.WithCancel(context.Background())
 
-	prev, err := makeRaw(int(os.Stdin.Fd()), int(os.Stdout.Fd()))
+	closeEvent, err := windows.CreateEvent(nil, 1, 0, nil)
 	if err != nil {
 		cancel()
 		return nil, err
 	}
-	wg.Add(1)
-	context.AfterFunc(cx, func() {
-		defer wg.Done()
 
-		if err := termRestore(int(os.Stdin.Fd()), int(os.Stdout.Fd()), prev); err != nil {
-			log.Println(err)
-		}
-	})
+	prev, err := makeRaw(int(in.Fd()), int(out.Fd()))
+	if err != nil {
+		windows.CloseHandle(closeEvent)
+		cancel()
+		return nil, err
+	}
 
-	return &tty{
+	t := &tty{
+		in:         in,
+		opts:       opts,
+		out:        out,
 		cancel:     cancel,
 		wg:         wg,
 		sigwinchCh: sigwinchCh,
-	}, nil
+		readInput:  readConsoleInput,
+		vtInput:    prev.vtInput,
+		closeEvent: closeEvent,
+		prev:       prev,
+	}
+	t.windowOrigin = t.consoleWindowOrigin
+
+	// The output is written with WriteConsoleW, but the bytes of the others
+	// sharing the console, like the children, are of the code page.
+	if t.restoreCP, err = switchToUTF8(consoleCodePage{}); err != nil {
+		t.debugf("Switching the code page to UTF-8: %s", err)
+	}
+
+	if !prev.vtOutput {
+		if t.vtOut, err = newVTWriter(&consoleAPI{windows.Handle(out.Fd())}); err != nil {
+			t.restore()
+			windows.CloseHandle(closeEvent)
+			cancel()
+			return nil, err
+		}
+	}
+
+	t.watch(cx)
+
+	return t, nil
+}
+
+// watch restores the terminal when cx is done, and on the signals.
+func (t *tty) watch(cx context.Context) {
+	t.wg.Add(1)
+	context.AfterFunc(cx, func() {
+		defer t.wg.Done()
+
+		t.restore()
+	})
+
+	// The runtime's console control handler delivers CTRL_CLOSE_EVENT,
+	// CTRL_LOGOFF_EVENT and CTRL_SHUTDOWN_EVENT as SIGTERM.
+	// REF https://pkg.go.dev/os/signal#hdr-Windows
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(cx, func() {
+		signal.Stop(c)
+		close(c)
+	})
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		for sig := range c {
+			t.restore()
+			if t.opts.ExitOnSignal {
+				exitOnSignal(sig.(syscall.Signal), t.opts.SignalExitDelay, cx.Done())
+				continue
+			}
+			// Left to the caller or the default action from now on. The
+			// console close events are not raised again, the system
+			// terminates the process anyway once the handlers return.
+			signal.Stop(c)
+		}
+	}()
+}
+
+// restore leaves raw mode for good.
+func (t *tty) restore() {
+	t.restoreOnce.Do(func() {
+		var err error
+		if t.msys {
+			_, err = stty(t.in, t.sttyState)
+		} else {
+			err = termRestore(int(t.in.Fd()), int(t.out.Fd()), t.prev)
+		}
+		if err != nil {
+			t.debugf("Restoring the terminal: %s", err)
+		}
+		if t.restoreCP != nil {
+			if err := t.restoreCP(); err != nil {
+				t.debugf("Restoring the code page: %s", err)
+			}
+		}
+	})
 }
 
 func (t *tty) close() error {
+	// The event is left open for the read that may still be waking up.
+	t.closed.Store(true)
+	if t.closeEvent != 0 {
+		if err := windows.SetEvent(t.closeEvent); err != nil {
+			t.debugf("Canceling the read: %s", err)
+		}
+	}
+
 	t.cancel()
 
 	t.wg.Wait()
+
+	if t.console != nil {
+		return t.console.Close()
+	}
 	return nil
 }
 
 func (t *tty) read(p []byte) (int, error) {
-	var buf []byte
+	if t.msys {
+		if t.closed.Load() {
+			return 0, io.EOF
+		}
+		return t.in.Read(p)
+	}
+
+	if t.rem == nil {
+		if t.closed.Load() {
+			return 0, io.EOF
+		}
+
+		buf, err := t.readRecords(t.buf[:0], len(p))
+		if err != nil {
+			return 0, err
+		}
+		// Reused, rem is drained before the next records.
+		t.buf = buf
+		t.rem = buf
+	}
 
-	if t.rem != nil {
-		buf = t.rem
-	} else {
-		// TODO WaitForSingleObjectEx
-		// OpenSSH (Windows) https://github.com/PowerShell/openssh-portable/blob/8fe096c7b7c7c51afd1d18654ec652187e85921b/contrib/win32/win32compat/tncon.c#L95-L104
-		// WezTerm too.
+	n := copy(p, t.rem)
+	t.rem = t.rem[n:]
+	if len(t.rem) == 0 {
+		t.rem = nil
+	}
 
-		fragment := t.fragment
+	return n, nil
+}
 
-		// https://github.com/microsoft/terminal/blob/8b78be5f4ae40f720d980ed41075cd11e9eb0814/samples/ReadConsoleInputStream/ReadConsoleInputStream.cs#L67
+const (
+	// defaultInputRecords is read when the number queued is unknown.
+	defaultInputRecords = 1024
+	maxInputRecords     = 16384
+)
 
-		var recs [1024]inputRecord
+// readRecords waits for the input and decodes the records queued. It goes on
+// reading while the records are queued until want bytes, so that a large
+// paste is read in a few calls.
+// https://github.com/microsoft/terminal/blob/8b78be5f4ae40f720d980ed41075cd11e9eb0814/samples/ReadConsoleInputStream/ReadConsoleInputStream.cs#L67
+func (t *tty) readRecords(buf []byte, want int) ([]byte, error) {
+	for {
+		n := defaultInputRecords
+		if t.closeEvent != 0 {
+			var err error
+			if len(buf) == 0 {
+				n, err = waitConsoleInput(t.in.Fd(), t.closeEvent)
+				if err != nil {
+					if t.closed.Load() {
+						return nil, io.EOF
+					}
+					return nil, err
+				}
+			} else {
+				// Never blocks with the bytes at hand.
+				n, err = getNumberOfConsoleInputEvents(t.in.Fd())
+				if err != nil || n == 0 {
+					return buf, nil
+				}
+			}
+		}
+		n = min(max(n, 1), maxInputRecords)
 
-		nr, err := readConsoleInput(os.Stdin.Fd(), recs[:])
+		if len(t.recs) < n {
+			t.recs = make([]inputRecord, n)
+		}
+		nr, err := t.readInput(t.in.Fd(), t.recs[:n])
 		if err != nil {
-			return 0, err
+			if len(buf) > 0 {
+				return buf, nil
+			}
+			return nil, err
+		}
+		buf = t.decodeRecords(buf, t.recs[:nr])
+
+		if t.closeEvent == 0 || len(buf) >= want {
+			return buf, nil
 		}
+	}
+}
+
+// decodeRecords appends the bytes of the records to buf.
+func (t *tty) decodeRecords(buf []byte, recs []inputRecord) []byte {
+	fragment := t.fragment
+
+	for _, rec := range recs {
+		switch rec.eventType {
+		case keyEvent:
+			kr := (*keyEventRecord)(unsafe.Pointer(&rec.event))
+
+			if isCtrlNul(kr) {
+				buf = append(buf, 0x00)
+				continue
+			}
 
-		buf = make([]byte, 0)
-		for _, rec := range recs[:nr] {
-			switch rec.eventType {
-			case keyEvent:
-				kr := (*keyEventRecord)(unsafe.Pointer(&rec.event))
-				// REF https://github.com/PowerShell/openssh-portable/blob/8fe096c7b7c7c51afd1d18654ec652187e85921b/contrib/win32/win32compat/tncon.c#L168-L178
-				if !((kr.keyDown != 0 || kr.virtualKeyCode == vkMenu) &&
-					(kr.unicodeChar != 0 || kr.virtualScanCode == 0)) {
+			if kr.keyDown != 0 && kr.unicodeChar == 0 {
+				if seq := vtKeySequence(kr.virtualKeyCode, kr.controlKeyState); seq != nil {
+					buf = append(buf, seq...)
 					continue
 				}
+			}
 
-				r := rune(kr.unicodeChar)
-				if utf16.IsSurrogate(fragment) {
-					r = utf16.DecodeRune(fragment, r)
-					fragment = 0
-				}
+			packetUp := packetKeyUp(kr, &t.packetDowns)
 
-				if utf16.IsSurrogate(r) {
-					fragment = r
-				} else {
-					buf = utf8.AppendRune(buf, r)
-					fragment = 0
-				}
+			// REF https://github.com/PowerShell/openssh-portable/blob/8fe096c7b7c7c51afd1d18654ec652187e85921b/contrib/win32/win32compat/tncon.c#L168-L178
+			if !((kr.keyDown != 0 || kr.virtualKeyCode == vkMenu || packetUp) &&
+				(kr.unicodeChar != 0 || kr.virtualScanCode == 0)) {
+				continue
+			}
 
-			case windowBufferSizeEvent:
-				t.sigwinchCh <- nil
+			if !t.vtInput && altPrefixed(kr) {
+				buf = append(buf, 0x1b)
+			}
 
-			default:
+			buf, fragment = appendUTF16(buf, fragment, kr.unicodeChar)
+
+		case mouseEvent:
+			if !t.mouse {
+				continue
 			}
-		}
 
-		t.fragment = fragment
-	}
+			mr := (*mouseEventRecord)(unsafe.Pointer(&rec.event))
+			ox, oy, err := t.windowOrigin()
+			if err != nil {
+				continue
+			}
+			x := int(mr.mousePosition.x) - ox + 1
+			y := int(mr.mousePosition.y) - oy + 1
+			buf = sgrMouse(buf, mr, t.mouseButtons, x, y)
+			if mr.eventFlags&(mouseWheeled|mouseHwheeled) == 0 {
+				t.mouseButtons = mr.buttonState & mouseButtonsMask
+			}
 
-	n := min(len(p), len(buf))
-	copy(p[:n], buf[:n])
+		case windowBufferSizeEvent:
+			// Never block the input on a busy consumer.
+			select {
+			case t.sigwinchCh <- struct{}{}:
+			default:
+			}
 
-	rem := buf[n:]
-	if len(rem) > 0 {
-		t.rem = rem
-	} else {
-		t.rem = nil
+		default:
+		}
 	}
 
-	return n, nil
+	t.fragment = fragment
+	return buf
+}
+
+// modes synthesizes the modes, the console has no termios.
+func (t *tty) modes() ssh.TerminalModes {
+	return defaultModes()
 }
 
 func (t *tty) write(p []byte) (int, error) {
-	return os.Stdout.Write(p)
+	if t.vtOut != nil {
+		return t.vtOut.Write(p)
+	}
+	return t.out.Write(p)
+}
+
+// translateOutput turns off the VT processing of the console for the
+// translation by write.
+func (t *tty) translateOutput() error {
+	if t.msys || t.vtOut != nil {
+		return nil
+	}
+
+	h := windows.Handle(t.out.Fd())
+	if err := windows.SetConsoleMode(h, t.prev.stout&^windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING); err != nil {
+		return err
+	}
+
+	vtOut, err := newVTWriter(&consoleAPI{h})
+	if err != nil {
+		return err
+	}
+	t.vtOut = vtOut
+	return nil
 }
 
 func (t *tty) size() (Winsize, error) {
-	w, h, err := term.GetSize(int(os.Stdout.Fd()))
+	if t.msys {
+		return t.msysSize()
+	}
+
+	w, h, err := term.GetSize(int(t.out.Fd()))
 	if err != nil {
 		return Winsize{}, err
 	}
 
-	return Winsize{W: w, H: h}, nil
+	// Best effort, the font of ConPTY (Windows Terminal) may be unrelated
+	// to what is shown.
+	var font consoleFontInfo
+	if err := getCurrentConsoleFont(t.out.Fd(), &font); err != nil {
+		return Winsize{W: w, H: h}, nil
+	}
+	return Winsize{W: w, H: h, Wpx: w * int(font.fontSize.x), Hpx: h * int(font.fontSize.y)}, nil
 }
@@ -0,0 +1,535 @@
+//go:build windows
+
+package tty
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+func keyRecord(c rune) inputRecord {
+	rec := inputRecord{eventType: keyEvent}
+	kr := (*keyEventRecord)(unsafe.Pointer(&rec.event))
+	kr.keyDown = 1
+	kr.repeatCount = 1
+	kr.unicodeChar = wchar(c)
+	return rec
+}
+
+func fakeReadInput(batches ...[]inputRecord) func(h uintptr, buf []inputRecord) (int, error) {
+	return func(h uintptr, buf []inputRecord) (int, error) {
+		if len(batches) == 0 {
+			select {} // like a console waiting for input
+		}
+
+		n := copy(buf, batches[0])
+		batches = batches[1:]
+		return n, nil
+	}
+}
+
+func TestReadResizeWithoutConsumer(t *testing.T) {
+	tty := &tty{
+		sigwinchCh: make(chan struct{}),
+		readInput: fakeReadInput(
+			[]inputRecord{{eventType: windowBufferSizeEvent}, keyRecord('a')},
+			[]inputRecord{{eventType: windowBufferSizeEvent}, keyRecord('b')},
+		),
+	}
+
+	done := make(chan string)
+	go func() {
+		var got []byte
+		for range 2 {
+			var b [16]byte
+			n, err := tty.read(b[:])
+			if err != nil {
+				t.Error(err)
+			}
+			got = append(got, b[:n]...)
+		}
+		done <- string(got)
+	}()
+
+	select {
+	case got := <-done:
+		if got != "ab" {
+			t.Fatalf("%q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Blocked on the resize event.")
+	}
+}
+
+func specialKeyRecord(vk word, state dword) inputRecord {
+	rec := keyRecord(0)
+	kr := (*keyEventRecord)(unsafe.Pointer(&rec.event))
+	kr.virtualKeyCode = vk
+	kr.virtualScanCode = 1
+	kr.controlKeyState = state
+	return rec
+}
+
+func TestReadSpecialKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		vk    word
+		state dword
+		want  string
+	}{
+		{"up", vkUp, 0, "\x1b[A"},
+		{"down", vkDown, 0, "\x1b[B"},
+		{"right", vkRight, 0, "\x1b[C"},
+		{"left", vkLeft, 0, "\x1b[D"},
+		{"home", vkHome, 0, "\x1b[H"},
+		{"end", vkEnd, 0, "\x1b[F"},
+		{"ctrl-right", vkRight, leftCtrlPressed, "\x1b[1;5C"},
+		{"shift-up", vkUp, shiftPressed, "\x1b[1;2A"},
+		{"alt-left", vkLeft, rightAltPressed, "\x1b[1;3D"},
+		{"ctrl-shift-end", vkEnd, rightCtrlPressed | shiftPressed, "\x1b[1;6F"},
+		{"insert", vkInsert, 0, "\x1b[2~"},
+		{"delete", vkDelete, 0, "\x1b[3~"},
+		{"pageup", vkPrior, 0, "\x1b[5~"},
+		{"pagedown", vkNext, 0, "\x1b[6~"},
+		{"ctrl-delete", vkDelete, leftCtrlPressed, "\x1b[3;5~"},
+		{"f1", vkF1, 0, "\x1bOP"},
+		{"f4", vkF1 + 3, 0, "\x1bOS"},
+		{"shift-f1", vkF1, shiftPressed, "\x1b[1;2P"},
+		{"f5", vkF1 + 4, 0, "\x1b[15~"},
+		{"f6", vkF1 + 5, 0, "\x1b[17~"},
+		{"f10", vkF1 + 9, 0, "\x1b[21~"},
+		{"f11", vkF1 + 10, 0, "\x1b[23~"},
+		{"f12", vkF12, 0, "\x1b[24~"},
+		{"ctrl-f5", vkF1 + 4, leftCtrlPressed, "\x1b[15;5~"},
+		// Shift alone produces nothing.
+		{"shift", 0x10, shiftPressed, ""},
+		{"ctrl", 0x11, leftCtrlPressed, ""},
+		{"ctrl-space", vkSpace, leftCtrlPressed, "\x00"},
+		{"ctrl-@", vk2, rightCtrlPressed | shiftPressed, "\x00"},
+		{"ctrl-2", vk2, leftCtrlPressed, "\x00"},
+	}
+
+	for _, tt := range tests {
+		tty := &tty{
+			readInput: fakeReadInput([]inputRecord{specialKeyRecord(tt.vk, tt.state), keyRecord('x')}),
+		}
+
+		var b [32]byte
+		n, err := tty.read(b[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b[:n]); got != tt.want+"x" {
+			t.Errorf("%s: %q", tt.name, got)
+		}
+	}
+}
+
+func TestReadAltPrefix(t *testing.T) {
+	withState := func(rec inputRecord, vk word, state dword, keyDown int32) inputRecord {
+		kr := (*keyEventRecord)(unsafe.Pointer(&rec.event))
+		kr.virtualKeyCode = vk
+		kr.virtualScanCode = 1
+		kr.controlKeyState = state
+		kr.keyDown = keyDown
+		return rec
+	}
+
+	tests := []struct {
+		name string
+		recs []inputRecord
+		want string
+	}{
+		{
+			name: "alt+b",
+			recs: []inputRecord{withState(keyRecord('b'), 'B', leftAltPressed, 1)},
+			want: "\x1bb",
+		},
+		{
+			name: "right alt+f",
+			recs: []inputRecord{withState(keyRecord('f'), 'F', rightAltPressed, 1)},
+			want: "\x1bf",
+		},
+		{
+			// German layout: AltGr+Q types @, reported as RightAlt+LeftCtrl.
+			name: "altgr+q",
+			recs: []inputRecord{withState(keyRecord('@'), 'Q', rightAltPressed|leftCtrlPressed, 1)},
+			want: "@",
+		},
+		{
+			name: "bare alt tap",
+			recs: []inputRecord{
+				withState(keyRecord(0), vkMenu, leftAltPressed, 1),
+				withState(keyRecord(0), vkMenu, 0, 0),
+			},
+			want: "",
+		},
+		{
+			// Alt+numpad 0228 composes ä on the Alt release.
+			name: "alt numpad",
+			recs: []inputRecord{withState(keyRecord('ä'), vkMenu, 0, 0)},
+			want: "ä",
+		},
+	}
+
+	for _, tt := range tests {
+		tty := &tty{
+			readInput: fakeReadInput(append(tt.recs, keyRecord('x'))),
+		}
+
+		var b [32]byte
+		n, err := tty.read(b[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b[:n]); got != tt.want+"x" {
+			t.Errorf("%s: %q", tt.name, got)
+		}
+	}
+
+	// The console prefixes by itself with VT input.
+	tty := &tty{
+		vtInput:   true,
+		readInput: fakeReadInput([]inputRecord{withState(keyRecord('b'), 'B', leftAltPressed, 1)}),
+	}
+	var b [32]byte
+	n, err := tty.read(b[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b[:n]); got != "b" {
+		t.Errorf("vt input: %q", got)
+	}
+}
+
+func TestReadCancelledByClose(t *testing.T) {
+	// An event never signaled stands in for the idle console input.
+	input, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer windows.CloseHandle(input)
+
+	closeEvent, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer windows.CloseHandle(closeEvent)
+
+	_, cancel := context.WithCancel(context.Background())
+	tty := &tty{
+		in:         os.NewFile(uintptr(input), "input"),
+		cancel:     cancel,
+		wg:         new(sync.WaitGroup),
+		closeEvent: closeEvent,
+		readInput: func(h uintptr, buf []inputRecord) (int, error) {
+			t.Error("read without input")
+			return 0, nil
+		},
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		var b [16]byte
+		_, err := tty.read(b[:])
+		errc <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := tty.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errc:
+		if err != io.EOF {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read is not cancelled.")
+	}
+}
+
+func mouseRecord(x, y int16, buttons, state, flags dword) inputRecord {
+	rec := inputRecord{eventType: mouseEvent}
+	mr := (*mouseEventRecord)(unsafe.Pointer(&rec.event))
+	mr.mousePosition = coord{x, y}
+	mr.buttonState = buttons
+	mr.controlKeyState = state
+	mr.eventFlags = flags
+	return rec
+}
+
+func TestReadMouse(t *testing.T) {
+	wheel := func(delta int16) dword {
+		return dword(uint16(delta)) << 16
+	}
+
+	tests := []struct {
+		name string
+		recs []inputRecord
+		want string
+	}{
+		{
+			name: "click",
+			recs: []inputRecord{
+				mouseRecord(10, 105, fromLeft1stButtonPressed, 0, 0),
+				mouseRecord(10, 105, 0, 0, 0),
+			},
+			want: "\x1b[<0;6;6M\x1b[<0;6;6m",
+		},
+		{
+			name: "right click with ctrl",
+			recs: []inputRecord{
+				mouseRecord(6, 100, rightmostButtonPressed, leftCtrlPressed, 0),
+				mouseRecord(6, 100, 0, leftCtrlPressed, 0),
+			},
+			want: "\x1b[<18;2;1M\x1b[<18;2;1m",
+		},
+		{
+			name: "wheel",
+			recs: []inputRecord{
+				mouseRecord(5, 100, wheel(120), 0, mouseWheeled),
+				mouseRecord(5, 100, wheel(-120), 0, mouseWheeled),
+			},
+			want: "\x1b[<64;1;1M\x1b[<65;1;1M",
+		},
+		{
+			name: "drag",
+			recs: []inputRecord{
+				mouseRecord(5, 100, fromLeft1stButtonPressed, 0, 0),
+				mouseRecord(6, 101, fromLeft1stButtonPressed, 0, mouseMoved),
+				mouseRecord(7, 102, fromLeft1stButtonPressed, 0, mouseMoved),
+				mouseRecord(7, 102, 0, 0, 0),
+			},
+			want: "\x1b[<0;1;1M\x1b[<32;2;2M\x1b[<32;3;3M\x1b[<0;3;3m",
+		},
+		{
+			name: "move without buttons",
+			recs: []inputRecord{mouseRecord(6, 101, 0, 0, mouseMoved)},
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		tty := &tty{
+			mouse:     true,
+			readInput: fakeReadInput(append(tt.recs, keyRecord('x'))),
+			// The window scrolled to the buffer line 100, column 5.
+			windowOrigin: func() (int, int, error) {
+				return 5, 100, nil
+			},
+		}
+
+		var b [128]byte
+		n, err := tty.read(b[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b[:n]); got != tt.want+"x" {
+			t.Errorf("%s: %q", tt.name, got)
+		}
+	}
+
+	// Ignored unless enabled.
+	tty := &tty{
+		readInput: fakeReadInput([]inputRecord{mouseRecord(0, 0, fromLeft1stButtonPressed, 0, 0), keyRecord('x')}),
+	}
+	var b [32]byte
+	n, err := tty.read(b[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b[:n]); got != "x" {
+		t.Errorf("disabled: %q", got)
+	}
+}
+
+func TestReadResizeBurstCoalesced(t *testing.T) {
+	recs := make([]inputRecord, 0, 101)
+	for range 100 {
+		recs = append(recs, inputRecord{eventType: windowBufferSizeEvent})
+	}
+	recs = append(recs, keyRecord('a'))
+
+	sigwinchCh := make(chan struct{}, 1)
+	tty := &tty{
+		sigwinchCh: sigwinchCh,
+		readInput:  fakeReadInput(recs),
+	}
+
+	done := make(chan string)
+	go func() {
+		var b [16]byte
+		n, err := tty.read(b[:])
+		if err != nil {
+			t.Error(err)
+		}
+		done <- string(b[:n])
+	}()
+
+	select {
+	case got := <-done:
+		if got != "a" {
+			t.Fatalf("%q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Blocked on the resize events.")
+	}
+
+	if n := len(sigwinchCh); n != 1 {
+		t.Fatalf("%d", n)
+	}
+}
+
+func TestAppendUTF16(t *testing.T) {
+	tests := []struct {
+		name  string
+		units []wchar
+		want  string
+		high  bool
+	}{
+		{name: "pair", units: []wchar{0xd842, 0xdfb7}, want: "𠮷"},
+		{name: "lone low", units: []wchar{0xdfb7, 'a'}, want: "�a"},
+		{name: "high then bmp", units: []wchar{0xd842, 'a'}, want: "�a"},
+		{name: "high then high", units: []wchar{0xd83d, 0xd83d, 0xde00}, want: "�😀"},
+		{name: "pending high", units: []wchar{'a', 0xd83d}, want: "a", high: true},
+	}
+
+	for _, tt := range tests {
+		var buf []byte
+		var high rune
+		for _, c := range tt.units {
+			buf, high = appendUTF16(buf, high, c)
+		}
+		if string(buf) != tt.want || (high != 0) != tt.high {
+			t.Errorf("%s: %q %x", tt.name, buf, high)
+		}
+	}
+}
+
+// unitRecords types s as UTF-16 units of vk, like the IME does.
+func unitRecords(s string, vk word, keyDown int32) []inputRecord {
+	var recs []inputRecord
+	for _, c := range utf16.Encode([]rune(s)) {
+		rec := keyRecord(rune(c))
+		kr := (*keyEventRecord)(unsafe.Pointer(&rec.event))
+		kr.virtualKeyCode = vk
+		kr.keyDown = keyDown
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestPacketKeyUp(t *testing.T) {
+	var downs []wchar
+
+	// SendInput with KEYEVENTF_UNICODE: down and up for each unit.
+	for _, rec := range append(unitRecords("あ", vkPacket, 1), unitRecords("あ", vkPacket, 0)...) {
+		kr := (*keyEventRecord)(unsafe.Pointer(&rec.event))
+		if packetKeyUp(kr, &downs) {
+			t.Fatal("typed twice")
+		}
+	}
+	if len(downs) != 0 {
+		t.Fatalf("%v", downs)
+	}
+
+	// The IMEs reporting the key up only.
+	rec := unitRecords("あ", vkPacket, 0)[0]
+	if !packetKeyUp((*keyEventRecord)(unsafe.Pointer(&rec.event)), &downs) {
+		t.Fatal("lost the key up")
+	}
+
+	// The key up of a real key.
+	rec = unitRecords("a", 'A', 0)[0]
+	if packetKeyUp((*keyEventRecord)(unsafe.Pointer(&rec.event)), &downs) {
+		t.Fatal("typed on the key up")
+	}
+}
+
+func TestReadSurrogatesAndIME(t *testing.T) {
+	const s = "𠮷😀あ"
+
+	var downUp []inputRecord
+	for _, rec := range unitRecords(s, vkPacket, 1) {
+		up := rec
+		(*keyEventRecord)(unsafe.Pointer(&up.event)).keyDown = 0
+		downUp = append(downUp, rec, up)
+	}
+
+	tests := []struct {
+		name    string
+		batches [][]inputRecord
+	}{
+		{name: "key down", batches: [][]inputRecord{unitRecords(s, 0, 1)}},
+		{name: "key down and up", batches: [][]inputRecord{downUp}},
+		{name: "key up only", batches: [][]inputRecord{unitRecords(s, vkPacket, 0)}},
+		{
+			// The pair is split across the reads.
+			name: "split",
+			batches: [][]inputRecord{
+				unitRecords(s, 0, 1)[:1],
+				unitRecords(s, 0, 1)[1:3],
+				unitRecords(s, 0, 1)[3:],
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tty := &tty{
+			readInput: fakeReadInput(tt.batches...),
+		}
+
+		// A byte at a time, shorter than a character.
+		var got []byte
+		for len(got) < len(s) {
+			var b [1]byte
+			n, err := tty.read(b[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, b[:n]...)
+		}
+		if string(got) != s {
+			t.Errorf("%s: %q", tt.name, got)
+		}
+	}
+}
+
+// BenchmarkReadPaste reads a paste of 100k keys, as the console queues them.
+func BenchmarkReadPaste(b *testing.B) {
+	recs := make([]inputRecord, 100000)
+	for i := range recs {
+		recs[i] = keyRecord(rune('a' + i%26))
+	}
+	b.SetBytes(int64(len(recs)))
+
+	var p [32 * 1024]byte
+	for range b.N {
+		queued := recs
+		tty := &tty{
+			readInput: func(h uintptr, buf []inputRecord) (int, error) {
+				n := copy(buf, queued)
+				queued = queued[n:]
+				return n, nil
+			},
+		}
+
+		for total := 0; total < len(recs); {
+			n, err := tty.read(p[:])
+			if err != nil {
+				b.Fatal(err)
+			}
+			total += n
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package tty
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// vtConsole is the console API the VT output is translated into. The
+// positions are of the screen buffer, zero based.
+type vtConsole interface {
+	write(s string) error
+	info() (vtConsoleInfo, error)
+	setAttributes(attr uint16) error
+	setCursor(x, y int) error
+	// fill blanks n cells from (x, y), wrapping at the line end.
+	fill(x, y, n int, attr uint16) error
+	// shiftLine moves the cells of the line y from x to the end by n, to the
+	// right (the left when negative), and blanks the cells left behind.
+	shiftLine(x, y, n int, attr uint16) error
+}
+
+type vtConsoleInfo struct {
+	// width is of the buffer, the window is the lines top to bottom.
+	width  int
+	top    int
+	bottom int
+	x      int
+	y      int
+	attr   uint16
+}
+
+// The character attributes of the console.
+// REF https://learn.microsoft.com/en-us/windows/console/console-screen-buffers#character-attributes
+const (
+	foregroundBlue      = 0x1
+	foregroundGreen     = 0x2
+	foregroundRed       = 0x4
+	foregroundIntensity = 0x8
+)
+
+const (
+	vtGround = iota
+	vtEscape
+	vtEscapeIntermediate
+	vtCSI
+	vtOSC
+	vtOSCEscape
+)
+
+// maxVTSequence bounds the parameters kept of a CSI sequence.
+const maxVTSequence = 64
+
+// vtWriter interprets the VT sequences of the output with the console API,
+// for the consoles without VT processing like Windows 8.1. The SGR colors,
+// the erases and the cursor moves are translated, enough for the shell and
+// the line editing. The others, like the private modes, are dropped.
+// REF https://github.com/PowerShell/openssh-portable/blob/8fe096c7b7c7c51afd1d18654ec652187e85921b/contrib/win32/win32compat/ansiprsr.c
+type vtWriter struct {
+	mu      sync.Mutex
+	con     vtConsole
+	defAttr uint16
+
+	state int
+	seq   []byte
+	// text waits for the rest of a UTF-8 sequence split across the writes.
+	text []byte
+
+	// fg and bg are the ANSI colors 0-15, -1 for the default.
+	fg      int
+	bg      int
+	bold    bool
+	reverse bool
+
+	savedX int
+	savedY int
+}
+
+func newVTWriter(con vtConsole) (*vtWriter, error) {
+	info, err := con.info()
+	if err != nil {
+		return nil, err
+	}
+
+	return &vtWriter{
+		con:     con,
+		defAttr: info.attr,
+		fg:      -1,
+		bg:      -1,
+		savedX:  info.x,
+		savedY:  info.y,
+	}, nil
+}
+
+func (w *vtWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, b := range p {
+		switch w.state {
+		case vtGround:
+			if b != 0x1b {
+				w.text = append(w.text, b)
+				continue
+			}
+			if err := w.flush(true); err != nil {
+				return 0, err
+			}
+			w.state = vtEscape
+
+		case vtEscape:
+			w.state = vtGround
+			switch {
+			case b == '[':
+				w.state = vtCSI
+				w.seq = w.seq[:0]
+			case b == ']':
+				w.state = vtOSC
+			case b >= 0x20 && b <= 0x2f:
+				// Like ESC ( B, the character sets.
+				w.state = vtEscapeIntermediate
+			case b == '7':
+				if err := w.saveCursor(); err != nil {
+					return 0, err
+				}
+			case b == '8':
+				if err := w.con.setCursor(w.savedX, w.savedY); err != nil {
+					return 0, err
+				}
+			case b == 'c':
+				if err := w.sgr(nil); err != nil {
+					return 0, err
+				}
+			}
+
+		case vtEscapeIntermediate:
+			if b >= 0x30 && b <= 0x7e {
+				w.state = vtGround
+			}
+
+		case vtCSI:
+			if b >= 0x40 && b <= 0x7e {
+				w.state = vtGround
+				if err := w.csi(b); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			if len(w.seq) < maxVTSequence {
+				w.seq = append(w.seq, b)
+			}
+
+		case vtOSC:
+			// The window title and the like, dropped.
+			switch b {
+			case 0x07:
+				w.state = vtGround
+			case 0x1b:
+				w.state = vtOSCEscape
+			}
+
+		case vtOSCEscape:
+			// ST, or the end of an aborted one.
+			w.state = vtGround
+		}
+	}
+
+	if err := w.flush(false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes the text, but the incomplete UTF-8 sequence at the end unless
+// all.
+func (w *vtWriter) flush(all bool) error {
+	n := len(w.text)
+	if !all {
+		n = completeUTF8(w.text)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	err := w.con.write(string(w.text[:n]))
+	w.text = append(w.text[:0], w.text[n:]...)
+	return err
+}
+
+// completeUTF8 returns the length of b without the incomplete rune at the
+// end.
+func completeUTF8(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
+
+// parseVTParams parses the parameters, the omitted ones as 0. The colons of
+// the sub-parameters, like 38:5:n, are taken as the semicolons.
+func parseVTParams(s string) []int {
+	if s == "" {
+		return nil
+	}
+
+	var ps []int
+	for _, p := range strings.Split(strings.ReplaceAll(s, ":", ";"), ";") {
+		n, _ := strconv.Atoi(p)
+		ps = append(ps, n)
+	}
+	return ps
+}
+
+// vtParam returns the i-th parameter, def when omitted or 0.
+func vtParam(ps []int, i, def int) int {
+	if i < len(ps) && ps[i] != 0 {
+		return ps[i]
+	}
+	return def
+}
+
+func (w *vtWriter) csi(final byte) error {
+	// The private modes (CSI ? 25 h) and the ones with the intermediates
+	// (CSI SP q) have no equivalent.
+	if strings.IndexFunc(string(w.seq), func(r rune) bool { return r < '0' || r > ';' }) >= 0 {
+		return nil
+	}
+	ps := parseVTParams(string(w.seq))
+
+	if final == 'm' {
+		return w.sgr(ps)
+	}
+
+	info, err := w.con.info()
+	if err != nil {
+		return err
+	}
+	x, y := info.x, info.y
+	n := vtParam(ps, 0, 1)
+	attr := w.attr()
+
+	switch final {
+	case 'A':
+		return w.moveTo(info, x, y-n)
+	case 'B', 'e':
+		return w.moveTo(info, x, y+n)
+	case 'C', 'a':
+		return w.moveTo(info, x+n, y)
+	case 'D':
+		return w.moveTo(info, x-n, y)
+	case 'E':
+		return w.moveTo(info, 0, y+n)
+	case 'F':
+		return w.moveTo(info, 0, y-n)
+	case 'G', '`':
+		return w.moveTo(info, n-1, y)
+	case 'd':
+		return w.moveTo(info, x, info.top+n-1)
+	case 'H', 'f':
+		return w.moveTo(info, vtParam(ps, 1, 1)-1, info.top+n-1)
+
+	case 'K':
+		switch vtParam(ps, 0, 0) {
+		case 0:
+			return w.con.fill(x, y, info.width-x, attr)
+		case 1:
+			return w.con.fill(0, y, x+1, attr)
+		case 2:
+			return w.con.fill(0, y, info.width, attr)
+		}
+	case 'J':
+		switch vtParam(ps, 0, 0) {
+		case 0:
+			return w.con.fill(x, y, info.width-x+(info.bottom-y)*info.width, attr)
+		case 1:
+			return w.con.fill(0, info.top, (y-info.top)*info.width+x+1, attr)
+		case 2, 3:
+			return w.con.fill(0, info.top, (info.bottom-info.top+1)*info.width, attr)
+		}
+	case 'X':
+		return w.con.fill(x, y, min(n, info.width-x), attr)
+	case '@':
+		return w.con.shiftLine(x, y, min(n, info.width-x), attr)
+	case 'P':
+		return w.con.shiftLine(x, y, -min(n, info.width-x), attr)
+
+	case 's':
+		return w.saveCursor()
+	case 'u':
+		return w.con.setCursor(w.savedX, w.savedY)
+	}
+
+	return nil
+}
+
+// moveTo moves the cursor, kept in the window.
+func (w *vtWriter) moveTo(info vtConsoleInfo, x, y int) error {
+	x = max(0, min(x, info.width-1))
+	y = max(info.top, min(y, info.bottom))
+	return w.con.setCursor(x, y)
+}
+
+func (w *vtWriter) saveCursor() error {
+	info, err := w.con.info()
+	if err != nil {
+		return err
+	}
+	w.savedX, w.savedY = info.x, info.y
+	return nil
+}
+
+// sgr sets the graphic rendition. The colors beyond 16 are approximated.
+// REF https://invisible-island.net/xterm/ctlseqs/ctlseqs.html#h4-Functions-using-CSI-_-ordered-by-the-final-character-lparen-s-rparen:CSI-Pm-m.1CA7
+func (w *vtWriter) sgr(ps []int) error {
+	if len(ps) == 0 {
+		ps = []int{0}
+	}
+
+	for i := 0; i < len(ps); i++ {
+		switch p := ps[i]; {
+		case p == 0:
+			w.fg, w.bg = -1, -1
+			w.bold, w.reverse = false, false
+		case p == 1:
+			w.bold = true
+		case p == 22:
+			w.bold = false
+		case p == 7:
+			w.reverse = true
+		case p == 27:
+			w.reverse = false
+		case p >= 30 && p <= 37:
+			w.fg = p - 30
+		case p == 39:
+			w.fg = -1
+		case p >= 40 && p <= 47:
+			w.bg = p - 40
+		case p == 49:
+			w.bg = -1
+		case p >= 90 && p <= 97:
+			w.fg = p - 90 + 8
+		case p >= 100 && p <= 107:
+			w.bg = p - 100 + 8
+		case p == 38 || p == 48:
+			c, n := extendedColor(ps[i+1:])
+			i += n
+			if c < 0 {
+				continue
+			}
+			if p == 38 {
+				w.fg = c
+			} else {
+				w.bg = c
+			}
+		}
+	}
+
+	return w.con.setAttributes(w.attr())
+}
+
+// extendedColor approximates 5;n and 2;r;g;b with the 16 colors, and returns
+// the parameters consumed.
+func extendedColor(ps []int) (int, int) {
+	switch {
+	case len(ps) >= 2 && ps[0] == 5:
+		n := ps[1]
+		switch {
+		case n < 16:
+			return n, 2
+		case n < 232:
+			level := func(l int) int {
+				if l == 0 {
+					return 0
+				}
+				return 55 + 40*l
+			}
+			n -= 16
+			return ansi16(level(n/36), level(n/6%6), level(n%6)), 2
+		default:
+			l := 8 + 10*(n-232)
+			return ansi16(l, l, l), 2
+		}
+	case len(ps) >= 4 && ps[0] == 2:
+		return ansi16(ps[1], ps[2], ps[3]), 4
+	default:
+		return -1, len(ps)
+	}
+}
+
+// ansi16 returns the nearest of the 16 ANSI colors.
+func ansi16(r, g, b int) int {
+	c := 0
+	if r > 127 {
+		c |= 1
+	}
+	if g > 127 {
+		c |= 2
+	}
+	if b > 127 {
+		c |= 4
+	}
+	if max(r, g, b) > 191 {
+		c |= 8
+	}
+	return c
+}
+
+// consoleColor converts the ANSI color, RGB from the lowest bit, to the
+// console one, BGR.
+func consoleColor(c int) uint16 {
+	var attr uint16
+	if c&1 != 0 {
+		attr |= foregroundRed
+	}
+	if c&2 != 0 {
+		attr |= foregroundGreen
+	}
+	if c&4 != 0 {
+		attr |= foregroundBlue
+	}
+	if c&8 != 0 {
+		attr |= foregroundIntensity
+	}
+	return attr
+}
+
+func (w *vtWriter) attr() uint16 {
+	fg := w.defAttr & 0xf
+	bg := w.defAttr >> 4 & 0xf
+	if w.fg >= 0 {
+		fg = consoleColor(w.fg)
+	}
+	if w.bg >= 0 {
+		bg = consoleColor(w.bg)
+	}
+	if w.bold {
+		fg |= foregroundIntensity
+	}
+	if w.reverse {
+		fg, bg = bg, fg
+	}
+	return w.defAttr&^0xff | bg<<4 | fg
+}
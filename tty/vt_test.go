@@ -0,0 +1,166 @@
+package tty
+
+import (
+	"strings"
+	"testing"
+)
+
+// fakeConsole is a screen buffer of 10x4, all in the window.
+type fakeConsole struct {
+	cells [4][10]rune
+	attrs [4][10]uint16
+	x, y  int
+	attr  uint16
+}
+
+func newFakeConsole() *fakeConsole {
+	c := &fakeConsole{attr: 0x07}
+	c.fill(0, 0, 40, 0x07)
+	return c
+}
+
+func (c *fakeConsole) write(s string) error {
+	for _, r := range s {
+		switch r {
+		case '\r':
+			c.x = 0
+		case '\n':
+			c.y = min(c.y+1, 3)
+		case '\b':
+			c.x = max(c.x-1, 0)
+		default:
+			c.cells[c.y][c.x] = r
+			c.attrs[c.y][c.x] = c.attr
+			c.x++
+			if c.x == 10 {
+				c.x = 0
+				c.y = min(c.y+1, 3)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *fakeConsole) info() (vtConsoleInfo, error) {
+	return vtConsoleInfo{width: 10, top: 0, bottom: 3, x: c.x, y: c.y, attr: c.attr}, nil
+}
+
+func (c *fakeConsole) setAttributes(attr uint16) error {
+	c.attr = attr
+	return nil
+}
+
+func (c *fakeConsole) setCursor(x, y int) error {
+	c.x, c.y = x, y
+	return nil
+}
+
+func (c *fakeConsole) fill(x, y, n int, attr uint16) error {
+	for i := y*10 + x; i < min(y*10+x+n, 40); i++ {
+		c.cells[i/10][i%10] = ' '
+		c.attrs[i/10][i%10] = attr
+	}
+	return nil
+}
+
+func (c *fakeConsole) shiftLine(x, y, n int, attr uint16) error {
+	line := c.cells[y]
+	for i := x; i < 10; i++ {
+		j := i - n
+		if j >= x && j < 10 {
+			c.cells[y][i] = line[j]
+		} else {
+			c.cells[y][i] = ' '
+			c.attrs[y][i] = attr
+		}
+	}
+	return nil
+}
+
+func (c *fakeConsole) lines() []string {
+	var lines []string
+	for _, l := range c.cells {
+		lines = append(lines, strings.TrimRight(string(l[:]), " "))
+	}
+	return lines
+}
+
+func TestVTWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   []string
+		x, y   int
+	}{
+		{"text", []string{"ab\r\ncd"}, []string{"ab", "cd", "", ""}, 2, 1},
+		{"erase in line", []string{"abcdef\r\x1b[3C\x1b[K"}, []string{"abc", "", "", ""}, 3, 0},
+		{"erase the line start", []string{"abcdef\x1b[3D\x1b[1K"}, []string{"    ef", "", "", ""}, 3, 0},
+		{"cursor position", []string{"\x1b[3;5Hx\x1b[Hy"}, []string{"y", "", "    x", ""}, 1, 0},
+		{"clamped", []string{"\x1b[99;99Hx"}, []string{"", "", "", "         x"}, 0, 3},
+		{"clear screen", []string{"ab\r\ncd\x1b[2J"}, []string{"", "", "", ""}, 2, 1},
+		{"erase below", []string{"ab\r\ncd\r\nef\x1b[2;2H\x1b[J"}, []string{"ab", "c", "", ""}, 1, 1},
+		{"delete chars", []string{"abcdef\r\x1b[C\x1b[2P"}, []string{"adef", "", "", ""}, 1, 0},
+		{"insert chars", []string{"abcdef\r\x1b[C\x1b[2@"}, []string{"a  bcdef", "", "", ""}, 1, 0},
+		{"split sequence", []string{"ab\x1b", "[", "1", "D", "x"}, []string{"ax", "", "", ""}, 2, 0},
+		{"split UTF-8", []string{"\xe3\x81", "\x82"}, []string{"あ", "", "", ""}, 1, 0},
+		{"private mode dropped", []string{"\x1b[?25l\x1b[?1049ha"}, []string{"a", "", "", ""}, 1, 0},
+		{"title dropped", []string{"\x1b]0;title\x07a\x1b]2;t\x1b\\b"}, []string{"ab", "", "", ""}, 2, 0},
+		{"charset dropped", []string{"\x1b(Ba"}, []string{"a", "", "", ""}, 1, 0},
+		{"save and restore", []string{"ab\x1b7\r\ncd\x1b8e"}, []string{"abe", "cd", "", ""}, 3, 0},
+		{"sanitize dropped", []string{"a" + sanitizeSequence + "b"}, []string{"ab", "", "", ""}, 2, 0},
+	}
+	for _, tt := range tests {
+		c := newFakeConsole()
+		w, err := newVTWriter(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range tt.writes {
+			if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+				t.Fatalf("%s: %d %v", tt.name, n, err)
+			}
+		}
+		if got := c.lines(); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: %q", tt.name, got)
+		}
+		if c.x != tt.x || c.y != tt.y {
+			t.Errorf("%s: cursor %d,%d", tt.name, c.x, c.y)
+		}
+	}
+}
+
+func TestVTWriterSGR(t *testing.T) {
+	tests := []struct {
+		seq  string
+		want uint16
+	}{
+		{"\x1b[31m", 0x04},
+		{"\x1b[1;32m", 0x0a},
+		{"\x1b[34;47m", 0x71},
+		{"\x1b[91m", 0x0c},
+		{"\x1b[104m", 0x97},
+		{"\x1b[7m", 0x70},
+		{"\x1b[31;7m", 0x40},
+		{"\x1b[38;5;9m", 0x0c},
+		{"\x1b[38;5;196m", 0x0c},
+		{"\x1b[38;2;0;0;255m", 0x09},
+		{"\x1b[48:5:2m", 0x27},
+		{"\x1b[31m\x1b[0m", 0x07},
+		{"\x1b[31m\x1b[m", 0x07},
+		{"\x1b[31m\x1b[39m", 0x07},
+		{"\x1b[1m\x1b[22m", 0x07},
+	}
+	for _, tt := range tests {
+		c := newFakeConsole()
+		w, err := newVTWriter(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(tt.seq + "x")); err != nil {
+			t.Fatal(err)
+		}
+		if c.attrs[0][0] != tt.want {
+			t.Errorf("%q: %#x", tt.seq, c.attrs[0][0])
+		}
+	}
+}
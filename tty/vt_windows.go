@@ -0,0 +1,124 @@
+//go:build windows
+
+package tty
+
+import (
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	procSetConsoleTextAttribute    = kernel32.NewProc("SetConsoleTextAttribute")
+	procSetConsoleCursorPosition   = kernel32.NewProc("SetConsoleCursorPosition")
+	procFillConsoleOutputCharacter = kernel32.NewProc("FillConsoleOutputCharacterW")
+	procFillConsoleOutputAttribute = kernel32.NewProc("FillConsoleOutputAttribute")
+	procScrollConsoleScreenBuffer  = kernel32.NewProc("ScrollConsoleScreenBufferW")
+)
+
+// REF https://learn.microsoft.com/en-us/windows/console/char-info-str
+type charInfo struct {
+	char wchar
+	attr word
+}
+
+// coordArg passes COORD by value.
+func coordArg(x, y int) uintptr {
+	return uintptr(uint16(x)) | uintptr(uint16(y))<<16
+}
+
+// consoleAPI is the console API for vtWriter.
+type consoleAPI struct {
+	h windows.Handle
+}
+
+func (c *consoleAPI) write(s string) error {
+	buf := utf16.Encode([]rune(s))
+	for len(buf) > 0 {
+		var n uint32
+		if err := windows.WriteConsole(c.h, &buf[0], uint32(len(buf)), &n, nil); err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+func (c *consoleAPI) info() (vtConsoleInfo, error) {
+	var info windows.ConsoleScreenBufferInfo
+	if err := windows.GetConsoleScreenBufferInfo(c.h, &info); err != nil {
+		return vtConsoleInfo{}, err
+	}
+
+	return vtConsoleInfo{
+		width:  int(info.Size.X),
+		top:    int(info.Window.Top),
+		bottom: int(info.Window.Bottom),
+		x:      int(info.CursorPosition.X),
+		y:      int(info.CursorPosition.Y),
+		attr:   info.Attributes,
+	}, nil
+}
+
+func (c *consoleAPI) setAttributes(attr uint16) error {
+	r, _, err := procSetConsoleTextAttribute.Call(uintptr(c.h), uintptr(attr))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func (c *consoleAPI) setCursor(x, y int) error {
+	r, _, err := procSetConsoleCursorPosition.Call(uintptr(c.h), coordArg(x, y))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func (c *consoleAPI) fill(x, y, n int, attr uint16) error {
+	if n <= 0 {
+		return nil
+	}
+
+	var written uint32
+	r, _, err := procFillConsoleOutputCharacter.Call(uintptr(c.h), ' ', uintptr(n), coordArg(x, y), uintptr(unsafe.Pointer(&written)))
+	if r == 0 {
+		return err
+	}
+	r, _, err = procFillConsoleOutputAttribute.Call(uintptr(c.h), uintptr(attr), uintptr(n), coordArg(x, y), uintptr(unsafe.Pointer(&written)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func (c *consoleAPI) shiftLine(x, y, n int, attr uint16) error {
+	info, err := c.info()
+	if err != nil {
+		return err
+	}
+	if n == 0 || x >= info.width {
+		return nil
+	}
+
+	// Clipped to the line, the cells vacated are filled.
+	clip := windows.SmallRect{Left: int16(x), Top: int16(y), Right: int16(info.width - 1), Bottom: int16(y)}
+	src := clip
+	dst := x + n
+	if n < 0 {
+		src.Left = int16(x - n)
+		dst = x
+	}
+	if int(src.Left) > int(src.Right) {
+		return c.fill(x, y, info.width-x, attr)
+	}
+
+	fill := charInfo{char: ' ', attr: word(attr)}
+	r, _, err := procScrollConsoleScreenBuffer.Call(uintptr(c.h), uintptr(unsafe.Pointer(&src)), uintptr(unsafe.Pointer(&clip)), coordArg(dst, y), uintptr(unsafe.Pointer(&fill)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
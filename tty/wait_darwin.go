@@ -0,0 +1,36 @@
+package tty
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitInput waits until in is readable or closeR is closed, and reports the
+// latter. It selects, poll rejects the terminal devices on macOS. The fds
+// past FD_SETSIZE are an error, not to overflow the FdSet.
+func waitInput(in, closeR int) (bool, error) {
+	if fd := max(in, closeR); fd >= unix.FD_SETSIZE {
+		return false, fmt.Errorf("The terminal fd %d is beyond FD_SETSIZE.", fd)
+	}
+
+	for {
+		var fds unix.FdSet
+		fds.Set(in)
+		fds.Set(closeR)
+		if _, err := unix.Select(max(in, closeR)+1, &fds, nil, nil, nil); err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return false, err
+		}
+
+		if fds.IsSet(closeR) {
+			return true, nil
+		}
+		if fds.IsSet(in) {
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,34 @@
+//go:build unix && !darwin
+
+package tty
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitInput waits until in is readable or closeR is closed, and reports the
+// latter. poll has no limit of the fd numbers, select has FD_SETSIZE.
+func waitInput(in, closeR int) (bool, error) {
+	fds := []unix.PollFd{
+		{Fd: int32(in), Events: unix.POLLIN},
+		{Fd: int32(closeR), Events: unix.POLLIN},
+	}
+	for {
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return false, err
+		}
+
+		if fds[1].Revents != 0 {
+			return true, nil
+		}
+		// The errors and the hangup are of the read.
+		if fds[0].Revents != 0 {
+			return false, nil
+		}
+	}
+}
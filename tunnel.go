@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"github.com/ysuzuki-bysystems/myssh/forward"
+	"golang.org/x/crypto/ssh"
+)
+
+func startRemoteForwards(ctx context.Context, client *ssh.Client, cfg *config) []*forward.Listener {
+	var listeners []*forward.Listener
+
+	for _, spec := range cfg.remoteForwards {
+		l, err := forward.Remote(client, spec.listen, spec.connect)
+		if err != nil {
+			log.Printf("Warning: remote port forwarding failed for listen %s: %s", spec.listen, err)
+			continue
+		}
+		context.AfterFunc(ctx, func() { l.Close() })
+		listeners = append(listeners, l)
+	}
+
+	return listeners
+}
+
+func startLocalForwards(ctx context.Context, client *ssh.Client, cfg *config) []*forward.Listener {
+	var listeners []*forward.Listener
+
+	for _, spec := range cfg.localForwards {
+		l, err := forward.Local(client, spec.listen, spec.connect)
+		if err != nil {
+			log.Printf("Warning: local port forwarding failed for listen %s: %s", spec.listen, err)
+			continue
+		}
+		context.AfterFunc(ctx, func() { l.Close() })
+		listeners = append(listeners, l)
+	}
+
+	return listeners
+}
+
+var errServerAliveTimeout = errors.New("Timeout, server not responding.")
+
+// ServerAliveAction, what to do when ServerAliveCountMax keepalives are
+// missed: exit, or reconnect like --auto-reconnect.
+const (
+	serverAliveExit      = "exit"
+	serverAliveReconnect = "reconnect"
+)
+
+// shouldReconnect decides whether the connection lost with err is to be
+// re-dialed: always with --auto-reconnect, and on the keepalive timeout with
+// ServerAliveAction reconnect.
+func shouldReconnect(cfg *config, err error) bool {
+	if errors.Is(err, errServerAliveTimeout) && cfg.serverAliveAction == serverAliveReconnect {
+		return true
+	}
+	return cfg.autoReconnect
+}
+
+// keepaliveRequest is the global request of the keepalives. The servers
+// reply a failure, as they do not know it, and that is enough.
+const keepaliveRequest = "keepalive@openssh.com"
+
+// keepalive sends keepalive@openssh.com every interval and returns
+// errServerAliveTimeout when countMax of them are left unanswered, or the
+// error of ctx when it is done.
+// REF ssh_config(5) ServerAliveInterval, ServerAliveCountMax
+func keepalive(ctx context.Context, conn ssh.Conn, interval time.Duration, countMax int) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if pending {
+			select {
+			case err := <-replies:
+				if err != nil {
+					return err
+				}
+				pending = false
+				missed = 0
+			default:
+				missed++
+				if missed >= countMax {
+					conn.Close()
+					return errServerAliveTimeout
+				}
+				continue
+			}
+		}
+
+		pending = true
+		go func() {
+			// Any reply, even a failure, means the server is alive.
+			_, _, err := conn.SendRequest(keepaliveRequest, true, nil)
+			replies <- err
+		}()
+	}
+}
+
+// tunnel establishes the forwards and waits until the connection is lost or
+// ctx is done, then shuts down.
+func tunnel(ctx context.Context, cfg *config, client *ssh.Client) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sd := newShutdown(ctx, client, shutdownGrace)
+	defer sd.run()
+
+	for _, l := range startLocalForwards(sd.ctx, client, cfg) {
+		sd.listener(l)
+	}
+	for _, l := range startRemoteForwards(sd.ctx, client, cfg) {
+		sd.listener(l)
+	}
+
+	errc := make(chan error, 3)
+	if m := startControl(cfg, client, func() { errc <- errControlExit }); m != nil {
+		defer m.Close()
+	}
+
+	go func() {
+		err := client.Wait()
+		if err == nil {
+			err = io.EOF
+		}
+		errc <- err
+	}()
+	if cfg.serverAliveInterval > 0 {
+		go func() {
+			errc <- keepalive(ctx, client, cfg.serverAliveInterval, cfg.serverAliveCountMax)
+		}()
+	}
+
+	return <-errc
+}
+
+var (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = time.Minute
+)
+
+// runTunnel runs tunnel, re-dialing with exponential backoff when
+// shouldReconnect. It returns nil when ctx is done.
+func runTunnel(ctx context.Context, cfg *config, dial func(ctx context.Context) (*ssh.Client, error)) error {
+	delay := reconnectMinDelay
+	// The dial failures are retried once a connection was up and lost, but
+	// the first dial and the permanent failures, like a wrong password,
+	// are reported.
+	retry := false
+
+	for {
+		client, err := dial(ctx)
+		if ctx.Err() != nil {
+			if client != nil {
+				client.Close()
+			}
+			return nil
+		}
+		if err == nil {
+			delay = reconnectMinDelay
+
+			err = tunnel(ctx, cfg, client)
+			if ctx.Err() != nil {
+				return nil
+			}
+			retry = shouldReconnect(cfg, err)
+		}
+
+		if errors.Is(err, errControlExit) {
+			return nil
+		}
+		if !retry || isPermanent(err) {
+			return err
+		}
+
+		log.Printf("Connection to %s lost: %s. Reconnecting in %s.", cfg.hostname, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+}
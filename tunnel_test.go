@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ysuzuki-bysystems/myssh/forward"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRunTunnelReconnect(t *testing.T) {
+	srvcfg := &ssh.ServerConfig{
+		NoClientAuth: true,
+	}
+	srv := newTestServer(t, srvcfg, nil)
+
+	defer func(min, max time.Duration) {
+		reconnectMinDelay, reconnectMaxDelay = min, max
+	}(reconnectMinDelay, reconnectMaxDelay)
+	reconnectMinDelay, reconnectMaxDelay = 10*time.Millisecond, 20*time.Millisecond
+
+	var dials atomic.Int32
+	connected := make(chan struct{}, 4)
+	dial := func(context.Context) (*ssh.Client, error) {
+		dials.Add(1)
+
+		client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+			User:            "user",
+			HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+		})
+		if err != nil {
+			return nil, err
+		}
+		connected <- struct{}{}
+		return client, nil
+	}
+
+	cfg := &config{
+		hostname:            "example.com",
+		autoReconnect:       true,
+		serverAliveInterval: 10 * time.Millisecond,
+		serverAliveCountMax: 3,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- runTunnel(ctx, cfg, dial)
+	}()
+
+	<-connected
+	srv.dropConns()
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reconnected")
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if n := dials.Load(); n < 2 {
+		t.Fatalf("%d", n)
+	}
+}
+
+func TestRunTunnelNoReconnect(t *testing.T) {
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, nil)
+
+	connected := make(chan struct{}, 1)
+	dial := func(context.Context) (*ssh.Client, error) {
+		client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+			User:            "user",
+			HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+		})
+		if err != nil {
+			return nil, err
+		}
+		connected <- struct{}{}
+		return client, nil
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- runTunnel(context.Background(), &config{}, dial)
+	}()
+
+	<-connected
+	srv.dropConns()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("must report the lost connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not returned")
+	}
+}
+
+func TestRunTunnelFirstDialFailure(t *testing.T) {
+	var dials atomic.Int32
+	dial := func(context.Context) (*ssh.Client, error) {
+		dials.Add(1)
+		return nil, errors.New("connection refused")
+	}
+
+	// Not retried, the connection never was up.
+	cfg := &config{hostname: "example.com", autoReconnect: true}
+	if err := runTunnel(context.Background(), cfg, dial); err == nil {
+		t.Fatal("must report the failure")
+	}
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("%d", n)
+	}
+}
+
+func TestRunTunnelPermanentFailure(t *testing.T) {
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, nil)
+
+	defer func(min, max time.Duration) {
+		reconnectMinDelay, reconnectMaxDelay = min, max
+	}(reconnectMinDelay, reconnectMaxDelay)
+	reconnectMinDelay, reconnectMaxDelay = 10*time.Millisecond, 20*time.Millisecond
+
+	var dials atomic.Int32
+	connected := make(chan struct{}, 1)
+	dial := func(context.Context) (*ssh.Client, error) {
+		if dials.Add(1) > 1 {
+			return nil, fmt.Errorf("ssh: handshake failed: %w", &permanentError{errors.New("NO MATCH ENTRIES FOUND: example.com")})
+		}
+		client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+			User:            "user",
+			HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+		})
+		if err != nil {
+			return nil, err
+		}
+		connected <- struct{}{}
+		return client, nil
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- runTunnel(context.Background(), &config{hostname: "example.com", autoReconnect: true}, dial)
+	}()
+
+	<-connected
+	srv.dropConns()
+
+	select {
+	case err := <-errc:
+		if !isPermanent(err) {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the host key failure must not be retried")
+	}
+	if n := dials.Load(); n != 2 {
+		t.Fatalf("%d", n)
+	}
+}
+
+func TestRunTunnelServerAliveExit(t *testing.T) {
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, nil)
+	srv.unresponsive.Store(true)
+
+	var dials atomic.Int32
+	dial := func(context.Context) (*ssh.Client, error) {
+		dials.Add(1)
+		return ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+			User:            "user",
+			HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+		})
+	}
+
+	cfg := &config{
+		hostname:            "example.com",
+		serverAliveInterval: 10 * time.Millisecond,
+		serverAliveCountMax: 3,
+		serverAliveAction:   serverAliveExit,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- runTunnel(context.Background(), cfg, dial)
+	}()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, errServerAliveTimeout) {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not returned")
+	}
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("%d", n)
+	}
+}
+
+func TestRunTunnelServerAliveReconnect(t *testing.T) {
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, nil)
+
+	defer func(min, max time.Duration) {
+		reconnectMinDelay, reconnectMaxDelay = min, max
+	}(reconnectMinDelay, reconnectMaxDelay)
+	reconnectMinDelay, reconnectMaxDelay = 10*time.Millisecond, 20*time.Millisecond
+
+	connected := make(chan struct{}, 4)
+	dial := func(context.Context) (*ssh.Client, error) {
+		client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+			User:            "user",
+			HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+		})
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case connected <- struct{}{}:
+		default:
+		}
+		return client, nil
+	}
+
+	// Without --auto-reconnect.
+	cfg := &config{
+		hostname:            "example.com",
+		serverAliveInterval: 10 * time.Millisecond,
+		serverAliveCountMax: 3,
+		serverAliveAction:   serverAliveReconnect,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- runTunnel(ctx, cfg, dial)
+	}()
+
+	<-connected
+	srv.unresponsive.Store(true)
+
+	select {
+	case <-connected:
+	case err := <-errc:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reconnected")
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalForwardUnix(t *testing.T) {
+	dir, err := os.MkdirTemp("", "myssh") // short enough for sun_path
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	remotePath := filepath.Join(dir, "remote.sock")
+	echo, err := net.Listen("unix", remotePath)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, func(conn *ssh.ServerConn, nch ssh.NewChannel) {
+		if nch.ChannelType() != "direct-streamlocal@openssh.com" {
+			nch.Reject(ssh.UnknownChannelType, "")
+			return
+		}
+
+		var msg struct {
+			SocketPath string
+			Reserved0  string
+			Reserved1  uint32
+		}
+		if err := ssh.Unmarshal(nch.ExtraData(), &msg); err != nil || msg.SocketPath != remotePath {
+			nch.Reject(ssh.Prohibited, "")
+			return
+		}
+
+		target, err := net.Dial("unix", msg.SocketPath)
+		if err != nil {
+			nch.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		defer target.Close()
+
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+		go ssh.DiscardRequests(reqs)
+
+		go func() {
+			io.Copy(target, ch)
+			target.(*net.UnixConn).CloseWrite()
+		}()
+		io.Copy(ch, target)
+	})
+
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	localPath := filepath.Join(dir, "local.sock")
+	spec, err := parseLocalForwardArg(localPath + ":" + remotePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners := startLocalForwards(context.Background(), client, &config{localForwards: []*forwardSpec{spec}})
+	if len(listeners) != 1 {
+		t.Fatal("not listening")
+	}
+	defer listeners[0].Close()
+
+	c, err := net.Dial("unix", localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := io.WriteString(c, "hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Fatalf("%q", line)
+	}
+}
+
+func TestLocalForwardCancel(t *testing.T) {
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, nil)
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	spec, err := parseLocalForwardArg("127.0.0.1:0:example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listeners := startLocalForwards(ctx, client, &config{localForwards: []*forwardSpec{spec}})
+	if len(listeners) != 1 {
+		t.Fatal("not listening")
+	}
+	defer listeners[0].Close()
+
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("tcp", listeners[0].Addr().String())
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("still listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoteForwardSocks(t *testing.T) {
+	opts, err := parseArgs("myssh", []string{"-config", "/dev/null", "-R", "1080", "-R", "8080:localhost:80", "example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := opts.loadConfig(opts.host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.remoteForwards) != 2 || cfg.remoteForwards[0].connect != (forward.Endpoint{}) || cfg.remoteForwards[1].connect.Address != "localhost:80" {
+		t.Fatalf("%+v", cfg.remoteForwards)
+	}
+	cfg.remoteForwards = cfg.remoteForwards[:1]
+
+	// The destination, dialed from this side.
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	srv := newTestServer(t, &ssh.ServerConfig{NoClientAuth: true}, nil)
+	forwarded := make(chan *ssh.ServerConn, 1)
+	canceled := make(chan struct{}, 1)
+	handle := func(conn *ssh.ServerConn, req *ssh.Request) {
+		switch req.Type {
+		case "tcpip-forward":
+			req.Reply(true, nil)
+			forwarded <- conn
+		case "cancel-tcpip-forward":
+			req.Reply(true, nil)
+			canceled <- struct{}{}
+		default:
+			req.Reply(false, nil)
+		}
+	}
+	srv.globalRequest.Store(&handle)
+
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	listeners := startRemoteForwards(context.Background(), client, cfg)
+	if len(listeners) != 1 {
+		t.Fatal("not listening")
+	}
+	conn := <-forwarded
+
+	// A connection accepted on the remote port 1080.
+	ch, reqs, err := conn.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}{"127.0.0.1", 1080, "192.0.2.1", 40000}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	// SOCKS5 CONNECT to the echo.
+	addr := echo.Addr().(*net.TCPAddr)
+	req := []byte{5, 1, 0, 5, 1, 0, 1}
+	req = append(req, addr.IP.To4()...)
+	req = append(req, byte(addr.Port>>8), byte(addr.Port))
+	if _, err := ch.Write(append(req, "hello\n"...)); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(ch)
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(r, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != 5 || reply[1] != 0 || reply[3] != 0 {
+		t.Fatalf("%x", reply)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("%q %v", line, err)
+	}
+
+	listeners[0].Close()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The remote listener is not canceled.")
+	}
+}
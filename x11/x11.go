@@ -2,7 +2,9 @@ package x11
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -11,9 +13,16 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/ysuzuki-bysystems/myssh/forward"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -21,15 +30,29 @@ type xdisplay struct {
 	host   string
 	number string
 	screen string
+	// socket is set when DISPLAY names the unix socket itself.
+	socket string
+	// localName is the host name of the "hostname/unix:N" form, which
+	// Xauthority keys the local entry by.
+	localName string
 }
 
 func parseDisplay(displayname string) (*xdisplay, error) {
 	// REF https://gitlab.freedesktop.org/xorg/app/xauth/-/blob/20125640fdc37732cb3c04627bd02011cff60a12/parsedpy.c#L94
 
+	if strings.HasPrefix(displayname, "/") && !strings.Contains(displayname, ":") {
+		// e.g. /tmp/.X11-unix/X0
+		m := regexp.MustCompile(`/X(\d+)$`).FindStringSubmatch(displayname)
+		if m == nil {
+			return nil, fmt.Errorf("Failed to parse DISPLAY: %q", displayname)
+		}
+		return &xdisplay{number: m[1], socket: displayname}, nil
+	}
+
 	p := regexp.MustCompile(`^(?<host>.*)??:(?<num>\d+)(\.(?<screen>\d+))?$`)
 	r := p.FindStringSubmatch(displayname)
 	if r == nil {
-		return nil, fmt.Errorf("Failed to parse DISPLAY: %s", displayname)
+		return nil, fmt.Errorf("Failed to parse DISPLAY: %q", displayname)
 	}
 
 	var host, num, screen string
@@ -50,25 +73,95 @@ func parseDisplay(displayname string) (*xdisplay, error) {
 		}
 	}
 
-	return &xdisplay{host, num, screen}, nil
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		// [2001:db8::1]:0
+		host = host[1 : len(host)-1]
+	}
+
+	if strings.HasPrefix(host, "/") {
+		// macOS XQuartz: /private/tmp/com.apple.launchd.XXXX/org.xquartz:0
+		// The socket is named including the display number.
+		return &xdisplay{number: num, screen: screen, socket: fmt.Sprintf("%s:%s", host, num)}, nil
+	}
+
+	if name, ok := strings.CutSuffix(host, "/unix"); ok && name != "" {
+		// hostname/unix:0, as xauth lists the local entries.
+		return &xdisplay{host: "unix", number: num, screen: screen, localName: name}, nil
+	}
+
+	return &xdisplay{host: host, number: num, screen: screen}, nil
 }
 
-func openDisplayConn(display string) (net.Conn, error) {
-	dp, err := parseDisplay(display)
-	if err != nil {
-		return nil, err
+// x11UnixDir is the directory of the X server sockets, X0 for :0.
+var x11UnixDir = "/tmp/.X11-unix"
+
+type dialTarget struct {
+	network string
+	addr    string
+}
+
+func displayDialTargets(dp *xdisplay) []dialTarget {
+	return displayDialTargetsFor(runtime.GOOS, dp)
+}
+
+func displayDialTargetsFor(goos string, dp *xdisplay) []dialTarget {
+	if dp.socket != "" {
+		return []dialTarget{{"unix", dp.socket}}
 	}
 
-	if dp.host == "" {
-		return net.Dial("unix", fmt.Sprintf("/tmp/.X11-unix/X%s", dp.number)) // Not tested.
-	} else {
+	if (dp.host == "" || dp.host == "unix") && goos == "windows" {
+		// X servers on Windows (VcXsrv, X410, ...) listen on TCP only.
 		num, err := strconv.Atoi(dp.number)
 		if err != nil {
 			panic("Must parse")
 		}
+		return []dialTarget{{"tcp", net.JoinHostPort("localhost", strconv.Itoa(6000+num))}}
+	}
+
+	var targets []dialTarget
+	if dp.host == "" || dp.host == "unix" || (dp.host == "localhost" && goos != "windows") {
+		// localhost:N is the same server as :N, faster on the socket and
+		// without the TCP listening, which the X servers disable by default.
+		path := fmt.Sprintf("%s/X%s", x11UnixDir, dp.number)
+		targets = append(targets, dialTarget{"unix", path})
+		if goos == "linux" {
+			// Modern X servers may only listen on the abstract namespace.
+			targets = append(targets, dialTarget{"unix", "@" + path})
+		}
+		if dp.host != "localhost" {
+			return targets
+		}
+	}
 
-		return net.Dial("tcp", fmt.Sprintf("%s:%d", dp.host, 6000+num))
+	num, err := strconv.Atoi(dp.number)
+	if err != nil {
+		panic("Must parse")
 	}
+
+	// The TCP only when the socket is absent for localhost.
+	return append(targets, dialTarget{"tcp", net.JoinHostPort(dp.host, strconv.Itoa(6000+num))})
+}
+
+func dialDisplay(dp *xdisplay, dial func(network, addr string) (net.Conn, error)) (net.Conn, error) {
+	var errs []error
+	for _, t := range displayDialTargets(dp) {
+		conn, err := dial(t.network, t.addr)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, fmt.Errorf("Failed to connect display: %w", errors.Join(errs...))
+}
+
+func openDisplayConn(display string) (net.Conn, error) {
+	dp, err := parseDisplay(display)
+	if err != nil {
+		return nil, err
+	}
+
+	return dialDisplay(dp, net.Dial)
 }
 
 func closeConnWrite(w net.Conn) error {
@@ -82,7 +175,56 @@ func closeConnWrite(w net.Conn) error {
 	}
 }
 
-func forwardX11Auth(r io.Reader, rcookie, pcookie []byte) ([]byte, error) {
+// authError is a rejection which should be reported to the X client.
+type authError struct {
+	ord    binary.ByteOrder
+	reason string
+}
+
+func (e *authError) Error() string {
+	return e.reason
+}
+
+// https://www.x.org/releases/X11R7.7/doc/xproto/x11protocol.html#Encoding::Connection_Setup
+func setupFailedReply(ord binary.ByteOrder, reason string) []byte {
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	p := (4 - len(reason)%4) % 4
+
+	b := make([]byte, 8, 8+len(reason)+p)
+	b[0] = 0 // Failed
+	b[1] = byte(len(reason))
+	ord.PutUint16(b[2:4], 11) // protocol-major-version
+	ord.PutUint16(b[4:6], 0)  // protocol-minor-version
+	ord.PutUint16(b[6:8], uint16((len(reason)+p)/4))
+	b = append(b, reason...)
+	b = append(b, make([]byte, p)...)
+	return b
+}
+
+const (
+	// Limits on the prelude sent by the (untrusted) remote client.
+	maxAuthProtoNameLen = 64
+	maxAuthProtoDataLen = 64
+
+	x11AuthTimeout = 30 * time.Second
+
+	// DefaultMaxConnections caps the concurrent X11 connections unless
+	// Options.MaxConnections is set.
+	DefaultMaxConnections = 64
+)
+
+// authInfo is an authorization protocol and its data.
+type authInfo struct {
+	name string
+	data []byte
+}
+
+// forwardX11Auth reads the setup request of the remote client, which must
+// carry the pseudo MIT-MAGIC-COOKIE-1, and rewrites it with the real
+// authorization.
+func forwardX11Auth(r io.Reader, real *authInfo, pcookie []byte) ([]byte, error) {
 	pad := func(e uint16) int {
 		// pad(E) = (4 - (E mod 4)) mod 4
 		return (4 - (int(e) % 4)) % 4
@@ -103,7 +245,6 @@ func forwardX11Auth(r io.Reader, rcookie, pcookie []byte) ([]byte, error) {
 	default:
 		return nil, fmt.Errorf("Incorrect byte order: %d", b[0])
 	}
-	_ = ord
 
 	var authProtoNameLen, authProtoDataLen uint16
 	if _, err := binary.Decode(b[6:8], ord, &authProtoNameLen); err != nil {
@@ -114,6 +255,10 @@ func forwardX11Auth(r io.Reader, rcookie, pcookie []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	if authProtoNameLen > maxAuthProtoNameLen || authProtoDataLen > maxAuthProtoDataLen {
+		return nil, &authError{ord, "Authorization data too long"}
+	}
+
 	b2 := make([]byte, int(authProtoNameLen)+pad(authProtoNameLen)+int(authProtoDataLen)+pad(authProtoDataLen))
 	if _, err := io.ReadFull(r, b2); err != nil {
 		return nil, err
@@ -121,22 +266,31 @@ func forwardX11Auth(r io.Reader, rcookie, pcookie []byte) ([]byte, error) {
 	authProtoName := b2[0:authProtoNameLen]
 	authProtoData := b2[int(authProtoNameLen)+pad(authProtoNameLen) : int(authProtoNameLen)+pad(authProtoNameLen)+int(authProtoDataLen)]
 
-	if string(authProtoName) != "MIT-MAGIC-COOKIE-1" {
-		return nil, fmt.Errorf("Unsupported protocol: %s", string(authProtoName))
+	if string(authProtoName) != authMitMagicCookie {
+		return nil, &authError{ord, fmt.Sprintf("Unsupported protocol: %s", string(authProtoName))}
 	}
 
-	if bytes.Compare(authProtoData, pcookie) != 0 {
-		return nil, errors.New("Cookie not match")
+	if subtle.ConstantTimeCompare(authProtoData, pcookie) != 1 {
+		return nil, &authError{ord, "Cookie not match"}
 	}
 
-	ret := make([]byte, 0, len(b)+int(authProtoNameLen)+pad(authProtoNameLen)+len(rcookie)+pad(uint16(len(rcookie))))
+	name, data := []byte(real.name), real.data
+	if len(name) > 0xffff || len(data) > 0xffff {
+		return nil, &authError{ord, "Authorization data too long"}
+	}
+
+	ret := make([]byte, 0, len(b)+len(name)+pad(uint16(len(name)))+len(data)+pad(uint16(len(data))))
 	w := bytes.NewBuffer(ret)
-	// ~length of authorization-protocol-name
-	if _, err := w.Write(b[:8]); err != nil {
+	// byte-order, unused, protocol-major-version, protocol-minor-version
+	if _, err := w.Write(b[:6]); err != nil {
+		return nil, err
+	}
+	// length of authorization-protocol-name
+	if err := binary.Write(w, ord, uint16(len(name))); err != nil {
 		return nil, err
 	}
 	// length of authorization-protocol-data
-	if err := binary.Write(w, ord, uint16(len(rcookie))); err != nil {
+	if err := binary.Write(w, ord, uint16(len(data))); err != nil {
 		return nil, err
 	}
 	// unused
@@ -146,15 +300,19 @@ func forwardX11Auth(r io.Reader, rcookie, pcookie []byte) ([]byte, error) {
 		}
 	}
 	// authorization-protocol-name, pad(n)
-	if _, err := w.Write(b2[:int(authProtoNameLen)+pad(authProtoNameLen)]); err != nil {
+	if _, err := w.Write(name); err != nil {
 		return nil, err
 	}
-	// authorization-protocol-data
-	if _, err := w.Write(rcookie); err != nil {
+	for range pad(uint16(len(name))) {
+		if err := w.WriteByte(0); err != nil {
+			return nil, err
+		}
+	}
+	// authorization-protocol-data, pad(d)
+	if _, err := w.Write(data); err != nil {
 		return nil, err
 	}
-	// pad(d)
-	for range pad(uint16(len(rcookie))) {
+	for range pad(uint16(len(data))) {
 		if err := w.WriteByte(0); err != nil {
 			return nil, err
 		}
@@ -163,47 +321,271 @@ func forwardX11Auth(r io.Reader, rcookie, pcookie []byte) ([]byte, error) {
 	return w.Bytes(), nil
 }
 
-func forwardX11Connection(ch ssh.Channel, display string, rcookie, pcookie []byte) error {
+func (h *x11Handler) forwardConnection(ch ssh.Channel, origin, display string, rauth *authInfo, pcookie []byte) error {
 	defer ch.Close()
 
-	ip, err := forwardX11Auth(ch, rcookie, pcookie)
+	// ssh.Channel has no read deadline. Give up the channel instead.
+	timer := time.AfterFunc(x11AuthTimeout, func() {
+		ch.Close()
+	})
+	ip, err := forwardX11Auth(ch, rauth, pcookie)
+	timer.Stop()
 	if err != nil {
-		// TODO error response
+		h.stats.authFailed.Add(1)
+		h.logf("X11 connection from %s: auth substitution failed: %s", origin, err)
+
+		var ae *authError
+		if errors.As(err, &ae) {
+			ch.Write(setupFailedReply(ae.ord, fmt.Sprintf("Authentication rejected: %s", ae.reason)))
+		}
 		return err
 	}
+	h.logf("X11 connection from %s: auth substitution ok", origin)
 
 	conn, err := openDisplayConn(display)
 	if err != nil {
+		h.stats.dialFailed.Add(1)
+		h.logf("X11 connection from %s: %s", origin, err)
 		return err
 	}
 	defer conn.Close()
+	if h.ctx != nil {
+		stop := context.AfterFunc(h.ctx, func() {
+			ch.Close()
+			conn.Close()
+		})
+		defer stop()
+	}
+	h.logf("X11 connection from %s: connected to %s (%s)", origin, conn.RemoteAddr(), conn.RemoteAddr().Network())
 
 	if _, err := conn.Write(ip); err != nil {
 		return err
 	}
 
+	// Each EOF is passed on as a half-close, and the both are closed only
+	// after the both directions drained. Closing the channel on the EOF of
+	// the display would drop the requests still in flight to it.
 	errChan := make(chan error)
 	go func() {
 		defer closeConnWrite(conn)
 
-		_, err := io.Copy(conn, ch)
+		n, err := forward.Copy(conn, ch)
+		h.stats.bytesToDisplay.Add(n)
+		h.logf("X11 connection from %s: %d bytes to the display", origin, n)
 		errChan <- err
 	}()
 	go func() {
-		defer ch.Close()
+		defer ch.CloseWrite()
 
-		_, err := io.Copy(ch, conn)
+		n, err := forward.Copy(ch, conn)
+		h.stats.bytesFromDisplay.Add(n)
+		h.logf("X11 connection from %s: %d bytes from the display", origin, n)
 		errChan <- err
 	}()
 
+	var errs []error
 	for range 2 {
 		if err := <-errChan; err != nil {
-			return err
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Stats are the counters of an X11 forwarding.
+type Stats struct {
+	// Accepted is the number of channels accepted.
+	Accepted int64
+	// Rejected is the number of channel opens rejected after close or timeout.
+	Rejected int64
+	// AuthFailed is the number of connections whose setup request was rejected.
+	AuthFailed int64
+	// DialFailed is the number of connections the local display refused.
+	DialFailed int64
+	// Active is the number of connections being forwarded.
+	Active int64
+
+	BytesToDisplay   int64
+	BytesFromDisplay int64
+}
+
+type x11Stats struct {
+	accepted         atomic.Int64
+	rejected         atomic.Int64
+	authFailed       atomic.Int64
+	dialFailed       atomic.Int64
+	active           atomic.Int64
+	bytesToDisplay   atomic.Int64
+	bytesFromDisplay atomic.Int64
+}
+
+// Forwarding is the X11 forwarding of a session.
+type Forwarding interface {
+	// Close stops accepting X11 connections and waits for the active ones.
+	io.Closer
+	Stats() Stats
+}
+
+type x11Handler struct {
+	display string
+	rauth   *authInfo
+	pcookie []byte
+	// deadline for accepting new channels. Zero means no timeout.
+	deadline time.Time
+	now      func() time.Time
+	// verbose logging. nil discards.
+	logger func(format string, args ...any)
+	stats  x11Stats
+	// maxConns caps the active connections. Zero means no limit.
+	maxConns int
+	// ctx closes the connections when done. nil never does.
+	ctx context.Context
+
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func (h *x11Handler) logf(format string, args ...any) {
+	if h.logger != nil {
+		h.logger(format, args...)
+	}
+}
+
+// REF https://datatracker.ietf.org/doc/html/rfc4254#section-6.3.2
+type x11ChannelOpen struct {
+	OriginatorAddress string
+	OriginatorPort    uint32
+}
+
+func channelOrigin(ch ssh.NewChannel) string {
+	var msg x11ChannelOpen
+	if err := ssh.Unmarshal(ch.ExtraData(), &msg); err != nil {
+		return "unknown"
+	}
+	return net.JoinHostPort(msg.OriginatorAddress, strconv.FormatUint(uint64(msg.OriginatorPort), 10))
+}
+
+func (h *x11Handler) reject(ch ssh.NewChannel, origin, reason string) {
+	h.stats.rejected.Add(1)
+	h.logf("X11 connection from %s rejected: %s", origin, reason)
+	ch.Reject(ssh.Prohibited, reason)
+}
+
+// rejectSetup accepts the channel only to answer the setup request with
+// the failure, so that the X client reports the reason.
+func (h *x11Handler) rejectSetup(ch ssh.NewChannel, origin, reason string) {
+	channel, req, err := ch.Accept()
+	if err != nil {
+		h.logf("X11 connection from %s: %s", origin, err)
+		return
+	}
+	go ssh.DiscardRequests(req)
+
+	h.stats.rejected.Add(1)
+	h.logf("X11 connection from %s rejected: %s", origin, reason)
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer channel.Close()
+
+		timer := time.AfterFunc(x11AuthTimeout, func() {
+			channel.Close()
+		})
+		defer timer.Stop()
+
+		// The byte order is all the reply needs.
+		var b [1]byte
+		if _, err := io.ReadFull(channel, b[:]); err != nil {
+			return
 		}
+		var ord binary.ByteOrder = binary.LittleEndian
+		if b[0] == 0x42 {
+			ord = binary.BigEndian
+		}
+		channel.Write(setupFailedReply(ord, reason))
+	}()
+}
+
+func (h *x11Handler) handle(ch ssh.NewChannel) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	origin := channelOrigin(ch)
+
+	if h.closed {
+		h.reject(ch, origin, "X11 forwarding closed")
+		return
+	}
+
+	if !h.deadline.IsZero() && h.now().After(h.deadline) {
+		h.reject(ch, origin, "X11 forwarding timeout")
+		return
+	}
+
+	if h.maxConns > 0 && h.stats.active.Load() >= int64(h.maxConns) {
+		h.rejectSetup(ch, origin, "Too many X11 connections")
+		return
+	}
+
+	channel, req, err := ch.Accept()
+	if err != nil {
+		h.logf("X11 connection from %s: %s", origin, err)
+		return
+	}
+	h.stats.accepted.Add(1)
+	h.logf("X11 connection from %s accepted", origin)
+
+	go ssh.DiscardRequests(req)
+
+	display, rauth, pcookie := h.display, h.rauth, h.pcookie
+	h.wg.Add(1)
+	h.stats.active.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer h.stats.active.Add(-1)
+
+		err := h.forwardConnection(channel, origin, display, rauth, pcookie)
+		if err != nil {
+			h.logf("X11 connection from %s closed: %s", origin, err)
+		} else {
+			h.logf("X11 connection from %s closed", origin)
+		}
+	}()
+}
+
+// serve handles the channel opens until the client is closed. Once the
+// handler is closed, they are rejected.
+func (h *x11Handler) serve(x11chs <-chan ssh.NewChannel) {
+	for ch := range x11chs {
+		h.handle(ch)
 	}
+}
+
+// Close stops accepting X11 connections and waits for the active ones.
+func (h *x11Handler) Close() error {
+	h.mu.Lock()
+	h.closed = true
+	h.rauth = nil
+	h.mu.Unlock()
+
+	h.wg.Wait()
 	return nil
 }
 
+func (h *x11Handler) Stats() Stats {
+	return Stats{
+		Accepted:         h.stats.accepted.Load(),
+		Rejected:         h.stats.rejected.Load(),
+		AuthFailed:       h.stats.authFailed.Load(),
+		DialFailed:       h.stats.dialFailed.Load(),
+		Active:           h.stats.active.Load(),
+		BytesToDisplay:   h.stats.bytesToDisplay.Load(),
+		BytesFromDisplay: h.stats.bytesFromDisplay.Load(),
+	}
+}
+
 // REF https://gist.github.com/blacknon/9eca2e2b5462f71474e1101179847d2a
 type x11request struct {
 	SingleConnection bool
@@ -212,8 +594,31 @@ type x11request struct {
 	ScreenNumber     uint32
 }
 
-func queryCookie(display, xAuthLocation string) ([]byte, error) {
-	cmd := exec.Command(xAuthLocation, "extract", "-", display)
+// queryAuth returns the authorization of the display itself (trusted).
+func queryAuth(ctx context.Context, display, xAuthLocation string) (*authInfo, error) {
+	dp, err := parseDisplay(display)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := xauthorityFile()
+	if err == nil {
+		auth, err := readAuth(path, dp, authMitMagicCookie, authXdmAuthorization)
+		if err == nil {
+			return auth, nil
+		}
+	}
+
+	if xAuthLocation == "" {
+		return nil, errors.New("Cookie not found.")
+	}
+
+	// Fallback for setups the native parser can't handle.
+	return queryAuthXauth(ctx, display, dp, xAuthLocation)
+}
+
+func queryAuthXauth(ctx context.Context, display string, dp *xdisplay, xAuthLocation string) (*authInfo, error) {
+	cmd := exec.CommandContext(ctx, xAuthLocation, "extract", "-", display)
 	cmd.Stdin = nil
 	cmd.Stderr = os.Stderr
 
@@ -228,20 +633,57 @@ func queryCookie(display, xAuthLocation string) ([]byte, error) {
 	}
 	defer cmd.Process.Kill()
 
-	var cookie []byte
-	for ent, err := range parseXauthority(stdout) {
+	return findAuth(stdout, dp, authMitMagicCookie, authXdmAuthorization)
+}
+
+// REF https://github.com/openssh/openssh-portable/blob/V_9_9_P1/clientloop.c (X11_TIMEOUT_SLACK)
+const x11TimeoutSlack = 60 * time.Second
+
+// untrustedArgs are the arguments of xauth generating the untrusted cookie.
+// The timeout 0 is none, the cookie never expires, like ssh.
+// REF https://github.com/openssh/openssh-portable/blob/V_9_9_P1/clientloop.c (client_x11_get_proto)
+func untrustedArgs(xauthfile, display string, timeout time.Duration) []string {
+	args := []string{"-f", xauthfile, "generate", display, ".", "untrusted"}
+	if timeout > 0 {
+		t := int64((timeout + x11TimeoutSlack) / time.Second)
+		args = append(args, "timeout", strconv.FormatInt(t, 10))
+	}
+	return args
+}
+
+func generateUntrustedCookie(ctx context.Context, display, xAuthLocation string, timeout time.Duration) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "myssh-xauth-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	xauthfile := filepath.Join(dir, "xauthfile")
+	cmd := exec.CommandContext(ctx, xAuthLocation, untrustedArgs(xauthfile, display, timeout)...)
+	cmd.Stdin = nil
+	cmd.Stdout = nil
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	fp, err := os.Open(xauthfile)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	for ent, err := range parseXauthority(fp) {
 		if err != nil {
 			return nil, err
 		}
 
-		cookie = ent.data
-	}
-
-	if cookie == nil {
-		return nil, errors.New("Cookie not found.")
+		if ent.Name == authMitMagicCookie {
+			return ent.Data, nil
+		}
 	}
 
-	return cookie, nil
+	return nil, errors.New("Untrusted cookie not generated.")
 }
 
 func genPseudoCookie() ([]byte, error) {
@@ -254,49 +696,92 @@ func genPseudoCookie() ([]byte, error) {
 	return c, nil
 }
 
-func ForwardX11(client *ssh.Client, sess *ssh.Session, display, xAuthLocation string) error {
+type Options struct {
+	Display       string
+	XAuthLocation string
+	// Trusted forwards with the display's own cookie (ssh -Y). Otherwise an
+	// untrusted cookie is generated via the SECURITY extension (ssh -X).
+	Trusted bool
+	Timeout time.Duration
+	// Logf receives the verbose log. nil discards it.
+	Logf func(format string, args ...any)
+	// MaxConnections caps the concurrent X11 connections. Zero means
+	// DefaultMaxConnections, negative no limit.
+	MaxConnections int
+}
+
+// ErrNoDisplay is returned by ForwardX11 without the local display.
+var ErrNoDisplay = errors.New("X11 forwarding requested but DISPLAY not set.")
+
+// ForwardX11 requests X11 forwarding for sess. Closing the returned handler
+// stops the forwarding and waits for the forwarded connections to finish.
+// ctx cancels the xauth commands, and when done closes the handler and the
+// connections being forwarded.
+func ForwardX11(ctx context.Context, client *ssh.Client, sess *ssh.Session, opts *Options) (Forwarding, error) {
+	display := opts.Display
 	if display == "" {
-		return nil
+		return nil, ErrNoDisplay
 	}
 
-	rcookie, err := queryCookie(display, xAuthLocation)
+	var rauth *authInfo
+	var err error
+	if opts.Trusted {
+		rauth, err = queryAuth(ctx, display, opts.XAuthLocation)
+	} else {
+		// Like ssh, no fallback to the display's own cookie, even without
+		// xauth: that is of -Y (ForwardX11Trusted).
+		var cookie []byte
+		cookie, err = generateUntrustedCookie(ctx, display, opts.XAuthLocation, opts.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Untrusted X11 forwarding setup failed: %w", err)
+		}
+		rauth = &authInfo{authMitMagicCookie, cookie}
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	pcookie, err := genPseudoCookie()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	// Register before the request so that no channel open slips through.
+	x11chs := client.HandleChannelOpen("x11")
+
 	// X11 forwarding
 	x11req := x11request{
 		SingleConnection: false,
-		AuthProtocol:     string("MIT-MAGIC-COOKIE-1"),
+		AuthProtocol:     authMitMagicCookie,
 		AuthCookie:       string(hex.EncodeToString(pcookie)),
 		ScreenNumber:     uint32(0),
 	}
 	ok, err := sess.SendRequest("x11-req", true, ssh.Marshal(x11req))
+	if err == nil && !ok {
+		err = errors.New("Failed to x11-req")
+	}
 	if err != nil {
-		return err
+		go (&x11Handler{closed: true, logger: opts.Logf}).serve(x11chs)
+		return nil, err
 	}
 
-	if !ok {
-		return errors.New("Failed to x11-req")
+	h := &x11Handler{
+		display:  display,
+		rauth:    rauth,
+		pcookie:  pcookie,
+		now:      time.Now,
+		logger:   opts.Logf,
+		maxConns: opts.MaxConnections,
+		ctx:      ctx,
 	}
+	if h.maxConns == 0 {
+		h.maxConns = DefaultMaxConnections
+	}
+	// Like OpenSSH, the untrusted cookie expires. So do the channel opens.
+	if !opts.Trusted && opts.Timeout > 0 {
+		h.deadline = time.Now().Add(opts.Timeout)
+	}
+	go h.serve(x11chs)
+	context.AfterFunc(ctx, func() { h.Close() })
 
-	go func() {
-		x11chs := client.HandleChannelOpen("x11")
-
-		for ch := range x11chs {
-			channel, req, err := ch.Accept()
-			if err != nil {
-				continue
-			}
-
-			go ssh.DiscardRequests(req)
-			go forwardX11Connection(channel, display, rcookie, pcookie)
-		}
-	}()
-
-	return nil
+	return h, nil
 }
@@ -0,0 +1,868 @@
+package x11
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSetupFailedReply(t *testing.T) {
+	tests := []struct {
+		ord    binary.ByteOrder
+		reason string
+		want   []byte
+	}{
+		{
+			binary.LittleEndian,
+			"No",
+			[]byte{0, 2, 11, 0, 0, 0, 1, 0, 'N', 'o', 0, 0},
+		},
+		{
+			binary.BigEndian,
+			"No",
+			[]byte{0, 2, 0, 11, 0, 0, 0, 1, 'N', 'o', 0, 0},
+		},
+		{
+			binary.BigEndian,
+			"Deny",
+			[]byte{0, 4, 0, 11, 0, 0, 0, 1, 'D', 'e', 'n', 'y'},
+		},
+	}
+
+	for _, tt := range tests {
+		got := setupFailedReply(tt.ord, tt.reason)
+		if !bytes.Equal(got, tt.want) {
+			t.Fatalf("%s %q: %v", tt.ord, tt.reason, got)
+		}
+	}
+}
+
+func TestDialDisplay(t *testing.T) {
+	tests := []struct {
+		display string
+		targets []dialTarget
+	}{
+		{":0", []dialTarget{{"unix", "/tmp/.X11-unix/X0"}, {"unix", "@/tmp/.X11-unix/X0"}}},
+		{"unix:1", []dialTarget{{"unix", "/tmp/.X11-unix/X1"}, {"unix", "@/tmp/.X11-unix/X1"}}},
+		{"unix:10.0", []dialTarget{{"unix", "/tmp/.X11-unix/X10"}, {"unix", "@/tmp/.X11-unix/X10"}}},
+		{"myhost/unix:1", []dialTarget{{"unix", "/tmp/.X11-unix/X1"}, {"unix", "@/tmp/.X11-unix/X1"}}},
+		{"/tmp/.X11-unix/X2", []dialTarget{{"unix", "/tmp/.X11-unix/X2"}}},
+		{"/private/tmp/com.apple.launchd.XXXX/org.xquartz:0", []dialTarget{{"unix", "/private/tmp/com.apple.launchd.XXXX/org.xquartz:0"}}},
+		{"localhost:10.0", []dialTarget{{"unix", "/tmp/.X11-unix/X10"}, {"unix", "@/tmp/.X11-unix/X10"}, {"tcp", "localhost:6010"}}},
+		{"192.0.2.1:1", []dialTarget{{"tcp", "192.0.2.1:6001"}}},
+		{"[2001:db8::1]:1", []dialTarget{{"tcp", "[2001:db8::1]:6001"}}},
+		{"2001:db8::1:2.0", []dialTarget{{"tcp", "[2001:db8::1]:6002"}}},
+	}
+
+	for _, tt := range tests {
+		dp, err := parseDisplay(tt.display)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := tt.targets
+		if runtime.GOOS != "linux" {
+			want = slices.DeleteFunc(slices.Clone(want), func(t dialTarget) bool {
+				return strings.HasPrefix(t.addr, "@")
+			})
+		}
+		if runtime.GOOS == "windows" {
+			want = displayDialTargetsFor("windows", dp)
+		}
+
+		var attempted []dialTarget
+		_, err = dialDisplay(dp, func(network, addr string) (net.Conn, error) {
+			attempted = append(attempted, dialTarget{network, addr})
+			return nil, fmt.Errorf("dial %s %s: refused", network, addr)
+		})
+		if err == nil {
+			t.Fatal("must fail")
+		}
+
+		if !slices.Equal(attempted, want) {
+			t.Fatalf("%s: %v", tt.display, attempted)
+		}
+		for _, target := range want {
+			if !strings.Contains(err.Error(), target.addr) {
+				t.Fatalf("%s: %s", tt.display, err)
+			}
+		}
+	}
+}
+
+func TestDisplayDialTargetsWindows(t *testing.T) {
+	tests := []struct {
+		display string
+		targets []dialTarget
+	}{
+		{":0", []dialTarget{{"tcp", "localhost:6000"}}},
+		{":0.0", []dialTarget{{"tcp", "localhost:6000"}}},
+		{"unix:1", []dialTarget{{"tcp", "localhost:6001"}}},
+		{"localhost:0.0", []dialTarget{{"tcp", "localhost:6000"}}},
+		// WSL NAT address
+		{"172.28.32.1:0", []dialTarget{{"tcp", "172.28.32.1:6000"}}},
+	}
+
+	for _, tt := range tests {
+		dp, err := parseDisplay(tt.display)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := displayDialTargetsFor("windows", dp); !slices.Equal(got, tt.targets) {
+			t.Fatalf("%s: %v", tt.display, got)
+		}
+	}
+}
+
+func TestDialDisplayFallback(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Abstract sockets are Linux only.")
+	}
+
+	dp, err := parseDisplay(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	conn, err := dialDisplay(dp, func(network, addr string) (net.Conn, error) {
+		if addr != "@/tmp/.X11-unix/X0" {
+			return nil, errors.New("refused")
+		}
+		return c1, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != c1 {
+		t.Fatal("must be the abstract socket")
+	}
+}
+
+func TestOpenDisplayConnLocalhostSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("X servers on Windows listen on TCP only.")
+	}
+
+	dir, err := os.MkdirTemp("", "x11") // short enough for sun_path
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	l, err := net.Listen("unix", filepath.Join(dir, "X0"))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	orig := x11UnixDir
+	x11UnixDir = dir
+	t.Cleanup(func() { x11UnixDir = orig })
+
+	accepted := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+		close(accepted)
+	}()
+
+	conn, err := openDisplayConn("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().Network() != "unix" {
+		t.Fatalf("%s", conn.RemoteAddr().Network())
+	}
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The socket is not dialed.")
+	}
+
+	// Absent, the TCP.
+	dp, err := parseDisplay("localhost:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last dialTarget
+	dialDisplay(dp, func(network, addr string) (net.Conn, error) {
+		last = dialTarget{network, addr}
+		if network == "unix" {
+			return net.Dial(network, addr)
+		}
+		return nil, errors.New("refused")
+	})
+	if last != (dialTarget{"tcp", "localhost:6001"}) {
+		t.Fatalf("%v", last)
+	}
+}
+
+func buildSetupRequest(ord binary.ByteOrder, name string, data []byte) []byte {
+	pad := func(n int) int {
+		return (4 - n%4) % 4
+	}
+
+	b := make([]byte, 12)
+	if ord == binary.BigEndian {
+		b[0] = 0x42
+	} else {
+		b[0] = 0x6c
+	}
+	ord.PutUint16(b[2:4], 11)
+	ord.PutUint16(b[4:6], 0)
+	ord.PutUint16(b[6:8], uint16(len(name)))
+	ord.PutUint16(b[8:10], uint16(len(data)))
+	b = append(b, name...)
+	b = append(b, make([]byte, pad(len(name)))...)
+	b = append(b, data...)
+	b = append(b, make([]byte, pad(len(data)))...)
+	return b
+}
+
+func TestForwardX11Auth(t *testing.T) {
+	pcookie := bytes.Repeat([]byte{0x11}, 16)
+	rcookie := bytes.Repeat([]byte{0x22}, 16)
+
+	for _, ord := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		req := buildSetupRequest(ord, "MIT-MAGIC-COOKIE-1", pcookie)
+
+		got, err := forwardX11Auth(bytes.NewReader(req), &authInfo{"MIT-MAGIC-COOKIE-1", rcookie}, pcookie)
+		if err != nil {
+			t.Fatalf("%s: %s", ord, err)
+		}
+
+		want := buildSetupRequest(ord, "MIT-MAGIC-COOKIE-1", rcookie)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: %x", ord, got)
+		}
+
+		// The lengths must be in the client's byte order.
+		if ord.Uint16(got[6:8]) != 18 || ord.Uint16(got[8:10]) != 16 {
+			t.Fatalf("%s: %x", ord, got[:12])
+		}
+	}
+}
+
+func TestForwardX11AuthXdmAuthorization(t *testing.T) {
+	pcookie := bytes.Repeat([]byte{0x11}, 16)
+	// XDM-AUTHORIZATION-1 data is 8 bytes of DES key and 8 bytes of
+	// authentication data. An odd length exercises the padding.
+	xdm := &authInfo{"XDM-AUTHORIZATION-1", bytes.Repeat([]byte{0x44}, 15)}
+
+	for _, ord := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		req := buildSetupRequest(ord, "MIT-MAGIC-COOKIE-1", pcookie)
+
+		got, err := forwardX11Auth(bytes.NewReader(req), xdm, pcookie)
+		if err != nil {
+			t.Fatalf("%s: %s", ord, err)
+		}
+
+		if want := buildSetupRequest(ord, "XDM-AUTHORIZATION-1", xdm.data); !bytes.Equal(got, want) {
+			t.Fatalf("%s: %x", ord, got)
+		}
+
+		// 12 bytes header, "XDM-AUTHORIZATION-1" (19) + pad 1, data (15) + pad 1
+		if len(got) != 12+20+16 {
+			t.Fatalf("%s: %d", ord, len(got))
+		}
+		if ord.Uint16(got[6:8]) != 19 || ord.Uint16(got[8:10]) != 15 {
+			t.Fatalf("%s: %x", ord, got[:12])
+		}
+		if string(got[12:31]) != "XDM-AUTHORIZATION-1" || got[31] != 0 || got[47] != 0 {
+			t.Fatalf("%s: %x", ord, got)
+		}
+	}
+
+	// The remote client must still present the pseudo cookie.
+	req := buildSetupRequest(binary.LittleEndian, "XDM-AUTHORIZATION-1", xdm.data)
+	if _, err := forwardX11Auth(bytes.NewReader(req), xdm, pcookie); err == nil {
+		t.Fatal("must reject the real protocol from the remote")
+	}
+}
+
+func TestForwardX11AuthBigEndianReject(t *testing.T) {
+	req := buildSetupRequest(binary.BigEndian, "MIT-MAGIC-COOKIE-1", bytes.Repeat([]byte{0x33}, 16))
+
+	_, err := forwardX11Auth(bytes.NewReader(req), &authInfo{"MIT-MAGIC-COOKIE-1", bytes.Repeat([]byte{0x22}, 16)}, bytes.Repeat([]byte{0x11}, 16))
+
+	var ae *authError
+	if !errors.As(err, &ae) {
+		t.Fatalf("%v", err)
+	}
+	if ae.ord != binary.BigEndian {
+		t.Fatalf("%s", ae.ord)
+	}
+}
+
+func TestParseDisplay(t *testing.T) {
+	tests := []struct {
+		display string
+		want    xdisplay
+	}{
+		{":0", xdisplay{number: "0"}},
+		{":1.2", xdisplay{number: "1", screen: "2"}},
+		{"host:10.2", xdisplay{host: "host", number: "10", screen: "2"}},
+		{"192.0.2.1:0", xdisplay{host: "192.0.2.1", number: "0"}},
+		{"2001:db8::1:1.0", xdisplay{host: "2001:db8::1", number: "1", screen: "0"}},
+		{"[2001:db8::1]:1", xdisplay{host: "2001:db8::1", number: "1"}},
+		{"[::1]:10.0", xdisplay{host: "::1", number: "10", screen: "0"}},
+		{
+			"/private/tmp/com.apple.launchd.XXXX/org.xquartz:0",
+			xdisplay{number: "0", socket: "/private/tmp/com.apple.launchd.XXXX/org.xquartz:0"},
+		},
+		{
+			"/private/tmp/com.apple.launchd.XXXX/org.xquartz:0.1",
+			xdisplay{number: "0", screen: "1", socket: "/private/tmp/com.apple.launchd.XXXX/org.xquartz:0"},
+		},
+		{"/tmp/.X11-unix/X0", xdisplay{number: "0", socket: "/tmp/.X11-unix/X0"}},
+		{"unix:0", xdisplay{host: "unix", number: "0"}},
+		{"unix:10.0", xdisplay{host: "unix", number: "10", screen: "0"}},
+		{"myhost/unix:0", xdisplay{host: "unix", number: "0", localName: "myhost"}},
+		{"myhost.example.com/unix:1.2", xdisplay{host: "unix", number: "1", screen: "2", localName: "myhost.example.com"}},
+	}
+
+	for _, tt := range tests {
+		dp, err := parseDisplay(tt.display)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.display, err)
+		}
+
+		if *dp != tt.want {
+			t.Fatalf("%s: %#v", tt.display, dp)
+		}
+	}
+
+	for _, display := range []string{"", "host", "host:", ":x", "unix:0 ", "/tmp/.X11-unix/Y0"} {
+		_, err := parseDisplay(display)
+		if err == nil {
+			t.Fatalf("%q: must fail", display)
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("%q", display)) {
+			t.Fatalf("%q: %s", display, err)
+		}
+	}
+}
+
+// chunkReader returns the data in the given sizes, like TCP segments
+// arriving through the channel one by one.
+type chunkReader struct {
+	data   []byte
+	chunks []int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+
+	n := len(r.data)
+	if len(r.chunks) > 0 {
+		n = min(n, r.chunks[0])
+		r.chunks = r.chunks[1:]
+	}
+	n = copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestForwardX11AuthFragmented(t *testing.T) {
+	pcookie := bytes.Repeat([]byte{0x11}, 16)
+	rcookie := bytes.Repeat([]byte{0x22}, 16)
+	req := buildSetupRequest(binary.LittleEndian, "MIT-MAGIC-COOKIE-1", pcookie)
+	want := buildSetupRequest(binary.LittleEndian, "MIT-MAGIC-COOKIE-1", rcookie)
+
+	readers := map[string]func() io.Reader{
+		"one byte": func() io.Reader {
+			return iotest.OneByteReader(bytes.NewReader(req))
+		},
+		"half": func() io.Reader {
+			return iotest.HalfReader(bytes.NewReader(req))
+		},
+		"header then body": func() io.Reader {
+			return &chunkReader{data: req, chunks: []int{12}}
+		},
+		"split inside header and cookie": func() io.Reader {
+			return &chunkReader{data: req, chunks: []int{5, 20, 3}}
+		},
+	}
+
+	for name, r := range readers {
+		got, err := forwardX11Auth(r(), &authInfo{"MIT-MAGIC-COOKIE-1", rcookie}, pcookie)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: %x", name, got)
+		}
+	}
+}
+
+type fakeNewChannel struct {
+	accepted bool
+	rejected ssh.RejectionReason
+	message  string
+	extra    []byte
+}
+
+func (c *fakeNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	c.accepted = true
+	return nil, nil, errors.New("not implemented")
+}
+
+func (c *fakeNewChannel) Reject(reason ssh.RejectionReason, message string) error {
+	c.rejected = reason
+	c.message = message
+	return nil
+}
+
+func (c *fakeNewChannel) ChannelType() string {
+	return "x11"
+}
+
+func (c *fakeNewChannel) ExtraData() []byte {
+	return c.extra
+}
+
+func TestX11HandlerTimeout(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+
+	h := &x11Handler{
+		deadline: start.Add(time.Minute),
+		now: func() time.Time {
+			return now
+		},
+	}
+
+	ch := &fakeNewChannel{}
+	h.handle(ch)
+	if !ch.accepted || ch.rejected != 0 {
+		t.Fatalf("%#v", ch)
+	}
+
+	now = start.Add(time.Minute + time.Second)
+	ch = &fakeNewChannel{}
+	h.handle(ch)
+	if ch.accepted || ch.rejected != ssh.Prohibited || ch.message != "X11 forwarding timeout" {
+		t.Fatalf("%#v", ch)
+	}
+
+	// No deadline
+	h.deadline = time.Time{}
+	ch = &fakeNewChannel{}
+	h.handle(ch)
+	if !ch.accepted {
+		t.Fatalf("%#v", ch)
+	}
+}
+
+// fakeChannel is an ssh.Channel over a net.Conn.
+type fakeChannel struct {
+	net.Conn
+}
+
+func (c *fakeChannel) CloseWrite() error {
+	return c.Conn.Close()
+}
+
+func (c *fakeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+
+func (c *fakeChannel) Stderr() io.ReadWriter {
+	return nil
+}
+
+type acceptingNewChannel struct {
+	fakeNewChannel
+	ch ssh.Channel
+}
+
+func (c *acceptingNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	c.accepted = true
+	reqs := make(chan *ssh.Request)
+	close(reqs)
+	return c.ch, reqs, nil
+}
+
+func TestX11HandlerClose(t *testing.T) {
+	h := &x11Handler{
+		display: ":0",
+		now:     time.Now,
+	}
+
+	local, remote := net.Pipe()
+	h.handle(&acceptingNewChannel{ch: &fakeChannel{local}})
+
+	closed := make(chan struct{})
+	go func() {
+		h.Close()
+		close(closed)
+	}()
+
+	// The connection waiting for its setup request is still active.
+	select {
+	case <-closed:
+		t.Fatal("Close must wait for the active connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ch := &fakeNewChannel{}
+	h.handle(ch)
+	if ch.accepted || ch.rejected != ssh.Prohibited {
+		t.Fatalf("%#v", ch)
+	}
+
+	remote.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close must return after the connection ends")
+	}
+}
+
+func TestForwardX11AuthMalformed(t *testing.T) {
+	pcookie := bytes.Repeat([]byte{0x11}, 16)
+	rcookie := bytes.Repeat([]byte{0x22}, 16)
+	valid := buildSetupRequest(binary.LittleEndian, "MIT-MAGIC-COOKIE-1", pcookie)
+
+	oversized := slices.Clone(valid[:12])
+	binary.LittleEndian.PutUint16(oversized[8:10], 0xffff)
+
+	wrongOrder := slices.Clone(valid)
+	wrongOrder[0] = 0x00
+
+	tests := []struct {
+		name  string
+		input []byte
+		// reply is whether a setup failed reply must be sent
+		reply bool
+	}{
+		{"empty", nil, false},
+		{"truncated header", valid[:7], false},
+		{"truncated body", valid[:20], false},
+		{"oversized data", oversized, true},
+		{"wrong byte order", wrongOrder, false},
+		{"wrong protocol", buildSetupRequest(binary.LittleEndian, "XDM-AUTHORIZATION-1", pcookie), true},
+		{"wrong cookie", buildSetupRequest(binary.LittleEndian, "MIT-MAGIC-COOKIE-1", rcookie), true},
+		{"short cookie", buildSetupRequest(binary.LittleEndian, "MIT-MAGIC-COOKIE-1", pcookie[:8]), true},
+	}
+
+	for _, tt := range tests {
+		_, err := forwardX11Auth(bytes.NewReader(tt.input), &authInfo{"MIT-MAGIC-COOKIE-1", rcookie}, pcookie)
+		if err == nil {
+			t.Fatalf("%s: must fail", tt.name)
+		}
+
+		var ae *authError
+		if errors.As(err, &ae) != tt.reply {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestX11HandlerStats(t *testing.T) {
+	var logs []string
+	var mu sync.Mutex
+	h := &x11Handler{
+		display: ":0",
+		rauth:   &authInfo{"MIT-MAGIC-COOKIE-1", bytes.Repeat([]byte{0x22}, 16)},
+		pcookie: bytes.Repeat([]byte{0x11}, 16),
+		now:     time.Now,
+		logger: func(format string, args ...any) {
+			mu.Lock()
+			defer mu.Unlock()
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+
+	extra := ssh.Marshal(&x11ChannelOpen{OriginatorAddress: "192.0.2.1", OriginatorPort: 40000})
+
+	// Wrong cookie
+	local, remote := net.Pipe()
+	ch := &acceptingNewChannel{ch: &fakeChannel{local}}
+	ch.extra = extra
+	h.handle(ch)
+
+	go io.Copy(io.Discard, remote)
+	remote.Write(buildSetupRequest(binary.LittleEndian, "MIT-MAGIC-COOKIE-1", bytes.Repeat([]byte{0x33}, 16)))
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	remote.Close()
+
+	rejected := &fakeNewChannel{extra: extra}
+	h.handle(rejected)
+	if rejected.rejected != ssh.Prohibited {
+		t.Fatalf("%#v", rejected)
+	}
+
+	stats := h.Stats()
+	if stats.Accepted != 1 || stats.AuthFailed != 1 || stats.Rejected != 1 || stats.Active != 0 {
+		t.Fatalf("%#v", stats)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"X11 connection from 192.0.2.1:40000 accepted",
+		"X11 connection from 192.0.2.1:40000: auth substitution failed: ",
+		"X11 connection from 192.0.2.1:40000 closed: ",
+		"X11 connection from 192.0.2.1:40000 rejected: X11 forwarding closed",
+	}
+	if len(logs) != len(want) {
+		t.Fatalf("%q", logs)
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(logs[i], w) {
+			t.Fatalf("%q", logs)
+		}
+	}
+}
+
+func TestX11HandlerUsesLocalDisplay(t *testing.T) {
+	dir, err := os.MkdirTemp("", "x11") // short enough for sun_path
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	// The local X server, named like a launchd DISPLAY.
+	display := filepath.Join(dir, "X5")
+	l, err := net.Listen("unix", display)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		b, _ := io.ReadAll(conn)
+		got <- b
+	}()
+
+	t.Setenv("DISPLAY", ":5")
+	rauth := &authInfo{"MIT-MAGIC-COOKIE-1", bytes.Repeat([]byte{0x22}, 16)}
+	pcookie := bytes.Repeat([]byte{0x11}, 16)
+	h := &x11Handler{
+		display: display,
+		rauth:   rauth,
+		pcookie: pcookie,
+		now:     time.Now,
+	}
+
+	// The remote side sets DISPLAY=localhost:10.0 and the local one changes
+	// mid-session. Neither is dialed.
+	t.Setenv("DISPLAY", "localhost:10.0")
+
+	local, remote := net.Pipe()
+	h.handle(&acceptingNewChannel{ch: &fakeChannel{local}})
+
+	go io.Copy(io.Discard, remote)
+	remote.Write(buildSetupRequest(binary.LittleEndian, "MIT-MAGIC-COOKIE-1", pcookie))
+	remote.Close()
+
+	select {
+	case b := <-got:
+		if want := buildSetupRequest(binary.LittleEndian, "MIT-MAGIC-COOKIE-1", rauth.data); !bytes.Equal(b, want) {
+			t.Fatalf("%x", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The local display is not dialed.")
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestX11HandlerMaxConnections(t *testing.T) {
+	h := &x11Handler{
+		display:  ":0",
+		rauth:    &authInfo{"MIT-MAGIC-COOKIE-1", bytes.Repeat([]byte{0x22}, 16)},
+		pcookie:  bytes.Repeat([]byte{0x11}, 16),
+		now:      time.Now,
+		maxConns: 2,
+	}
+
+	// Two connections held in the setup.
+	var remotes []net.Conn
+	for range 2 {
+		local, remote := net.Pipe()
+		remotes = append(remotes, remote)
+		h.handle(&acceptingNewChannel{ch: &fakeChannel{local}})
+	}
+
+	local, remote := net.Pipe()
+	ch := &acceptingNewChannel{ch: &fakeChannel{local}}
+	h.handle(ch)
+
+	go remote.Write(buildSetupRequest(binary.BigEndian, "MIT-MAGIC-COOKIE-1", h.pcookie))
+	reply, err := io.ReadAll(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := setupFailedReply(binary.BigEndian, "Too many X11 connections"); !bytes.Equal(reply, want) {
+		t.Fatalf("%q", reply)
+	}
+
+	if stats := h.Stats(); stats.Accepted != 2 || stats.Rejected != 1 || stats.Active != 2 {
+		t.Fatalf("%#v", stats)
+	}
+
+	for _, r := range remotes {
+		r.Close()
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pipeChannel is a channel that half-closes, reading r and writing w.
+type pipeChannel struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func (c *pipeChannel) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *pipeChannel) Write(p []byte) (int, error) { return c.w.Write(p) }
+func (c *pipeChannel) CloseWrite() error           { return c.w.Close() }
+
+func (c *pipeChannel) Close() error {
+	c.r.Close()
+	return c.w.Close()
+}
+
+func (c *pipeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+
+func (c *pipeChannel) Stderr() io.ReadWriter {
+	return nil
+}
+
+func TestX11HandlerHalfClose(t *testing.T) {
+	dir, err := os.MkdirTemp("", "x11") // short enough for sun_path
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	display := filepath.Join(dir, "X6")
+	l, err := net.Listen("unix", display)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	rauth := &authInfo{"MIT-MAGIC-COOKIE-1", bytes.Repeat([]byte{0x22}, 16)}
+	pcookie := bytes.Repeat([]byte{0x11}, 16)
+	setup := buildSetupRequest(binary.LittleEndian, "MIT-MAGIC-COOKIE-1", rauth.data)
+	payload := bytes.Repeat([]byte("x11 request "), 32*1024)
+
+	// The display replies and closes its writing at once, then reads slowly.
+	got := make(chan int, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("reply"))
+		conn.(*net.UnixConn).CloseWrite()
+
+		n := 0
+		buf := make([]byte, 16*1024)
+		for {
+			time.Sleep(time.Millisecond)
+			m, err := conn.Read(buf)
+			n += m
+			if err != nil {
+				break
+			}
+		}
+		got <- n
+	}()
+
+	h := &x11Handler{
+		display: display,
+		rauth:   rauth,
+		pcookie: pcookie,
+		now:     time.Now,
+	}
+
+	chR, remoteW := io.Pipe()
+	remoteR, chW := io.Pipe()
+	h.handle(&acceptingNewChannel{ch: &pipeChannel{chR, chW}})
+
+	go func() {
+		remoteW.Write(buildSetupRequest(binary.LittleEndian, "MIT-MAGIC-COOKIE-1", pcookie))
+		remoteW.Write(payload)
+		remoteW.Close()
+	}()
+
+	reply, err := io.ReadAll(remoteR)
+	if err != nil || string(reply) != "reply" {
+		t.Fatalf("%q %v", reply, err)
+	}
+
+	select {
+	case n := <-got:
+		if want := len(setup) + len(payload); n != want {
+			t.Fatalf("The display got %d bytes, want %d", n, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUntrustedArgs(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    []string
+	}{
+		{20 * time.Minute, []string{"-f", "f", "generate", ":0", ".", "untrusted", "timeout", "1260"}},
+		// No timeout, the cookie does not expire.
+		{0, []string{"-f", "f", "generate", ":0", ".", "untrusted"}},
+	}
+	for _, tt := range tests {
+		if got := untrustedArgs("f", ":0", tt.timeout); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %q", tt.timeout, got)
+		}
+	}
+}
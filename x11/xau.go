@@ -2,23 +2,43 @@ package x11
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
 	"iter"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
 )
 
 // REF https://gitlab.freedesktop.org/xorg/lib/libxau
 
-type xauthorityEntry struct {
-	family  uint16
-	address []byte
-	number  string
-	name    string
-	data    []byte
+// The families of XauthorityEntry.
+// REF https://gitlab.freedesktop.org/xorg/proto/xorgproto/-/blob/master/include/X11/X.h
+const (
+	FamilyInternet  uint16 = 0
+	FamilyInternet6 uint16 = 6
+	FamilyLocal     uint16 = 256
+	FamilyWild      uint16 = 0xffff
+)
+
+var localHostname = os.Hostname
+
+// XauthorityEntry is an entry of the Xauthority file, Xauth of libXau.
+type XauthorityEntry struct {
+	Family uint16
+	// Address is of Family: the IP address, or the hostname of FamilyLocal.
+	Address []byte
+	// Number is the display number, empty for any display.
+	Number string
+	// Name is the protocol, like MIT-MAGIC-COOKIE-1, and Data its data.
+	Name string
+	Data []byte
 }
 
-func readXauthorityEntry(r io.Reader, ent *xauthorityEntry) error {
+func readXauthorityEntry(r io.Reader, ent *XauthorityEntry) error {
 	wrapErr := func(err error) error {
 		if !errors.Is(err, io.EOF) {
 			return err
@@ -38,7 +58,7 @@ func readXauthorityEntry(r io.Reader, ent *xauthorityEntry) error {
 		return b, nil
 	}
 
-	if err := binary.Read(r, binary.BigEndian, &ent.family); err != nil {
+	if err := binary.Read(r, binary.BigEndian, &ent.Family); err != nil {
 		return err
 	}
 
@@ -46,35 +66,86 @@ func readXauthorityEntry(r io.Reader, ent *xauthorityEntry) error {
 	if err != nil {
 		return wrapErr(err)
 	}
-	ent.address = addr
+	ent.Address = addr
 
 	number, err := readData()
 	if err != nil {
 		return wrapErr(err)
 	}
-	ent.number = string(number)
+	ent.Number = string(number)
 
 	name, err := readData()
 	if err != nil {
 		return wrapErr(err)
 	}
-	ent.name = string(name)
+	ent.Name = string(name)
 
 	data, err := readData()
 	if err != nil {
 		return wrapErr(err)
 	}
-	ent.data = data
+	ent.Data = data
 
 	return nil
 }
 
-func parseXauthority(r io.Reader) iter.Seq2[*xauthorityEntry, error] {
-	return func(yield func(*xauthorityEntry, error) bool) {
+// WriteXauthorityEntry writes ent in the format of the Xauthority file, the
+// family and the fields prefixed by their length, big-endian.
+func WriteXauthorityEntry(w io.Writer, ent *XauthorityEntry) error {
+	writeData := func(b []byte) error {
+		if len(b) > 0xffff {
+			return errors.New("Xauthority field too long.")
+		}
+		if err := binary.Write(w, binary.BigEndian, uint16(len(b))); err != nil {
+			return err
+		}
+		_, err := w.Write(b)
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, ent.Family); err != nil {
+		return err
+	}
+
+	for _, b := range [][]byte{ent.Address, []byte(ent.Number), []byte(ent.Name), ent.Data} {
+		if err := writeData(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteXauthority creates (or truncates) the file with mode 0600 and writes
+// the entries, as xauth reads them with -f.
+func WriteXauthority(path string, ents []*XauthorityEntry) error {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(fp)
+	for _, ent := range ents {
+		if err := WriteXauthorityEntry(w, ent); err != nil {
+			fp.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		fp.Close()
+		return err
+	}
+
+	return fp.Close()
+}
+
+func parseXauthority(r io.Reader) iter.Seq2[*XauthorityEntry, error] {
+	return func(yield func(*XauthorityEntry, error) bool) {
 		buf := bufio.NewReader(r)
 
 		for {
-			var ent xauthorityEntry
+			var ent XauthorityEntry
 			if err := readXauthorityEntry(buf, &ent); err != nil {
 				if errors.Is(err, io.EOF) {
 					return
@@ -90,3 +161,132 @@ func parseXauthority(r io.Reader) iter.Seq2[*xauthorityEntry, error] {
 		}
 	}
 }
+
+func xauthorityFile() (string, error) {
+	if p := os.Getenv("XAUTHORITY"); p != "" {
+		return p, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".Xauthority"), nil
+}
+
+type displayAddr struct {
+	family  uint16
+	address []byte
+}
+
+// displayAddrs returns the addresses the display is known as in Xauthority.
+func displayAddrs(dp *xdisplay) ([]displayAddr, error) {
+	local := func() ([]displayAddr, error) {
+		if dp.localName != "" {
+			return []displayAddr{{FamilyLocal, []byte(dp.localName)}}, nil
+		}
+
+		hostname, err := localHostname()
+		if err != nil {
+			return nil, err
+		}
+		return []displayAddr{{FamilyLocal, []byte(hostname)}}, nil
+	}
+
+	if dp.host == "" || dp.host == "unix" {
+		return local()
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(dp.host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		resolved, err := net.LookupIP(dp.host)
+		if err != nil {
+			return nil, err
+		}
+		ips = resolved
+	}
+
+	var addrs []displayAddr
+	for _, ip := range ips {
+		if ip.IsLoopback() {
+			// Like libxcb, a loopback connection is authorized by the local entry.
+			l, err := local()
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, l...)
+			continue
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			addrs = append(addrs, displayAddr{FamilyInternet, ip4})
+		} else {
+			addrs = append(addrs, displayAddr{FamilyInternet6, ip.To16()})
+		}
+	}
+	return addrs, nil
+}
+
+// Authorization protocols the forwarding can pass to the local display.
+const (
+	authMitMagicCookie   = "MIT-MAGIC-COOKIE-1"
+	authXdmAuthorization = "XDM-AUTHORIZATION-1"
+)
+
+// findAuth selects the entry like XauGetBestAuthByAddr. An entry matching
+// the family, address and display number exactly is preferred. Otherwise, the
+// first entry of FamilyWild or without a display number is used. Only the
+// entries of the given protocol names are considered.
+func findAuth(r io.Reader, dp *xdisplay, names ...string) (*authInfo, error) {
+	addrs, err := displayAddrs(dp)
+	if err != nil {
+		return nil, err
+	}
+
+	var fallback *authInfo
+	for ent, err := range parseXauthority(r) {
+		if err != nil {
+			return nil, err
+		}
+
+		if !slices.Contains(names, ent.Name) {
+			continue
+		}
+		if ent.Number != "" && ent.Number != dp.number {
+			continue
+		}
+
+		exact := false
+		matched := ent.Family == FamilyWild
+		for _, addr := range addrs {
+			if ent.Family == addr.family && bytes.Equal(ent.Address, addr.address) {
+				exact = true
+				matched = true
+			}
+		}
+
+		if exact && ent.Number == dp.number {
+			return &authInfo{ent.Name, ent.Data}, nil
+		}
+		if matched && fallback == nil {
+			fallback = &authInfo{ent.Name, ent.Data}
+		}
+	}
+
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, errors.New("Cookie not found.")
+}
+
+func readAuth(path string, dp *xdisplay, names ...string) (*authInfo, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return findAuth(fp, dp, names...)
+}
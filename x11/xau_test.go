@@ -3,8 +3,11 @@ package x11
 import (
 	"bytes"
 	"encoding/hex"
+	"net"
 	"net/netip"
 	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 )
 
@@ -25,20 +28,20 @@ func TestParseXauthority(t *testing.T) {
 	}
 	defer fp.Close()
 
-	match := func(ent *xauthorityEntry, family uint16, addr []byte, number, name, data string) bool {
-		if ent.family != family {
+	match := func(ent *XauthorityEntry, family uint16, addr []byte, number, name, data string) bool {
+		if ent.Family != family {
 			return false
 		}
 
-		if bytes.Compare(ent.address, addr) != 0 {
+		if bytes.Compare(ent.Address, addr) != 0 {
 			return false
 		}
 
-		if ent.number != number {
+		if ent.Number != number {
 			return false
 		}
 
-		if ent.name != name {
+		if ent.Name != name {
 			return false
 		}
 
@@ -46,7 +49,7 @@ func TestParseXauthority(t *testing.T) {
 		if err != nil {
 			panic(err)
 		}
-		if bytes.Compare(ent.data, datah) != 0 {
+		if bytes.Compare(ent.Data, datah) != 0 {
 			return false
 		}
 
@@ -75,3 +78,313 @@ func TestParseXauthority(t *testing.T) {
 		}
 	}
 }
+
+func setLocalHostname(t *testing.T, hostname string) {
+	orig := localHostname
+	localHostname = func() (string, error) {
+		return hostname, nil
+	}
+	t.Cleanup(func() {
+		localHostname = orig
+	})
+}
+
+func TestReadAuth(t *testing.T) {
+	setLocalHostname(t, "localhost")
+
+	tests := []struct {
+		display string
+		cookie  string
+	}{
+		{":1", "11112222333344445555666677778888"},
+		{"192.0.2.1:2", "22223333444455556666777788889999"},
+		{"[2001:db8::1]:1", "3333444455556666777788889999aaaa"},
+		{"2001:db8::1:1.0", "3333444455556666777788889999aaaa"},
+	}
+
+	for _, tt := range tests {
+		dp, err := parseDisplay(tt.display)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		auth, err := readAuth("./test-data/Xauthority", dp, authMitMagicCookie, authXdmAuthorization)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if auth.name != authMitMagicCookie || hex.EncodeToString(auth.data) != tt.cookie {
+			t.Fatalf("%s: %s %x", tt.display, auth.name, auth.data)
+		}
+	}
+
+	dp, err := parseDisplay(":9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAuth("./test-data/Xauthority", dp, authMitMagicCookie, authXdmAuthorization); err == nil {
+		t.Fatal("must not be found")
+	}
+}
+
+func TestReadAuthConflict(t *testing.T) {
+	// ```
+	// $ xauth -n -f test-data/Xauthority-conflict list
+	// otherhost/unix:0  MIT-MAGIC-COOKIE-1  aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa
+	// 192.0.2.1:0  MIT-MAGIC-COOKIE-1  bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb
+	// myhost/unix:0  MIT-MAGIC-COOKIE-1  cccccccccccccccccccccccccccccccc
+	// myhost/unix:1  MIT-MAGIC-COOKIE-1  dddddddddddddddddddddddddddddddd
+	// 192.0.2.2:0  MIT-MAGIC-COOKIE-1  eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee
+	// ```
+	setLocalHostname(t, "myhost")
+
+	tests := []struct {
+		display string
+		cookie  string
+	}{
+		{":0", "cccccccccccccccccccccccccccccccc"},
+		{":1", "dddddddddddddddddddddddddddddddd"},
+		{"unix:0", "cccccccccccccccccccccccccccccccc"},
+		{"unix:1.0", "dddddddddddddddddddddddddddddddd"},
+		{"myhost/unix:1", "dddddddddddddddddddddddddddddddd"},
+		{"otherhost/unix:0", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		{"127.0.0.1:0", "cccccccccccccccccccccccccccccccc"},
+		{"192.0.2.1:0", "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"},
+		{"192.0.2.2:0", "eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee"},
+	}
+
+	for _, tt := range tests {
+		dp, err := parseDisplay(tt.display)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		auth, err := readAuth("./test-data/Xauthority-conflict", dp, authMitMagicCookie, authXdmAuthorization)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.display, err)
+		}
+
+		if auth.name != authMitMagicCookie || hex.EncodeToString(auth.data) != tt.cookie {
+			t.Fatalf("%s: %s %x", tt.display, auth.name, auth.data)
+		}
+	}
+
+	for _, display := range []string{"192.0.2.1:1", "192.0.2.3:0"} {
+		dp, err := parseDisplay(display)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readAuth("./test-data/Xauthority-conflict", dp, authMitMagicCookie, authXdmAuthorization); err == nil {
+			t.Fatalf("%s: must not be found", display)
+		}
+	}
+}
+
+func TestWriteXauthorityRoundTrip(t *testing.T) {
+	for _, name := range []string{"./test-data/Xauthority", "./test-data/Xauthority-conflict"} {
+		orig, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ents []*XauthorityEntry
+		for ent, err := range parseXauthority(bytes.NewReader(orig)) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			ents = append(ents, ent)
+		}
+
+		path := filepath.Join(t.TempDir(), "Xauthority")
+		if err := WriteXauthority(path, ents); err != nil {
+			t.Fatal(err)
+		}
+
+		written, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(orig, written) {
+			t.Fatalf("%s: %x != %x", name, written, orig)
+		}
+
+		if runtime.GOOS != "windows" {
+			st, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := st.Mode().Perm(); mode != 0600 {
+				t.Fatalf("%s: %o", name, mode)
+			}
+		}
+	}
+}
+
+func TestFindAuthFamilies(t *testing.T) {
+	setLocalHostname(t, "myhost")
+
+	cookie := func(b byte) []byte {
+		return bytes.Repeat([]byte{b}, 16)
+	}
+	entry := func(family uint16, address []byte, number string, data []byte) *XauthorityEntry {
+		return &XauthorityEntry{
+			Family:  family,
+			Address: address,
+			Number:  number,
+			Name:    authMitMagicCookie,
+			Data:    data,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		ents    []*XauthorityEntry
+		display string
+		// auth is the protocol, MIT-MAGIC-COOKIE-1 when empty.
+		auth   string
+		cookie []byte
+	}{
+		{
+			name:    "local",
+			ents:    []*XauthorityEntry{entry(FamilyLocal, []byte("myhost"), "0", cookie(1))},
+			display: ":0",
+			cookie:  cookie(1),
+		},
+		{
+			name:    "local other host",
+			ents:    []*XauthorityEntry{entry(FamilyLocal, []byte("otherhost"), "0", cookie(1))},
+			display: ":0",
+		},
+		{
+			name:    "wild",
+			ents:    []*XauthorityEntry{entry(FamilyWild, nil, "0", cookie(2))},
+			display: "192.0.2.1:0",
+			cookie:  cookie(2),
+		},
+		{
+			name:    "wild other display",
+			ents:    []*XauthorityEntry{entry(FamilyWild, nil, "1", cookie(2))},
+			display: ":0",
+		},
+		{
+			name: "exact preferred over wild",
+			ents: []*XauthorityEntry{
+				entry(FamilyWild, nil, "0", cookie(2)),
+				entry(FamilyInternet, []byte{192, 0, 2, 1}, "0", cookie(3)),
+			},
+			display: "192.0.2.1:0",
+			cookie:  cookie(3),
+		},
+		{
+			name:    "empty number",
+			ents:    []*XauthorityEntry{entry(FamilyLocal, []byte("myhost"), "", cookie(4))},
+			display: ":5",
+			cookie:  cookie(4),
+		},
+		{
+			name: "exact number preferred over empty number",
+			ents: []*XauthorityEntry{
+				entry(FamilyLocal, []byte("myhost"), "", cookie(4)),
+				entry(FamilyLocal, []byte("myhost"), "5", cookie(5)),
+			},
+			display: ":5",
+			cookie:  cookie(5),
+		},
+		{
+			name:    "internet6",
+			ents:    []*XauthorityEntry{entry(FamilyInternet6, net.ParseIP("2001:db8::1").To16(), "1", cookie(6))},
+			display: "[2001:db8::1]:1",
+			cookie:  cookie(6),
+		},
+		{
+			name: "xdm-authorization",
+			ents: []*XauthorityEntry{
+				{Family: FamilyWild, Number: "0", Name: authXdmAuthorization, Data: cookie(7)},
+			},
+			display: ":0",
+			auth:    authXdmAuthorization,
+			cookie:  cookie(7),
+		},
+		{
+			name: "exact xdm-authorization preferred over wild",
+			ents: []*XauthorityEntry{
+				entry(FamilyWild, nil, "0", cookie(2)),
+				{Family: FamilyLocal, Address: []byte("myhost"), Number: "0", Name: authXdmAuthorization, Data: cookie(8)},
+			},
+			display: ":0",
+			auth:    authXdmAuthorization,
+			cookie:  cookie(8),
+		},
+		{
+			name: "unsupported protocol",
+			ents: []*XauthorityEntry{
+				{Family: FamilyWild, Number: "0", Name: "SUN-DES-1", Data: cookie(9)},
+			},
+			display: ":0",
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		for _, ent := range tt.ents {
+			if err := WriteXauthorityEntry(&buf, ent); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dp, err := parseDisplay(tt.display)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := findAuth(&buf, dp, authMitMagicCookie, authXdmAuthorization)
+		if tt.cookie == nil {
+			if err == nil {
+				t.Errorf("%s: must not be found", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		want := tt.auth
+		if want == "" {
+			want = authMitMagicCookie
+		}
+		if got.name != want || !bytes.Equal(got.data, tt.cookie) {
+			t.Errorf("%s: %s %x", tt.name, got.name, got.data)
+		}
+	}
+}
+
+func TestFindAuthXdmAuthorization(t *testing.T) {
+	setLocalHostname(t, "myhost")
+
+	var buf bytes.Buffer
+	for _, ent := range []*XauthorityEntry{
+		{Family: FamilyLocal, Address: []byte("myhost"), Number: "0", Name: "XDM-AUTHORIZATION-1", Data: bytes.Repeat([]byte{0x44}, 16)},
+		{Family: FamilyLocal, Address: []byte("myhost"), Number: "1", Name: "MIT-MAGIC-COOKIE-1", Data: bytes.Repeat([]byte{0x55}, 16)},
+	} {
+		if err := WriteXauthorityEntry(&buf, ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dp, err := parseDisplay(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := findAuth(bytes.NewReader(buf.Bytes()), dp, authMitMagicCookie, authXdmAuthorization)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.name != "XDM-AUTHORIZATION-1" || !bytes.Equal(auth.data, bytes.Repeat([]byte{0x44}, 16)) {
+		t.Fatalf("%#v", auth)
+	}
+
+	if _, err := findAuth(bytes.NewReader(buf.Bytes()), dp, authMitMagicCookie); err == nil {
+		t.Fatal("MIT-MAGIC-COOKIE-1 must not be found")
+	}
+}